@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ananthb/systemd-cri/internal/machineman"
+)
+
+// reloadTarget is what a reload applies settings to: the image and runtime
+// services.
+type reloadTarget interface {
+	SetRegistries(allowed, blocked []string) error
+	SetRegistryCADir(dir string) error
+	SetMaxRegistryDownloads(max uint)
+	SetDebug(debug bool)
+	SetExecBudget(window time.Duration, maxExecs int, maxOutput int64)
+	SetIPPools(pools []string)
+}
+
+// services is the reloadTarget of the running daemon.
+type services struct {
+	*machineman.ImageService
+	*machineman.RuntimeService
+}
+
+// reloader applies flags that a reload of the config file changes to the
+// running daemon, from their current values.
+type reloader struct {
+	// flags are the flags it applies together.
+	flags []string
+	apply func(reloadTarget) error
+}
+
+// reloaders apply the settings that can change while the daemon runs. All
+// of them apply to what starts from then on, such as new pulls, execs and
+// sandboxes. Everything else only changes with a restart, since it shapes
+// the gRPC server, the listeners, the state dir, or units that are already
+// running. There are no settings for registry mirrors and CNI, and the
+// credentials of registries come from kubelet with each pull.
+var reloaders = []reloader{
+	{
+		flags: []string{"allowed-registries", "blocked-registries"},
+		apply: func(t reloadTarget) error {
+			return t.SetRegistries(splitList(*allowedRegistries), splitList(*blockedRegistries))
+		},
+	},
+	{
+		flags: []string{"registry-ca-dir"},
+		apply: func(t reloadTarget) error { return t.SetRegistryCADir(*registryCADir) },
+	},
+	{
+		flags: []string{"max-registry-layer-downloads"},
+		apply: func(t reloadTarget) error {
+			t.SetMaxRegistryDownloads(*maxRegistryLayerDownloads)
+			return nil
+		},
+	},
+	{
+		flags: []string{"debug"},
+		apply: func(t reloadTarget) error {
+			t.SetDebug(*debugLogging)
+			return nil
+		},
+	},
+	{
+		flags: []string{"exec-budget-window", "max-pod-execs", "max-pod-exec-output"},
+		apply: func(t reloadTarget) error {
+			t.SetExecBudget(*execBudgetWindow, *maxPodExecs, *maxPodExecOutput)
+			return nil
+		},
+	},
+	{
+		flags: []string{"ip-pools"},
+		apply: func(t reloadTarget) error {
+			t.SetIPPools(splitList(*ipPools))
+			return nil
+		},
+	},
+}
+
+// reloadable reports whether a reload applies the flag name.
+func reloadable(name string) bool {
+	for _, r := range reloaders {
+		for _, flag := range r.flags {
+			if flag == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// readConfig reads a config file of flag settings, one "name = value" per
+// line, where name is the name of a flag without the dash. Blank lines and
+// lines starting with # are skipped.
+func readConfig(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	settings := map[string]string{}
+	lines := bufio.NewScanner(f)
+	for n := 1; lines.Scan(); n++ {
+		line := strings.TrimSpace(lines.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%s:%d: want name = value", path, n)
+		}
+		if flag.Lookup(name) == nil {
+			return nil, fmt.Errorf("%s:%d: unknown setting %q", path, n, name)
+		}
+		settings[name] = strings.TrimSpace(value)
+	}
+	if err := lines.Err(); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// commandLineFlags returns the flags given on the command line, which
+// override the config file.
+func commandLineFlags() map[string]bool {
+	given := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	return given
+}
+
+// loadConfig sets the flags of the config file at path that weren't given
+// on the command line.
+func loadConfig(path string, given map[string]bool) error {
+	settings, err := readConfig(path)
+	if err != nil {
+		return err
+	}
+	for name, value := range settings {
+		if given[name] {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("%s: %s: %w", path, name, err)
+		}
+	}
+	return nil
+}
+
+// reloadConfig rereads the config file at path and applies the settings
+// that can change while the daemon runs to target. Changes to other
+// settings are logged and left for the next restart. Settings that were
+// removed from the file keep their current value, and so do settings that
+// fail to apply.
+func reloadConfig(path string, given map[string]bool, target reloadTarget) {
+	settings, err := readConfig(path)
+	if err != nil {
+		log.Printf("failed to reload config: %v", err)
+		return
+	}
+	previous := map[string]string{}
+	for name, value := range settings {
+		f := flag.Lookup(name)
+		if given[name] || f.Value.String() == value {
+			continue
+		}
+		if !reloadable(name) {
+			log.Printf("config: %s changed, it takes effect after a restart", name)
+			continue
+		}
+		previous[name] = f.Value.String()
+		if err := f.Value.Set(value); err != nil {
+			log.Printf("config: %s: %v, keeping %q", name, err, previous[name])
+			delete(previous, name)
+		}
+	}
+	if len(previous) == 0 {
+		log.Printf("config reloaded, nothing to apply")
+		return
+	}
+	for _, r := range reloaders {
+		var changed []string
+		for _, name := range r.flags {
+			if _, ok := previous[name]; ok {
+				changed = append(changed, name)
+			}
+		}
+		if len(changed) == 0 {
+			continue
+		}
+		if err := r.apply(target); err != nil {
+			log.Printf("config: failed to apply %s, keeping the previous values: %v", strings.Join(changed, ", "), err)
+			for _, name := range changed {
+				flag.Set(name, previous[name])
+			}
+			continue
+		}
+		for _, name := range changed {
+			log.Printf("config: applied %s = %q", name, flag.Lookup(name).Value.String())
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeTarget records what a reload applies.
+type fakeTarget struct {
+	applied       map[string]interface{}
+	registriesErr error
+}
+
+func (f *fakeTarget) SetRegistries(allowed, blocked []string) error {
+	if f.registriesErr != nil {
+		return f.registriesErr
+	}
+	f.applied["registries"] = [2][]string{allowed, blocked}
+	return nil
+}
+
+func (f *fakeTarget) SetRegistryCADir(dir string) error {
+	f.applied["registry-ca-dir"] = dir
+	return nil
+}
+
+func (f *fakeTarget) SetMaxRegistryDownloads(max uint) { f.applied["downloads"] = max }
+
+func (f *fakeTarget) SetDebug(debug bool) { f.applied["debug"] = debug }
+
+func (f *fakeTarget) SetExecBudget(window time.Duration, maxExecs int, maxOutput int64) {
+	f.applied["exec-budget"] = []interface{}{window, maxExecs, maxOutput}
+}
+
+func (f *fakeTarget) SetIPPools(pools []string) { f.applied["ip-pools"] = pools }
+
+// keepFlags restores the values of flags once a test is done.
+func keepFlags(t *testing.T) {
+	t.Helper()
+	saved := map[string]string{}
+	flag.VisitAll(func(f *flag.Flag) { saved[f.Name] = f.Value.String() })
+	t.Cleanup(func() {
+		for name, value := range saved {
+			flag.Set(name, value)
+		}
+	})
+}
+
+func writeConfig(t *testing.T, config string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReloadConfig(t *testing.T) {
+	keepFlags(t)
+	path := writeConfig(t, `
+# Applied.
+debug = true
+max-registry-layer-downloads = 2
+max-pod-execs = 5
+ip-pools = blue,green
+# Needs a restart.
+state-dir = /srv/systemd-cri
+# Given on the command line, which wins.
+max-pod-exec-output = 4096
+`)
+	target := &fakeTarget{applied: map[string]interface{}{}}
+	reloadConfig(path, map[string]bool{"max-pod-exec-output": true}, target)
+	want := map[string]interface{}{
+		"debug":       true,
+		"downloads":   uint(2),
+		"exec-budget": []interface{}{time.Minute, 5, int64(0)},
+		"ip-pools":    []string{"blue", "green"},
+	}
+	if !reflect.DeepEqual(target.applied, want) {
+		t.Errorf("applied %v, want %v", target.applied, want)
+	}
+	if *stateDir != "/var/lib/systemd-cri" {
+		t.Errorf("-state-dir = %q, want it unchanged until a restart", *stateDir)
+	}
+	if *maxPodExecOutput != 0 {
+		t.Errorf("-max-pod-exec-output = %d, want the command line's", *maxPodExecOutput)
+	}
+}
+
+func TestReloadConfigFailure(t *testing.T) {
+	keepFlags(t)
+	path := writeConfig(t, "blocked-registries = [\ndebug = true\n")
+	target := &fakeTarget{
+		applied:       map[string]interface{}{},
+		registriesErr: errors.New("bad pattern"),
+	}
+	reloadConfig(path, nil, target)
+	// Settings that fail to apply keep their value, the others apply.
+	if *blockedRegistries != "" {
+		t.Errorf("-blocked-registries = %q, want the previous value", *blockedRegistries)
+	}
+	if want := map[string]interface{}{"debug": true}; !reflect.DeepEqual(target.applied, want) {
+		t.Errorf("applied %v, want %v", target.applied, want)
+	}
+}
+
+func TestImageDecompressionParallelismAlias(t *testing.T) {
+	keepFlags(t)
+	path := writeConfig(t, "image-decompression-parallelism = 3\n")
+	if err := loadConfig(path, nil); err != nil {
+		t.Fatal(err)
+	}
+	if *maxParallelLayerDownloads != 3 {
+		t.Errorf("-max-parallel-layer-downloads = %d, want 3 from its alias", *maxParallelLayerDownloads)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"flag"
+	"runtime"
+	"strings"
+	"time"
+)
+
+var (
+	configFile = flag.String(
+		"config",
+		"",
+		"file of settings to use for flags not given on the command line, one "+
+			"name = value per line; on SIGHUP it is read again and changes to the "+
+			"registry, -debug, exec budget and -ip-pools settings are applied, "+
+			"other changes need a restart",
+	)
+	maxRecvMsgSize = flag.Int(
+		"max-recv-msg-size",
+		16<<20,
+		"largest CRI request in bytes the server accepts; gRPC's own default is 4 MiB",
+	)
+	maxSendMsgSize = flag.Int(
+		"max-send-msg-size",
+		16<<20,
+		"largest CRI response in bytes the server sends, list and stats responses "+
+			"of dense nodes can exceed gRPC's default of 4 MiB; a message is held in memory "+
+			"while it is encoded, so higher limits let single calls take more memory",
+	)
+	listenBacklog = flag.Int(
+		"listen-backlog",
+		0,
+		"length of the queue of connections waiting to be accepted by the CRI listener, "+
+			"capped by net.core.somaxconn; kubelet keeps one connection open, so the "+
+			"kernel default used if 0 suffices unless many CRI clients reconnect at once",
+	)
+	keepaliveMaxConnectionIdle = flag.Duration(
+		"keepalive-max-connection-idle",
+		0,
+		"close CRI connections without any calls for this long, never if 0; "+
+			"kubelet reuses a single connection for its lifetime, so leave it at 0",
+	)
+	keepaliveTime = flag.Duration(
+		"keepalive-time",
+		time.Minute,
+		"ping CRI clients after this long without activity to detect dead connections; "+
+			"1m notices a kubelet that went away without tying up the connection",
+	)
+	keepaliveTimeout = flag.Duration(
+		"keepalive-timeout",
+		20*time.Second,
+		"close a CRI connection whose client doesn't answer a ping within this long",
+	)
+	stateDir = flag.String(
+		"state-dir",
+		"/var/lib/systemd-cri",
+		"directory to keep runtime state in, only one instance can use it at a time",
+	)
+	checkpointDir = flag.String(
+		"checkpoint-dir",
+		"/var/lib/kubelet/checkpoints",
+		"directory containers can be restored from the checkpoint archives in, kubelet's by default; "+
+			"archives anywhere else are refused, and all of them if empty",
+	)
+	metricsAddr = flag.String(
+		"metrics-addr",
+		"",
+		"address to serve Prometheus metrics and /healthz on, disabled if empty",
+	)
+	statsStream = flag.Bool(
+		"stats-stream",
+		false,
+		"stream container stats as lines of JSON under /stats/stream on the metrics address",
+	)
+	statsStreamInterval = flag.Duration(
+		"stats-stream-interval",
+		10*time.Second,
+		"how often /stats/stream pushes stats, and the shortest interval clients can ask for",
+	)
+	statsStreamMetrics = flag.String(
+		"stats-stream-metrics",
+		"cpu,memory,writable_layer",
+		"comma-separated metrics /stats/stream includes unless a client asks for others",
+	)
+	enableProfiling = flag.Bool(
+		"enable-profiling",
+		false,
+		"serve pprof profiles under /debug/pprof/ on the metrics address",
+	)
+	maxParallelLayerDownloads = flag.Uint(
+		"max-parallel-layer-downloads",
+		uint(runtime.GOMAXPROCS(0)),
+		"number of layers of a single image to download at once; "+
+			"higher values pull large images faster at the cost of CPU, memory and "+
+			"bandwidth that running containers compete for, defaults to GOMAXPROCS",
+	)
+	maxRegistryLayerDownloads = flag.Uint(
+		"max-registry-layer-downloads",
+		0,
+		"number of layers to download at once from a single registry, across all "+
+			"pulls, so that parallel downloads stay within the registry's rate limit; "+
+			"no limit if 0",
+	)
+	allowedRegistries = flag.String(
+		"allowed-registries",
+		"",
+		"comma-separated registry hosts images can be pulled from, with * wildcards "+
+			"like *.example.com; Docker Hub is docker.io; all registries if empty",
+	)
+	blockedRegistries = flag.String(
+		"blocked-registries",
+		"",
+		"comma-separated registry hosts images must not be pulled from, with * wildcards; "+
+			"takes precedence over -allowed-registries",
+	)
+	registryCADir = flag.String(
+		"registry-ca-dir",
+		"",
+		"directory with a subdirectory per registry host[:port] holding the *.crt CA "+
+			"certificates to trust for it, like /etc/containers/certs.d, which is used if empty",
+	)
+	verifyImages = flag.Bool(
+		"verify-images",
+		false,
+		"check the digests of all stored images at startup, which reads the whole image store; "+
+			"otherwise only done after an unclean shutdown, blobs are just checked to be of the right size",
+	)
+	manifestCacheTTL = flag.Duration(
+		"manifest-cache-ttl",
+		30*time.Second,
+		"pull a tag the registry reports unchanged by the digest it resolved to on a pull within this long, "+
+			"skipping its manifest list; always fetch the manifest list if 0",
+	)
+	containerRootfsTmpfsSize = flag.String(
+		"container-rootfs-tmpfs-size",
+		"",
+		"keep container root filesystems on a tmpfs of this size, such as 8G or 50%, "+
+			"instead of the state dir's disk; containers that don't fit are refused",
+	)
+	defaultStopGracePeriod = flag.Duration(
+		"default-stop-grace-period",
+		10*time.Second,
+		"grace period for containers stopped along with their pod sandbox",
+	)
+	maxStopGracePeriod = flag.Duration(
+		"max-stop-grace-period",
+		0,
+		"longest grace period a container can be stopped with, longer requests are clamped, no limit if 0",
+	)
+	stopCgroupKill = flag.Bool(
+		"stop-cgroup-kill",
+		true,
+		"kill containers that outlive their stop grace period at once through cgroup.kill, "+
+			"instead of leaving it to systemd to SIGKILL each of their processes",
+	)
+	runtimeHandlers = flag.String(
+		"runtime-handlers",
+		"",
+		"comma-separated runtime handlers RuntimeClasses can name, as name or "+
+			"name:feature+feature, the only feature being user-namespaces; "+
+			"unknown handlers are rejected, if empty any handler is taken as the default one",
+	)
+	ipPools = flag.String(
+		"ip-pools",
+		"",
+		"comma-separated IP pools pod sandboxes can pick with the systemd-cri.io/ip-pool "+
+			"annotation, the first being the default; if empty the network plugin picks",
+	)
+	defaultUlimits = flag.String(
+		"default-ulimits",
+		"",
+		"comma-separated resource limits of containers, as name=soft:hard or name=limit "+
+			"like nofile=1024:524288, which the image's io.systemd-cri.ulimits label and "+
+			"the systemd-cri.io/ulimits annotation override; if empty the host's defaults apply",
+	)
+	debugLogging = flag.Bool(
+		"debug",
+		false,
+		"log details that help diagnose problems, such as create calls kubelet retried",
+	)
+	imageHealthchecks = flag.Bool(
+		"image-healthchecks",
+		false,
+		"run the HEALTHCHECK of container images and report unhealthy containers in their status; "+
+			"the systemd-cri.io/image-healthcheck annotation overrides it per pod or container",
+	)
+	containerInit = flag.Bool(
+		"container-init",
+		true,
+		"run container commands as PID 2 below a minimal init that reaps orphaned "+
+			"processes; the systemd-cri.io/init annotation overrides it per pod or container",
+	)
+	exitedContainerRetention = flag.Duration(
+		"exited-container-retention",
+		0,
+		"how long exited containers and their logs are kept before the runtime "+
+			"reclaims them on its own, never if 0; RemoveContainer is not affected",
+	)
+	maxRetainedRootfs = flag.Int(
+		"max-retained-rootfs",
+		3,
+		"most writable layers of exited instances of a container that are kept for "+
+			"inspection when the container has the systemd-cri.io/retain-rootfs annotation",
+	)
+	compressRotatedLogs = flag.Bool(
+		"compress-rotated-logs",
+		false,
+		"gzip the segments container logs are rotated into, leaving the live log file uncompressed",
+	)
+	streamingAddr = flag.String(
+		"streaming-addr",
+		"127.0.0.1:0",
+		"host:port to serve exec and attach sessions on over SPDY and WebSockets, kubelet "+
+			"must be able to reach it under that host; a port of 0 picks a free one, "+
+			"exec and attach are unsupported if empty",
+	)
+	streamingIdleTimeout = flag.Duration(
+		"streaming-idle-timeout",
+		4*time.Hour,
+		"tear down exec and attach sessions and kill their process after this long "+
+			"without any input or output, never if 0",
+	)
+	execBudgetWindow = flag.Duration(
+		"exec-budget-window",
+		time.Minute,
+		"sliding window the -max-pod-execs and -max-pod-exec-output budgets are counted over",
+	)
+	maxPodExecs = flag.Int(
+		"max-pod-execs",
+		0,
+		"fail execs in the containers of a pod with ResourceExhausted once it ran this many "+
+			"within -exec-budget-window, including exec probes; unlimited if 0",
+	)
+	maxPodExecOutput = flag.Int64(
+		"max-pod-exec-output",
+		0,
+		"fail execs in the containers of a pod with ResourceExhausted once its execs "+
+			"produced this many bytes of output within -exec-budget-window; unlimited if 0",
+	)
+	statsCacheTTL = flag.Duration(
+		"stats-cache-ttl",
+		time.Second,
+		"reuse the cgroup counters read for container stats for this long, "+
+			"so that back-to-back stats calls read them once; read every time if 0",
+	)
+)
+
+func init() {
+	// -image-decompression-parallelism is kept for the command lines and
+	// config files that still set it. It always set the number of parallel
+	// downloads, and now sets the same value as -max-parallel-layer-downloads,
+	// so that whichever is given last applies.
+	flag.Var(
+		flag.Lookup("max-parallel-layer-downloads").Value,
+		"image-decompression-parallelism",
+		"alias of -max-parallel-layer-downloads; images are stored in the dir "+
+			"transport with their layers compressed as downloaded, so there is "+
+			"no decompression to parallelize",
+	)
+}
+
+// splitList splits a comma-separated flag value, an empty value is an empty
+// list.
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
@@ -1,32 +1,334 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/ananthb/systemd-cri/internal/health"
 	"github.com/ananthb/systemd-cri/internal/machineman"
+	"github.com/ananthb/systemd-cri/internal/metrics"
+	"github.com/ananthb/systemd-cri/internal/mig"
+	"github.com/ananthb/systemd-cri/internal/statedir"
+	"github.com/coreos/go-systemd/v22/activation"
+	"golang.org/x/sys/unix"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
 	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
 )
 
 func main() {
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", 8080))
+	flag.Parse()
+	given := commandLineFlags()
+	if *configFile != "" {
+		if err := loadConfig(*configFile, given); err != nil {
+			log.Fatalf("failed to load config: %v", err)
+		}
+	}
+	var (
+		debug    *http.Server
+		debugMux *http.ServeMux
+	)
+	if *metricsAddr != "" {
+		debug, debugMux = serveDebug(*metricsAddr)
+	} else if *enableProfiling {
+		log.Printf("-enable-profiling has no effect without -metrics-addr")
+	}
+	state, err := statedir.Open(*stateDir)
+	if err != nil {
+		log.Fatalf("failed to open state dir: %v", err)
+	}
+	listener, err := listen(fmt.Sprintf(":%d", 8080), *listenBacklog)
 	if err != nil {
 		log.Fatalf("failed to listen: %v", err)
 	}
-	s := grpc.NewServer()
-	imagesvc, err := machineman.NewImageService()
+	s := grpc.NewServer(
+		grpc.UnaryInterceptor(contextErrors),
+		grpc.MaxRecvMsgSize(*maxRecvMsgSize),
+		grpc.MaxSendMsgSize(*maxSendMsgSize),
+		grpc.KeepaliveParams(keepalive.ServerParameters{
+			MaxConnectionIdle: *keepaliveMaxConnectionIdle,
+			Time:              *keepaliveTime,
+			Timeout:           *keepaliveTimeout,
+		}),
+		// Clients that ping more often than gRPC's default minimum of
+		// 5m would otherwise be disconnected with too_many_pings.
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             10 * time.Second,
+			PermitWithoutStream: true,
+		}),
+	)
+	// The URL of the streaming server is needed by the runtime, which in
+	// turn serves it, so it listens first and serves later.
+	var (
+		streamingListener net.Listener
+		streamingURL      string
+	)
+	if *streamingAddr != "" {
+		streamingListener, err = net.Listen("tcp", *streamingAddr)
+		if err != nil {
+			log.Fatalf("failed to listen for streaming: %v", err)
+		}
+		streamingURL = "http://" + streamingListener.Addr().String()
+	}
+	imagesvc, err := machineman.NewImageService(machineman.ImageOptions{
+		Root:                 filepath.Join(state.Path(), "images"),
+		MaxParallelDownloads: *maxParallelLayerDownloads,
+		MaxRegistryDownloads: *maxRegistryLayerDownloads,
+		AllowedRegistries:    splitList(*allowedRegistries),
+		BlockedRegistries:    splitList(*blockedRegistries),
+		ManifestCacheTTL:     *manifestCacheTTL,
+		RegistryCADir:        *registryCADir,
+		VerifyImages:         *verifyImages,
+		RootfsDir:            filepath.Join(state.Path(), "rootfs"),
+		RootfsTmpfsSize:      *containerRootfsTmpfsSize,
+	})
 	if err != nil {
 		log.Fatalf("failed to create image service: %v", err)
 	}
-	runtimesvc, err := machineman.NewRuntimeService()
+	runtimesvc, err := machineman.NewRuntimeService(imagesvc, machineman.RuntimeOptions{
+		DefaultStopGracePeriod:   *defaultStopGracePeriod,
+		MaxStopGracePeriod:       *maxStopGracePeriod,
+		CgroupKill:               *stopCgroupKill,
+		DeviceResolvers:          []machineman.DeviceResolver{mig.Resolver{}},
+		Debug:                    *debugLogging,
+		ImageHealthchecks:        *imageHealthchecks,
+		ContainerInit:            *containerInit,
+		ExitedContainerRetention: *exitedContainerRetention,
+		MaxRetainedRootfs:        *maxRetainedRootfs,
+		SandboxStateDir:          filepath.Join(state.Path(), "sandboxes"),
+		ContainerStateDir:        filepath.Join(state.Path(), "containers"),
+		CheckpointDir:            *checkpointDir,
+		NotifySocket:             os.Getenv("NOTIFY_SOCKET"),
+		KeptFiles:                keptFiles(),
+		CompressRotatedLogs:      *compressRotatedLogs,
+		StreamingURL:             streamingURL,
+		StreamingIdleTimeout:     *streamingIdleTimeout,
+		StreamingSessionsFile:    filepath.Join(state.Path(), "streaming-sessions"),
+		StatsCacheTTL:            *statsCacheTTL,
+		ExecBudgetWindow:         *execBudgetWindow,
+		MaxPodExecs:              *maxPodExecs,
+		MaxPodExecOutput:         *maxPodExecOutput,
+		IPPools:                  splitList(*ipPools),
+		RuntimeHandlers:          splitList(*runtimeHandlers),
+		DefaultUlimits:           splitList(*defaultUlimits),
+	})
 	if err != nil {
 		log.Fatalf("failed to create runtime service: %v", err)
 	}
+	var streaming *http.Server
+	if streamingListener != nil {
+		streaming = serveStreaming(streamingListener, runtimesvc.StreamingHandler())
+	}
+	if *configFile != "" {
+		hangups := make(chan os.Signal, 1)
+		signal.Notify(hangups, syscall.SIGHUP)
+		go func() {
+			for range hangups {
+				reloadConfig(*configFile, given, services{imagesvc, runtimesvc})
+			}
+		}()
+	}
+	if *statsStream {
+		if debugMux == nil {
+			log.Fatalf("-stats-stream requires -metrics-addr")
+		}
+		if *statsStreamInterval <= 0 {
+			log.Fatalf("-stats-stream-interval must be positive")
+		}
+		metrics := splitList(*statsStreamMetrics)
+		if err := machineman.ValidateStreamMetrics(metrics); err != nil {
+			log.Fatalf("invalid -stats-stream-metrics: %v", err)
+		}
+		debugMux.Handle("/stats/stream", runtimesvc.StatsStreamHandler(machineman.StatsStreamOptions{
+			Interval: *statsStreamInterval,
+			Metrics:  metrics,
+		}))
+	}
 	runtimeapi.RegisterImageServiceServer(s, imagesvc)
 	runtimeapi.RegisterRuntimeServiceServer(s, runtimesvc)
-	if err := s.Serve(listener); err != nil {
-		log.Fatalf("failed to serve: %v", err)
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(listener) }()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case sig := <-signals:
+		log.Printf("received %v, shutting down", sig)
+	case err := <-served:
+		log.Printf("failed to serve: %v", err)
+	}
+	shutdown([]shutdownStage{
+		{"stop serving CRI calls", 30 * time.Second, func(ctx context.Context) error {
+			return gracefulStop(ctx, s)
+		}},
+		{"drain streaming sessions", 10 * time.Second, runtimesvc.DrainSessions},
+		{"stop streaming server", 5 * time.Second, func(ctx context.Context) error {
+			if streaming == nil {
+				return nil
+			}
+			return streaming.Shutdown(ctx)
+		}},
+		{"disconnect from systemd", 5 * time.Second, func(context.Context) error {
+			runtimesvc.Close()
+			return nil
+		}},
+		{"close image store", 5 * time.Second, func(context.Context) error {
+			return imagesvc.Close()
+		}},
+		{"stop debug server", 5 * time.Second, func(ctx context.Context) error {
+			if debug == nil {
+				return nil
+			}
+			return debug.Shutdown(ctx)
+		}},
+		// Released last, so that another instance can't take over the
+		// state dir while this one still writes to it.
+		{"release state dir", 5 * time.Second, func(context.Context) error {
+			return state.Close()
+		}},
+	})
+}
+
+// keptFiles returns the files systemd kept in the service's file
+// descriptor store while the runtime restarted, by name.
+func keptFiles() map[string]*os.File {
+	files := activation.Files(true)
+	if len(files) == 0 {
+		return nil
+	}
+	kept := make(map[string]*os.File, len(files))
+	for _, f := range files {
+		kept[f.Name()] = f
+	}
+	return kept
+}
+
+// listen listens for CRI connections on addr. A positive backlog replaces
+// the length of the accept queue Go picks, which is net.core.somaxconn.
+func listen(addr string, backlog int) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil || backlog <= 0 {
+		return listener, err
+	}
+	raw, err := listener.(*net.TCPListener).SyscallConn()
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	// Calling listen(2) again on a listening socket only changes the
+	// length of its queue.
+	var listenErr error
+	if err := raw.Control(func(fd uintptr) {
+		listenErr = unix.Listen(int(fd), backlog)
+	}); err != nil {
+		listenErr = err
+	}
+	if listenErr != nil {
+		listener.Close()
+		return nil, fmt.Errorf("set listen backlog: %w", listenErr)
+	}
+	return listener, nil
+}
+
+// serveStreaming serves exec and attach sessions on listener in the
+// background, and reports on /healthz whether it still does. A server that
+// stopped serving breaks exec and attach only, so it doesn't take the
+// runtime and its CRI calls down with it.
+func serveStreaming(listener net.Listener, handler http.Handler) *http.Server {
+	server := &http.Server{Handler: handler}
+	var failed atomic.Pointer[error]
+	subsystem := health.Register("streaming", func() error {
+		if err := failed.Load(); err != nil {
+			return *err
+		}
+		return nil
+	})
+	go func() {
+		if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			err = fmt.Errorf("stopped serving: %w", err)
+			log.Printf("failed to serve streaming: %v", err)
+			subsystem.RecordError(err)
+			failed.Store(&err)
+		}
+	}()
+	return server
+}
+
+// gracefulStop stops the gRPC server from taking new calls and waits for the
+// calls in flight to finish. Calls still running when ctx is done are
+// cancelled.
+func gracefulStop(ctx context.Context, s *grpc.Server) error {
+	stopped := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		s.Stop()
+		return ctx.Err()
+	}
+}
+
+// contextErrors turns the errors of calls that ran out of time or were
+// cancelled into the matching status codes, so that kubelet sees
+// DeadlineExceeded rather than Unknown.
+func contextErrors(
+	ctx context.Context,
+	req interface{},
+	_ *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	resp, err := handler(ctx, req)
+	if err == nil {
+		return resp, nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return resp, err
+	}
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return nil, status.Error(codes.DeadlineExceeded, err.Error())
+	case errors.Is(err, context.Canceled):
+		return nil, status.Error(codes.Canceled, err.Error())
+	}
+	return resp, err
+}
+
+// serveDebug serves metrics and health checks on addr, and profiles if
+// profiling is enabled, in the background. Handlers added to the returned
+// mux later are served too.
+func serveDebug(addr string) (*http.Server, *http.ServeMux) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.Handle("/healthz", health.Handler())
+	if *enableProfiling {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
 	}
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("failed to serve metrics: %v", err)
+		}
+	}()
+	return server, mux
 }
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ananthb/systemd-cri/internal/health"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestContextErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want codes.Code
+	}{
+		{name: "success", want: codes.OK},
+		{name: "deadline", err: context.DeadlineExceeded, want: codes.DeadlineExceeded},
+		{name: "wrapped deadline", err: fmt.Errorf("pull: %w", context.DeadlineExceeded), want: codes.DeadlineExceeded},
+		{name: "cancelled", err: context.Canceled, want: codes.Canceled},
+		{name: "status kept", err: status.Error(codes.NotFound, "no such container"), want: codes.NotFound},
+		{name: "other", err: errors.New("boom"), want: codes.Unknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := func(context.Context, interface{}) (interface{}, error) {
+				if tt.err != nil {
+					return nil, tt.err
+				}
+				return "resp", nil
+			}
+			resp, err := contextErrors(context.Background(), nil, &grpc.UnaryServerInfo{}, handler)
+			if code := status.Code(err); code != tt.want {
+				t.Errorf("contextErrors() error = %v, code %v, want %v", err, code, tt.want)
+			}
+			if err == nil && resp != "resp" {
+				t.Errorf("contextErrors() = %v, want the handler's response", resp)
+			}
+		})
+	}
+}
+
+func TestServeStreamingReportsHealth(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := serveStreaming(listener, http.NotFoundHandler())
+	defer server.Close()
+	streamingStatus := func() health.Status {
+		for _, st := range health.Statuses() {
+			if st.Name == "streaming" {
+				return st
+			}
+		}
+		t.Fatal("streaming server isn't reported")
+		return health.Status{}
+	}
+	if st := streamingStatus(); !st.Healthy {
+		t.Errorf("serving streaming server is unhealthy: %s", st.Error)
+	}
+	// The server stops serving once its listener fails.
+	listener.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for streamingStatus().Healthy {
+		if time.Now().After(deadline) {
+			t.Fatal("streaming server that stopped serving is still healthy")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if st := streamingStatus(); st.LastError == "" {
+		t.Error("streaming server that stopped serving has no last error")
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// shutdownStage is a step of shutting down that must finish before the next
+// one starts.
+type shutdownStage struct {
+	name string
+	// timeout bounds how long the stage may take. The stage is expected to
+	// give up, or force its way through, once its context is done.
+	timeout time.Duration
+	run     func(context.Context) error
+}
+
+// shutdown runs stages in order, logging the start and outcome of each so
+// that a shutdown that hangs shows where. A stage that fails or times out
+// doesn't keep the later ones from running.
+func shutdown(stages []shutdownStage) {
+	start := time.Now()
+	for _, stage := range stages {
+		log.Printf("shutdown: %s", stage.name)
+		began := time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), stage.timeout)
+		err := stage.run(ctx)
+		cancel()
+		if err != nil {
+			log.Printf("shutdown: %s failed after %v: %v", stage.name, time.Since(began), err)
+			continue
+		}
+		log.Printf("shutdown: %s done in %v", stage.name, time.Since(began))
+	}
+	log.Printf("shutdown: complete in %v", time.Since(start))
+}
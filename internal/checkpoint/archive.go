@@ -0,0 +1,214 @@
+// Package checkpoint writes and verifies container checkpoint archives.
+//
+// An archive is a tar file holding the checkpoint's files followed by a
+// manifest that lists every one of them with its size and digest. The
+// manifest comes last, so an archive that was cut short has none and is
+// rejected as incomplete.
+package checkpoint
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+// ManifestName is the name of the manifest within an archive.
+const ManifestName = "checkpoint-manifest.json"
+
+// manifestVersion is the version of the manifest format written.
+const manifestVersion = 1
+
+// ErrCorrupt is returned for archives whose contents don't match their
+// manifest, or that have none.
+var ErrCorrupt = errors.New("corrupt checkpoint archive")
+
+// Manifest lists the contents of an archive.
+type Manifest struct {
+	Version     int       `json:"version"`
+	ContainerID string    `json:"containerID"`
+	Created     time.Time `json:"created"`
+	Files       []File    `json:"files"`
+}
+
+// File is a file of an archive.
+type File struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	// Digest is the SHA-256 of the file's contents, e.g. "sha256:2c26b4...".
+	Digest string `json:"digest"`
+}
+
+// Writer writes an archive.
+type Writer struct {
+	tw       *tar.Writer
+	manifest Manifest
+	names    map[string]bool
+}
+
+// NewWriter returns a writer of an archive of a checkpoint of containerID
+// to w.
+func NewWriter(w io.Writer, containerID string) *Writer {
+	return &Writer{
+		tw: tar.NewWriter(w),
+		manifest: Manifest{
+			Version:     manifestVersion,
+			ContainerID: containerID,
+			Created:     time.Now().UTC(),
+		},
+		names: map[string]bool{},
+	}
+}
+
+// AddFile adds a file of size bytes read from r to the archive.
+func (w *Writer) AddFile(name string, size int64, r io.Reader) error {
+	name, err := cleanName(name)
+	if err != nil {
+		return err
+	}
+	if name == ManifestName || w.names[name] {
+		return fmt.Errorf("checkpoint file %s: already in archive", name)
+	}
+	err = w.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0o600,
+		ModTime:  w.manifest.Created,
+	})
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(w.tw, h), r)
+	if err != nil {
+		return fmt.Errorf("checkpoint file %s: %w", name, err)
+	}
+	if n != size {
+		return fmt.Errorf("checkpoint file %s: read %d of %d bytes", name, n, size)
+	}
+	w.names[name] = true
+	w.manifest.Files = append(w.manifest.Files, File{
+		Name:   name,
+		Size:   size,
+		Digest: "sha256:" + hex.EncodeToString(h.Sum(nil)),
+	})
+	return nil
+}
+
+// Close writes the manifest and finishes the archive. It doesn't close the
+// underlying writer.
+func (w *Writer) Close() error {
+	data, err := json.Marshal(w.manifest)
+	if err != nil {
+		return err
+	}
+	err = w.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     ManifestName,
+		Size:     int64(len(data)),
+		Mode:     0o600,
+		ModTime:  w.manifest.Created,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := w.tw.Write(data); err != nil {
+		return err
+	}
+	return w.tw.Close()
+}
+
+// Verify reads an archive to the end and checks that it holds exactly the
+// files its manifest lists, with the listed sizes and digests. It returns
+// the manifest of an intact archive, and an error wrapping ErrCorrupt
+// otherwise.
+func Verify(r io.Reader) (*Manifest, error) {
+	tr := tar.NewReader(r)
+	digests := map[string]File{}
+	var manifest *Manifest
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+		}
+		if manifest != nil {
+			return nil, fmt.Errorf("%w: %s follows the manifest", ErrCorrupt, hdr.Name)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return nil, fmt.Errorf("%w: %s is not a regular file", ErrCorrupt, hdr.Name)
+		}
+		if hdr.Name == ManifestName {
+			manifest = &Manifest{}
+			if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+				return nil, fmt.Errorf("%w: manifest: %v", ErrCorrupt, err)
+			}
+			continue
+		}
+		name, err := cleanName(hdr.Name)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+		}
+		if _, ok := digests[name]; ok {
+			return nil, fmt.Errorf("%w: %s appears twice", ErrCorrupt, name)
+		}
+		h := sha256.New()
+		n, err := io.Copy(h, tr)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrCorrupt, name, err)
+		}
+		digests[name] = File{
+			Name:   name,
+			Size:   n,
+			Digest: "sha256:" + hex.EncodeToString(h.Sum(nil)),
+		}
+	}
+	if manifest == nil {
+		return nil, fmt.Errorf("%w: no manifest, the archive is incomplete", ErrCorrupt)
+	}
+	if manifest.Version != manifestVersion {
+		return nil, fmt.Errorf("%w: unsupported manifest version %d", ErrCorrupt, manifest.Version)
+	}
+	for _, want := range manifest.Files {
+		got, ok := digests[want.Name]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s is missing", ErrCorrupt, want.Name)
+		}
+		if got.Size != want.Size {
+			return nil, fmt.Errorf(
+				"%w: %s has %d bytes, want %d",
+				ErrCorrupt, want.Name, got.Size, want.Size,
+			)
+		}
+		if got.Digest != want.Digest {
+			return nil, fmt.Errorf(
+				"%w: %s has digest %s, want %s",
+				ErrCorrupt, want.Name, got.Digest, want.Digest,
+			)
+		}
+		delete(digests, want.Name)
+	}
+	for name := range digests {
+		return nil, fmt.Errorf("%w: %s is not in the manifest", ErrCorrupt, name)
+	}
+	return manifest, nil
+}
+
+// cleanName rejects file names that would escape the directory an archive
+// is extracted to.
+func cleanName(name string) (string, error) {
+	clean := path.Clean(name)
+	if path.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("invalid checkpoint file name %q", name)
+	}
+	return clean, nil
+}
@@ -0,0 +1,246 @@
+package checkpoint
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// writeArchive writes an archive of files, by name, and returns it.
+func writeArchive(t *testing.T, files map[string]string, order ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := NewWriter(&buf, "c1")
+	for _, name := range order {
+		if err := w.AddFile(name, int64(len(files[name])), strings.NewReader(files[name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// rewrite copies the entries of archive to a new one, passing each through
+// edit, which may change its header and contents, and appending extra
+// before the manifest.
+func rewrite(
+	t *testing.T,
+	archive []byte,
+	edit func(hdr *tar.Header, data []byte) []byte,
+	extra ...tar.Header,
+) []byte {
+	t.Helper()
+	tr := tar.NewReader(bytes.NewReader(archive))
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		var data bytes.Buffer
+		if _, err := data.ReadFrom(tr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Name == ManifestName {
+			for _, e := range extra {
+				e := e
+				if err := tw.WriteHeader(&e); err != nil {
+					t.Fatal(err)
+				}
+				tw.Write(bytes.Repeat([]byte("x"), int(e.Size)))
+			}
+		}
+		contents := data.Bytes()
+		if edit != nil {
+			contents = edit(hdr, contents)
+		}
+		hdr.Size = int64(len(contents))
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(contents); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestRoundTrip(t *testing.T) {
+	files := map[string]string{
+		"config.dump":          `{"id":"c1"}`,
+		"checkpoint/pages.img": strings.Repeat("p", 10000),
+		"empty":                "",
+	}
+	archive := writeArchive(t, files, "config.dump", "checkpoint/pages.img", "empty")
+	manifest, err := Verify(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.ContainerID != "c1" || manifest.Version != manifestVersion {
+		t.Errorf("manifest = %+v, want version %d of c1", manifest, manifestVersion)
+	}
+	if len(manifest.Files) != len(files) {
+		t.Fatalf("manifest lists %d files, want %d", len(manifest.Files), len(files))
+	}
+	for _, f := range manifest.Files {
+		if int(f.Size) != len(files[f.Name]) {
+			t.Errorf("%s has size %d in the manifest, want %d", f.Name, f.Size, len(files[f.Name]))
+		}
+		if !strings.HasPrefix(f.Digest, "sha256:") {
+			t.Errorf("%s has digest %q, want a sha256", f.Name, f.Digest)
+		}
+	}
+}
+
+func TestVerifyCorrupt(t *testing.T) {
+	files := map[string]string{"a": "alpha", "b/c": "gamma"}
+	archive := writeArchive(t, files, "a", "b/c")
+
+	for _, tc := range []struct {
+		name    string
+		archive []byte
+		want    string
+	}{{
+		name:    "empty",
+		archive: nil,
+		want:    "no manifest",
+	}, {
+		name:    "truncated after a file",
+		archive: archive[:1024],
+		want:    "no manifest",
+	}, {
+		name:    "truncated within a header",
+		archive: archive[:1100],
+		want:    "unexpected EOF",
+	}, {
+		name:    "truncated within the manifest",
+		archive: archive[:len(archive)-1536],
+		want:    "unexpected EOF",
+	}, {
+		name: "tampered contents",
+		archive: rewrite(t, archive, func(hdr *tar.Header, data []byte) []byte {
+			if hdr.Name == "a" {
+				return []byte("alphA")
+			}
+			return data
+		}),
+		want: "a has digest",
+	}, {
+		name: "tampered digest",
+		archive: rewrite(t, archive, func(hdr *tar.Header, data []byte) []byte {
+			if hdr.Name != ManifestName {
+				return data
+			}
+			var m Manifest
+			if err := json.Unmarshal(data, &m); err != nil {
+				t.Fatal(err)
+			}
+			m.Files[1].Digest = "sha256:" + strings.Repeat("0", 64)
+			data, err := json.Marshal(m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return data
+		}),
+		want: "b/c has digest",
+	}, {
+		name: "shortened file",
+		archive: rewrite(t, archive, func(hdr *tar.Header, data []byte) []byte {
+			if hdr.Name == "b/c" {
+				return data[:2]
+			}
+			return data
+		}),
+		want: "b/c has 2 bytes, want 5",
+	}, {
+		name: "missing file",
+		archive: rewrite(t, archive, func(hdr *tar.Header, data []byte) []byte {
+			if hdr.Name == "a" {
+				hdr.Name = "z"
+			}
+			return data
+		}),
+		want: "a is missing",
+	}, {
+		name:    "extra file",
+		archive: rewrite(t, archive, nil, tar.Header{Typeflag: tar.TypeReg, Name: "extra", Size: 3}),
+		want:    "extra is not in the manifest",
+	}, {
+		name:    "parent directory",
+		archive: rewrite(t, archive, nil, tar.Header{Typeflag: tar.TypeReg, Name: "../evil", Size: 3}),
+		want:    `invalid checkpoint file name "../evil"`,
+	}, {
+		name:    "escaping name",
+		archive: rewrite(t, archive, nil, tar.Header{Typeflag: tar.TypeReg, Name: "b/../../evil", Size: 3}),
+		want:    `invalid checkpoint file name "b/../../evil"`,
+	}, {
+		name:    "absolute name",
+		archive: rewrite(t, archive, nil, tar.Header{Typeflag: tar.TypeReg, Name: "/etc/passwd", Size: 3}),
+		want:    `invalid checkpoint file name "/etc/passwd"`,
+	}, {
+		name: "symbolic link",
+		archive: rewrite(t, archive, nil, tar.Header{
+			Typeflag: tar.TypeSymlink,
+			Name:     "link",
+			Linkname: "/etc/passwd",
+		}),
+		want: "link is not a regular file",
+	}, {
+		name:    "duplicate file",
+		archive: rewrite(t, archive, nil, tar.Header{Typeflag: tar.TypeReg, Name: "./a", Size: 5}),
+		want:    "a appears twice",
+	}, {
+		name: "file after the manifest",
+		archive: func() []byte {
+			var buf bytes.Buffer
+			buf.Write(archive[:len(archive)-1024])
+			tw := tar.NewWriter(&buf)
+			tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "late", Size: 1})
+			tw.Write([]byte("x"))
+			tw.Close()
+			return buf.Bytes()
+		}(),
+		want: "late follows the manifest",
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Verify(bytes.NewReader(tc.archive))
+			if !errors.Is(err, ErrCorrupt) {
+				t.Fatalf("Verify() = %v, want %v", err, ErrCorrupt)
+			}
+			if !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("Verify() = %v, want it to mention %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestAddFileRejects(t *testing.T) {
+	for _, name := range []string{"../evil", "a/../../evil", "/etc/passwd", ".", "..", ManifestName} {
+		t.Run(name, func(t *testing.T) {
+			w := NewWriter(&bytes.Buffer{}, "c1")
+			if err := w.AddFile(name, 1, strings.NewReader("x")); err == nil {
+				t.Errorf("AddFile(%q) succeeded, want an error", name)
+			}
+		})
+	}
+
+	w := NewWriter(&bytes.Buffer{}, "c1")
+	if err := w.AddFile("a", 1, strings.NewReader("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddFile("./a", 1, strings.NewReader("x")); err == nil {
+		t.Error("AddFile() of a file twice succeeded, want an error")
+	}
+	if err := w.AddFile("b", 2, strings.NewReader("x")); err == nil {
+		t.Error("AddFile() of fewer bytes than the size succeeded, want an error")
+	}
+}
@@ -0,0 +1,140 @@
+// Package crilog writes container output in the CRI log format.
+//
+// Every line of output is stored as an entry tagged with the stream it was
+// written to. Lines longer than the writer's buffer are split into partial
+// (P) entries followed by a final full (F) entry, so that a reader can
+// reassemble them.
+package crilog
+
+import (
+	"bytes"
+	"sync"
+	"time"
+)
+
+// Stream names the output stream an entry was written to.
+type Stream string
+
+const (
+	Stdout Stream = "stdout"
+	Stderr Stream = "stderr"
+)
+
+// Tags that mark an entry as part of a line or the end of one.
+const (
+	TagPartial = "P"
+	TagFull    = "F"
+)
+
+// DefaultBufferSize is the longest chunk of a line stored as a single entry.
+// It matches the buffer kubelet and containerd use.
+const DefaultBufferSize = 16 * 1024
+
+// Entry is a line, or part of a line, of container output.
+type Entry struct {
+	Time    time.Time
+	Stream  Stream
+	Partial bool
+	Content []byte
+}
+
+// Tag returns the CRI tag of the entry.
+func (e Entry) Tag() string {
+	if e.Partial {
+		return TagPartial
+	}
+	return TagFull
+}
+
+// Sink stores log entries. The file and journald drivers are sinks.
+type Sink interface {
+	WriteEntry(Entry) error
+}
+
+// Writer splits the output of one stream into entries and writes them to a
+// sink. It is safe for concurrent use.
+type Writer struct {
+	mu     sync.Mutex
+	sink   Sink
+	stream Stream
+	size   int
+	buf    []byte
+}
+
+// NewWriter returns a writer for stream that writes chunks of at most size
+// bytes. A size of zero or less selects DefaultBufferSize.
+func NewWriter(sink Sink, stream Stream, size int) *Writer {
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+	return &Writer{
+		sink:   sink,
+		stream: stream,
+		size:   size,
+		buf:    make([]byte, 0, size),
+	}
+}
+
+// Write buffers p and writes an entry for every complete line in it.
+// Trailing output without a newline is held until the line is completed, the
+// buffer fills up, or the writer is closed.
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			return n, w.buffer(p)
+		}
+		if err := w.buffer(p[:i]); err != nil {
+			return n - len(p), err
+		}
+		if err := w.flush(false); err != nil {
+			return n - len(p), err
+		}
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+// Close writes any buffered output as a full entry.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.buf) == 0 {
+		return nil
+	}
+	return w.flush(false)
+}
+
+// buffer appends data without a newline to the buffer, writing a partial
+// entry each time the buffer is full and more data follows.
+func (w *Writer) buffer(data []byte) error {
+	for len(data) > 0 {
+		if len(w.buf) == w.size {
+			if err := w.flush(true); err != nil {
+				return err
+			}
+		}
+		n := w.size - len(w.buf)
+		if n > len(data) {
+			n = len(data)
+		}
+		w.buf = append(w.buf, data[:n]...)
+		data = data[n:]
+	}
+	return nil
+}
+
+// flush writes the buffer as a single entry and empties it.
+func (w *Writer) flush(partial bool) error {
+	entry := Entry{
+		Time:    time.Now(),
+		Stream:  w.stream,
+		Partial: partial,
+		Content: append([]byte(nil), w.buf...),
+	}
+	w.buf = w.buf[:0]
+	return w.sink.WriteEntry(entry)
+}
@@ -0,0 +1,166 @@
+package crilog
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// entries is a sink that keeps the entries written to it.
+type entries []Entry
+
+func (s *entries) WriteEntry(e Entry) error {
+	*s = append(*s, e)
+	return nil
+}
+
+// chunk is an entry without its time, for comparing.
+type chunk struct {
+	Tag     string
+	Content string
+}
+
+func chunks(es []Entry) []chunk {
+	var cs []chunk
+	for _, e := range es {
+		cs = append(cs, chunk{e.Tag(), string(e.Content)})
+	}
+	return cs
+}
+
+func TestWriter(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int
+		writes []string
+		close  bool
+		want   []chunk
+	}{
+		{
+			name:   "lines",
+			size:   16,
+			writes: []string{"one\ntwo\n"},
+			want:   []chunk{{TagFull, "one"}, {TagFull, "two"}},
+		},
+		{
+			name:   "line across writes",
+			size:   16,
+			writes: []string{"o", "n", "e\n"},
+			want:   []chunk{{TagFull, "one"}},
+		},
+		{
+			name:   "empty line",
+			size:   16,
+			writes: []string{"\n"},
+			want:   []chunk{{TagFull, ""}},
+		},
+		{
+			name:   "line of exactly the buffer size",
+			size:   4,
+			writes: []string{"abcd\n"},
+			want:   []chunk{{TagFull, "abcd"}},
+		},
+		{
+			name:   "long line",
+			size:   4,
+			writes: []string{"abcdefghij\n"},
+			want:   []chunk{{TagPartial, "abcd"}, {TagPartial, "efgh"}, {TagFull, "ij"}},
+		},
+		{
+			name:   "long line across writes",
+			size:   4,
+			writes: []string{"abc", "def", "gh\n"},
+			want:   []chunk{{TagPartial, "abcd"}, {TagFull, "efgh"}},
+		},
+		{
+			name:   "unterminated line is held",
+			size:   16,
+			writes: []string{"one\ntw"},
+			want:   []chunk{{TagFull, "one"}},
+		},
+		{
+			name:   "unterminated line is flushed on close",
+			size:   16,
+			writes: []string{"one\ntw"},
+			close:  true,
+			want:   []chunk{{TagFull, "one"}, {TagFull, "tw"}},
+		},
+		{
+			name:   "close without buffered output",
+			size:   16,
+			writes: []string{"one\n"},
+			close:  true,
+			want:   []chunk{{TagFull, "one"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sink entries
+			w := NewWriter(&sink, Stdout, tt.size)
+			for _, p := range tt.writes {
+				n, err := w.Write([]byte(p))
+				if err != nil || n != len(p) {
+					t.Fatalf("Write(%q) = %d, %v", p, n, err)
+				}
+			}
+			if tt.close {
+				if err := w.Close(); err != nil {
+					t.Fatalf("Close() = %v", err)
+				}
+			}
+			if got := chunks(sink); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("entries = %q, want %q", got, tt.want)
+			}
+			for _, e := range sink {
+				if e.Stream != Stdout {
+					t.Errorf("entry %q has stream %q, want %q", e.Content, e.Stream, Stdout)
+				}
+			}
+		})
+	}
+}
+
+func TestNewWriterDefaultSize(t *testing.T) {
+	var sink entries
+	w := NewWriter(&sink, Stderr, 0)
+	line := strings.Repeat("x", DefaultBufferSize+1)
+	if _, err := w.Write([]byte(line + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	want := []chunk{{TagPartial, line[:DefaultBufferSize]}, {TagFull, "x"}}
+	if got := chunks(sink); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %d entries, want a partial one of the default size and a full one", len(got))
+	}
+}
+
+func TestFileWriteEntry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "0.log")
+	f, err := OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2016, 10, 6, 0, 17, 9, 669794202, time.FixedZone("CEST", 2*60*60))
+	for _, e := range []Entry{
+		{Time: at, Stream: Stdout, Content: []byte("log line")},
+		{Time: at, Stream: Stderr, Partial: true, Content: []byte("part")},
+	} {
+		if err := f.WriteEntry(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "2016-10-05T22:17:09.669794202Z stdout F log line\n" +
+		"2016-10-05T22:17:09.669794202Z stderr P part\n"
+	if string(got) != want {
+		t.Errorf("log file is %q, want %q", got, want)
+	}
+}
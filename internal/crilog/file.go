@@ -0,0 +1,68 @@
+package crilog
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// File is a sink that appends entries to a log file in the format kubelet
+// reads:
+//
+//	2016-10-06T00:17:09.669794202Z stdout F log line
+type File struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+}
+
+// OpenFile opens path for appending, creating it if it doesn't exist.
+func OpenFile(path string) (*File, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return nil, err
+	}
+	return &File{path: path, f: f}, nil
+}
+
+// WriteEntry appends e as a single line.
+func (f *File) WriteEntry(e Entry) error {
+	line := make([]byte, 0, len(e.Content)+64)
+	line = e.Time.UTC().AppendFormat(line, time.RFC3339Nano)
+	line = append(line, ' ')
+	line = append(line, e.Stream...)
+	line = append(line, ' ')
+	line = append(line, e.Tag()...)
+	line = append(line, ' ')
+	line = append(line, e.Content...)
+	line = append(line, '\n')
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, err := f.f.Write(line)
+	return err
+}
+
+// Reopen switches to a new file at the log file's path, after kubelet moved
+// the old one away to rotate it. The new file is opened before the old one
+// is closed, and entries are written to one or the other but never lost in
+// between. Partial lines still buffered in a Writer are unaffected and end
+// up in the new file. If the new file can't be opened, the old one stays in
+// use.
+func (f *File) Reopen() error {
+	next, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	prev := f.f
+	f.f = next
+	f.mu.Unlock()
+	return prev.Close()
+}
+
+// Close closes the log file.
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.f.Close()
+}
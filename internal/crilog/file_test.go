@@ -0,0 +1,102 @@
+package crilog
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileReopen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "0.log")
+	f, err := OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	at := time.Unix(0, 0)
+	w := NewWriter(f, Stdout, 0)
+	if _, err := w.Write([]byte("before\nhalf ")); err != nil {
+		t.Fatal(err)
+	}
+	// Kubelet rotates the log by renaming it, and asks for a new one.
+	rotated := filepath.Join(dir, "0.log.20161006-001709")
+	if err := os.Rename(path, rotated); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("line\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.WriteEntry(Entry{Time: at, Stream: Stderr, Content: []byte("after")}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{rotated, []string{"before"}},
+		// The line that was buffered across the rotation ends up in the
+		// new file.
+		{path, []string{"half line", "after"}},
+	}
+	for _, tt := range tests {
+		r, err := os.Open(tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		err = ReadEntries(r, func(e Entry) error {
+			got = append(got, string(e.Content))
+			return nil
+		})
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s holds %q, want %q", filepath.Base(tt.path), got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s holds %q, want %q", filepath.Base(tt.path), got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestFileReopenFailureKeepsFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "pod", "0.log")
+	if err := os.Mkdir(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// With the directory gone the new file can't be created.
+	moved := filepath.Join(dir, "moved")
+	if err := os.Rename(filepath.Dir(path), moved); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Reopen(); err == nil {
+		t.Fatal("Reopen() succeeded without a directory to create the file in")
+	}
+	if err := f.WriteEntry(Entry{Time: time.Unix(0, 0), Stream: Stdout, Content: []byte("kept")}); err != nil {
+		t.Fatalf("WriteEntry() after a failed Reopen() = %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(moved, "0.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "1970-01-01T00:00:00Z stdout F kept\n"; string(data) != want {
+		t.Errorf("old file holds %q, want %q", data, want)
+	}
+}
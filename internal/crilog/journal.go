@@ -0,0 +1,30 @@
+package crilog
+
+import (
+	"github.com/coreos/go-systemd/v22/journal"
+)
+
+// Journal is a sink that sends entries to journald. Every entry carries the
+// fields in Fields, which identify the container it came from.
+type Journal struct {
+	Fields map[string]string
+}
+
+// WriteEntry sends e to the journal. Stderr output is logged at error
+// priority and partial lines are marked with CONTAINER_PARTIAL_MESSAGE so
+// that they can be reassembled.
+func (j *Journal) WriteEntry(e Entry) error {
+	vars := make(map[string]string, len(j.Fields)+2)
+	for k, v := range j.Fields {
+		vars[k] = v
+	}
+	vars["CONTAINER_STREAM"] = string(e.Stream)
+	if e.Partial {
+		vars["CONTAINER_PARTIAL_MESSAGE"] = "true"
+	}
+	priority := journal.PriInfo
+	if e.Stream == Stderr {
+		priority = journal.PriErr
+	}
+	return journal.Send(string(e.Content), priority, vars)
+}
@@ -0,0 +1,141 @@
+package crilog
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// ParseLine parses a line of a log file, without its newline, into an entry.
+func ParseLine(line []byte) (Entry, error) {
+	fields := bytes.SplitN(line, []byte{' '}, 4)
+	if len(fields) < 3 {
+		return Entry{}, fmt.Errorf("malformed log line %q", line)
+	}
+	t, err := time.Parse(time.RFC3339Nano, string(fields[0]))
+	if err != nil {
+		return Entry{}, fmt.Errorf("malformed log line timestamp: %w", err)
+	}
+	e := Entry{Time: t, Stream: Stream(fields[1])}
+	switch e.Stream {
+	case Stdout, Stderr:
+	default:
+		return Entry{}, fmt.Errorf("unknown log stream %q", fields[1])
+	}
+	switch string(fields[2]) {
+	case TagFull:
+	case TagPartial:
+		e.Partial = true
+	default:
+		return Entry{}, fmt.Errorf("unknown log tag %q", fields[2])
+	}
+	if len(fields) == 4 {
+		e.Content = fields[3]
+	}
+	return e, nil
+}
+
+// ReadEntries calls fn for every entry of a log file read from r, in order.
+// Malformed lines, such as one cut short by a crash while it was written, are
+// skipped. The content of an entry is only valid until fn returns.
+func ReadEntries(r io.Reader, fn func(Entry) error) error {
+	s := bufio.NewScanner(r)
+	// Writers may have been set up with buffers larger than the default,
+	// leave room for their entries.
+	s.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for s.Scan() {
+		e, err := ParseLine(s.Bytes())
+		if err != nil {
+			continue
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return s.Err()
+}
+
+// SeekSince moves the offset of a log file to the first entry logged at or
+// after since, so that reading from there skips the older ones. It binary
+// searches the file by the timestamps that start every line, reading only a
+// handful of lines even in a large file. Entries are expected in the order
+// they were logged.
+func SeekSince(f *os.File, since time.Time) (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	start, err := sinceOffset(f, info.Size(), since)
+	if err != nil {
+		return 0, err
+	}
+	return f.Seek(start, io.SeekStart)
+}
+
+// sinceOffset returns the offset of the first entry logged at or after since
+// in the size bytes of a log file read from f, size if there is none.
+func sinceOffset(f io.ReaderAt, size int64, since time.Time) (int64, error) {
+	// Find the smallest offset from which the next entry isn't older than
+	// since.
+	lo, hi := int64(0), size
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		start, t, err := nextEntry(f, mid, size)
+		if err != nil {
+			return 0, err
+		}
+		if start >= size || !t.Before(since) {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	start, _, err := nextEntry(f, lo, size)
+	return start, err
+}
+
+// nextEntry returns the offset and time of the first well-formed entry that
+// starts at or after off. The offset is size if there is none.
+func nextEntry(f io.ReaderAt, off, size int64) (int64, time.Time, error) {
+	r := bufio.NewReader(io.NewSectionReader(f, off, size-off))
+	pos := off
+	if off > 0 {
+		// off may be in the middle of a line, unless the previous one
+		// ends right before it.
+		var prev [1]byte
+		if _, err := f.ReadAt(prev[:], off-1); err != nil {
+			return 0, time.Time{}, err
+		}
+		if prev[0] != '\n' {
+			skipped, err := r.ReadBytes('\n')
+			if errors.Is(err, io.EOF) {
+				return size, time.Time{}, nil
+			}
+			if err != nil {
+				return 0, time.Time{}, err
+			}
+			pos += int64(len(skipped))
+		}
+	}
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			if e, perr := ParseLine(line[:len(line)-1]); perr == nil {
+				return pos, e.Time, nil
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			// A line without a newline at the end of the file is
+			// still being written.
+			return size, time.Time{}, nil
+		}
+		if err != nil {
+			return 0, time.Time{}, err
+		}
+		pos += int64(len(line))
+	}
+}
@@ -0,0 +1,225 @@
+package crilog
+
+import (
+	"io"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLine(t *testing.T) {
+	at := time.Date(2016, 10, 6, 0, 17, 9, 669794202, time.UTC)
+	tests := []struct {
+		line    string
+		want    Entry
+		wantErr bool
+	}{
+		{
+			line: "2016-10-06T00:17:09.669794202Z stdout F log line",
+			want: Entry{Time: at, Stream: Stdout, Content: []byte("log line")},
+		},
+		{
+			line: "2016-10-06T00:17:09.669794202Z stderr P part",
+			want: Entry{Time: at, Stream: Stderr, Partial: true, Content: []byte("part")},
+		},
+		{
+			line: "2016-10-06T00:17:09.669794202Z stdout F",
+			want: Entry{Time: at, Stream: Stdout},
+		},
+		{
+			line: "2016-10-06T00:17:09.669794202Z stdout F  spaces  kept ",
+			want: Entry{Time: at, Stream: Stdout, Content: []byte(" spaces  kept ")},
+		},
+		{line: "", wantErr: true},
+		{line: "2016-10-06T00:17:09Z stdout", wantErr: true},
+		{line: "yesterday stdout F line", wantErr: true},
+		{line: "2016-10-06T00:17:09Z stdin F line", wantErr: true},
+		{line: "2016-10-06T00:17:09Z stdout X line", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			got, err := ParseLine([]byte(tt.line))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseLine() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !got.Time.Equal(tt.want.Time) || got.Stream != tt.want.Stream ||
+				got.Partial != tt.want.Partial || string(got.Content) != string(tt.want.Content) {
+				t.Errorf("ParseLine() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadEntriesSkipsMalformed(t *testing.T) {
+	log := "2016-10-06T00:17:09Z stdout F one\n" +
+		"garbage\n" +
+		"2016-10-06T00:17:10Z stderr F two\n" +
+		"2016-10-06T00:17:11Z std"
+	var got []string
+	err := ReadEntries(strings.NewReader(log), func(e Entry) error {
+		got = append(got, string(e.Content))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"one", "two"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadEntries() read %q, want %q", got, want)
+	}
+}
+
+// countingReaderAt counts the reads of a log file.
+type countingReaderAt struct {
+	r     io.ReaderAt
+	reads int
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	c.reads++
+	return c.r.ReadAt(p, off)
+}
+
+// logEntry is where an entry of a test log was written.
+type logEntry struct {
+	file string
+	off  int64
+	time time.Time
+}
+
+// writeRotatedLog writes hours of entries, four a second, to the log file at
+// path and the segments it was rotated into every hour, like kubelet does.
+// Lines vary in length so that probes land mid-line. The live file has a
+// malformed line after its entry at malformed, and ends in a line still
+// being written. It returns the entries in order.
+func writeRotatedLog(t *testing.T, path string, base time.Time, hours, malformed int) []logEntry {
+	t.Helper()
+	const perHour = 4 * 3600
+	var entries []logEntry
+	for h := 0; h < hours; h++ {
+		file := path
+		if h < hours-1 {
+			file += "." + base.Add(time.Duration(h+1)*time.Hour).Format("20060102-150405")
+		}
+		var log strings.Builder
+		for i := h * perHour; i < (h+1)*perHour; i++ {
+			at := base.Add(time.Duration(i) * 250 * time.Millisecond)
+			entries = append(entries, logEntry{file: file, off: int64(log.Len()), time: at})
+			log.WriteString(at.Format(time.RFC3339Nano))
+			log.WriteString(" stdout F ")
+			log.WriteString(strings.Repeat("x", i%7))
+			log.WriteString("\n")
+			if i == malformed {
+				log.WriteString("malformed\n")
+			}
+		}
+		if h == hours-1 {
+			log.WriteString(base.Add(time.Duration(hours) * time.Hour).Format(time.RFC3339Nano))
+		}
+		if err := os.WriteFile(file, []byte(log.String()), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return entries
+}
+
+func TestSeekSince(t *testing.T) {
+	const (
+		hours     = 4
+		malformed = 3*4*3600 + 5000
+		last      = hours*4*3600 - 1
+	)
+	base := time.Date(2016, 10, 6, 0, 0, 0, 0, time.UTC)
+	path := filepath.Join(t.TempDir(), "0.log")
+	entries := writeRotatedLog(t, path, base, hours, malformed)
+	at := func(i int) time.Time { return entries[i].time }
+
+	tests := []struct {
+		name  string
+		since time.Time
+		// first is the index of the first entry read, -1 for none.
+		first int
+	}{
+		{"before the log", base.Add(-time.Hour), 0},
+		{"first entry", base, 0},
+		{"exact entry", at(5000), 5000},
+		{"between entries", at(5000).Add(time.Millisecond), 5001},
+		{"last entry of a segment", at(4*3600 - 1), 4*3600 - 1},
+		{"first entry of a segment", at(4 * 3600), 4 * 3600},
+		{"between segments", at(2*4*3600 - 1).Add(time.Millisecond), 2 * 4 * 3600},
+		{"after malformed line", at(malformed + 1), malformed + 1},
+		{"last entry", at(last), last},
+		{"after the log", base.Add(hours * time.Hour), -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Every segment is searched for its first entry to read:
+			// none of those before since, all of those after it.
+			files := map[string]int64{}
+			for _, e := range entries {
+				if _, ok := files[e.file]; !ok {
+					files[e.file] = -1
+				}
+				if files[e.file] < 0 && !e.time.Before(tt.since) {
+					files[e.file] = e.off
+				}
+			}
+			for file, want := range files {
+				f, err := os.Open(file)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer f.Close()
+				info, err := f.Stat()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want < 0 {
+					want = info.Size()
+				}
+				off, err := SeekSince(f, tt.since)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if off != want {
+					t.Errorf("SeekSince(%s) = %d, want %d", filepath.Base(file), off, want)
+				}
+				if cur, _ := f.Seek(0, io.SeekCurrent); cur != off {
+					t.Errorf("SeekSince(%s) = %d, file offset is %d", filepath.Base(file), off, cur)
+				}
+				// Binary search reads a block or two per halving of
+				// the file, not the blocks before the entry.
+				counter := &countingReaderAt{r: f}
+				if _, err := sinceOffset(counter, info.Size(), tt.since); err != nil {
+					t.Fatal(err)
+				}
+				if max := 2 * (bits.Len64(uint64(info.Size())) + 1); counter.reads > max {
+					t.Errorf(
+						"finding the entry in %d bytes of %s took %d reads, want at most %d",
+						info.Size(), filepath.Base(file), counter.reads, max,
+					)
+				}
+			}
+
+			first := -1
+			err := Read(path, ReadOptions{Since: tt.since}, func(e Entry) error {
+				if first < 0 {
+					first = int(e.Time.Sub(base) / (250 * time.Millisecond))
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if first != tt.first {
+				t.Errorf("first entry read since %v is #%d, want #%d", tt.since, first, tt.first)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package crilog
+
+// MaxReassembledLine is the longest line a Reassembler joins. Longer lines
+// are still delivered in parts of about that size, marked partial, so that
+// a process that never ends its line can't make a reader buffer all of it.
+const MaxReassembledLine = 1 << 20
+
+// Reassembler joins the partial entries a long line was split into back into
+// a single full entry, for readers that can't handle the partial tag. The
+// parts of lines written to stdout and stderr may be interleaved, each
+// stream is reassembled on its own. A joined entry has the time of the
+// line's first part.
+type Reassembler struct {
+	fn      func(Entry) error
+	pending map[Stream]*Entry
+}
+
+// NewReassembler returns a Reassembler that calls fn for every complete
+// line.
+func NewReassembler(fn func(Entry) error) *Reassembler {
+	return &Reassembler{fn: fn, pending: map[Stream]*Entry{}}
+}
+
+// Add adds an entry, calling fn once it completes a line. The content of e
+// is copied if it has to be held on to.
+func (r *Reassembler) Add(e Entry) error {
+	pending := r.pending[e.Stream]
+	if pending == nil {
+		if !e.Partial {
+			return r.fn(e)
+		}
+		pending = &Entry{Time: e.Time, Stream: e.Stream, Partial: true}
+		r.pending[e.Stream] = pending
+	}
+	pending.Content = append(pending.Content, e.Content...)
+	if !e.Partial {
+		delete(r.pending, e.Stream)
+		pending.Partial = false
+		return r.fn(*pending)
+	}
+	if len(pending.Content) >= MaxReassembledLine {
+		delete(r.pending, e.Stream)
+		return r.fn(*pending)
+	}
+	return nil
+}
+
+// Flush calls fn for the lines whose final part hasn't been added, as
+// partial entries, stdout first. A log file can end in the middle of a line
+// while the container is still writing it.
+func (r *Reassembler) Flush() error {
+	for _, stream := range []Stream{Stdout, Stderr} {
+		pending := r.pending[stream]
+		if pending == nil {
+			continue
+		}
+		delete(r.pending, stream)
+		if err := r.fn(*pending); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package crilog
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReassembler(t *testing.T) {
+	at := time.Date(2016, 10, 6, 0, 17, 9, 0, time.UTC)
+	part := func(stream Stream, s string) Entry {
+		return Entry{Time: at, Stream: stream, Partial: true, Content: []byte(s)}
+	}
+	full := func(stream Stream, s string) Entry {
+		return Entry{Time: at, Stream: stream, Content: []byte(s)}
+	}
+	long := strings.Repeat("x", MaxReassembledLine/2)
+	tests := []struct {
+		name    string
+		entries []Entry
+		want    []Entry
+	}{
+		{
+			name:    "full lines",
+			entries: []Entry{full(Stdout, "one"), full(Stdout, "two")},
+			want:    []Entry{full(Stdout, "one"), full(Stdout, "two")},
+		},
+		{
+			name: "line split across several parts",
+			entries: []Entry{
+				part(Stdout, "a "), part(Stdout, "long "), part(Stdout, "line "), full(Stdout, "ends"),
+				full(Stdout, "next"),
+			},
+			want: []Entry{full(Stdout, "a long line ends"), full(Stdout, "next")},
+		},
+		{
+			name: "interleaved streams",
+			entries: []Entry{
+				part(Stdout, "out "), part(Stderr, "err "), part(Stdout, "line"),
+				full(Stderr, "line"), full(Stdout, ""),
+			},
+			want: []Entry{full(Stderr, "err line"), full(Stdout, "out line")},
+		},
+		{
+			name:    "unfinished lines",
+			entries: []Entry{part(Stderr, "err"), part(Stdout, "out "), part(Stdout, "so far")},
+			want:    []Entry{part(Stdout, "out so far"), part(Stderr, "err")},
+		},
+		{
+			name:    "overlong line",
+			entries: []Entry{part(Stdout, long), part(Stdout, long), part(Stdout, "rest"), full(Stdout, "")},
+			want:    []Entry{part(Stdout, long+long), full(Stdout, "rest")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []Entry
+			r := NewReassembler(func(e Entry) error {
+				got = append(got, e)
+				return nil
+			})
+			for _, e := range tt.entries {
+				if err := r.Add(e); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := r.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("reassembled %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadReassemble(t *testing.T) {
+	log := "2016-10-06T00:17:09Z stdout P a \n" +
+		"2016-10-06T00:17:10Z stdout P long \n" +
+		"2016-10-06T00:17:11Z stdout P line \n" +
+		"2016-10-06T00:17:12Z stdout F ends\n"
+	path := filepath.Join(t.TempDir(), "0.log")
+	if err := os.WriteFile(path, []byte(log), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		opts ReadOptions
+		want []string
+	}{
+		{"passthrough", ReadOptions{}, []string{"a ", "long ", "line ", "ends"}},
+		{"reassembled", ReadOptions{Reassemble: true}, []string{"a long line ends"}},
+		{
+			// The parts logged before the time are left out.
+			name: "since a later part",
+			opts: ReadOptions{Since: time.Date(2016, 10, 6, 0, 17, 10, 0, time.UTC), Reassemble: true},
+			want: []string{"long line ends"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			err := Read(path, tt.opts, func(e Entry) error {
+				if tt.opts.Reassemble && e.Partial {
+					t.Errorf("read a partial entry %q", e.Content)
+				}
+				got = append(got, string(e.Content))
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Read() read %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package crilog
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// compressedSuffix marks rotated segments of a log file that are gzipped.
+const compressedSuffix = ".gz"
+
+// rotatedSegments returns the segments kubelet rotated the log file at path
+// into, oldest first. Kubelet names them after the log file with a
+// timestamp appended, so they sort by name.
+func rotatedSegments(path string) ([]string, error) {
+	segments, err := filepath.Glob(globEscape(path) + ".*")
+	if err != nil {
+		return nil, err
+	}
+	var rotated []string
+	for _, segment := range segments {
+		// Leftovers of an interrupted compression aren't segments.
+		if strings.HasSuffix(segment, ".tmp") {
+			continue
+		}
+		rotated = append(rotated, segment)
+	}
+	sort.Slice(rotated, func(i, j int) bool {
+		return strings.TrimSuffix(rotated[i], compressedSuffix) < strings.TrimSuffix(rotated[j], compressedSuffix)
+	})
+	return rotated, nil
+}
+
+// globEscape escapes the characters of p that filepath.Glob would take for
+// a pattern.
+func globEscape(p string) string {
+	var b strings.Builder
+	for _, r := range p {
+		if strings.ContainsRune(`*?[\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// CompressRotated gzips the rotated segments of the log file at path that
+// aren't yet. The live file at path itself is left alone so that it can be
+// followed. A segment is only removed once its compressed copy is complete.
+func CompressRotated(path string) error {
+	segments, err := rotatedSegments(path)
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		if strings.HasSuffix(segment, compressedSuffix) {
+			continue
+		}
+		if err := compressFile(segment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	tmp := path + compressedSuffix + ".tmp"
+	dst, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	zw := gzip.NewWriter(dst)
+	if _, err := io.Copy(zw, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path+compressedSuffix); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// Remove removes the log file at path along with the segments it was
+// rotated into. Files that are already gone are skipped.
+func Remove(path string) error {
+	segments, err := rotatedSegments(path)
+	if err != nil {
+		return err
+	}
+	for _, segment := range append(segments, path) {
+		if err := os.Remove(segment); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadOptions tune how Read reads a log file.
+type ReadOptions struct {
+	// Since skips the entries logged before it. Zero reads everything.
+	Since time.Time
+	// Reassemble joins the partial entries of a line into a full one
+	// before fn sees it, see Reassembler. By default entries are passed
+	// through as they were logged.
+	Reassemble bool
+}
+
+// Read calls fn for every entry of the log file at path, in order, reading
+// through the segments it was rotated into, compressed or not, before the
+// live file. Plain segments are searched for the first entry to read,
+// compressed ones have to be read from their start.
+func Read(path string, opts ReadOptions, fn func(Entry) error) error {
+	if opts.Reassemble {
+		r := NewReassembler(fn)
+		if err := readAll(path, opts.Since, r.Add); err != nil {
+			return err
+		}
+		return r.Flush()
+	}
+	return readAll(path, opts.Since, fn)
+}
+
+func readAll(path string, since time.Time, fn func(Entry) error) error {
+	segments, err := rotatedSegments(path)
+	if err != nil {
+		return err
+	}
+	for _, segment := range append(segments, path) {
+		err := readSegment(segment, since, fn)
+		if errors.Is(err, fs.ErrNotExist) {
+			// Rotated or compressed away since it was listed, or the
+			// container hasn't logged anything yet.
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readSegment(path string, since time.Time, fn func(Entry) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if !strings.HasSuffix(path, compressedSuffix) {
+		if !since.IsZero() {
+			if _, err := SeekSince(f, since); err != nil {
+				return err
+			}
+		}
+		return ReadEntries(f, fn)
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	return ReadEntries(zr, func(e Entry) error {
+		if e.Time.Before(since) {
+			return nil
+		}
+		return fn(e)
+	})
+}
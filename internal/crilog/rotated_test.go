@@ -0,0 +1,133 @@
+package crilog
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRemove(t *testing.T) {
+	tests := []struct {
+		name string
+		// log is the log file removed, files are the files in its
+		// directory, kept those expected to be left.
+		log   string
+		files []string
+		kept  []string
+	}{
+		{
+			name:  "live file only",
+			log:   "0.log",
+			files: []string{"0.log"},
+		},
+		{
+			name:  "rotated segments",
+			log:   "0.log",
+			files: []string{"0.log", "0.log.20161006-001709", "0.log.20161005-001709.gz"},
+		},
+		{
+			name:  "already rotated away",
+			log:   "0.log",
+			files: []string{"0.log.20161006-001709"},
+		},
+		{
+			name:  "logs of other containers and restarts",
+			log:   "0.log",
+			files: []string{"0.log", "1.log", "1.log.20161006-001709", "10.log"},
+			kept:  []string{"1.log", "1.log.20161006-001709", "10.log"},
+		},
+		{
+			// The name isn't taken for a glob pattern.
+			name:  "glob characters",
+			log:   "[0].log",
+			files: []string{"[0].log", "[0].log.20161006-001709", "0.log"},
+			kept:  []string{"0.log"},
+		},
+		{name: "nothing to remove", log: "0.log"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, name := range tt.files {
+				if err := os.WriteFile(filepath.Join(dir, name), nil, 0o640); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := Remove(filepath.Join(dir, tt.log)); err != nil {
+				t.Fatal(err)
+			}
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var left []string
+			for _, entry := range entries {
+				left = append(left, entry.Name())
+			}
+			sort.Strings(left)
+			if !reflect.DeepEqual(left, tt.kept) {
+				t.Errorf("Remove() left %q, want %q", left, tt.kept)
+			}
+		})
+	}
+}
+
+func TestReadSince(t *testing.T) {
+	base := time.Date(2016, 10, 6, 0, 0, 0, 0, time.UTC)
+	// Entries 0-9 are in a compressed segment, 10-19 in a plain one and
+	// 20-29 in the live file.
+	dir := t.TempDir()
+	path := filepath.Join(dir, "0.log")
+	files := []string{path + ".20161005-001709", path + ".20161006-001709", path}
+	for i, name := range files {
+		var log strings.Builder
+		for j := 0; j < 10; j++ {
+			n := i*10 + j
+			fmt.Fprintf(&log, "%s stdout F %d\n", base.Add(time.Duration(n)*time.Second).Format(time.RFC3339Nano), n)
+		}
+		if err := os.WriteFile(name, []byte(log.String()), 0o640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := compressFile(files[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		since time.Time
+		// first is the first entry read, -1 for none.
+		first int
+	}{
+		{"everything", time.Time{}, 0},
+		{"within the compressed segment", base.Add(5 * time.Second), 5},
+		{"within the plain segment", base.Add(15 * time.Second), 15},
+		{"between segments", base.Add(19*time.Second + time.Millisecond), 20},
+		{"within the live file", base.Add(25 * time.Second), 25},
+		{"after the log", base.Add(time.Hour), -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			err := Read(path, ReadOptions{Since: tt.since}, func(e Entry) error {
+				got = append(got, string(e.Content))
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want []string
+			for n := tt.first; n >= 0 && n < 30; n++ {
+				want = append(want, fmt.Sprint(n))
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Read() since %v read %q, want %q", tt.since, got, want)
+			}
+		})
+	}
+}
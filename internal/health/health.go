@@ -0,0 +1,134 @@
+// Package health tracks the health of systemd-cri's subsystems and serves it
+// over HTTP.
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	mu         sync.Mutex
+	subsystems = map[string]*Subsystem{}
+)
+
+// Subsystem is a part of the runtime whose health is reported on /healthz.
+type Subsystem struct {
+	name  string
+	check func() error
+
+	mu          sync.Mutex
+	lastErr     error
+	lastErrTime time.Time
+}
+
+// Register adds a subsystem to the health report. check reports whether the
+// subsystem is currently usable; it is called on every health request and
+// must be cheap. A nil check means the subsystem is always healthy and only
+// its last error is reported.
+func Register(name string, check func() error) *Subsystem {
+	s := &Subsystem{name: name, check: check}
+	mu.Lock()
+	defer mu.Unlock()
+	subsystems[name] = s
+	return s
+}
+
+// RecordError remembers err as the most recent error of the subsystem. It
+// does nothing if err is nil.
+func (s *Subsystem) RecordError(err error) {
+	if err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastErr = err
+	s.lastErrTime = time.Now()
+}
+
+// Status is the health of a subsystem as reported by the verbose endpoint.
+type Status struct {
+	Name          string     `json:"name"`
+	Healthy       bool       `json:"healthy"`
+	Error         string     `json:"error,omitempty"`
+	LastError     string     `json:"lastError,omitempty"`
+	LastErrorTime *time.Time `json:"lastErrorTime,omitempty"`
+}
+
+func (s *Subsystem) status() Status {
+	st := Status{Name: s.name, Healthy: true}
+	if s.check != nil {
+		if err := s.check(); err != nil {
+			st.Healthy = false
+			st.Error = err.Error()
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lastErr != nil {
+		t := s.lastErrTime
+		st.LastError = s.lastErr.Error()
+		st.LastErrorTime = &t
+	}
+	return st
+}
+
+// Statuses returns the health of every registered subsystem, sorted by name.
+func Statuses() []Status {
+	mu.Lock()
+	list := make([]*Subsystem, 0, len(subsystems))
+	for _, s := range subsystems {
+		list = append(list, s)
+	}
+	mu.Unlock()
+	statuses := make([]Status, 0, len(list))
+	for _, s := range list {
+		statuses = append(statuses, s.status())
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+	return statuses
+}
+
+// Handler serves the health of the runtime. It responds with 200 when every
+// subsystem is healthy and 503 otherwise. With the verbose query parameter
+// set, the body lists every subsystem with its status and last error as
+// JSON.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		statuses := Statuses()
+		code := http.StatusOK
+		for _, st := range statuses {
+			if !st.Healthy {
+				code = http.StatusServiceUnavailable
+			}
+		}
+		if _, verbose := req.URL.Query()["verbose"]; verbose {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(code)
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			_ = enc.Encode(struct {
+				Healthy    bool     `json:"healthy"`
+				Subsystems []Status `json:"subsystems"`
+			}{code == http.StatusOK, statuses})
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(code)
+		if code == http.StatusOK {
+			_, _ = w.Write([]byte("ok\n"))
+		} else {
+			_, _ = w.Write([]byte("unhealthy\n"))
+		}
+	})
+}
@@ -0,0 +1,125 @@
+// Package imageref parses and normalizes container image references, so
+// that every image operation agrees on what names the same image.
+package imageref
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/containers/image/v5/docker/reference"
+)
+
+// ErrEmpty is returned for empty or blank references.
+var ErrEmpty = errors.New("image reference is required")
+
+// Ref is a normalized image reference. References without a tag or digest
+// are tagged latest, and short names are expanded, so "alpine" becomes
+// "docker.io/library/alpine:latest".
+type Ref struct {
+	named reference.Named
+}
+
+// Parse validates and normalizes an image reference.
+func Parse(s string) (Ref, error) {
+	if strings.TrimSpace(s) == "" {
+		return Ref{}, ErrEmpty
+	}
+	named, err := reference.ParseNormalizedNamed(s)
+	if err != nil {
+		return Ref{}, fmt.Errorf("invalid image reference %q: %w", s, err)
+	}
+	return Ref{named: reference.TagNameOnly(named)}, nil
+}
+
+// Named returns the reference for use with containers/image.
+func (r Ref) Named() reference.Named {
+	return r.named
+}
+
+// String returns the fully qualified reference, e.g.
+// "docker.io/library/alpine:latest".
+func (r Ref) String() string {
+	return r.named.String()
+}
+
+// Familiar returns the shortest form of the reference, e.g. "alpine:latest".
+func (r Ref) Familiar() string {
+	return reference.FamiliarString(r.named)
+}
+
+// Name returns the repository of the reference without tag or digest, e.g.
+// "docker.io/library/alpine".
+func (r Ref) Name() string {
+	return r.named.Name()
+}
+
+// Domain returns the registry of the reference, e.g. "docker.io".
+func (r Ref) Domain() string {
+	return reference.Domain(r.named)
+}
+
+// Path returns the repository path within the registry, e.g.
+// "library/alpine".
+func (r Ref) Path() string {
+	return reference.Path(r.named)
+}
+
+// Tag returns the tag of the reference, empty if it only has a digest.
+func (r Ref) Tag() string {
+	if tagged, ok := r.named.(reference.Tagged); ok {
+		return tagged.Tag()
+	}
+	return ""
+}
+
+// Digest returns the digest of the reference, e.g. "sha256:...", empty if
+// it has none.
+func (r Ref) Digest() string {
+	if digested, ok := r.named.(reference.Digested); ok {
+		return digested.Digest().String()
+	}
+	return ""
+}
+
+// WithDigest returns the reference to the image of r's repository with
+// digest, e.g. "sha256:...". Any tag of r is dropped.
+func (r Ref) WithDigest(digest string) (Ref, error) {
+	return Parse(r.Name() + "@" + digest)
+}
+
+// StoragePath maps the reference to a directory below root. Digests win
+// over tags, since a reference with both pins the digest:
+//
+//	<root>/<domain>/<path>/digests/<algorithm>/<hex>
+//	<root>/<domain>/<path>/tags/<tag>
+//
+// The reference grammar rules out ".." and absolute components, so the
+// path never leaves root.
+func (r Ref) StoragePath(root string) string {
+	repo := filepath.Join(root, r.Domain(), filepath.FromSlash(r.Path()))
+	if digest := r.Digest(); digest != "" {
+		algorithm, hex, _ := strings.Cut(digest, ":")
+		return filepath.Join(repo, "digests", algorithm, hex)
+	}
+	return filepath.Join(repo, "tags", r.Tag())
+}
+
+// FromStoragePath returns the reference StoragePath maps to dir below root.
+func FromStoragePath(root, dir string) (Ref, error) {
+	rel, err := filepath.Rel(root, dir)
+	if err != nil {
+		return Ref{}, err
+	}
+	rel = filepath.ToSlash(rel)
+	parent := path.Dir(rel)
+	if path.Base(parent) == "tags" {
+		return Parse(path.Dir(parent) + ":" + path.Base(rel))
+	}
+	if grandparent := path.Dir(parent); path.Base(grandparent) == "digests" {
+		return Parse(path.Dir(grandparent) + "@" + path.Base(parent) + ":" + path.Base(rel))
+	}
+	return Ref{}, fmt.Errorf("%s is not an image storage path", dir)
+}
@@ -0,0 +1,156 @@
+package imageref
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+const digest = "sha256:4bcff63911fcb4448bd4fdacec207030997caf25e9bea4045fa6c8c44de311d1"
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in       string
+		want     string
+		familiar string
+		domain   string
+		path     string
+		tag      string
+		digest   string
+	}{
+		{
+			in:       "alpine",
+			want:     "docker.io/library/alpine:latest",
+			familiar: "alpine:latest",
+			domain:   "docker.io",
+			path:     "library/alpine",
+			tag:      "latest",
+		},
+		{
+			in:       "user/app:v1",
+			want:     "docker.io/user/app:v1",
+			familiar: "user/app:v1",
+			domain:   "docker.io",
+			path:     "user/app",
+			tag:      "v1",
+		},
+		{
+			in:       "localhost:5000/app",
+			want:     "localhost:5000/app:latest",
+			familiar: "localhost:5000/app:latest",
+			domain:   "localhost:5000",
+			path:     "app",
+			tag:      "latest",
+		},
+		{
+			in:       "alpine@" + digest,
+			want:     "docker.io/library/alpine@" + digest,
+			familiar: "alpine@" + digest,
+			domain:   "docker.io",
+			path:     "library/alpine",
+			digest:   digest,
+		},
+		{
+			in:       "alpine:3.18@" + digest,
+			want:     "docker.io/library/alpine:3.18@" + digest,
+			familiar: "alpine:3.18@" + digest,
+			domain:   "docker.io",
+			path:     "library/alpine",
+			tag:      "3.18",
+			digest:   digest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			ref, err := Parse(tt.in)
+			if err != nil {
+				t.Fatalf("Parse(%q) = %v", tt.in, err)
+			}
+			for _, field := range []struct{ name, got, want string }{
+				{"String", ref.String(), tt.want},
+				{"Familiar", ref.Familiar(), tt.familiar},
+				{"Domain", ref.Domain(), tt.domain},
+				{"Path", ref.Path(), tt.path},
+				{"Tag", ref.Tag(), tt.tag},
+				{"Digest", ref.Digest(), tt.digest},
+			} {
+				if field.got != field.want {
+					t.Errorf("%s() = %q, want %q", field.name, field.got, field.want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	tests := []struct {
+		in    string
+		empty bool
+	}{
+		{"", true},
+		{" \t", true},
+		{"UPPER", false},
+		{"alpine:", false},
+		{"alpine@sha256:short", false},
+		{"docker://alpine", false},
+	}
+	for _, tt := range tests {
+		_, err := Parse(tt.in)
+		if err == nil {
+			t.Errorf("Parse(%q) succeeded", tt.in)
+			continue
+		}
+		if empty := errors.Is(err, ErrEmpty); empty != tt.empty {
+			t.Errorf("Parse(%q) = %v, ErrEmpty: %v, want %v", tt.in, err, empty, tt.empty)
+		}
+	}
+}
+
+func TestStoragePath(t *testing.T) {
+	root := "/var/lib/images"
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"alpine", "docker.io/library/alpine/tags/latest"},
+		{"localhost:5000/app:v1", "localhost:5000/app/tags/v1"},
+		{"alpine@" + digest, "docker.io/library/alpine/digests/sha256/" + digest[len("sha256:"):]},
+		// The digest wins over the tag.
+		{"alpine:3.18@" + digest, "docker.io/library/alpine/digests/sha256/" + digest[len("sha256:"):]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			ref, err := Parse(tt.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dir := ref.StoragePath(root)
+			if want := filepath.Join(root, tt.want); dir != want {
+				t.Fatalf("StoragePath() = %q, want %q", dir, want)
+			}
+			back, err := FromStoragePath(root, dir)
+			if err != nil {
+				t.Fatalf("FromStoragePath(%q) = %v", dir, err)
+			}
+			// A tag next to a digest isn't stored.
+			want := ref
+			if ref.Digest() != "" {
+				want, _ = ref.WithDigest(ref.Digest())
+			}
+			if back.String() != want.String() {
+				t.Errorf("FromStoragePath(StoragePath(%q)) = %q, want %q", tt.in, back, want)
+			}
+		})
+	}
+}
+
+func TestFromStoragePathInvalid(t *testing.T) {
+	for _, dir := range []string{
+		"/var/lib/images/docker.io/library/alpine",
+		"/var/lib/images/.corrupt/x",
+	} {
+		if ref, err := FromStoragePath("/var/lib/images", dir); err == nil {
+			t.Errorf("FromStoragePath(%q) = %q, want an error", dir, ref)
+		}
+	}
+}
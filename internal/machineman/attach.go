@@ -0,0 +1,121 @@
+package machineman
+
+import (
+	"context"
+	"io"
+
+	"github.com/ananthb/systemd-cri/internal/crilog"
+	"github.com/ananthb/systemd-cri/internal/streaming"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// attachProcess returns the process whose streams a client attaching to a
+// container is connected to. A client attached to a running container
+// writes to the stdin of containers created with one, and gets the output
+// the container writes from then on, until it exits. A container that isn't
+// running has no process left to attach to, the client gets the output it
+// logged instead and the streams close once that was delivered, like
+// containerd and Docker do.
+func (r *RuntimeService) attachProcess(
+	ctx context.Context,
+	c *containerRecord,
+	req *runtimeapi.AttachRequest,
+) (streaming.Process, error) {
+	times, err := r.containerTimes(ctx, c)
+	if err != nil {
+		return streaming.Process{}, err
+	}
+	if times.StartedAt == 0 || times.FinishedAt != 0 {
+		return auditSession(ctx, replayLog(c.LogPath), "attach", c.ID, nil), nil
+	}
+	c.lifecycle.Lock()
+	output := c.output
+	c.lifecycle.Unlock()
+	if output == nil {
+		return streaming.Process{}, status.Errorf(
+			codes.FailedPrecondition,
+			"container %s has no log its output could be attached from",
+			c.ID,
+		)
+	}
+	return auditSession(ctx, attachRunning(c, output, req), "attach", c.ID, nil), nil
+}
+
+// attachRunning returns the process of a client attached to a running
+// container. Killing it only detaches the client, the container keeps
+// running.
+func attachRunning(c *containerRecord, output *containerOutput, req *runtimeapi.AttachRequest) streaming.Process {
+	var proc streaming.Process
+	if req.GetStdin() && c.Stdin != nil {
+		proc.Stdin = c.Stdin
+	}
+	stdout, stderr := output.attach()
+	// The streams the client didn't ask for are dropped.
+	for _, stream := range []struct {
+		want bool
+		r    *io.PipeReader
+		ours *io.Reader
+	}{
+		{req.GetStdout(), stdout, &proc.Stdout},
+		{req.GetStderr(), stderr, &proc.Stderr},
+	} {
+		if stream.want {
+			*stream.ours = stream.r
+		} else {
+			stream.r.CloseWithError(io.ErrClosedPipe)
+		}
+	}
+	proc.Kill = func() error {
+		stdout.CloseWithError(io.ErrClosedPipe)
+		stderr.CloseWithError(io.ErrClosedPipe)
+		return nil
+	}
+	return proc
+}
+
+// replayLog returns a process that writes the entries of a container log
+// file to its stdout and stderr, and exits at the end of the file. A
+// container without a log file has no output to replay.
+func replayLog(path string) streaming.Process {
+	stdout, stdoutW := io.Pipe()
+	stderr, stderrW := io.Pipe()
+	go func() {
+		err := copyLog(path, stdoutW, stderrW)
+		stdoutW.CloseWithError(err)
+		stderrW.CloseWithError(err)
+	}()
+	return streaming.Process{
+		Stdout: stdout,
+		Stderr: stderr,
+		Kill: func() error {
+			stdout.CloseWithError(io.ErrClosedPipe)
+			stderr.CloseWithError(io.ErrClosedPipe)
+			return nil
+		},
+	}
+}
+
+// copyLog writes the lines of a container log file, and of the segments it
+// was rotated into, to the writer of the stream they were logged to,
+// joining partial entries back into lines.
+func copyLog(path string, stdout, stderr io.Writer) error {
+	if path == "" {
+		return nil
+	}
+	return crilog.Read(path, crilog.ReadOptions{}, func(e crilog.Entry) error {
+		w := stdout
+		if e.Stream == crilog.Stderr {
+			w = stderr
+		}
+		if _, err := w.Write(e.Content); err != nil {
+			return err
+		}
+		if e.Partial {
+			return nil
+		}
+		_, err := w.Write([]byte{'\n'})
+		return err
+	})
+}
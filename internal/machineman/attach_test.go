@@ -0,0 +1,289 @@
+package machineman
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ananthb/systemd-cri/internal/crilog"
+	"github.com/ananthb/systemd-cri/internal/streaming"
+	"golang.org/x/net/websocket"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// streamingRuntime returns a runtime that hands out sessions served by a
+// test server.
+func streamingRuntime(t *testing.T, fake *fakeSystemd) *RuntimeService {
+	t.Helper()
+	sessions := streaming.NewSessions(time.Minute, 0)
+	server := httptest.NewServer(sessions.Handler())
+	t.Cleanup(server.Close)
+	return &RuntimeService{
+		opts:     RuntimeOptions{StreamingURL: server.URL},
+		systemd:  fake,
+		sessions: sessions,
+	}
+}
+
+// readSession joins the session at url and returns what it sent on stdout
+// and stderr, and the status it ended with.
+func readSession(t *testing.T, url string) (stdout, stderr, result string) {
+	t.Helper()
+	config, err := websocket.NewConfig("ws"+strings.TrimPrefix(url, "http"), "http://localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Protocol = []string{"v4.channel.k8s.io"}
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	ws.SetDeadline(time.Now().Add(5 * time.Second))
+	var out, errOut strings.Builder
+	for {
+		var msg []byte
+		if err := websocket.Message.Receive(ws, &msg); err != nil {
+			t.Fatal(err)
+		}
+		switch msg[0] {
+		case 1:
+			out.Write(msg[1:])
+		case 2:
+			errOut.Write(msg[1:])
+		case 3:
+			var st struct{ Status string }
+			if err := json.Unmarshal(msg[1:], &st); err != nil {
+				t.Fatal(err)
+			}
+			return out.String(), errOut.String(), st.Status
+		}
+	}
+}
+
+func TestAttachStoppedContainer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "0.log")
+	f, err := crilog.OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []crilog.Entry{
+		{Stream: crilog.Stdout, Content: []byte("hello")},
+		{Stream: crilog.Stderr, Content: []byte("oops")},
+		{Stream: crilog.Stdout, Content: []byte("split "), Partial: true},
+		{Stream: crilog.Stdout, Content: []byte("line")},
+	} {
+		e.Time = time.Unix(0, 0)
+		if err := f.WriteEntry(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+	fake := newFakeSystemd()
+	fake.setUnit(containerUnit("c1"), map[string]interface{}{
+		"ActiveState":                     "inactive",
+		"ExecMainStartTimestampMonotonic": uint64(1),
+		"ExecMainExitTimestamp":           uint64(2),
+	})
+	r := streamingRuntime(t, fake)
+	r.containers.add(&containerRecord{ID: "c1", LogPath: path})
+
+	resp, err := r.Attach(context.Background(), &runtimeapi.AttachRequest{
+		ContainerId: "c1",
+		Stdout:      true,
+		Stderr:      true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, stderr, result := readSession(t, resp.Url)
+	if want := "hello\nsplit line\n"; stdout != want {
+		t.Errorf("stdout = %q, want %q", stdout, want)
+	}
+	if want := "oops\n"; stderr != want {
+		t.Errorf("stderr = %q, want %q", stderr, want)
+	}
+	if result != "Success" {
+		t.Errorf("session ended with %s, want Success", result)
+	}
+}
+
+func TestAttachRunningContainerWithoutLog(t *testing.T) {
+	fake := newFakeSystemd()
+	fake.setUnit(containerUnit("c1"), map[string]interface{}{
+		"ExecMainStartTimestampMonotonic": uint64(1),
+	})
+	r := streamingRuntime(t, fake)
+	r.containers.add(&containerRecord{ID: "c1"})
+	_, err := r.Attach(context.Background(), &runtimeapi.AttachRequest{ContainerId: "c1", Stdout: true})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("Attach() to a running container without a log = %v, want FailedPrecondition", err)
+	}
+}
+
+func TestAttachStdin(t *testing.T) {
+	// The container is set up the way CreateContainer and StartContainer
+	// do for a config with Stdin and StdinOnce.
+	dir := t.TempDir()
+	stdin, err := newStdinPipe(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logPath := filepath.Join(dir, "0.log")
+	logFile, err := crilog.OpenFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logFile.Close()
+	output, err := openOutput(dir, logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer output.close()
+	// The container's process holds its ends of the FIFOs.
+	containerIn, err := os.Open(stdin.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer containerIn.Close()
+	containerOut, err := os.OpenFile(output.stdout, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer containerOut.Close()
+	output.started()
+
+	fake := newFakeSystemd()
+	fake.setUnit(containerUnit("c1"), map[string]interface{}{
+		"ExecMainStartTimestampMonotonic": uint64(1),
+	})
+	r := streamingRuntime(t, fake)
+	r.containers.add(&containerRecord{ID: "c1", Rootfs: dir, LogPath: logPath, Stdin: stdin, output: output})
+	resp, err := r.Attach(context.Background(), &runtimeapi.AttachRequest{
+		ContainerId: "c1",
+		Stdin:       true,
+		Stdout:      true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := websocket.NewConfig("ws"+strings.TrimPrefix(resp.Url, "http"), "http://localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Protocol = []string{"v5.channel.k8s.io"}
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	ws.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// What the client types reaches the container.
+	if err := websocket.Message.Send(ws, []byte("\x00typed\n")); err != nil {
+		t.Fatal(err)
+	}
+	containerIn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got := make([]byte, len("typed\n"))
+	if _, err := io.ReadFull(containerIn, got); err != nil {
+		t.Fatalf("container's read of stdin: %v", err)
+	}
+	if string(got) != "typed\n" {
+		t.Errorf("container read %q, want %q", got, "typed\n")
+	}
+	// What the container writes reaches the client, and its log.
+	if _, err := containerOut.Write([]byte("echoed\n")); err != nil {
+		t.Fatal(err)
+	}
+	var stdout strings.Builder
+	for stdout.Len() < len("echoed\n") {
+		var msg []byte
+		if err := websocket.Message.Receive(ws, &msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg[0] != 1 {
+			t.Fatalf("message on channel %d, want stdout", msg[0])
+		}
+		stdout.Write(msg[1:])
+	}
+	if got := stdout.String(); got != "echoed\n" {
+		t.Errorf("stdout = %q, want %q", got, "echoed\n")
+	}
+	// With StdinOnce, the container sees the end of its input once the
+	// client closes stdin.
+	if err := websocket.Message.Send(ws, []byte{255, 0}); err != nil {
+		t.Fatal(err)
+	}
+	if rest, err := io.ReadAll(containerIn); err != nil || len(rest) != 0 {
+		t.Errorf("container's read of closed stdin = %q, %v, want EOF", rest, err)
+	}
+	// The session ends with the container.
+	containerOut.Close()
+	for {
+		var msg []byte
+		if err := websocket.Message.Receive(ws, &msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg[0] != 3 {
+			continue
+		}
+		var st struct{ Status string }
+		if err := json.Unmarshal(msg[1:], &st); err != nil {
+			t.Fatal(err)
+		}
+		if st.Status != "Success" {
+			t.Errorf("session ended with %s, want Success", st.Status)
+		}
+		break
+	}
+	output.close()
+	var logged []string
+	if err := crilog.Read(logPath, crilog.ReadOptions{}, func(e crilog.Entry) error {
+		logged = append(logged, string(e.Content))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"echoed"}; !reflect.DeepEqual(logged, want) {
+		t.Errorf("logged %q, want %q", logged, want)
+	}
+}
+
+func TestOutputTeeCutsOffClientBehind(t *testing.T) {
+	var tee outputTee
+	behind := tee.attach()
+	keeping := tee.attach()
+	// The stream carries on while a client doesn't read, the one that
+	// does gets all of it.
+	for i := 0; i < attachBacklog+2; i++ {
+		tee.Write([]byte{'0' + byte(i%10)})
+		got := make([]byte, 1)
+		if _, err := io.ReadFull(keeping, got); err != nil {
+			t.Fatalf("read of the client keeping up: %v", err)
+		}
+		if want := '0' + byte(i%10); got[0] != want {
+			t.Fatalf("client keeping up read %q, want %q", got, want)
+		}
+	}
+	tee.end()
+	if _, err := io.ReadAll(behind); !errors.Is(err, errAttachBehind) {
+		t.Errorf("read of the client behind = %v, want %v", err, errAttachBehind)
+	}
+	if rest, err := io.ReadAll(keeping); err != nil || len(rest) != 0 {
+		t.Errorf("read of the client keeping up after the end = %q, %v, want EOF", rest, err)
+	}
+	// A client attached to a stream that ended sees its end.
+	if n, err := tee.attach().Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Errorf("read after the end = %d, %v, want EOF", n, err)
+	}
+}
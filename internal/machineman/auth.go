@@ -0,0 +1,77 @@
+package machineman
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+
+	"github.com/containers/image/v5/types"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// systemContext returns the containers/image context that authenticates a
+// pull with the credentials kubelet passed along, or nil without any.
+//
+// Credential provider plugins hand out short-lived tokens. A registry token
+// is sent as is, and an identity token is an OAuth2 refresh token that is
+// traded for an access token, not a password to log in with.
+func systemContext(auth *runtimeapi.AuthConfig) (*types.SystemContext, error) {
+	if auth == nil {
+		return nil, nil
+	}
+	if token := auth.GetRegistryToken(); token != "" {
+		return &types.SystemContext{DockerBearerRegistryToken: token}, nil
+	}
+	username, password := auth.GetUsername(), auth.GetPassword()
+	if auth.GetAuth() != "" {
+		decoded, err := base64.StdEncoding.DecodeString(auth.GetAuth())
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "malformed auth: %v", err)
+		}
+		var ok bool
+		username, password, ok = strings.Cut(string(decoded), ":")
+		if !ok {
+			return nil, status.Error(codes.InvalidArgument, "malformed auth: missing ':'")
+		}
+	}
+	if token := auth.GetIdentityToken(); token != "" {
+		return &types.SystemContext{
+			DockerAuthConfig: &types.DockerAuthConfig{
+				Username:      username,
+				IdentityToken: token,
+			},
+		}, nil
+	}
+	if username == "" && password == "" {
+		return nil, nil
+	}
+	return &types.SystemContext{
+		DockerAuthConfig: &types.DockerAuthConfig{
+			Username: username,
+			Password: password,
+		},
+	}, nil
+}
+
+// authKey identifies a set of credentials without holding on to them, so that
+// only pulls with the same credentials are shared.
+func authKey(auth *runtimeapi.AuthConfig) string {
+	if auth == nil {
+		return ""
+	}
+	h := sha256.New()
+	for _, field := range []string{
+		auth.GetUsername(),
+		auth.GetPassword(),
+		auth.GetAuth(),
+		auth.GetIdentityToken(),
+		auth.GetRegistryToken(),
+	} {
+		h.Write([]byte(field))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,93 @@
+package machineman
+
+import (
+	"encoding/base64"
+	"reflect"
+	"testing"
+
+	"github.com/containers/image/v5/types"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+func TestSystemContext(t *testing.T) {
+	basic := base64.StdEncoding.EncodeToString([]byte("user:secret"))
+	tests := []struct {
+		name     string
+		auth     *runtimeapi.AuthConfig
+		want     *types.SystemContext
+		wantCode codes.Code
+	}{
+		{
+			name: "no credentials",
+		},
+		{
+			name: "empty credentials",
+			auth: &runtimeapi.AuthConfig{},
+		},
+		{
+			name: "username and password",
+			auth: &runtimeapi.AuthConfig{Username: "user", Password: "secret"},
+			want: &types.SystemContext{DockerAuthConfig: &types.DockerAuthConfig{Username: "user", Password: "secret"}},
+		},
+		{
+			name: "encoded auth takes precedence",
+			auth: &runtimeapi.AuthConfig{Username: "other", Password: "other", Auth: basic},
+			want: &types.SystemContext{DockerAuthConfig: &types.DockerAuthConfig{Username: "user", Password: "secret"}},
+		},
+		{
+			name: "registry token",
+			auth: &runtimeapi.AuthConfig{Username: "user", Password: "secret", RegistryToken: "token"},
+			want: &types.SystemContext{DockerBearerRegistryToken: "token"},
+		},
+		{
+			name: "identity token is not a password",
+			auth: &runtimeapi.AuthConfig{Username: "user", Password: "secret", IdentityToken: "refresh"},
+			want: &types.SystemContext{DockerAuthConfig: &types.DockerAuthConfig{Username: "user", IdentityToken: "refresh"}},
+		},
+		{
+			name:     "auth that isn't base64",
+			auth:     &runtimeapi.AuthConfig{Auth: "!"},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "auth without a colon",
+			auth:     &runtimeapi.AuthConfig{Auth: base64.StdEncoding.EncodeToString([]byte("user"))},
+			wantCode: codes.InvalidArgument,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := systemContext(tt.auth)
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("systemContext() error = %v, want code %v", err, tt.wantCode)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("systemContext() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthKey(t *testing.T) {
+	a := &runtimeapi.AuthConfig{Username: "user", Password: "secret"}
+	tests := []struct {
+		name string
+		x, y *runtimeapi.AuthConfig
+		same bool
+	}{
+		{"same credentials", a, &runtimeapi.AuthConfig{Username: "user", Password: "secret"}, true},
+		{"other password", a, &runtimeapi.AuthConfig{Username: "user", Password: "other"}, false},
+		// Without the separators both would hash "usersecret".
+		{"fields don't run together", a, &runtimeapi.AuthConfig{Username: "users", Password: "ecret"}, false},
+		{"no credentials", nil, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if same := authKey(tt.x) == authKey(tt.y); same != tt.same {
+				t.Errorf("authKey() of %v and %v equal: %v, want %v", tt.x, tt.y, same, tt.same)
+			}
+		})
+	}
+}
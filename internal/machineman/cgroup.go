@@ -0,0 +1,88 @@
+package machineman
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// cgroupRoot is where the cgroup hierarchy is mounted, a variable so that
+// tests can point it at a directory of their own.
+var cgroupRoot = "/sys/fs/cgroup"
+
+// errNoCgroup is returned for units that have no processes and therefore no
+// cgroup.
+var errNoCgroup = errors.New("no control group")
+
+// errNoCgroupKill is returned by killCgroup on kernels before 5.14, which
+// lack cgroup.kill.
+var errNoCgroupKill = errors.New("cgroup.kill is not supported")
+
+// checkCgroupVersion returns an error unless the host uses the unified
+// cgroup v2 hierarchy, which the resource limits and stats rely on.
+func checkCgroupVersion() error {
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err != nil {
+		return status.Errorf(
+			codes.FailedPrecondition,
+			"cgroup v2 required: %s is not a unified cgroup hierarchy, "+
+				"boot with systemd.unified_cgroup_hierarchy=1",
+			cgroupRoot,
+		)
+	}
+	return nil
+}
+
+// unitCgroup returns the cgroup systemd placed a unit in, relative to the
+// root of the hierarchy.
+func (r *RuntimeService) unitCgroup(ctx context.Context, unit string) (string, error) {
+	props, err := r.systemd.UnitProperties(ctx, unit)
+	if err != nil {
+		return "", err
+	}
+	cgroup, ok := props["ControlGroup"].(string)
+	if !ok || cgroup == "" {
+		return "", fmt.Errorf("unit %s: %w", unit, errNoCgroup)
+	}
+	return cgroup, nil
+}
+
+// writeCgroupFile writes value to an interface file of a cgroup.
+func writeCgroupFile(cgroup, file, value string) error {
+	return os.WriteFile(filepath.Join(cgroupRoot, cgroup, file), []byte(value), 0o644)
+}
+
+// cgroupHasController reports whether controller is enabled for a cgroup,
+// which takes its parent listing it in cgroup.subtree_control.
+func cgroupHasController(cgroup, controller string) (bool, error) {
+	data, err := os.ReadFile(filepath.Join(cgroupRoot, cgroup, "cgroup.controllers"))
+	if err != nil {
+		return false, err
+	}
+	for _, enabled := range strings.Fields(string(data)) {
+		if enabled == controller {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// killCgroup kills every process in a cgroup and its descendants at once
+// with cgroup.kill, so that none of them can escape by forking while they
+// are being signaled. A cgroup that is already gone is left alone.
+func killCgroup(cgroup string) error {
+	err := writeCgroupFile(cgroup, "cgroup.kill", "1")
+	if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(cgroupRoot, cgroup)); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return errNoCgroupKill
+}
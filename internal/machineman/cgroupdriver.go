@@ -0,0 +1,84 @@
+package machineman
+
+import (
+	"log"
+	"path"
+	"strings"
+)
+
+// Styles of the cgroup parents kubelet passes for pod sandboxes, which
+// follow its cgroup driver.
+const (
+	// cgroupParentSystemd is a slice name, like
+	// "kubepods-burstable-pod1234.slice", which the systemd driver passes.
+	cgroupParentSystemd = "systemd"
+	// cgroupParentCgroupfs is a cgroup path, like
+	// "/kubepods/burstable/pod1234", which the cgroupfs driver passes.
+	cgroupParentCgroupfs = "cgroupfs"
+)
+
+// runtimeCgroupDriver is the cgroup driver the runtime manages cgroups
+// with. Kubelet has to use the same one.
+const runtimeCgroupDriver = cgroupParentSystemd
+
+// cgroupParentStyle returns the style of a cgroup parent kubelet passed,
+// empty for none.
+func cgroupParentStyle(parent string) string {
+	switch {
+	case parent == "":
+		return ""
+	case strings.HasSuffix(parent, ".slice") && !strings.Contains(parent, "/"):
+		return cgroupParentSystemd
+	}
+	return cgroupParentCgroupfs
+}
+
+// systemdCgroupParent translates a cgroupfs style cgroup parent into the
+// slice the systemd driver names it, the way kubelet does: the components
+// of the path are joined with dashes, after the dashes in them are turned
+// into underscores.
+func systemdCgroupParent(parent string) string {
+	var components []string
+	for _, component := range strings.Split(path.Clean("/"+parent), "/") {
+		if component != "" {
+			components = append(components, strings.ReplaceAll(component, "-", "_"))
+		}
+	}
+	if len(components) == 0 {
+		return "-.slice"
+	}
+	return strings.Join(components, "-") + ".slice"
+}
+
+// checkCgroupParent notes the style of the cgroup parent of a sandbox, and
+// returns it in the style of the runtime's driver. A kubelet using the
+// cgroupfs driver double nests pods and breaks their accounting, which is
+// logged the first time it shows.
+func (r *RuntimeService) checkCgroupParent(parent string) string {
+	style := cgroupParentStyle(parent)
+	if style == "" {
+		return ""
+	}
+	if previous := r.kubeletCgroupDriver.Swap(&style); previous == nil || *previous != style {
+		if style != runtimeCgroupDriver {
+			log.Printf(
+				"WARNING: kubelet passes %s cgroup parents like %q, but this runtime uses the %s cgroup driver; "+
+					"set cgroupDriver: %s in the kubelet configuration. Translating them to slices meanwhile.",
+				style, parent, runtimeCgroupDriver, runtimeCgroupDriver,
+			)
+		}
+	}
+	if style == cgroupParentCgroupfs {
+		return systemdCgroupParent(parent)
+	}
+	return parent
+}
+
+// kubeletCgroupDriverInfo returns the cgroup driver kubelet's cgroup parents
+// suggest it uses, "unknown" until it passed one.
+func (r *RuntimeService) kubeletCgroupDriverInfo() string {
+	if style := r.kubeletCgroupDriver.Load(); style != nil {
+		return *style
+	}
+	return "unknown"
+}
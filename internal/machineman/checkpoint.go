@@ -0,0 +1,97 @@
+package machineman
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ananthb/systemd-cri/internal/checkpoint"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// isCheckpointArchive reports whether the image of a container to create is
+// a checkpoint archive to restore from. Like CRI-O, kubelet passes the path
+// of the archive in place of an image reference.
+func isCheckpointArchive(image string) bool {
+	return filepath.IsAbs(image)
+}
+
+// verifyCheckpoint checks that a checkpoint archive is complete and intact
+// before anything is restored from it, so that a corrupt archive fails
+// cleanly instead of halfway through a restore. Only regular files below dir
+// are read: the path comes from the client, and the runtime can read any
+// file of the host.
+func verifyCheckpoint(dir, archive string) (*checkpoint.Manifest, error) {
+	f, err := openCheckpoint(dir, archive)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	manifest, err := checkpoint.Verify(f)
+	if errors.Is(err, checkpoint.ErrCorrupt) {
+		return nil, status.Errorf(codes.FailedPrecondition, "checkpoint archive %s: %v", archive, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// openCheckpoint opens the checkpoint archive at path, once it made sure
+// that it is a regular file below dir. Symbolic links are resolved before
+// the check, and the archive itself mustn't be one, so that neither can
+// lead out of dir. It is opened without blocking, a FIFO can't hold the
+// restore up.
+func openCheckpoint(dir, path string) (*os.File, error) {
+	if dir == "" {
+		return nil, status.Errorf(
+			codes.FailedPrecondition,
+			"restoring container from checkpoint %s: no checkpoint directory is configured",
+			path,
+		)
+	}
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "checkpoint directory: %v", err)
+	}
+	parent, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, status.Errorf(codes.NotFound, "checkpoint archive %s not found", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	resolved := filepath.Join(parent, filepath.Base(path))
+	if rel, err := filepath.Rel(root, resolved); err != nil || rel == "." || rel == ".." ||
+		strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, status.Errorf(
+			codes.PermissionDenied,
+			"checkpoint archive %s is not in the checkpoint directory %s",
+			path, dir,
+		)
+	}
+	f, err := os.OpenFile(resolved, os.O_RDONLY|unix.O_NONBLOCK|unix.O_NOFOLLOW, 0)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, status.Errorf(codes.NotFound, "checkpoint archive %s not found", path)
+	}
+	if errors.Is(err, unix.ELOOP) {
+		return nil, status.Errorf(codes.FailedPrecondition, "checkpoint archive %s is a symbolic link", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		f.Close()
+		return nil, status.Errorf(codes.FailedPrecondition, "checkpoint archive %s is not a regular file", path)
+	}
+	return f, nil
+}
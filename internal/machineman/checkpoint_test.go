@@ -0,0 +1,88 @@
+package machineman
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ananthb/systemd-cri/internal/checkpoint"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// writeCheckpoint writes an intact checkpoint archive to path.
+func writeCheckpoint(t *testing.T, path string) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := checkpoint.NewWriter(f, "c1")
+	if err := w.AddFile("config.dump", 2, strings.NewReader("{}")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	outside := t.TempDir()
+	writeCheckpoint(t, filepath.Join(dir, "c1.tar"))
+	writeCheckpoint(t, filepath.Join(outside, "c1.tar"))
+	if err := os.WriteFile(filepath.Join(dir, "corrupt.tar"), []byte("not a tar"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Mkfifo(filepath.Join(dir, "fifo.tar"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for name, target := range map[string]string{
+		"link.tar": filepath.Join(dir, "c1.tar"),
+		"out.tar":  filepath.Join(outside, "c1.tar"),
+		"outdir":   outside,
+	} {
+		if err := os.Symlink(target, filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		name     string
+		dir      string
+		archive  string
+		wantCode codes.Code
+	}{
+		{"intact", dir, filepath.Join(dir, "c1.tar"), codes.OK},
+		{"no checkpoint directory", "", filepath.Join(dir, "c1.tar"), codes.FailedPrecondition},
+		{"outside the directory", dir, filepath.Join(outside, "c1.tar"), codes.PermissionDenied},
+		{"parent directory", dir, dir + "/../" + filepath.Base(outside) + "/c1.tar", codes.PermissionDenied},
+		{"the directory itself", dir, dir, codes.PermissionDenied},
+		{"through a linked directory", dir, filepath.Join(dir, "outdir", "c1.tar"), codes.PermissionDenied},
+		{"symbolic link", dir, filepath.Join(dir, "link.tar"), codes.FailedPrecondition},
+		{"symbolic link out", dir, filepath.Join(dir, "out.tar"), codes.FailedPrecondition},
+		{"FIFO", dir, filepath.Join(dir, "fifo.tar"), codes.FailedPrecondition},
+		{"corrupt", dir, filepath.Join(dir, "corrupt.tar"), codes.FailedPrecondition},
+		{"missing", dir, filepath.Join(dir, "missing.tar"), codes.NotFound},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			done := make(chan error, 1)
+			go func() {
+				_, err := verifyCheckpoint(tt.dir, tt.archive)
+				done <- err
+			}()
+			select {
+			case err := <-done:
+				if code := status.Code(err); code != tt.wantCode {
+					t.Errorf("verifyCheckpoint() = %v, want code %v", err, tt.wantCode)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("verifyCheckpoint() blocked")
+			}
+		})
+	}
+}
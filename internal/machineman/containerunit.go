@@ -0,0 +1,267 @@
+package machineman
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/ananthb/systemd-cri/internal/health"
+	"github.com/coreos/go-systemd/v22/dbus"
+	godbus "github.com/godbus/dbus/v5"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// containerRootDir is the directory of a container's rootfs directory that
+// systemd-nspawn runs it in: the overlay of the writable layer on the
+// image's layers.
+const containerRootDir = "merged"
+
+// nspawnArgs returns the arguments systemd-nspawn runs a container in sb
+// with, ending with the container's command.
+func nspawnArgs(c *containerRecord, sb *sandboxRecord) []string {
+	stopSignal := c.StopSignal
+	if stopSignal == "" {
+		stopSignal = "SIGTERM"
+	}
+	args := []string{
+		"--quiet",
+		// The unit is the container, systemd-nspawn mustn't move into a
+		// scope of its own or register with machined.
+		"--keep-unit",
+		"--register=no",
+		"--directory=" + filepath.Join(c.Rootfs, containerRootDir),
+		// The container's stdio is the unit's, which the runtime
+		// connects to its stdin and log.
+		"--console=pipe",
+		// systemd-nspawn turns the SIGTERM stopping the unit sends it
+		// into this signal to the container, rather than the SIGKILL it
+		// sends by default.
+		"--kill-signal=" + stopSignal,
+	}
+	if c.WorkingDir != "" {
+		args = append(args, "--chdir="+c.WorkingDir)
+	}
+	for _, env := range c.Env {
+		args = append(args, "--setenv="+env)
+	}
+	if sb.NetNSPath != "" {
+		args = append(args, "--network-namespace-path="+sb.NetNSPath)
+	}
+	for _, bind := range c.Binds {
+		option := "--bind="
+		if bind.GetReadonly() {
+			option = "--bind-ro="
+		}
+		args = append(args, option+bind.GetHostPath()+":"+bind.GetContainerPath())
+	}
+	for _, device := range c.Devices {
+		args = append(args, "--bind="+device.GetHostPath()+":"+device.GetContainerPath())
+	}
+	resources, _ := c.resources()
+	args = append(args, hugepageBinds(resources.GetHugepageLimits())...)
+	args = append(args, userArgs(c)...)
+	args = append(args, initArgs(c)...)
+	_, readyArgs := readinessProperties(c.Readiness)
+	args = append(args, readyArgs...)
+	_, credentialArgs := credentialProperties(c.Credentials)
+	args = append(args, credentialArgs...)
+	return append(append(args, "--"), c.Command...)
+}
+
+// containerUnitProperties returns the definition of the transient service a
+// container in sb runs in, below the sandbox's slice. systemd only creates
+// transient units by starting them, so the unit itself only exists once the
+// container is started with these. The service's start job finishes once
+// the container's command runs, or with readiness notification once it
+// said it is ready.
+func containerUnitProperties(c *containerRecord, sb *sandboxRecord) ([]dbus.Property, error) {
+	resources, annotations := c.resources()
+	limits, err := resourceProperties(resources, annotations)
+	if err != nil {
+		return nil, err
+	}
+	// systemd wants the absolute path of the program it runs.
+	nspawn, err := exec.LookPath(nspawnBinary)
+	if err != nil {
+		return nil, err
+	}
+	props := []dbus.Property{
+		dbus.PropDescription("Container " + c.Metadata.GetName() + " of pod " +
+			sb.Metadata.GetNamespace() + "/" + sb.Metadata.GetName()),
+		dbus.PropSlice(sb.Slice),
+		dbus.PropExecStart(append([]string{nspawn}, nspawnArgs(c, sb)...), false),
+		{Name: "Environment", Value: godbus.MakeVariant(nspawnEnvironment(c))},
+		// Stopping sends SIGTERM to systemd-nspawn alone, which sends
+		// the container its stop signal, and SIGKILL to everything left
+		// once the grace period is up.
+		{Name: "KillMode", Value: godbus.MakeVariant("mixed")},
+	}
+	if sb.IPCNSPath != "" {
+		props = append(props, dbus.Property{Name: "IPCNamespacePath", Value: godbus.MakeVariant(sb.IPCNSPath)})
+	}
+	props = append(props, limits...)
+	props = append(props, ulimitProperties(c.Ulimits)...)
+	if len(c.Devices) > 0 {
+		props = append(props, deviceAllowProperty(c.Devices))
+	}
+	readyProps, _ := readinessProperties(c.Readiness)
+	if len(readyProps) == 0 {
+		readyProps = []dbus.Property{{Name: "Type", Value: godbus.MakeVariant("exec")}}
+	}
+	props = append(props, readyProps...)
+	props = append(props, exitRecordProperty(c.Rootfs))
+	if c.Stdin != nil {
+		props = append(props, dbus.Property{Name: "StandardInputFile", Value: godbus.MakeVariant(c.Stdin.Path)})
+	}
+	credentialProps, _ := credentialProperties(c.Credentials)
+	return append(props, credentialProps...), nil
+}
+
+// containerUnits keeps which unit each container runs in, the sandbox it
+// belongs to and where its output goes, in a file of its own below dir, so
+// that a container a CreateContainer call made before the runtime restarted
+// is known when kubelet retries the call, and the output of the containers
+// still running is forwarded again. An empty dir keeps nothing.
+type containerUnits struct {
+	dir string
+	// health records the last failed write, if set.
+	health *health.Subsystem
+}
+
+func (s containerUnits) path(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+// savedContainer is what containerUnits keeps of a container: enough to
+// list it, report its status, exec into it, stop it and remove it after a
+// restart.
+type savedContainer struct {
+	Unit         string                        `json:"unit"`
+	SandboxID    string                        `json:"sandboxId"`
+	Metadata     *runtimeapi.ContainerMetadata `json:"metadata"`
+	Rootfs       string                        `json:"rootfs,omitempty"`
+	LogPath      string                        `json:"logPath,omitempty"`
+	Image        string                        `json:"image,omitempty"`
+	ImageRef     string                        `json:"imageRef,omitempty"`
+	Labels       map[string]string             `json:"labels,omitempty"`
+	Annotations  map[string]string             `json:"annotations,omitempty"`
+	CreatedAt    int64                         `json:"createdAt,omitempty"`
+	Env          []string                      `json:"env,omitempty"`
+	WorkingDir   string                        `json:"workingDir,omitempty"`
+	User         *containerUser                `json:"user,omitempty"`
+	Seccomp      *runtimeapi.SecurityProfile   `json:"seccomp,omitempty"`
+	Mounts       []*runtimeapi.Mount           `json:"mounts,omitempty"`
+	StopPriority int                           `json:"stopPriority,omitempty"`
+	RetainRootfs int                           `json:"retainRootfs,omitempty"`
+}
+
+// record returns the record of the container with the given ID that c
+// was saved from, without what only lasts as long as the runtime runs.
+func (c savedContainer) record(id string) *containerRecord {
+	return &containerRecord{
+		ID:           id,
+		SandboxID:    c.SandboxID,
+		Metadata:     c.Metadata,
+		Rootfs:       c.Rootfs,
+		LogPath:      c.LogPath,
+		Image:        c.Image,
+		ImageRef:     c.ImageRef,
+		Labels:       c.Labels,
+		Annotations:  c.Annotations,
+		CreatedAt:    c.CreatedAt,
+		Env:          c.Env,
+		WorkingDir:   c.WorkingDir,
+		User:         c.User,
+		Seccomp:      c.Seccomp,
+		Mounts:       c.Mounts,
+		StopPriority: c.StopPriority,
+		RetainRootfs: c.RetainRootfs,
+	}
+}
+
+// save records a container atomically.
+func (s containerUnits) save(c *containerRecord) error {
+	if s.dir == "" {
+		return nil
+	}
+	data, err := json.Marshal(savedContainer{
+		Unit:         containerUnit(c.ID),
+		SandboxID:    c.SandboxID,
+		Metadata:     c.Metadata,
+		Rootfs:       c.Rootfs,
+		LogPath:      c.LogPath,
+		Image:        c.Image,
+		ImageRef:     c.ImageRef,
+		Labels:       c.Labels,
+		Annotations:  c.Annotations,
+		CreatedAt:    c.CreatedAt,
+		Env:          c.Env,
+		WorkingDir:   c.WorkingDir,
+		User:         c.User,
+		Seccomp:      c.Seccomp,
+		Mounts:       c.Mounts,
+		StopPriority: c.StopPriority,
+		RetainRootfs: c.RetainRootfs,
+	})
+	if err != nil {
+		return err
+	}
+	return recordStateError(s.health, writeFileAtomic(s.dir, c.ID+".json", data))
+}
+
+// saved reports whether a container was recorded.
+func (s containerUnits) saved(id string) bool {
+	if s.dir == "" {
+		return false
+	}
+	_, err := os.Stat(s.path(id))
+	return err == nil
+}
+
+// list returns the recorded containers by ID.
+func (s containerUnits) list() (map[string]savedContainer, error) {
+	if s.dir == "" {
+		return nil, nil
+	}
+	entries, err := os.ReadDir(s.dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	saved := make(map[string]savedContainer, len(entries))
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(s.dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var c savedContainer
+		if err := json.Unmarshal(data, &c); err != nil {
+			return nil, fmt.Errorf("read state of container %s: %w", id, err)
+		}
+		saved[id] = c
+	}
+	return saved, nil
+}
+
+// remove forgets a removed container.
+func (s containerUnits) remove(id string) error {
+	if s.dir == "" {
+		return nil
+	}
+	err := os.Remove(s.path(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return recordStateError(s.health, err)
+}
@@ -0,0 +1,323 @@
+package machineman
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ananthb/systemd-cri/internal/health"
+	"github.com/coreos/go-systemd/v22/dbus"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+func TestNspawnArgs(t *testing.T) {
+	base := []string{
+		"--quiet",
+		"--keep-unit",
+		"--register=no",
+		"--directory=/var/lib/systemd-cri/c1/merged",
+		"--console=pipe",
+		"--kill-signal=SIGTERM",
+	}
+	tests := []struct {
+		name string
+		c    *containerRecord
+		sb   *sandboxRecord
+		want []string
+	}{
+		{
+			name: "minimal",
+			c:    &containerRecord{Command: []string{"/bin/app", "--flag"}},
+			sb:   &sandboxRecord{},
+			want: append(append([]string{}, base...), "--", "/bin/app", "--flag"),
+		},
+		{
+			name: "stop signal of the image",
+			c:    &containerRecord{StopSignal: "SIGRTMIN+3", Command: []string{"/bin/app"}},
+			sb:   &sandboxRecord{},
+			want: []string{
+				"--quiet",
+				"--keep-unit",
+				"--register=no",
+				"--directory=/var/lib/systemd-cri/c1/merged",
+				"--console=pipe",
+				"--kill-signal=SIGRTMIN+3",
+				"--", "/bin/app",
+			},
+		},
+		{
+			name: "environment and working directory",
+			c: &containerRecord{
+				WorkingDir: "/srv",
+				Env:        []string{"A=1", "B=two words"},
+				Command:    []string{"/bin/app"},
+			},
+			sb: &sandboxRecord{},
+			want: append(append([]string{}, base...),
+				"--chdir=/srv", "--setenv=A=1", "--setenv=B=two words", "--", "/bin/app"),
+		},
+		{
+			name: "network namespace of the pod",
+			c:    &containerRecord{Command: []string{"/bin/app"}},
+			sb:   &sandboxRecord{NetNSPath: "/run/netns/pod"},
+			want: append(append([]string{}, base...),
+				"--network-namespace-path=/run/netns/pod", "--", "/bin/app"),
+		},
+		{
+			name: "binds and devices",
+			c: &containerRecord{
+				Binds: []*runtimeapi.Mount{
+					{HostPath: "/srv/data", ContainerPath: "/data"},
+					{HostPath: "/etc/app", ContainerPath: "/etc/app", Readonly: true},
+				},
+				Devices: []*runtimeapi.Device{{HostPath: "/dev/fuse", ContainerPath: "/dev/fuse"}},
+				Command: []string{"/bin/app"},
+			},
+			sb: &sandboxRecord{},
+			want: append(append([]string{}, base...),
+				"--bind=/srv/data:/data",
+				"--bind-ro=/etc/app:/etc/app",
+				"--bind=/dev/fuse:/dev/fuse",
+				"--", "/bin/app"),
+		},
+		{
+			name: "init, readiness and credentials",
+			c: &containerRecord{
+				Init:        true,
+				Readiness:   readiness{Notify: true, Timeout: time.Minute},
+				Credentials: map[string]string{"token": "s3cret", "key": "k"},
+				Command:     []string{"/bin/app"},
+			},
+			sb: &sandboxRecord{},
+			want: append(append([]string{}, base...),
+				"--as-pid2",
+				"--notify-ready=yes",
+				"--load-credential=key:key",
+				"--load-credential=token:token",
+				"--", "/bin/app"),
+		},
+		{
+			// The user comes from the config of the rootfs directory as
+			// an OCI bundle.
+			name: "user and groups",
+			c: &containerRecord{
+				User:    &containerUser{UID: 1000, GID: 1000, Groups: []uint32{2000}},
+				Command: []string{"/bin/app"},
+			},
+			sb: &sandboxRecord{},
+			want: append(append([]string{}, base...),
+				"--oci-bundle=/var/lib/systemd-cri/c1",
+				"--", "/bin/app"),
+		},
+		{
+			// Arguments that look like options belong to the command.
+			name: "command with options",
+			c:    &containerRecord{Command: []string{"--help"}},
+			sb:   &sandboxRecord{},
+			want: append(append([]string{}, base...), "--", "--help"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.c.Rootfs = "/var/lib/systemd-cri/c1"
+			if got := nspawnArgs(tt.c, tt.sb); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("nspawnArgs() = %q\nwant %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeNspawn puts an executable systemd-nspawn in PATH, and returns its path.
+func fakeNspawn(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, nspawnBinary)
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+	return path
+}
+
+// propertyValues returns the values of props by name, failing on a property
+// that is set twice.
+func propertyValues(t *testing.T, props []dbus.Property) map[string]interface{} {
+	t.Helper()
+	values := make(map[string]interface{}, len(props))
+	for _, prop := range props {
+		if _, ok := values[prop.Name]; ok {
+			t.Errorf("property %s is set twice", prop.Name)
+		}
+		values[prop.Name] = prop.Value.Value()
+	}
+	return values
+}
+
+// execArgv returns the command line of an ExecStart-like property value.
+func execArgv(t *testing.T, value interface{}) (string, []string) {
+	t.Helper()
+	execs := reflect.ValueOf(value)
+	if execs.Kind() != reflect.Slice || execs.Len() != 1 {
+		t.Fatalf("exec property holds %#v, want one command", value)
+	}
+	return execs.Index(0).FieldByName("Path").String(),
+		execs.Index(0).FieldByName("Args").Interface().([]string)
+}
+
+func TestContainerUnitProperties(t *testing.T) {
+	nspawn := fakeNspawn(t)
+	sb := &sandboxRecord{
+		Metadata: &runtimeapi.PodSandboxMetadata{Namespace: "default", Name: "web"},
+		Slice:    "systemd-cri-pod-1.slice",
+	}
+	tests := []struct {
+		name string
+		c    *containerRecord
+		// want are properties expected among those of the unit, absent
+		// those expected to be missing.
+		want   map[string]interface{}
+		absent []string
+	}{
+		{
+			name: "plain",
+			c:    &containerRecord{Metadata: &runtimeapi.ContainerMetadata{Name: "app"}},
+			want: map[string]interface{}{
+				"Description": "Container app of pod default/web",
+				"Slice":       "systemd-cri-pod-1.slice",
+				"KillMode":    "mixed",
+				"Type":        "exec",
+				"Environment": []string{"SYSTEMD_NSPAWN_USE_CGNS=1", "SYSTEMD_NSPAWN_SHARE_NS_IPC=1"},
+			},
+			absent: []string{"StandardInputFile", "SetCredential", "TimeoutStartUSec", "DeviceAllow", "IPCNamespacePath"},
+		},
+		{
+			name: "notify readiness",
+			c: &containerRecord{
+				Metadata:  &runtimeapi.ContainerMetadata{Name: "app"},
+				Readiness: readiness{Notify: true, Timeout: time.Minute},
+			},
+			want: map[string]interface{}{
+				"Type":             "notify",
+				"TimeoutStartUSec": uint64(time.Minute / time.Microsecond),
+			},
+		},
+		{
+			name: "stdin",
+			c: &containerRecord{
+				Metadata: &runtimeapi.ContainerMetadata{Name: "app"},
+				Stdin:    &stdinPipe{Path: "/run/systemd-cri/c1/stdin"},
+			},
+			want: map[string]interface{}{"StandardInputFile": "/run/systemd-cri/c1/stdin"},
+		},
+		{
+			name: "host cgroup namespace",
+			c: &containerRecord{
+				Metadata:            &runtimeapi.ContainerMetadata{Name: "app"},
+				HostCgroupNamespace: true,
+			},
+			want: map[string]interface{}{
+				"Environment": []string{"SYSTEMD_NSPAWN_USE_CGNS=0", "SYSTEMD_NSPAWN_SHARE_NS_IPC=1"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.c.Rootfs = "/var/lib/systemd-cri/c1"
+			tt.c.Command = []string{"/bin/app"}
+			props, err := containerUnitProperties(tt.c, sb)
+			if err != nil {
+				t.Fatal(err)
+			}
+			values := propertyValues(t, props)
+			for name, want := range tt.want {
+				if got := values[name]; !reflect.DeepEqual(got, want) {
+					t.Errorf("%s = %#v, want %#v", name, got, want)
+				}
+			}
+			for _, name := range tt.absent {
+				if got, ok := values[name]; ok {
+					t.Errorf("%s = %#v, want it unset", name, got)
+				}
+			}
+			path, argv := execArgv(t, values["ExecStart"])
+			if path != nspawn {
+				t.Errorf("ExecStart runs %s, want %s", path, nspawn)
+			}
+			if want := append([]string{nspawn}, nspawnArgs(tt.c, sb)...); !reflect.DeepEqual(argv, want) {
+				t.Errorf("ExecStart = %q, want %q", argv, want)
+			}
+			// Every unit records how its container exited.
+			if _, ok := values["ExecStopPost"]; !ok {
+				t.Error("ExecStopPost is unset")
+			}
+		})
+	}
+}
+
+func TestContainerUnitPropertiesWithoutNspawn(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+	c := &containerRecord{Metadata: &runtimeapi.ContainerMetadata{Name: "app"}}
+	if _, err := containerUnitProperties(c, &sandboxRecord{}); err == nil {
+		t.Error("containerUnitProperties() succeeded without systemd-nspawn")
+	}
+}
+
+func TestContainerUnits(t *testing.T) {
+	s := containerUnits{dir: t.TempDir()}
+	c := &containerRecord{ID: "c1", SandboxID: "pod", Metadata: &runtimeapi.ContainerMetadata{Name: "app"}}
+	if s.saved(c.ID) {
+		t.Fatal("saved() before save()")
+	}
+	if err := s.save(c); err != nil {
+		t.Fatal(err)
+	}
+	if !s.saved(c.ID) {
+		t.Error("saved() after save() = false")
+	}
+	if err := s.remove(c.ID); err != nil {
+		t.Fatal(err)
+	}
+	if s.saved(c.ID) {
+		t.Error("saved() after remove() = true")
+	}
+	if err := s.remove(c.ID); err != nil {
+		t.Errorf("remove() of a removed container = %v", err)
+	}
+
+	// Without a directory nothing is kept.
+	var none containerUnits
+	if err := none.save(c); err != nil || none.saved(c.ID) {
+		t.Errorf("containerUnits without a directory: save() = %v, saved() = %v", err, none.saved(c.ID))
+	}
+}
+
+func TestContainerUnitsReportFailedWrites(t *testing.T) {
+	// A state dir below a file can be neither made nor written to.
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(file, "containers")
+	if err := checkStateDirs(t.TempDir(), filepath.Join(t.TempDir(), "missing", "containers")); err != nil {
+		t.Errorf("checkStateDirs() of writable dirs = %v", err)
+	}
+	if err := checkStateDirs(dir); err == nil {
+		t.Error("checkStateDirs() of a dir below a file = nil")
+	}
+	s := containerUnits{dir: dir, health: health.Register("test-state-store", nil)}
+	c := &containerRecord{ID: "c1", SandboxID: "pod", Metadata: &runtimeapi.ContainerMetadata{Name: "app"}}
+	if err := s.save(c); err == nil {
+		t.Fatal("save() below a file = nil")
+	}
+	var lastError string
+	for _, st := range health.Statuses() {
+		if st.Name == "test-state-store" {
+			lastError = st.LastError
+		}
+	}
+	if lastError == "" {
+		t.Error("failed save() isn't reported as the last error")
+	}
+}
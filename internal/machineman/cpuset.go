@@ -0,0 +1,136 @@
+package machineman
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-systemd/v22/dbus"
+	godbus "github.com/godbus/dbus/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+const (
+	// onlineCPUsPath lists the CPUs the kernel has brought online.
+	onlineCPUsPath = "/sys/devices/system/cpu/online"
+	// onlineNodesPath lists the NUMA memory nodes that are online.
+	onlineNodesPath = "/sys/devices/system/node/online"
+)
+
+// maxCPUListID is the highest CPU or node ID parseCPUList accepts, the
+// most CPUs the kernel can be built for. Ranges are expanded, so a request
+// for a huge one would otherwise take all the memory there is.
+const maxCPUListID = 8191
+
+// parseCPUList parses a kernel CPU or node list such as "0-3,7" into sorted,
+// de-duplicated IDs.
+func parseCPUList(list string) ([]int, error) {
+	seen := map[int]bool{}
+	for _, part := range strings.Split(strings.TrimSpace(list), ",") {
+		if part == "" {
+			continue
+		}
+		first, last, isRange := strings.Cut(part, "-")
+		start, err := strconv.Atoi(first)
+		if err != nil || start < 0 {
+			return nil, fmt.Errorf("invalid cpu list %q", list)
+		}
+		end := start
+		if isRange {
+			end, err = strconv.Atoi(last)
+			if err != nil || end < start {
+				return nil, fmt.Errorf("invalid cpu list %q", list)
+			}
+		}
+		if end > maxCPUListID {
+			return nil, fmt.Errorf("cpu list %q has IDs above %d", list, maxCPUListID)
+		}
+		for id := start; id <= end; id++ {
+			seen[id] = true
+		}
+	}
+	ids := make([]int, 0, len(seen))
+	for id := range seen {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+// cpuMask encodes IDs as the little-endian bitmask systemd expects for
+// AllowedCPUs= and AllowedMemoryNodes=.
+func cpuMask(ids []int) []byte {
+	if len(ids) == 0 {
+		return nil
+	}
+	mask := make([]byte, ids[len(ids)-1]/8+1)
+	for _, id := range ids {
+		mask[id/8] |= 1 << (id % 8)
+	}
+	return mask
+}
+
+// validateCPUSet parses a requested cpuset and checks every ID in it against
+// the online list at onlinePath. kind names the set in errors.
+func validateCPUSet(kind, list, onlinePath string) ([]int, error) {
+	ids, err := parseCPUList(list)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if len(ids) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "%s set %q is empty", kind, list)
+	}
+	data, err := os.ReadFile(onlinePath)
+	if err != nil {
+		return nil, err
+	}
+	online, err := parseCPUList(string(data))
+	if err != nil {
+		return nil, err
+	}
+	available := make(map[int]bool, len(online))
+	for _, id := range online {
+		available[id] = true
+	}
+	for _, id := range ids {
+		if !available[id] {
+			return nil, status.Errorf(
+				codes.InvalidArgument,
+				"%s %d in %q is not online, online %ss are %s",
+				kind, id, list, kind, strings.TrimSpace(string(data)),
+			)
+		}
+	}
+	return ids, nil
+}
+
+// cpusetProperties translates CpusetCpus and CpusetMems into AllowedCPUs=
+// and AllowedMemoryNodes= unit properties.
+func cpusetProperties(resources *runtimeapi.LinuxContainerResources) ([]dbus.Property, error) {
+	var props []dbus.Property
+	if cpus := resources.GetCpusetCpus(); cpus != "" {
+		ids, err := validateCPUSet("cpu", cpus, onlineCPUsPath)
+		if err != nil {
+			return nil, err
+		}
+		props = append(props, dbus.Property{
+			Name:  "AllowedCPUs",
+			Value: godbus.MakeVariant(cpuMask(ids)),
+		})
+	}
+	if mems := resources.GetCpusetMems(); mems != "" {
+		ids, err := validateCPUSet("memory node", mems, onlineNodesPath)
+		if err != nil {
+			return nil, err
+		}
+		props = append(props, dbus.Property{
+			Name:  "AllowedMemoryNodes",
+			Value: godbus.MakeVariant(cpuMask(ids)),
+		})
+	}
+	return props, nil
+}
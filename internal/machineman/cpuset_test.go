@@ -0,0 +1,35 @@
+package machineman
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCPUList(t *testing.T) {
+	tests := []struct {
+		list string
+		want []int
+		ok   bool
+	}{
+		{list: "", want: []int{}, ok: true},
+		{list: "0-3,7", want: []int{0, 1, 2, 3, 7}, ok: true},
+		{list: "3,1-2,2\n", want: []int{1, 2, 3}, ok: true},
+		{list: "8191", want: []int{8191}, ok: true},
+		{list: "3-1"},
+		{list: "-1"},
+		{list: "a"},
+		// Such ranges would be expanded into billions of IDs.
+		{list: "0-2147483647"},
+		{list: "8192"},
+	}
+	for _, tt := range tests {
+		got, err := parseCPUList(tt.list)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseCPUList(%q) = %v, want success %v", tt.list, err, tt.ok)
+			continue
+		}
+		if tt.ok && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseCPUList(%q) = %v, want %v", tt.list, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package machineman
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/coreos/go-systemd/v22/dbus"
+	godbus "github.com/godbus/dbus/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// credentialEnvAnnotation is a container annotation that lists, separated by
+// commas, environment variables that hold secrets. Their values are passed
+// to the container as systemd credentials instead of in its environment,
+// which anyone who can run systemctl show on the node can read. The
+// container reads them from the files in $CREDENTIALS_DIRECTORY.
+const credentialEnvAnnotation = "systemd-cri.io/credential-env"
+
+// minCredentialsVersion is the first systemd version that supports
+// SetCredential= and passing credentials on with systemd-nspawn.
+const minCredentialsVersion = 247
+
+// splitCredentials moves the variables that the annotations of a container
+// name out of its environment and into credentials keyed by variable name.
+// Without support for credentials, the environment is returned as it is.
+func splitCredentials(
+	env []string,
+	annotations map[string]string,
+	supported bool,
+) ([]string, map[string]string, error) {
+	value, ok := annotations[credentialEnvAnnotation]
+	if !ok || !supported {
+		return env, nil, nil
+	}
+	names := map[string]bool{}
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || strings.ContainsAny(name, "/:") {
+			return nil, nil, status.Errorf(
+				codes.InvalidArgument,
+				"annotation %s: %q is not a valid credential name",
+				credentialEnvAnnotation, name,
+			)
+		}
+		names[name] = true
+	}
+	rest := make([]string, 0, len(env))
+	creds := make(map[string]string, len(names))
+	for _, kv := range env {
+		key, value, _ := strings.Cut(kv, "=")
+		if names[key] {
+			creds[key] = value
+			continue
+		}
+		rest = append(rest, kv)
+	}
+	for name := range names {
+		if _, ok := creds[name]; !ok {
+			return nil, nil, status.Errorf(
+				codes.InvalidArgument,
+				"annotation %s: container has no environment variable %s",
+				credentialEnvAnnotation, name,
+			)
+		}
+	}
+	return rest, creds, nil
+}
+
+// credentialProperties returns the unit properties that hand a container's
+// credentials to systemd-nspawn, and the arguments that make systemd-nspawn
+// pass them on to the container.
+func credentialProperties(creds map[string]string) ([]dbus.Property, []string) {
+	if len(creds) == 0 {
+		return nil, nil
+	}
+	type credential struct {
+		ID    string
+		Value []byte
+	}
+	names := make([]string, 0, len(creds))
+	for name := range creds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	set := make([]credential, 0, len(creds))
+	args := make([]string, 0, len(creds))
+	for _, name := range names {
+		set = append(set, credential{ID: name, Value: []byte(creds[name])})
+		// A relative path is looked up in the credentials systemd
+		// handed to systemd-nspawn.
+		args = append(args, "--load-credential="+name+":"+name)
+	}
+	props := []dbus.Property{
+		{Name: "SetCredential", Value: godbus.MakeVariant(set)},
+	}
+	return props, args
+}
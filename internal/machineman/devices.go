@@ -0,0 +1,71 @@
+package machineman
+
+import (
+	"github.com/coreos/go-systemd/v22/dbus"
+	godbus "github.com/godbus/dbus/v5"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// DeviceResolver translates a container annotation that asks for devices
+// by something other than their paths, such as a slice of an accelerator,
+// into the device nodes the container needs. Resolvers for particular
+// hardware live outside the runtime and are passed in RuntimeOptions.
+type DeviceResolver interface {
+	// Annotation returns the container annotation the resolver handles.
+	Annotation() string
+	// Resolve returns the devices the value of the annotation asks for. It
+	// fails with FailedPrecondition if the node doesn't have them, and
+	// with InvalidArgument if the value is malformed.
+	Resolve(value string) ([]*runtimeapi.Device, error)
+}
+
+// resolveDevices returns the devices of a container: those kubelet gave it,
+// followed by those its annotations ask the runtime's resolvers for. A
+// device that is both is only listed once.
+func (r *RuntimeService) resolveDevices(
+	devices []*runtimeapi.Device,
+	annotations map[string]string,
+) ([]*runtimeapi.Device, error) {
+	seen := map[string]bool{}
+	for _, device := range devices {
+		seen[device.GetHostPath()] = true
+	}
+	for _, resolver := range r.opts.DeviceResolvers {
+		value, ok := annotations[resolver.Annotation()]
+		if !ok {
+			continue
+		}
+		resolved, err := resolver.Resolve(value)
+		if err != nil {
+			return nil, err
+		}
+		for _, device := range resolved {
+			if seen[device.GetHostPath()] {
+				continue
+			}
+			seen[device.GetHostPath()] = true
+			devices = append(devices, device)
+		}
+	}
+	return devices, nil
+}
+
+// deviceAllow is an entry of the DeviceAllow unit property.
+type deviceAllow struct {
+	Path        string
+	Permissions string
+}
+
+// deviceAllowProperty returns the DeviceAllow property that lets a unit
+// access the devices of a container, with the permissions they were given.
+func deviceAllowProperty(devices []*runtimeapi.Device) dbus.Property {
+	allow := []deviceAllow{}
+	for _, device := range devices {
+		permissions := device.GetPermissions()
+		if permissions == "" {
+			permissions = "rwm"
+		}
+		allow = append(allow, deviceAllow{device.GetHostPath(), permissions})
+	}
+	return dbus.Property{Name: "DeviceAllow", Value: godbus.MakeVariant(allow)}
+}
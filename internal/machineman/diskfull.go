@@ -0,0 +1,64 @@
+package machineman
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// imageFilesystemPressure is the runtime condition that is true while the
+// image filesystem is out of space.
+const imageFilesystemPressure = "ImageFilesystemPressure"
+
+// isDiskFull reports whether err comes from a filesystem that ran out of
+// space or quota.
+func isDiskFull(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT)
+}
+
+// diskFull turns an error that comes from the image or root filesystem
+// store running out of space into ResourceExhausted, which kubelet reports
+// as such rather than as an opaque failure. It marks the store as under
+// pressure until an operation writing to it succeeds again, and reclaims
+// what space it can right away. Other errors are returned as they are.
+func (i *ImageService) diskFull(op string, err error) error {
+	if err == nil {
+		i.diskPressure.Store(false)
+		return nil
+	}
+	if !isDiskFull(err) {
+		return err
+	}
+	if !i.diskPressure.Swap(true) {
+		log.Printf("image filesystem is full, reclaiming space: %v", err)
+		go i.reclaimSpace()
+	}
+	return status.Errorf(codes.ResourceExhausted, "%s: disk full: %v", op, err)
+}
+
+// DiskPressure reports whether the image or root filesystem store ran out
+// of space since the last operation that wrote to it successfully.
+func (i *ImageService) DiskPressure() bool {
+	return i.diskPressure.Load()
+}
+
+// reclaimSpace is an early image garbage collection pass for when the disk
+// is full. It removes what the runtime keeps only for inspection: corrupt
+// images moved out of the store and the writable layers retained from
+// exited containers. Pulled images are left to kubelet's image garbage
+// collection, which the pressure condition in Status prompts.
+func (i *ImageService) reclaimSpace() {
+	for _, dir := range []string{
+		filepath.Join(i.opts.Root, corruptDir),
+		filepath.Join(i.rootfs.dir, retainedDir),
+	} {
+		if err := os.RemoveAll(dir); err != nil {
+			log.Printf("failed to reclaim space from %s: %v", dir, err)
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package machineman
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ananthb/systemd-cri/internal/streaming"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// containerEnv merges the environment of a container's image with the
+// variables set in its config, which win over the image's.
+func containerEnv(image []string, config []*runtimeapi.KeyValue) []string {
+	env := make([]string, 0, len(image)+len(config))
+	index := make(map[string]int, len(image)+len(config))
+	set := func(key, value string) {
+		if i, ok := index[key]; ok {
+			env[i] = key + "=" + value
+			return
+		}
+		index[key] = len(env)
+		env = append(env, key+"="+value)
+	}
+	for _, kv := range image {
+		key, value, _ := strings.Cut(kv, "=")
+		set(key, value)
+	}
+	// Like Kubernetes, a variable may refer to those set before it in the
+	// config, but not to later ones or to the image's.
+	defined := make(map[string]string, len(config))
+	lookup := func(name string) (string, bool) {
+		value, ok := defined[name]
+		return value, ok
+	}
+	for _, kv := range config {
+		value := expand(kv.GetValue(), lookup)
+		defined[kv.GetKey()] = value
+		set(kv.GetKey(), value)
+	}
+	return env
+}
+
+// containerWorkingDir returns the directory a container's processes start
+// in: the config's, else the image's, else the root.
+func containerWorkingDir(image, config string) string {
+	switch {
+	case config != "":
+		return config
+	case image != "":
+		return image
+	}
+	return "/"
+}
+
+// containerLeader returns the host PID of a container's init process. The
+// main process of the unit is systemd-nspawn, the container is its child.
+func (r *RuntimeService) containerLeader(ctx context.Context, id string) (int, error) {
+	props, err := r.systemd.UnitTypeProperties(ctx, containerUnit(id), "Service")
+	if err != nil {
+		return 0, err
+	}
+	mainPID, _ := props["MainPID"].(uint32)
+	if mainPID == 0 {
+		return 0, status.Errorf(codes.FailedPrecondition, "container %s is not running", id)
+	}
+	children, err := os.ReadFile(filepath.Join(
+		"/proc", strconv.Itoa(int(mainPID)),
+		"task", strconv.Itoa(int(mainPID)),
+		"children",
+	))
+	if err != nil {
+		return 0, fmt.Errorf("find init of container %s: %w", id, err)
+	}
+	fields := strings.Fields(string(children))
+	if len(fields) == 0 {
+		return 0, status.Errorf(codes.FailedPrecondition, "container %s is not running", id)
+	}
+	return strconv.Atoi(fields[0])
+}
+
+// leaderCgroup returns the cgroup of a container's init. systemd-nspawn
+// runs the container in a cgroup of its own below its unit's.
+func leaderCgroup(leader int) (string, error) {
+	data, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(leader), "cgroup"))
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if cgroup, ok := strings.CutPrefix(line, "0::"); ok {
+			return cgroup, nil
+		}
+	}
+	return "", fmt.Errorf("process %d: %w", leader, errNoCgroup)
+}
+
+// startInContainer starts nsenter running a command in a container whose
+// init is leader. It starts in the init's cgroup, so that the command
+// counts against the container's limits and is killed along with it, and
+// confined by the container's seccomp profile.
+func startInContainer(nsenter *exec.Cmd, c *containerRecord, leader int) error {
+	cgroup, err := leaderCgroup(leader)
+	if err != nil {
+		return fmt.Errorf("find cgroup of container %s: %w", c.ID, err)
+	}
+	dir, err := os.Open(filepath.Join(cgroupRoot, cgroup))
+	if err != nil {
+		return fmt.Errorf("find cgroup of container %s: %w", c.ID, err)
+	}
+	defer dir.Close()
+	nsenter.SysProcAttr.UseCgroupFD = true
+	nsenter.SysProcAttr.CgroupFD = int(dir.Fd())
+	return startSeccomp(nsenter, c.Seccomp)
+}
+
+// execWaitDelay is how long execSync waits for the output of a command it
+// killed, from processes that left its process group.
+const execWaitDelay = time.Second
+
+// execSync runs a command inside a running container and collects its
+// output. The command joins every namespace of the container, runs chrooted
+// into its root filesystem and starts in its working directory with its
+// environment, the way the container's own processes do.
+func (r *RuntimeService) execSync(
+	ctx context.Context,
+	c *containerRecord,
+	cmd []string,
+	timeout time.Duration,
+) (*runtimeapi.ExecSyncResponse, error) {
+	if len(cmd) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "command is required")
+	}
+	leader, err := r.containerLeader(ctx, c.ID)
+	if err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	nsenter := exec.CommandContext(ctx, "nsenter", nsenterArgs(c, leader, cmd)...)
+	// nsenter hands its environment to the command, and looks the command
+	// up in its PATH after entering the container.
+	nsenter.Env = c.Env
+	// Killing nsenter alone leaves the command it forked holding the
+	// output pipes, so the timeout kills its whole process group, and
+	// stops waiting for the pipes soon after.
+	nsenter.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Credential: execCredential(c)}
+	nsenter.Cancel = func() error {
+		return unix.Kill(-nsenter.Process.Pid, unix.SIGKILL)
+	}
+	nsenter.WaitDelay = execWaitDelay
+	var stdout, stderr bytes.Buffer
+	nsenter.Stdout = &stdout
+	nsenter.Stderr = &stderr
+	err = startInContainer(nsenter, c, leader)
+	if err == nil {
+		err = nsenter.Wait()
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, status.Errorf(codes.DeadlineExceeded, "command timed out after %v", timeout)
+	}
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return nil, err
+	}
+	return &runtimeapi.ExecSyncResponse{
+		Stdout:   stdout.Bytes(),
+		Stderr:   stderr.Bytes(),
+		ExitCode: int32(nsenter.ProcessState.ExitCode()),
+	}, nil
+}
+
+// nsenterArgs returns the arguments that make nsenter run cmd in a container
+// whose init is leader.
+func nsenterArgs(c *containerRecord, leader int, cmd []string) []string {
+	args := []string{
+		"--target=" + strconv.Itoa(leader),
+		"--all",
+		"--root",
+		// Unlike --wd, --wdns resolves the directory inside the
+		// container's root.
+		"--wdns=" + c.WorkingDir,
+	}
+	if c.User != nil {
+		// Only the user: nsenter's --setgid would drop the groups
+		// execCredential starts it with.
+		args = append(args, "--setuid="+strconv.FormatUint(uint64(c.User.UID), 10))
+	}
+	return append(append(args, "--"), cmd...)
+}
+
+// execCredential returns who nsenter runs as to exec into a container: root,
+// to enter it, with the group and supplementary groups of the container's
+// user, which the command keeps once nsenter switches to the user. It is
+// nil for containers that run as root without any.
+func execCredential(c *containerRecord) *syscall.Credential {
+	if c.User == nil {
+		return nil
+	}
+	return &syscall.Credential{Gid: c.User.GID, Groups: c.User.Groups}
+}
+
+// execProcess starts a command inside a running container the way execSync
+// does, for a streaming session. Only the streams req asks for are
+// connected; with a TTY, the command's streams are all the same terminal
+// and its output comes on stdout. The command runs in its own process
+// group, which the session's Kill kills as a whole, since nsenter forks the
+// command into the container's PID namespace rather than becoming it.
+func (r *RuntimeService) execProcess(
+	ctx context.Context,
+	c *containerRecord,
+	req *runtimeapi.ExecRequest,
+) (streaming.Process, error) {
+	switch {
+	case len(req.GetCmd()) == 0:
+		return streaming.Process{}, status.Error(codes.InvalidArgument, "command is required")
+	case !req.GetStdin() && !req.GetStdout() && !req.GetStderr():
+		return streaming.Process{}, status.Error(
+			codes.InvalidArgument,
+			"one of stdin, stdout and stderr is required",
+		)
+	case req.GetTty() && req.GetStderr():
+		return streaming.Process{}, status.Error(
+			codes.InvalidArgument,
+			"a TTY has no separate stderr",
+		)
+	}
+	leader, err := r.containerLeader(ctx, c.ID)
+	if err != nil {
+		return streaming.Process{}, err
+	}
+	// The command outlives the call that starts it.
+	nsenter := exec.Command("nsenter", nsenterArgs(c, leader, req.GetCmd())...)
+	nsenter.Env = c.Env
+	nsenter.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Credential: execCredential(c)}
+	var proc streaming.Process
+	// The command's ends of its streams are closed once it started, ours
+	// only if it didn't.
+	var ours, theirs []*os.File
+	defer func() {
+		for _, f := range theirs {
+			f.Close()
+		}
+	}()
+	fail := func(err error) (streaming.Process, error) {
+		for _, f := range ours {
+			f.Close()
+		}
+		return streaming.Process{}, err
+	}
+	if req.GetTty() {
+		ptm, pts, err := openPty()
+		if err != nil {
+			return fail(fmt.Errorf("open terminal: %w", err))
+		}
+		ours, theirs = append(ours, ptm), append(theirs, pts)
+		nsenter.Stdin, nsenter.Stdout, nsenter.Stderr = pts, pts, pts
+		// The terminal becomes the controlling one of a new session,
+		// so that ^C and the like reach the command. The session is
+		// its process group.
+		nsenter.SysProcAttr.Setpgid = false
+		nsenter.SysProcAttr.Setsid = true
+		nsenter.SysProcAttr.Setctty = true
+		if req.GetStdin() {
+			proc.Stdin = ptyInput{ptm}
+		}
+		proc.Stdout = ptyOutput{ptm}
+		proc.Resize = func(size streaming.TerminalSize) error {
+			return resizePty(ptm, size)
+		}
+	} else {
+		if req.GetStdin() {
+			pr, pw, err := os.Pipe()
+			if err != nil {
+				return fail(err)
+			}
+			ours, theirs = append(ours, pw), append(theirs, pr)
+			nsenter.Stdin, proc.Stdin = pr, pw
+		}
+		for _, stream := range []struct {
+			want   bool
+			theirs *io.Writer
+			ours   *io.Reader
+		}{
+			{req.GetStdout(), &nsenter.Stdout, &proc.Stdout},
+			{req.GetStderr(), &nsenter.Stderr, &proc.Stderr},
+		} {
+			if !stream.want {
+				continue
+			}
+			pr, pw, err := os.Pipe()
+			if err != nil {
+				return fail(err)
+			}
+			ours, theirs = append(ours, pr), append(theirs, pw)
+			*stream.theirs, *stream.ours = pw, pr
+		}
+	}
+	if err := startInContainer(nsenter, c, leader); err != nil {
+		return fail(err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		nsenter.Wait()
+		close(exited)
+	}()
+	proc.Kill = func() error {
+		return unix.Kill(-nsenter.Process.Pid, unix.SIGKILL)
+	}
+	proc.ExitCode = func() int {
+		<-exited
+		return nsenter.ProcessState.ExitCode()
+	}
+	return proc, nil
+}
@@ -0,0 +1,291 @@
+package machineman
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+func TestContainerEnv(t *testing.T) {
+	tests := []struct {
+		name   string
+		image  []string
+		config []*runtimeapi.KeyValue
+		want   []string
+	}{
+		{
+			name:  "image only",
+			image: []string{"PATH=/bin", "LANG=C"},
+			want:  []string{"PATH=/bin", "LANG=C"},
+		},
+		{
+			name:   "config overrides the image in place",
+			image:  []string{"PATH=/bin", "LANG=C"},
+			config: []*runtimeapi.KeyValue{{Key: "PATH", Value: "/usr/bin"}, {Key: "HOME", Value: "/root"}},
+			want:   []string{"PATH=/usr/bin", "LANG=C", "HOME=/root"},
+		},
+		{
+			name:  "image variable without a value",
+			image: []string{"EMPTY"},
+			want:  []string{"EMPTY="},
+		},
+		{
+			name: "config refers to earlier variables",
+			config: []*runtimeapi.KeyValue{
+				{Key: "HOST", Value: "db"},
+				{Key: "URL", Value: "postgres://$(HOST)/$(NAME)"},
+				{Key: "NAME", Value: "app"},
+			},
+			want: []string{"HOST=db", "URL=postgres://db/$(NAME)", "NAME=app"},
+		},
+		{
+			name:   "config doesn't refer to the image",
+			image:  []string{"HOST=db"},
+			config: []*runtimeapi.KeyValue{{Key: "URL", Value: "$(HOST)"}},
+			want:   []string{"HOST=db", "URL=$(HOST)"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := containerEnv(tt.image, tt.config); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("containerEnv() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContainerWorkingDir(t *testing.T) {
+	tests := []struct {
+		image, config, want string
+	}{
+		{"", "", "/"},
+		{"/app", "", "/app"},
+		{"/app", "/srv", "/srv"},
+		{"", "/srv", "/srv"},
+	}
+	for _, tt := range tests {
+		if got := containerWorkingDir(tt.image, tt.config); got != tt.want {
+			t.Errorf("containerWorkingDir(%q, %q) = %q, want %q", tt.image, tt.config, got, tt.want)
+		}
+	}
+}
+
+func TestExecSyncWithoutCommand(t *testing.T) {
+	var r RuntimeService
+	_, err := r.execSync(context.Background(), &containerRecord{ID: "a"}, nil, 0)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("execSync() without a command = %v, want InvalidArgument", err)
+	}
+}
+
+func TestExecProcessInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		req  *runtimeapi.ExecRequest
+	}{
+		{"no command", &runtimeapi.ExecRequest{Stdout: true}},
+		{"no streams", &runtimeapi.ExecRequest{Cmd: []string{"sh"}}},
+		{"TTY with stderr", &runtimeapi.ExecRequest{Cmd: []string{"sh"}, Tty: true, Stdout: true, Stderr: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var r RuntimeService
+			_, err := r.execProcess(context.Background(), &containerRecord{ID: "a"}, tt.req)
+			if status.Code(err) != codes.InvalidArgument {
+				t.Errorf("execProcess() = %v, want InvalidArgument", err)
+			}
+		})
+	}
+}
+
+// runningContainer plays a running container to exec into: its unit's main
+// process is a shell standing in for systemd-nspawn, whose child, the
+// container's init, shares the host's namespaces and root. Both run in the
+// returned cgroup.
+func runningContainer(t *testing.T, c *containerRecord) (*RuntimeService, string) {
+	t.Helper()
+	if _, err := exec.LookPath("nsenter"); err != nil {
+		t.Skip("nsenter is not installed")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("nsenter needs root")
+	}
+	cgroup := testCgroup(t)
+	dir, err := os.Open(filepath.Join(cgroupRoot, cgroup))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dir.Close()
+	nspawn := exec.Command("sh", "-c", "sleep 60; true")
+	nspawn.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, UseCgroupFD: true, CgroupFD: int(dir.Fd())}
+	if err := nspawn.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		// Along with what was exec'd into it.
+		writeCgroupFile(cgroup, "cgroup.kill", "1")
+		nspawn.Wait()
+		procs := filepath.Join(cgroupRoot, cgroup, "cgroup.procs")
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if data, _ := os.ReadFile(procs); len(data) == 0 {
+				break
+			}
+		}
+	})
+	pid := nspawn.Process.Pid
+	children := filepath.Join("/proc", strconv.Itoa(pid), "task", strconv.Itoa(pid), "children")
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if data, _ := os.ReadFile(children); len(strings.Fields(string(data))) > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("init of the container didn't start")
+		}
+	}
+	fake := newFakeSystemd()
+	fake.setUnit(containerUnit(c.ID), map[string]interface{}{"MainPID": uint32(pid)})
+	return &RuntimeService{systemd: fake}, cgroup
+}
+
+func TestExecSyncRunsInContainer(t *testing.T) {
+	dir := t.TempDir()
+	c := &containerRecord{
+		ID:         "a",
+		Env:        containerEnv([]string{"PATH=/usr/bin:/bin", "GREETING=image"}, []*runtimeapi.KeyValue{{Key: "GREETING", Value: "config"}}),
+		WorkingDir: containerWorkingDir("/", dir),
+	}
+	r, _ := runningContainer(t, c)
+	resp, err := r.execSync(context.Background(), c, []string{"sh", "-c", `pwd; echo "$GREETING"`}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(resp.GetStdout()), dir+"\nconfig\n"; got != want || resp.GetExitCode() != 0 {
+		t.Errorf("execSync() = %q, exit code %d, want %q, exit code 0", got, resp.GetExitCode(), want)
+	}
+}
+
+func TestExecSyncRunsAsContainerUser(t *testing.T) {
+	c := &containerRecord{
+		ID:         "a",
+		Env:        []string{"PATH=/usr/bin:/bin"},
+		WorkingDir: "/",
+		User:       &containerUser{UID: 1000, GID: 1001, Groups: []uint32{2000, 3000}},
+	}
+	r, _ := runningContainer(t, c)
+	resp, err := r.execSync(context.Background(), c, []string{"sh", "-c", "id -u; id -g; id -G"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(resp.GetStdout()), "1000\n1001\n1001 2000 3000\n"; got != want || resp.GetExitCode() != 0 {
+		t.Errorf("id through execSync() = %q, exit code %d, stderr %q, want %q",
+			got, resp.GetExitCode(), resp.GetStderr(), want)
+	}
+}
+
+func TestExecProcessWithTTYRunsAsContainerUser(t *testing.T) {
+	c := &containerRecord{
+		ID:         "a",
+		Env:        []string{"PATH=/usr/bin:/bin"},
+		WorkingDir: "/",
+		User:       &containerUser{UID: 1000, GID: 1001, Groups: []uint32{2000}},
+	}
+	r, _ := runningContainer(t, c)
+	proc, err := r.execProcess(context.Background(), c, &runtimeapi.ExecRequest{
+		Cmd:    []string{"id", "-G"},
+		Tty:    true,
+		Stdout: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _ := io.ReadAll(proc.Stdout)
+	if code := proc.ExitCode(); code != 0 {
+		t.Fatalf("id exited with %d: %q", code, out)
+	}
+	if got, want := strings.TrimSpace(string(out)), "1001 2000"; got != want {
+		t.Errorf("groups of a command with a terminal = %q, want %q", got, want)
+	}
+}
+
+func TestExecSyncRunsInContainerCgroup(t *testing.T) {
+	c := &containerRecord{ID: "a", Env: []string{"PATH=/usr/bin:/bin"}, WorkingDir: "/"}
+	r, cgroup := runningContainer(t, c)
+	procs := filepath.Join(cgroupRoot, cgroup, "cgroup.procs")
+	resp, err := r.execSync(context.Background(), c, []string{"sh", "-c", "echo $$; cat " + procs}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Fields(string(resp.GetStdout()))
+	if len(lines) == 0 {
+		t.Fatalf("execSync() printed nothing, stderr %q", resp.GetStderr())
+	}
+	pid, members := lines[0], lines[1:]
+	for _, member := range members {
+		if member == pid {
+			return
+		}
+	}
+	t.Errorf("exec'd process %s is not in the container's cgroup, which holds %q", pid, members)
+}
+
+func TestExecSyncSeccompProfile(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile *runtimeapi.SecurityProfile
+		want    string
+	}{
+		{
+			name:    "runtime default",
+			profile: &runtimeapi.SecurityProfile{ProfileType: runtimeapi.SecurityProfile_RuntimeDefault},
+			want:    "denied\n",
+		},
+		{
+			name:    "unconfined",
+			profile: &runtimeapi.SecurityProfile{ProfileType: runtimeapi.SecurityProfile_Unconfined},
+			want:    "allowed\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &containerRecord{ID: "a", Env: []string{"PATH=/usr/bin:/bin"}, WorkingDir: "/", Seccomp: tt.profile}
+			r, _ := runningContainer(t, c)
+			// unshare(2) is one of the calls the runtime default
+			// profile denies.
+			resp, err := r.execSync(context.Background(), c,
+				[]string{"sh", "-c", "unshare --mount true 2>/dev/null && echo allowed || echo denied"}, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := string(resp.GetStdout()); got != tt.want {
+				t.Errorf("unshare through execSync() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExecSyncTimeout(t *testing.T) {
+	c := &containerRecord{ID: "a", Env: []string{"PATH=/usr/bin:/bin"}, WorkingDir: "/"}
+	r, _ := runningContainer(t, c)
+	// The shell forks sleep, which holds on to the output pipes after
+	// the shell is killed.
+	start := time.Now()
+	_, err := r.execSync(context.Background(), c, []string{"sh", "-c", "sleep 60; true"}, 100*time.Millisecond)
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("execSync() = %v, want DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("execSync() with a timeout of 100ms returned after %v", elapsed)
+	}
+}
@@ -0,0 +1,143 @@
+package machineman
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// execBudget caps how many commands the containers of each pod sandbox can
+// exec, and how much output those commands can produce, within a sliding
+// window, so that a pod that execs in a loop can't starve the node. Exec
+// probes count towards the budget of their pod like any other exec.
+type execBudget struct {
+	mu sync.Mutex
+	// window is how far back execs and their output are counted.
+	window time.Duration
+	// maxExecs caps the execs of a pod within the window, 0 doesn't.
+	maxExecs int
+	// maxOutput caps the bytes of output of a pod's execs within the
+	// window, 0 doesn't.
+	maxOutput int64
+	pods      map[string]*podExecs
+}
+
+// podExecs is what a pod's execs used of its budget.
+type podExecs struct {
+	// execs are the times the pod's execs started, oldest first.
+	execs []time.Time
+	// output is the output of the pod's execs, oldest first.
+	output []execOutput
+	// throttled is set while the pod is over its budget, so that it is
+	// only logged once each time it runs out.
+	throttled bool
+}
+
+type execOutput struct {
+	at    time.Time
+	bytes int64
+}
+
+// setLimits replaces the window and the caps of the budget. What pods used
+// so far counts against the new caps.
+func (b *execBudget) setLimits(window time.Duration, maxExecs int, maxOutput int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.window, b.maxExecs, b.maxOutput = window, maxExecs, maxOutput
+}
+
+// enabled reports whether the budget caps anything. It is called with mu
+// held.
+func (b *execBudget) enabled() bool {
+	return b.window > 0 && (b.maxExecs > 0 || b.maxOutput > 0)
+}
+
+// admit counts an exec of a pod towards its budget, or fails with
+// ResourceExhausted if the pod has used it up.
+func (b *execBudget) admit(sb *sandboxRecord, now time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.enabled() {
+		return nil
+	}
+	if b.pods == nil {
+		b.pods = map[string]*podExecs{}
+	}
+	p, ok := b.pods[sb.ID]
+	if !ok {
+		p = &podExecs{}
+		b.pods[sb.ID] = p
+	}
+	p.expire(now.Add(-b.window))
+	var output int64
+	for _, o := range p.output {
+		output += o.bytes
+	}
+	var reason string
+	switch {
+	case b.maxExecs > 0 && len(p.execs) >= b.maxExecs:
+		reason = "execs"
+	case b.maxOutput > 0 && output >= b.maxOutput:
+		reason = "exec output bytes"
+	}
+	if reason != "" {
+		if !p.throttled {
+			p.throttled = true
+			log.Printf(
+				"pod sandbox %s (%s/%s) ran out of its exec budget: %d execs and %d output bytes in the last %v",
+				sb.ID, sb.Metadata.GetNamespace(), sb.Metadata.GetName(),
+				len(p.execs), output, b.window,
+			)
+		}
+		return status.Errorf(
+			codes.ResourceExhausted,
+			"pod sandbox %s exceeded its budget of %s per %v",
+			sb.ID, reason, b.window,
+		)
+	}
+	p.throttled = false
+	p.execs = append(p.execs, now)
+	return nil
+}
+
+// charge counts the output of an exec of a pod towards its budget.
+func (b *execBudget) charge(sandboxID string, bytes int64, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.enabled() || bytes == 0 {
+		return
+	}
+	if p, ok := b.pods[sandboxID]; ok {
+		p.output = append(p.output, execOutput{now, bytes})
+	}
+}
+
+// SetExecBudget replaces the exec budget of pods, see
+// RuntimeOptions.ExecBudgetWindow, MaxPodExecs and MaxPodExecOutput.
+func (r *RuntimeService) SetExecBudget(window time.Duration, maxExecs int, maxOutput int64) {
+	r.execs.setLimits(window, maxExecs, maxOutput)
+}
+
+// forget drops the budget of a removed pod.
+func (b *execBudget) forget(sandboxID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.pods, sandboxID)
+}
+
+// expire drops the execs and output from before since.
+func (p *podExecs) expire(since time.Time) {
+	n := 0
+	for n < len(p.execs) && p.execs[n].Before(since) {
+		n++
+	}
+	p.execs = p.execs[n:]
+	n = 0
+	for n < len(p.output) && p.output[n].at.Before(since) {
+		n++
+	}
+	p.output = p.output[n:]
+}
@@ -0,0 +1,90 @@
+package machineman
+
+import "strings"
+
+// expand replaces the $(VAR) references in s the way Kubernetes does for
+// container commands, arguments and environment variables: a reference to
+// a variable lookup knows is replaced by its value, any other reference is
+// left as is, and "$$" is an escaped "$", so "$$(VAR)" becomes "$(VAR)".
+// A "$" followed by anything else is kept.
+func expand(s string, lookup func(string) (string, bool)) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		switch next := s[i+1]; next {
+		case '$':
+			b.WriteByte('$')
+			i++
+		case '(':
+			end := strings.IndexByte(s[i+2:], ')')
+			if end < 0 {
+				// An unterminated reference is kept, but what follows
+				// it may still hold escapes.
+				b.WriteString("$(")
+				i++
+				continue
+			}
+			name := s[i+2 : i+2+end]
+			if value, ok := lookup(name); ok {
+				b.WriteString(value)
+			} else {
+				b.WriteString("$(" + name + ")")
+			}
+			i += 2 + end
+		default:
+			b.WriteByte('$')
+			b.WriteByte(next)
+			i++
+		}
+	}
+	return b.String()
+}
+
+// envLookup returns a lookup for expand over an environment of "KEY=value"
+// entries.
+func envLookup(env []string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		for i := len(env) - 1; i >= 0; i-- {
+			if key, value, _ := strings.Cut(env[i], "="); key == name {
+				return value, true
+			}
+		}
+		return "", false
+	}
+}
+
+// containerCommand returns the command line a container runs: the config's
+// command, else the image's entrypoint, followed by the config's arguments,
+// else the image's command unless the config set its own command. As for
+// Kubernetes pods, $(VAR) references in the config's command and arguments
+// are expanded against the container's environment, those of the image
+// are not.
+func containerCommand(entrypoint, cmd, command, args, env []string) []string {
+	lookup := envLookup(env)
+	command = expandAll(command, lookup)
+	args = expandAll(args, lookup)
+	var argv []string
+	switch {
+	case len(command) > 0:
+		argv = append(argv, command...)
+		argv = append(argv, args...)
+	case len(args) > 0:
+		argv = append(argv, entrypoint...)
+		argv = append(argv, args...)
+	default:
+		argv = append(argv, entrypoint...)
+		argv = append(argv, cmd...)
+	}
+	return argv
+}
+
+func expandAll(ss []string, lookup func(string) (string, bool)) []string {
+	expanded := make([]string, len(ss))
+	for i, s := range ss {
+		expanded[i] = expand(s, lookup)
+	}
+	return expanded
+}
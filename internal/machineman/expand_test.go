@@ -0,0 +1,80 @@
+package machineman
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpand(t *testing.T) {
+	lookup := envLookup([]string{"HOST=db", "EMPTY=", "PORT=1", "PORT=5432"})
+	tests := []struct {
+		in, want string
+	}{
+		{"", ""},
+		{"plain", "plain"},
+		{"$(HOST)", "db"},
+		{"postgres://$(HOST):$(PORT)/", "postgres://db:5432/"},
+		{"[$(EMPTY)]", "[]"},
+		{"$(MISSING)", "$(MISSING)"},
+		{"$$(HOST)", "$(HOST)"},
+		{"$$$(HOST)", "$db"},
+		{"$$$$", "$$"},
+		{"$HOST", "$HOST"},
+		{"cost: 5$", "cost: 5$"},
+		{"$(HOST", "$(HOST"},
+		{"$(HOST $$", "$(HOST $"},
+		{"$()", "$()"},
+	}
+	for _, tt := range tests {
+		if got := expand(tt.in, lookup); got != tt.want {
+			t.Errorf("expand(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestContainerCommand(t *testing.T) {
+	entrypoint := []string{"/entrypoint.sh"}
+	cmd := []string{"serve"}
+	env := []string{"NAME=app"}
+	tests := []struct {
+		name          string
+		command, args []string
+		want          []string
+	}{
+		{
+			name: "image defaults",
+			want: []string{"/entrypoint.sh", "serve"},
+		},
+		{
+			name: "arguments replace the image command",
+			args: []string{"migrate", "$(NAME)"},
+			want: []string{"/entrypoint.sh", "migrate", "app"},
+		},
+		{
+			name:    "command drops the image command",
+			command: []string{"/bin/sh", "-c", "echo $(NAME)"},
+			want:    []string{"/bin/sh", "-c", "echo app"},
+		},
+		{
+			name:    "command and arguments",
+			command: []string{"/bin/app"},
+			args:    []string{"--name=$(NAME)", "$$(NAME)"},
+			want:    []string{"/bin/app", "--name=app", "$(NAME)"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := containerCommand(entrypoint, cmd, tt.command, tt.args, env)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("containerCommand() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContainerCommandKeepsImageReferences(t *testing.T) {
+	got := containerCommand([]string{"/bin/sh", "-c"}, []string{"echo $(NAME)"}, nil, nil, []string{"NAME=app"})
+	if want := []string{"/bin/sh", "-c", "echo $(NAME)"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("containerCommand() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,64 @@
+package machineman
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// fdStore hands file descriptors to the file descriptor store of the
+// systemd service the runtime runs as, which keeps them open while the
+// runtime restarts and passes them back to it, named, when it starts again.
+// The service needs FileDescriptorStoreMax= and NotifyAccess=main for that.
+// An empty socket keeps nothing.
+type fdStore struct {
+	// socket is the service manager's notification socket, from
+	// $NOTIFY_SOCKET.
+	socket string
+}
+
+// add stores f under name. systemd drops it by itself once its other end
+// hangs up.
+func (s fdStore) add(name string, f *os.File) error {
+	return s.notify("FDSTORE=1\nFDNAME="+name, f)
+}
+
+// remove drops what is stored under name.
+func (s fdStore) remove(name string) error {
+	return s.notify("FDSTOREREMOVE=1\nFDNAME="+name, nil)
+}
+
+// notify sends state to the service manager, along with f if it is set.
+func (s fdStore) notify(state string, f *os.File) error {
+	if s.socket == "" {
+		return nil
+	}
+	sock, err := unix.Socket(unix.AF_UNIX, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return os.NewSyscallError("socket", err)
+	}
+	defer unix.Close(sock)
+	to := &unix.SockaddrUnix{Name: s.socket}
+	if f == nil {
+		return os.NewSyscallError("sendmsg", unix.Sendmsg(sock, []byte(state), nil, to, 0))
+	}
+	// Unlike Fd, Control leaves the file non-blocking, which the
+	// forwarding reading it relies on.
+	raw, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sendErr error
+	if err := raw.Control(func(fd uintptr) {
+		sendErr = unix.Sendmsg(sock, []byte(state), unix.UnixRights(int(fd)), to, 0)
+	}); err != nil {
+		return err
+	}
+	return os.NewSyscallError("sendmsg", sendErr)
+}
+
+// outputFDName is the name the read end of a container's output FIFO is
+// stored under.
+func outputFDName(id, stream string) string {
+	return "output-" + id + "-" + stream
+}
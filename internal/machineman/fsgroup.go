@@ -0,0 +1,176 @@
+package machineman
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+const (
+	// fsGroupAnnotation is a container annotation holding the GID that
+	// the volumes named by fsGroupVolumesAnnotation are given to, like a
+	// pod's fsGroup. The container runs with it as a supplemental group.
+	fsGroupAnnotation = "systemd-cri.io/fs-group"
+	// fsGroupVolumesAnnotation is a container annotation listing, comma
+	// separated, the container paths of the mounts fsGroup applies to.
+	fsGroupVolumesAnnotation = "systemd-cri.io/fs-group-volumes"
+	// fsGroupChangePolicyAnnotation is a container annotation that is
+	// either "Always", the default, to change the ownership of the whole
+	// volume on every create, or "OnRootMismatch" to skip volumes whose
+	// top directory already has it.
+	fsGroupChangePolicyAnnotation = "systemd-cri.io/fs-group-change-policy"
+)
+
+const (
+	fsGroupChangeAlways         = "Always"
+	fsGroupChangeOnRootMismatch = "OnRootMismatch"
+)
+
+// fsGroupFileMode and fsGroupDirMode are the permissions volume contents are
+// given on top of theirs, the same as kubelet gives them: the group can
+// read and write files and enter directories, and files created in
+// directories inherit their group.
+const (
+	fsGroupFileMode = 0o660
+	fsGroupDirMode  = 0o770 | fs.ModeSetgid
+)
+
+// fsGroup is the group ownership a container's volumes get.
+type fsGroup struct {
+	GID int
+	// Volumes are the container paths of the mounts to apply it to.
+	Volumes map[string]bool
+	// OnRootMismatch skips volumes whose top directory already has the
+	// group and permissions.
+	OnRootMismatch bool
+}
+
+// fsGroupConfig reads the fsGroup of a container from its annotations, nil
+// if it has none.
+func fsGroupConfig(annotations map[string]string) (*fsGroup, error) {
+	value, ok := annotations[fsGroupAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	gid, err := strconv.Atoi(value)
+	if err != nil || gid < 0 {
+		return nil, status.Errorf(
+			codes.InvalidArgument,
+			"annotation %s: %q is not a group ID",
+			fsGroupAnnotation, value,
+		)
+	}
+	group := &fsGroup{GID: gid, Volumes: map[string]bool{}}
+	if volumes := annotations[fsGroupVolumesAnnotation]; volumes != "" {
+		for _, volume := range strings.Split(volumes, ",") {
+			group.Volumes[filepath.Clean(volume)] = true
+		}
+	}
+	switch policy := annotations[fsGroupChangePolicyAnnotation]; policy {
+	case "", fsGroupChangeAlways:
+	case fsGroupChangeOnRootMismatch:
+		group.OnRootMismatch = true
+	default:
+		return nil, status.Errorf(
+			codes.InvalidArgument,
+			"annotation %s: %q is neither %s nor %s",
+			fsGroupChangePolicyAnnotation, policy, fsGroupChangeAlways, fsGroupChangeOnRootMismatch,
+		)
+	}
+	return group, nil
+}
+
+// supplementalGroups returns the supplemental groups a container runs with,
+// those of its security context and its fsGroup.
+func supplementalGroups(security *runtimeapi.LinuxContainerSecurityContext, group *fsGroup) ([]int64, error) {
+	groups := append([]int64(nil), security.GetSupplementalGroups()...)
+	for _, gid := range groups {
+		if gid < 0 || gid > int64(^uint32(0)) {
+			return nil, status.Errorf(codes.InvalidArgument, "supplemental group %d is not a group ID", gid)
+		}
+	}
+	if group != nil {
+		groups = append(groups, int64(group.GID))
+	}
+	return groups, nil
+}
+
+// applyFSGroup gives the writable volumes of a container named by its
+// fsGroup to the group, before the container gets to use them. Read-only
+// volumes are left alone, the container can't write to them anyway.
+func applyFSGroup(mounts []*runtimeapi.Mount, group *fsGroup) error {
+	if group == nil {
+		return nil
+	}
+	for _, mount := range mounts {
+		if mount.GetReadonly() || !group.Volumes[filepath.Clean(mount.GetContainerPath())] {
+			continue
+		}
+		path := filepath.Clean(mount.GetHostPath())
+		if relabelDenylist[path] {
+			return status.Errorf(
+				codes.InvalidArgument,
+				"changing the group of host path %s is not allowed",
+				path,
+			)
+		}
+		if group.OnRootMismatch && hasFSGroup(path, group.GID) {
+			continue
+		}
+		if err := chgrpVolume(path, group.GID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasFSGroup reports whether the top directory of a volume already belongs
+// to gid with the permissions fsGroup gives.
+func hasFSGroup(path string, gid int) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || int(st.Gid) != gid {
+		return false
+	}
+	want := fs.FileMode(fsGroupFileMode)
+	if info.IsDir() {
+		want = fsGroupDirMode
+	}
+	return info.Mode()&want == want
+}
+
+// chgrpVolume gives everything below path to gid, and adds the group
+// permissions of fsGroup. Symbolic links are changed themselves rather than
+// followed.
+func chgrpVolume(path string, gid int) error {
+	return filepath.WalkDir(path, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := os.Lchown(name, -1, gid); err != nil {
+			return err
+		}
+		if d.Type()&fs.ModeSymlink != 0 {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		mode := info.Mode() | fsGroupFileMode
+		if d.IsDir() {
+			mode |= fsGroupDirMode
+		}
+		return os.Chmod(name, mode)
+	})
+}
@@ -0,0 +1,150 @@
+package machineman
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// ownership returns the group and permissions of path.
+func ownership(t *testing.T, path string) (int, fs.FileMode) {
+	t.Helper()
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return int(info.Sys().(*syscall.Stat_t).Gid), info.Mode()
+}
+
+func TestApplyFSGroup(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing the group of files needs root")
+	}
+	const gid = 4242
+	tests := []struct {
+		name     string
+		group    *fsGroup
+		readonly bool
+		// rootHasGroup gives the volume's top directory the group and
+		// permissions beforehand.
+		rootHasGroup bool
+		hostPath     string
+		wantChanged  bool
+		wantCode     codes.Code
+	}{
+		{
+			name:        "always",
+			group:       &fsGroup{GID: gid, Volumes: map[string]bool{"/data": true}},
+			wantChanged: true,
+		},
+		{
+			name:         "always, even when the root has the group",
+			group:        &fsGroup{GID: gid, Volumes: map[string]bool{"/data": true}},
+			rootHasGroup: true,
+			wantChanged:  true,
+		},
+		{
+			name:        "on root mismatch, mismatching",
+			group:       &fsGroup{GID: gid, Volumes: map[string]bool{"/data": true}, OnRootMismatch: true},
+			wantChanged: true,
+		},
+		{
+			name:         "on root mismatch, matching",
+			group:        &fsGroup{GID: gid, Volumes: map[string]bool{"/data": true}, OnRootMismatch: true},
+			rootHasGroup: true,
+		},
+		{
+			name:     "read-only volume",
+			group:    &fsGroup{GID: gid, Volumes: map[string]bool{"/data": true}},
+			readonly: true,
+		},
+		{
+			name:  "volume not named",
+			group: &fsGroup{GID: gid, Volumes: map[string]bool{"/other": true}},
+		},
+		{
+			name: "no fsGroup",
+		},
+		{
+			name:     "host directory",
+			group:    &fsGroup{GID: gid, Volumes: map[string]bool{"/data": true}},
+			hostPath: "/etc",
+			wantCode: codes.InvalidArgument,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			volume := t.TempDir()
+			file := filepath.Join(volume, "sub", "file")
+			if err := os.MkdirAll(filepath.Dir(file), 0o700); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(file, nil, 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if tt.rootHasGroup {
+				if err := os.Chown(volume, -1, gid); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Chmod(volume, fsGroupDirMode); err != nil {
+					t.Fatal(err)
+				}
+			}
+			hostPath := volume
+			if tt.hostPath != "" {
+				hostPath = tt.hostPath
+			}
+			mounts := []*runtimeapi.Mount{{HostPath: hostPath, ContainerPath: "/data/", Readonly: tt.readonly}}
+			err := applyFSGroup(mounts, tt.group)
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("applyFSGroup() = %v, want code %v", err, tt.wantCode)
+			}
+			if err != nil {
+				return
+			}
+			for _, path := range []string{filepath.Dir(file), file} {
+				group, mode := ownership(t, path)
+				want := fs.FileMode(fsGroupFileMode)
+				if mode.IsDir() {
+					want = fsGroupDirMode
+				}
+				changed := group == gid && mode&want == want
+				if changed != tt.wantChanged {
+					t.Errorf("%s has group %d and mode %v, changed = %v, want %v",
+						path, group, mode, changed, tt.wantChanged)
+				}
+			}
+		})
+	}
+}
+
+func TestChgrpVolumeLeavesSymlinkTargets(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing the group of files needs root")
+	}
+	const gid = 4242
+	outside := filepath.Join(t.TempDir(), "outside")
+	if err := os.WriteFile(outside, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	volume := t.TempDir()
+	link := filepath.Join(volume, "link")
+	if err := os.Symlink(outside, link); err != nil {
+		t.Fatal(err)
+	}
+	if err := chgrpVolume(volume, gid); err != nil {
+		t.Fatal(err)
+	}
+	if group, _ := ownership(t, link); group != gid {
+		t.Errorf("link has group %d, want %d", group, gid)
+	}
+	if group, mode := ownership(t, outside); group == gid || mode.Perm() != 0o600 {
+		t.Errorf("target of a link out of the volume has group %d and mode %v, want it left alone", group, mode)
+	}
+}
@@ -0,0 +1,56 @@
+package machineman
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"time"
+)
+
+// gcInterval is how often exited containers are checked for reclaiming.
+const gcInterval = time.Minute
+
+// collectGarbage periodically reclaims containers that exited longer than
+// the retention window ago. kubelet removes the containers it knows about
+// itself; this catches the ones it abandoned.
+func (r *RuntimeService) collectGarbage(ctx context.Context) {
+	ticker := time.NewTicker(gcInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			r.collectExitedContainers(ctx, now)
+		}
+	}
+}
+
+// collectExitedContainers removes containers that exited before now minus
+// the retention window. Containers exited more recently are kept, so that
+// kubelet can still read their status and logs.
+func (r *RuntimeService) collectExitedContainers(ctx context.Context, now time.Time) {
+	deadline := now.Add(-r.opts.ExitedContainerRetention).UnixNano()
+	for _, c := range r.containers.list(nil) {
+		times, err := r.containerTimes(ctx, c)
+		if err != nil {
+			log.Printf("gc: container %s: %v", c.ID, err)
+			continue
+		}
+		if times.FinishedAt == 0 || times.FinishedAt > deadline {
+			continue
+		}
+		if err := r.removeContainer(ctx, c); err != nil {
+			log.Printf("gc: %v", err)
+			continue
+		}
+		if c.LogPath != "" {
+			if err := os.Remove(c.LogPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				log.Printf("gc: container %s: %v", c.ID, err)
+			}
+		}
+		log.Printf("gc: removed container %s, exited at %v", c.ID, time.Unix(0, times.FinishedAt))
+	}
+}
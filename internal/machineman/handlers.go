@@ -0,0 +1,73 @@
+package machineman
+
+import (
+	"fmt"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// featureUserNamespaces lets a runtime handler run pods in user namespaces.
+const featureUserNamespaces = "user-namespaces"
+
+// runtimeHandler is what a runtime handler, and with it a RuntimeClass,
+// supports.
+type runtimeHandler struct {
+	UserNamespaces bool
+}
+
+// parseRuntimeHandlers parses runtime handlers given as "name" or as
+// "name:feature+feature". The default handler, named "", supports no
+// features unless it is given too. Without any handlers, every handler
+// kubelet asks for is taken to be the default one.
+func parseRuntimeHandlers(specs []string) (map[string]runtimeHandler, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+	handlers := map[string]runtimeHandler{"": {}}
+	for _, spec := range specs {
+		name, features, _ := strings.Cut(spec, ":")
+		var handler runtimeHandler
+		if features != "" {
+			for _, feature := range strings.Split(features, "+") {
+				switch feature {
+				case featureUserNamespaces:
+					handler.UserNamespaces = true
+				default:
+					return nil, fmt.Errorf(
+						"runtime handler %q: unknown feature %q, want %s",
+						name, feature, featureUserNamespaces,
+					)
+				}
+			}
+		}
+		handlers[name] = handler
+	}
+	return handlers, nil
+}
+
+// validateRuntimeHandler rejects a sandbox whose config asks for features
+// its runtime handler doesn't support, or whose handler is unknown.
+func (r *RuntimeService) validateRuntimeHandler(name string, config *runtimeapi.PodSandboxConfig) error {
+	var handler runtimeHandler
+	if r.handlers != nil {
+		var ok bool
+		if handler, ok = r.handlers[name]; !ok {
+			return status.Errorf(codes.InvalidArgument, "unknown runtime handler %q", name)
+		}
+	}
+	// Kubelets that predate user namespaces send no options, which means
+	// the host's user namespace rather than the POD mode's zero value.
+	userns := config.GetLinux().GetSecurityContext().GetNamespaceOptions().GetUsernsOptions()
+	if userns != nil && userns.GetMode() == runtimeapi.NamespaceMode_POD && !handler.UserNamespaces {
+		return status.Errorf(
+			codes.InvalidArgument,
+			"runtime handler %q does not support user namespaces, "+
+				"use a runtime class whose handler has the %s feature or hostUsers: true",
+			name, featureUserNamespaces,
+		)
+	}
+	return nil
+}
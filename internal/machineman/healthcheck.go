@@ -0,0 +1,214 @@
+package machineman
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// imageHealthcheckAnnotation is a container or sandbox annotation that says
+// whether the HEALTHCHECK of the container's image is run, which Kubernetes
+// otherwise ignores in favor of probes. The container's annotation takes
+// precedence over the sandbox's, and RuntimeOptions.ImageHealthchecks over
+// both when neither sets it.
+const imageHealthcheckAnnotation = "systemd-cri.io/image-healthcheck"
+
+// The defaults of the settings of a HEALTHCHECK, which Docker uses for
+// those the image leaves out.
+const (
+	defaultHealthInterval = 30 * time.Second
+	defaultHealthTimeout  = 30 * time.Second
+	defaultHealthRetries  = 3
+)
+
+// maxHealthOutput caps how much of the output of a healthcheck is kept for
+// status.
+const maxHealthOutput = 4096
+
+// Health statuses of a container, as Docker reports them.
+const (
+	healthStarting  = "starting"
+	healthHealthy   = "healthy"
+	healthUnhealthy = "unhealthy"
+)
+
+// healthcheck is the HEALTHCHECK an image declares.
+type healthcheck struct {
+	Command     []string
+	Interval    time.Duration
+	Timeout     time.Duration
+	StartPeriod time.Duration
+	Retries     int
+}
+
+// parseHealthcheck reads the HEALTHCHECK of an image from its config blob.
+// Only Docker images have one, nil is returned for others, for images
+// without one and for those that turned it off with HEALTHCHECK NONE.
+func parseHealthcheck(blob []byte) (*healthcheck, error) {
+	var config struct {
+		Config struct {
+			Healthcheck *struct {
+				Test        []string
+				Interval    time.Duration
+				Timeout     time.Duration
+				StartPeriod time.Duration
+				Retries     int
+			}
+		}
+	}
+	if err := json.Unmarshal(blob, &config); err != nil {
+		return nil, err
+	}
+	declared := config.Config.Healthcheck
+	if declared == nil || len(declared.Test) == 0 {
+		return nil, nil
+	}
+	hc := &healthcheck{
+		Interval:    declared.Interval,
+		Timeout:     declared.Timeout,
+		StartPeriod: declared.StartPeriod,
+		Retries:     declared.Retries,
+	}
+	switch declared.Test[0] {
+	case "CMD":
+		hc.Command = declared.Test[1:]
+	case "CMD-SHELL":
+		if len(declared.Test) != 2 {
+			return nil, nil
+		}
+		hc.Command = []string{"/bin/sh", "-c", declared.Test[1]}
+	default:
+		// NONE, or an inherited check the image doesn't override.
+		return nil, nil
+	}
+	if len(hc.Command) == 0 {
+		return nil, nil
+	}
+	if hc.Interval <= 0 {
+		hc.Interval = defaultHealthInterval
+	}
+	if hc.Timeout <= 0 {
+		hc.Timeout = defaultHealthTimeout
+	}
+	if hc.Retries <= 0 {
+		hc.Retries = defaultHealthRetries
+	}
+	return hc, nil
+}
+
+// imageHealthcheck reports whether a container runs the healthcheck of its
+// image.
+func imageHealthcheck(container, sandbox map[string]string, fallback bool) (bool, error) {
+	value, ok := container[imageHealthcheckAnnotation]
+	if !ok {
+		value, ok = sandbox[imageHealthcheckAnnotation]
+	}
+	if !ok {
+		return fallback, nil
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, status.Errorf(
+			codes.InvalidArgument,
+			"annotation %s: %q is not a boolean",
+			imageHealthcheckAnnotation, value,
+		)
+	}
+	return enabled, nil
+}
+
+// healthState is the outcome of a container's healthchecks so far.
+type healthState struct {
+	Status        string `json:"status"`
+	FailingStreak int    `json:"failingStreak"`
+	LastOutput    string `json:"lastOutput,omitempty"`
+	// CheckedAt is when the last check finished, in nanoseconds since the
+	// epoch.
+	CheckedAt int64 `json:"checkedAt,omitempty"`
+}
+
+func (c *containerRecord) setHealth(h healthState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.health = &h
+}
+
+// healthStatus returns the outcome of the container's healthchecks, nil if
+// it doesn't run any or none ran yet.
+func (c *containerRecord) healthStatus() *healthState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.health == nil {
+		return nil
+	}
+	h := *c.health
+	return &h
+}
+
+// runHealthcheck runs the healthcheck of a started container every interval
+// until ctx is done or the container stops running, the way Docker does:
+// a container is unhealthy once the check failed retries times in a row,
+// except that failures within the start period don't count, and healthy
+// again as soon as it passes.
+func (r *RuntimeService) runHealthcheck(ctx context.Context, c *containerRecord) {
+	hc := c.Healthcheck
+	if hc == nil {
+		return
+	}
+	started := time.Now()
+	h := healthState{Status: healthStarting}
+	c.setHealth(h)
+	ticker := time.NewTicker(hc.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		resp, err := r.execSync(ctx, c, hc.Command, hc.Timeout)
+		if status.Code(err) == codes.FailedPrecondition {
+			// The container is no longer running.
+			return
+		}
+		var output string
+		passed := false
+		switch {
+		case err != nil:
+			output = err.Error()
+		default:
+			output = string(resp.GetStdout()) + string(resp.GetStderr())
+			passed = resp.GetExitCode() == 0
+		}
+		if len(output) > maxHealthOutput {
+			output = output[:maxHealthOutput]
+		}
+		h.LastOutput = output
+		h.CheckedAt = time.Now().UnixNano()
+		switch {
+		case passed:
+			h.Status = healthHealthy
+			h.FailingStreak = 0
+		case h.Status == healthStarting && time.Since(started) < hc.StartPeriod:
+		default:
+			h.FailingStreak++
+			if h.FailingStreak >= hc.Retries {
+				h.Status = healthUnhealthy
+			}
+		}
+		c.setHealth(h)
+	}
+}
+
+// healthInfo renders the health of a container for verbose status.
+func healthInfo(h *healthState) string {
+	data, err := json.Marshal(h)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
@@ -0,0 +1,157 @@
+package machineman
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+const (
+	// hugepagesDir lists the huge page pools the kernel supports.
+	hugepagesDir = "/sys/kernel/mm/hugepages"
+	// hugetlbfsPath is where containers expect a hugetlbfs to be mounted.
+	hugetlbfsPath = "/dev/hugepages"
+)
+
+// hostHugepageSizes returns the huge page sizes supported by the host, named
+// the way the hugetlb controller names them, e.g. "2MB" or "1GB".
+func hostHugepageSizes() (map[string]bool, error) {
+	entries, err := os.ReadDir(hugepagesDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return map[string]bool{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sizes := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		kb, ok := strings.CutPrefix(entry.Name(), "hugepages-")
+		if !ok {
+			continue
+		}
+		kb, ok = strings.CutSuffix(kb, "kB")
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseUint(kb, 10, 64)
+		if err != nil {
+			continue
+		}
+		sizes[hugepageSize(n<<10)] = true
+	}
+	return sizes, nil
+}
+
+// hugepageSize formats a page size in bytes, e.g. 2097152 as "2MB".
+func hugepageSize(size uint64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	i := 0
+	for size >= 1024 && size%1024 == 0 && i < len(units)-1 {
+		size /= 1024
+		i++
+	}
+	return fmt.Sprintf("%d%s", size, units[i])
+}
+
+// validateHugepageLimits rejects limits for page sizes the host doesn't
+// support.
+func validateHugepageLimits(limits []*runtimeapi.HugepageLimit) error {
+	if len(limits) == 0 {
+		return nil
+	}
+	sizes, err := hostHugepageSizes()
+	if err != nil {
+		return err
+	}
+	for _, limit := range limits {
+		if !sizes[limit.GetPageSize()] {
+			return status.Errorf(
+				codes.InvalidArgument,
+				"hugepage size %q is not supported by the host",
+				limit.GetPageSize(),
+			)
+		}
+	}
+	return nil
+}
+
+// applyHugepageLimits sets the hugetlb limits of a cgroup. systemd doesn't
+// manage the hugetlb controller, so it is only enabled for the cgroup if it
+// was delegated along the way from the root. Without it, limits of zero are
+// left alone, since kubelet passes one for every page size a container
+// doesn't ask for, and containers only get the host's hugetlbfs once they
+// ask for pages. If a limit fails to be set, those set before it are
+// restored; otherwise undo restores all of them.
+func applyHugepageLimits(cgroup string, limits []*runtimeapi.HugepageLimit) (_ func() error, err error) {
+	var previous []cgroupWrite
+	undo := func() error {
+		for n := len(previous) - 1; n >= 0; n-- {
+			if err := writeCgroupFile(cgroup, previous[n].file, previous[n].value); err != nil {
+				return fmt.Errorf("restore %s: %w", previous[n].file, err)
+			}
+		}
+		return nil
+	}
+	defer func() {
+		if err != nil {
+			if uerr := undo(); uerr != nil {
+				err = fmt.Errorf("%w, and %v", err, uerr)
+			}
+		}
+	}()
+	if len(limits) == 0 {
+		return undo, nil
+	}
+	enabled, err := cgroupHasController(cgroup, "hugetlb")
+	if err != nil {
+		return nil, err
+	}
+	for _, limit := range limits {
+		if !enabled {
+			if limit.GetLimit() == 0 {
+				continue
+			}
+			return nil, status.Errorf(
+				codes.FailedPrecondition,
+				"hugetlb controller is not enabled for cgroup %s, "+
+					"enable it in the cgroup.subtree_control of its parents to limit %s pages",
+				cgroup, limit.GetPageSize(),
+			)
+		}
+		file := "hugetlb." + limit.GetPageSize() + ".max"
+		old, err := os.ReadFile(filepath.Join(cgroupRoot, cgroup, file))
+		if err != nil {
+			return nil, fmt.Errorf("read hugetlb limit for %s pages: %w", limit.GetPageSize(), err)
+		}
+		value := strconv.FormatUint(limit.GetLimit(), 10)
+		if err := writeCgroupFile(cgroup, file, value); err != nil {
+			return nil, fmt.Errorf("set hugetlb limit for %s pages: %w", limit.GetPageSize(), err)
+		}
+		previous = append(previous, cgroupWrite{file: file, value: strings.TrimSpace(string(old))})
+	}
+	return undo, nil
+}
+
+// cgroupWrite is a cgroup file that was written, and what it held before.
+type cgroupWrite struct {
+	file, value string
+}
+
+// hugepageBinds returns the systemd-nspawn arguments that expose the host's
+// hugetlbfs to a container that requested huge pages.
+func hugepageBinds(limits []*runtimeapi.HugepageLimit) []string {
+	for _, limit := range limits {
+		if limit.GetLimit() > 0 {
+			return []string{"--bind=" + hugetlbfsPath}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package machineman
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// fakeCgroupRoot points the cgroup hierarchy at a directory of the test.
+func fakeCgroupRoot(t *testing.T) string {
+	t.Helper()
+	root, saved := t.TempDir(), cgroupRoot
+	cgroupRoot = root
+	t.Cleanup(func() { cgroupRoot = saved })
+	return root
+}
+
+// startableContainer adds a container with resources, and its sandbox, to
+// a runtime, and returns the cgroup directory its unit gets from the fake
+// systemd.
+func startableContainer(t *testing.T, r *RuntimeService, resources *runtimeapi.LinuxContainerResources) string {
+	t.Helper()
+	fakeNspawn(t)
+	sb := &sandboxRecord{
+		ID:       "sb1",
+		Metadata: &runtimeapi.PodSandboxMetadata{Namespace: "default", Name: "web"},
+		Slice:    "systemd-cri-pod-sb1.slice",
+	}
+	r.sandboxes.add(sb)
+	c := &containerRecord{
+		ID:        "c1",
+		SandboxID: sb.ID,
+		Metadata:  &runtimeapi.ContainerMetadata{Name: "app"},
+		Rootfs:    t.TempDir(),
+		Command:   []string{"/bin/app"},
+		Resources: resources,
+	}
+	r.containers.add(c)
+	dir := filepath.Join(cgroupRoot, sb.Slice, containerUnit(c.ID))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestStartContainerHugepageLimits(t *testing.T) {
+	limits := []*runtimeapi.HugepageLimit{{PageSize: "2MB", Limit: 4 << 20}}
+	if _, err := os.Stat(filepath.Join(hugepagesDir, "hugepages-2048kB")); err != nil {
+		t.Skip("host has no 2MB huge pages")
+	}
+	tests := []struct {
+		name        string
+		controllers string
+		limits      []*runtimeapi.HugepageLimit
+		// limit is what the cgroup's limit of 2MB pages ends up as,
+		// empty if it isn't written.
+		limit string
+		code  codes.Code
+	}{
+		{
+			name:        "delegated",
+			controllers: "cpu memory hugetlb",
+			limits:      limits,
+			limit:       "4194304",
+		},
+		{
+			name:        "not delegated",
+			controllers: "cpu memory",
+			limits:      limits,
+			code:        codes.FailedPrecondition,
+		},
+		{
+			// The limits kubelet passes for pages a container doesn't ask
+			// for need no controller.
+			name:        "no pages without delegation",
+			controllers: "cpu memory",
+			limits:      []*runtimeapi.HugepageLimit{{PageSize: "2MB"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeCgroupRoot(t)
+			fake := newFakeSystemd()
+			r := &RuntimeService{systemd: fake}
+			cgroup := startableContainer(t, r, &runtimeapi.LinuxContainerResources{HugepageLimits: tt.limits})
+			if err := os.WriteFile(filepath.Join(cgroup, "cgroup.controllers"), []byte(tt.controllers+"\n"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			// The controller's files are there once it is enabled.
+			if strings.Contains(tt.controllers, "hugetlb") {
+				if err := os.WriteFile(filepath.Join(cgroup, "hugetlb.2MB.max"), []byte("max\n"), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, err := r.StartContainer(context.Background(), &runtimeapi.StartContainerRequest{ContainerId: "c1"})
+			if status.Code(err) != tt.code {
+				t.Fatalf("StartContainer() = %v, want code %v", err, tt.code)
+			}
+			data, _ := os.ReadFile(filepath.Join(cgroup, "hugetlb.2MB.max"))
+			if string(data) != tt.limit {
+				t.Errorf("hugetlb.2MB.max = %q, want %q", data, tt.limit)
+			}
+			c, _ := r.containers.get("c1")
+			unit := fake.unitProperties(containerUnit("c1"))
+			if tt.code != codes.OK {
+				// A container that can't have its limits doesn't run, and
+				// can be started again.
+				if unit["ActiveState"] != "inactive" {
+					t.Errorf("unit is %v, want it stopped", unit["ActiveState"])
+				}
+				if c.startedTime() != 0 {
+					t.Error("container counts as started")
+				}
+			} else if unit["ActiveState"] != "active" {
+				t.Errorf("unit is %v, want it running", unit["ActiveState"])
+			}
+		})
+	}
+}
+
+func TestUpdateContainerResourcesRestoresHugepageLimits(t *testing.T) {
+	if _, err := os.Stat(filepath.Join(hugepagesDir, "hugepages-2048kB")); err != nil {
+		t.Skip("host has no 2MB huge pages")
+	}
+	fakeCgroupRoot(t)
+	fake := newFakeSystemd()
+	r := &RuntimeService{systemd: fake}
+	cgroup := startableContainer(t, r, nil)
+	c, _ := r.containers.get("c1")
+	c.setStarted(1)
+	fake.setUnit(containerUnit(c.ID), map[string]interface{}{
+		"ControlGroup": strings.TrimPrefix(cgroup, cgroupRoot),
+		"MemoryMax":    uint64(128 << 20),
+	})
+	// The memory limit doesn't take, the cgroup still has the old one.
+	for file, value := range map[string]string{
+		"cgroup.controllers": "cpu memory hugetlb",
+		"hugetlb.2MB.max":    "2097152",
+		"memory.max":         "134217728",
+	} {
+		if err := os.WriteFile(filepath.Join(cgroup, file), []byte(value+"\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := r.UpdateContainerResources(context.Background(), &runtimeapi.UpdateContainerResourcesRequest{
+		ContainerId: c.ID,
+		Linux: &runtimeapi.LinuxContainerResources{
+			MemoryLimitInBytes: 64 << 20,
+			HugepageLimits:     []*runtimeapi.HugepageLimit{{PageSize: "2MB", Limit: 4 << 20}},
+		},
+	})
+	if err == nil {
+		t.Fatal("UpdateContainerResources() succeeded with a limit the cgroup didn't take")
+	}
+	if data, _ := os.ReadFile(filepath.Join(cgroup, "hugetlb.2MB.max")); string(data) != "2097152" {
+		t.Errorf("hugetlb.2MB.max after the failed update = %q, want the old limit", data)
+	}
+	if got := fake.unitProperties(containerUnit(c.ID))["MemoryMax"]; got != uint64(128<<20) {
+		t.Errorf("MemoryMax after the failed update = %v, want the old limit", got)
+	}
+}
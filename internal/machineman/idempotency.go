@@ -0,0 +1,109 @@
+package machineman
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// sandboxKey identifies a RunPodSandbox request across retries. Kubelet
+// retries a call that failed or timed out with the same metadata, while a
+// new sandbox for the pod gets the next attempt number.
+func sandboxKey(m *runtimeapi.PodSandboxMetadata) string {
+	return fmt.Sprintf("%s/%s/%s/%d", m.GetNamespace(), m.GetName(), m.GetUid(), m.GetAttempt())
+}
+
+// keyID derives the ID of a sandbox or container from its key, so that a
+// retry that the runtime didn't see the first call of, such as one after a
+// restart, still gets the same sandbox or container.
+func keyID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// containerKey identifies a CreateContainer request across retries, like
+// sandboxKey.
+func containerKey(sandboxID string, m *runtimeapi.ContainerMetadata) string {
+	return fmt.Sprintf("%s/%s/%d", sandboxID, m.GetName(), m.GetAttempt())
+}
+
+// createReservations holds the keys of the create calls in progress, so
+// that a retry that arrives while the call it repeats still runs doesn't
+// create a second sandbox or container.
+type createReservations struct {
+	mu   sync.Mutex
+	keys map[string]bool
+}
+
+// reserve reserves key for a create call, and returns the function that
+// releases it once the call is done. It fails if key is reserved already.
+func (c *createReservations) reserve(key string) (unreserve func(), ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.keys[key] {
+		return nil, false
+	}
+	if c.keys == nil {
+		c.keys = map[string]bool{}
+	}
+	c.keys[key] = true
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.keys, key)
+	}, true
+}
+
+// retriedSandbox returns the sandbox an earlier RunPodSandbox call with
+// the same key created, or nil.
+func (r *RuntimeService) retriedSandbox(key string) *sandboxRecord {
+	sb, err := r.sandboxes.get(keyID(key))
+	if err != nil {
+		return nil
+	}
+	return sb
+}
+
+// retriedContainer returns the container an earlier CreateContainer call
+// with the same key created, or nil.
+func (r *RuntimeService) retriedContainer(key string) *containerRecord {
+	c, err := r.containers.get(keyID(key))
+	if err != nil {
+		return nil
+	}
+	return c
+}
+
+// deduplicated records that a create call was a retry of an earlier one
+// that created id.
+func (r *RuntimeService) deduplicated(operation, key, id string) {
+	createRetries.WithLabelValues(operation, "created").Inc()
+	r.debugf("%s: %s is a retry, returning %s created for it before", operation, key, id)
+}
+
+// inProgress is the error of a create call that is a retry of one that
+// still runs. Kubelet retries it again, and gets the result of the first
+// once it is done.
+func (r *RuntimeService) inProgress(operation, key string) error {
+	createRetries.WithLabelValues(operation, "in_progress").Inc()
+	r.debugf("%s: %s is a retry of a call still in progress", operation, key)
+	return status.Errorf(codes.Aborted, "%s for %s is already in progress", operation, key)
+}
+
+// debugf logs a message when the runtime runs with debug logging.
+func (r *RuntimeService) debugf(format string, args ...any) {
+	if r.debug.Load() {
+		log.Printf(format, args...)
+	}
+}
+
+// SetDebug turns debug logging on or off.
+func (r *RuntimeService) SetDebug(debug bool) {
+	r.debug.Store(debug)
+}
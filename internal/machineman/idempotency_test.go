@@ -0,0 +1,79 @@
+package machineman
+
+import (
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+func TestCreateReservations(t *testing.T) {
+	var c createReservations
+	unreserve, ok := c.reserve("a")
+	if !ok {
+		t.Fatal("reserve() of a free key failed")
+	}
+	if _, ok := c.reserve("a"); ok {
+		t.Error("reserve() of a reserved key succeeded")
+	}
+	unreserveB, ok := c.reserve("b")
+	if !ok {
+		t.Fatal("reserve() of another key failed")
+	}
+	unreserve()
+	again, ok := c.reserve("a")
+	if !ok {
+		t.Fatal("reserve() of a released key failed")
+	}
+	again()
+	unreserveB()
+	if len(c.keys) != 0 {
+		t.Errorf("keys left reserved: %v", c.keys)
+	}
+}
+
+func TestSandboxKey(t *testing.T) {
+	base := &runtimeapi.PodSandboxMetadata{Namespace: "default", Name: "web", Uid: "u1", Attempt: 0}
+	tests := []struct {
+		name string
+		m    *runtimeapi.PodSandboxMetadata
+		same bool
+	}{
+		{"retry", &runtimeapi.PodSandboxMetadata{Namespace: "default", Name: "web", Uid: "u1"}, true},
+		{"next attempt", &runtimeapi.PodSandboxMetadata{Namespace: "default", Name: "web", Uid: "u1", Attempt: 1}, false},
+		{"recreated pod", &runtimeapi.PodSandboxMetadata{Namespace: "default", Name: "web", Uid: "u2"}, false},
+		{"other namespace", &runtimeapi.PodSandboxMetadata{Namespace: "prod", Name: "web", Uid: "u1"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := keyID(sandboxKey(base)), keyID(sandboxKey(tt.m))
+			if (a == b) != tt.same {
+				t.Errorf("IDs %s and %s, want same: %v", a, b, tt.same)
+			}
+		})
+	}
+}
+
+func TestRetriedContainer(t *testing.T) {
+	var r RuntimeService
+	key := containerKey("pod", &runtimeapi.ContainerMetadata{Name: "app"})
+	if c := r.retriedContainer(key); c != nil {
+		t.Fatalf("retriedContainer() before the first call = %s", c.ID)
+	}
+	r.containers.add(&containerRecord{ID: keyID(key), SandboxID: "pod"})
+	if c := r.retriedContainer(key); c == nil || c.ID != keyID(key) {
+		t.Errorf("retriedContainer() after the first call = %v", c)
+	}
+	next := containerKey("pod", &runtimeapi.ContainerMetadata{Name: "app", Attempt: 1})
+	if c := r.retriedContainer(next); c != nil {
+		t.Errorf("retriedContainer() of the next attempt = %s", c.ID)
+	}
+}
+
+func TestInProgress(t *testing.T) {
+	var r RuntimeService
+	if err := r.inProgress("RunPodSandbox", "default/web/u1/0"); status.Code(err) != codes.Aborted {
+		t.Errorf("inProgress() = %v, want Aborted", err)
+	}
+}
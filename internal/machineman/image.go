@@ -2,76 +2,648 @@ package machineman
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/ananthb/systemd-cri/internal/health"
+	"github.com/ananthb/systemd-cri/internal/imageref"
 	"github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/directory"
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/manifest"
 	"github.com/containers/image/v5/signature"
-	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/containers/image/v5/types"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
 )
 
-func NewImageService() (runtimeapi.ImageServiceServer, error) {
-	return &ImageService{}, nil
+// ImageOptions configures an ImageService.
+type ImageOptions struct {
+	// Root is the directory pulled images are stored in.
+	Root string
+	// MaxParallelDownloads is how many layers of an image are downloaded
+	// at the same time. Zero leaves it to containers/image.
+	MaxParallelDownloads uint
+	// MaxRegistryDownloads is how many blobs are downloaded from a single
+	// registry at the same time, across all pulls. Zero is no limit.
+	MaxRegistryDownloads uint
+	// AllowedRegistries lists the registries images can be pulled from, as
+	// host patterns like "*.example.com". Empty allows all registries.
+	AllowedRegistries []string
+	// BlockedRegistries lists the registries images must not be pulled
+	// from, even if they are allowed.
+	BlockedRegistries []string
+	// RootfsDir is the directory the root filesystems of containers are
+	// made from images in.
+	RootfsDir string
+	// RootfsTmpfsSize puts RootfsDir on a tmpfs of this size, in the form
+	// of the tmpfs size= option. Empty keeps it on disk.
+	RootfsTmpfsSize string
+	// ManifestCacheTTL is how long pulls of a tag that the registry
+	// reports unchanged reuse the digest an earlier pull of it resolved
+	// to, skipping the manifest list. Zero fetches it every time.
+	ManifestCacheTTL time.Duration
+	// VerifyImages checks the digests of all blobs in the store at
+	// startup, which reads the whole store. It is done anyway when the
+	// runtime didn't shut down cleanly before.
+	VerifyImages bool
+	// RegistryCADir holds the CA certificates of registries that aren't
+	// signed by a CA the system trusts, in a subdirectory per registry.
+	// Empty uses /etc/containers/certs.d and /etc/docker/certs.d.
+	RegistryCADir string
+}
+
+func NewImageService(opts ImageOptions) (*ImageService, error) {
+	registries, err := newRegistryPolicy(opts.AllowedRegistries, opts.BlockedRegistries)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRegistryCADir(opts.RegistryCADir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(opts.Root, 0o700); err != nil {
+		return nil, err
+	}
+	rootfs, err := newRootfsStore(opts.RootfsDir, opts.RootfsTmpfsSize)
+	if err != nil {
+		return nil, err
+	}
+	i := &ImageService{
+		opts:      opts,
+		rootfs:    rootfs,
+		manifests: manifestCache{ttl: opts.ManifestCacheTTL},
+		downloads: registryLimits{max: opts.MaxRegistryDownloads},
+		health:    health.Register("image-store", nil),
+	}
+	i.registries.Store(&registries)
+	i.registryCADir.Store(&opts.RegistryCADir)
+	unclean, err := i.markRunning()
+	if err != nil {
+		return nil, err
+	}
+	if unclean {
+		log.Printf("image store wasn't closed cleanly, verifying the digests of all images")
+	}
+	if err := i.recoverStore(unclean || opts.VerifyImages); err != nil {
+		return nil, err
+	}
+	if i.index, err = openImageIndex(opts.Root); err != nil {
+		return nil, err
+	}
+	return i, nil
 }
 
 // ImageService implements RuntimeService and ImageService.
 type ImageService struct {
 	imageClient runtimeapi.ImageServiceClient
+	opts        ImageOptions
+	// registries restricts where images are pulled from. It is replaced
+	// as a whole when the policy is reloaded.
+	registries atomic.Pointer[registryPolicy]
+	// registryCADir is the directory of registry CAs, replaced when it is
+	// reloaded.
+	registryCADir atomic.Pointer[string]
+	// rootfs holds the root filesystems made from images.
+	rootfs *rootfsStore
+	// pulls deduplicates concurrent pulls of the same image.
+	pulls pullGroup
+	// manifests remembers what tags resolved to on recent pulls.
+	manifests manifestCache
+	// downloads limits the blob downloads from each registry.
+	downloads registryLimits
+	// locks serializes changes to an image against its readers.
+	locks imageLocks
+	// layersMu is held for reading while layers are unpacked, and for
+	// writing while the unused ones are pruned.
+	layersMu sync.RWMutex
+	// index lists the images in the store.
+	index *imageIndex
+	// health records the last failed pull.
+	health *health.Subsystem
+	// quarantined counts the corrupt images moved out of the store.
+	quarantined atomic.Int64
+	// diskPressure is set while the store is out of space.
+	diskPressure atomic.Bool
 }
 
+// SetRegistries replaces the registries images can be pulled from, and those
+// they must not be pulled from, for the pulls that start from then on.
+func (i *ImageService) SetRegistries(allowed, blocked []string) error {
+	registries, err := newRegistryPolicy(allowed, blocked)
+	if err != nil {
+		return err
+	}
+	i.registries.Store(&registries)
+	return nil
+}
+
+// SetMaxRegistryDownloads replaces the number of layers downloaded at once
+// from a single registry, zero for no limit, for the pulls that start from
+// then on.
+func (i *ImageService) SetMaxRegistryDownloads(max uint) {
+	i.downloads.setMax(max)
+}
+
+// ListImages lists the images in the store, from its index. Images pulled
+// by several references are listed once, with all their tags and digests.
 func (i *ImageService) ListImages(
-	context.Context,
-	*runtimeapi.ListImagesRequest,
+	_ context.Context,
+	req *runtimeapi.ListImagesRequest,
 ) (*runtimeapi.ListImagesResponse, error) {
-	return nil, nil
+	filter := req.GetFilter().GetImage().GetImage()
+	byID := map[string]*runtimeapi.Image{}
+	for _, entry := range i.index.list() {
+		ref, err := imageref.Parse(entry.Ref)
+		if err != nil {
+			continue
+		}
+		repoDigest := ref.Name() + "@" + entry.Digest
+		if filter != "" && !imageMatches(filter, entry, ref, repoDigest) {
+			continue
+		}
+		image, ok := byID[entry.ID]
+		if !ok {
+			image = &runtimeapi.Image{Id: entry.ID, Size_: uint64(entry.Size)}
+			byID[entry.ID] = image
+		}
+		if ref.Tag() != "" {
+			image.RepoTags = appendUnique(image.RepoTags, ref.String())
+		}
+		image.RepoDigests = appendUnique(image.RepoDigests, repoDigest)
+	}
+	response := &runtimeapi.ListImagesResponse{}
+	for _, image := range byID {
+		sort.Strings(image.RepoTags)
+		sort.Strings(image.RepoDigests)
+		response.Images = append(response.Images, image)
+	}
+	sort.Slice(response.Images, func(a, b int) bool {
+		return response.Images[a].Id < response.Images[b].Id
+	})
+	return response, nil
+}
+
+// imageMatches reports whether an image filter names the indexed image
+// pulled by ref: by its ID or the digest of its manifest, with or without
+// the "sha256:" prefix, or by any spelling of its tag or repository digest.
+func imageMatches(filter string, entry indexEntry, ref imageref.Ref, repoDigest string) bool {
+	switch filter {
+	case entry.ID, entry.Digest, strings.TrimPrefix(entry.ID, "sha256:"), strings.TrimPrefix(entry.Digest, "sha256:"):
+		return true
+	}
+	key := imageKey(filter)
+	return key == ref.String() || key == repoDigest
+}
+
+func appendUnique(list []string, s string) []string {
+	for _, existing := range list {
+		if existing == s {
+			return list
+		}
+	}
+	return append(list, s)
 }
 
 func (i *ImageService) ImageStatus(
-	context.Context,
-	*runtimeapi.ImageStatusRequest,
+	ctx context.Context,
+	req *runtimeapi.ImageStatusRequest,
 ) (*runtimeapi.ImageStatusResponse, error) {
-	return nil, nil
+	if _, err := parseImage(req.GetImage().GetImage()); err != nil {
+		return nil, err
+	}
+	list, err := i.ListImages(ctx, &runtimeapi.ListImagesRequest{
+		Filter: &runtimeapi.ImageFilter{Image: req.GetImage()},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(list.Images) == 0 {
+		return &runtimeapi.ImageStatusResponse{}, nil
+	}
+	response := &runtimeapi.ImageStatusResponse{Image: list.Images[0]}
+	if req.GetVerbose() {
+		image, _ := i.resolveImage(req.GetImage().GetImage())
+		config, err := i.imageConfig(ctx, image)
+		if err != nil {
+			return nil, err
+		}
+		response.Info = map[string]string{"exposedPorts": exposedPortsInfo(config.ExposedPorts)}
+	}
+	return response, nil
+}
+
+// exposedPortsInfo renders the ports an image exposes for verbose status.
+func exposedPortsInfo(ports []string) string {
+	data, err := json.Marshal(ports)
+	if err != nil {
+		return ""
+	}
+	return string(data)
 }
 
 func (i *ImageService) PullImage(
 	ctx context.Context,
 	req *runtimeapi.PullImageRequest,
 ) (*runtimeapi.PullImageResponse, error) {
+	imageRef, err := i.pull(ctx, req.GetImage().GetImage(), req.GetAuth())
+	if err != nil {
+		return nil, err
+	}
+	response := &runtimeapi.PullImageResponse{
+		ImageRef: imageRef,
+	}
+	return response, nil
+}
+
+// pull fetches an image and returns its reference. Concurrent pulls of the
+// same image with the same credentials share a single copy.
+func (i *ImageService) pull(
+	ctx context.Context,
+	image string,
+	auth *runtimeapi.AuthConfig,
+) (string, error) {
+	ref, err := parseImage(image)
+	if err != nil {
+		return "", err
+	}
+	if err := i.registries.Load().check(ref); err != nil {
+		return "", err
+	}
+	sys, err := systemContext(auth)
+	if err != nil {
+		return "", err
+	}
+	sys = i.withRegistryCAs(sys)
+	imageRef, err := i.pulls.do(ctx, ref.String()+"\x00"+authKey(auth), func(ctx context.Context) (string, error) {
+		return i.copyImage(ctx, ref, sys)
+	})
+	err = i.diskFull("pull image "+ref.String(), err)
+	if err != nil {
+		i.health.RecordError(err)
+		return "", err
+	}
+	return imageRef, nil
+}
+
+func (i *ImageService) copyImage(
+	ctx context.Context,
+	image imageref.Ref,
+	sys *types.SystemContext,
+) (string, error) {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
+	unlock := i.locks.Lock(image.String())
+	defer unlock()
 	policyContext, err := signature.NewPolicyContext(&signature.Policy{
 		Default: []signature.PolicyRequirement{signature.NewPRInsecureAcceptAnything()},
 	})
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-	srcRef, err := alltransports.ParseImageName(req.Image.GetImage())
+	src, tagDigest, err := i.cachedSource(ctx, image, sys)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-	destRef, err := alltransports.ParseImageName("docker://localhost:5000/alpine:latest")
+	srcRef, err := docker.NewReference(src.Named())
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-	options := &copy.Options{}
-	if _, err := copy.Image(ctx, policyContext, destRef, srcRef, options); err != nil {
-		return nil, err
+	srcRef = i.downloads.reference(srcRef, image.Domain())
+	dir := image.StoragePath(i.opts.Root)
+	staged, err := i.stagePull(dir)
+	if err != nil {
+		return "", err
 	}
-	response := &runtimeapi.PullImageResponse{
-		ImageRef: destRef.DockerReference().String(),
+	// Left behind are a failed pull or the image the pull replaced.
+	defer func() {
+		if err := os.RemoveAll(staged); err != nil {
+			log.Printf("failed to clean up pull of %s: %v", image, err)
+		}
+	}()
+	destRef, err := directory.NewReference(staged)
+	if err != nil {
+		return "", err
 	}
-	return response, nil
+	progress := make(chan types.ProgressProperties)
+	options := &copy.Options{
+		SourceCtx:            sys,
+		MaxParallelDownloads: i.opts.MaxParallelDownloads,
+		Progress:             progress,
+		ProgressInterval:     pullProgressInterval,
+	}
+	history := startPull(image)
+	watched := make(chan struct{})
+	go func() {
+		history.watch(progress)
+		close(watched)
+	}()
+	copied, err := copy.Image(ctx, policyContext, destRef, srcRef, options)
+	close(progress)
+	<-watched
+	if err == nil {
+		err = checkRunnable(image, staged)
+	}
+	history.done(err)
+	if err != nil {
+		var artifact manifest.NonImageArtifactError
+		if errors.As(err, &artifact) {
+			return "", status.Errorf(codes.FailedPrecondition, "%s is not a container image: %v", image, err)
+		}
+		return "", err
+	}
+	if tagDigest != "" {
+		if digest, err := manifest.Digest(copied); err == nil {
+			i.manifests.put(image.String(), tagDigest, digest.String())
+		}
+	}
+	if err := i.storePulled(dir, staged); err != nil {
+		return "", fmt.Errorf("store image %s: %w", image, err)
+	}
+	return image.String(), nil
+}
+
+// storePulled moves the image pulled to staged into dir, in place of the
+// image stored there. The same image pulled again is left where it is, and
+// the layers only the replaced image had are pruned.
+func (i *ImageService) storePulled(dir, staged string) error {
+	blob, err := os.ReadFile(filepath.Join(staged, "manifest.json"))
+	if err != nil {
+		return err
+	}
+	digest, err := manifest.Digest(blob)
+	if err != nil {
+		return err
+	}
+	if stored, ok := i.index.get(dir); ok && stored.Digest == digest.String() {
+		return nil
+	}
+	if err := i.index.replace(dir, staged); err != nil {
+		return err
+	}
+	if err := i.pruneLayers(); err != nil {
+		log.Printf("failed to prune image layers: %v", err)
+	}
+	return nil
 }
 
+// cachedSource returns what to pull a tag from: the digest an earlier pull
+// of it resolved to if the registry reports the tag unchanged since, the
+// tag itself otherwise. tagDigest is what the registry reported, empty if
+// it wasn't asked.
+func (i *ImageService) cachedSource(
+	ctx context.Context,
+	image imageref.Ref,
+	sys *types.SystemContext,
+) (src imageref.Ref, tagDigest string, err error) {
+	if image.Digest() != "" || i.manifests.ttl <= 0 {
+		return image, "", nil
+	}
+	tagRef, err := docker.NewReference(image.Named())
+	if err != nil {
+		return imageref.Ref{}, "", err
+	}
+	current, err := docker.GetDigest(ctx, sys, tagRef)
+	if err != nil {
+		// The pull itself reports what's wrong with the registry.
+		return image, "", nil
+	}
+	digest, ok := i.manifests.get(image.String(), current.String())
+	if !ok {
+		return image, current.String(), nil
+	}
+	src, err = image.WithDigest(digest)
+	return src, current.String(), err
+}
+
+// RemoveImage removes an image from the store, by reference or by ID. An ID
+// removes the image under every reference it was pulled by.
 func (i *ImageService) RemoveImage(
-	context.Context,
-	*runtimeapi.RemoveImageRequest,
+	ctx context.Context,
+	req *runtimeapi.RemoveImageRequest,
 ) (*runtimeapi.RemoveImageResponse, error) {
-	return nil, nil
+	image := req.GetImage().GetImage()
+	refs := i.index.refsWithID(image)
+	if len(refs) == 0 {
+		ref, err := parseImage(image)
+		if err != nil {
+			return nil, err
+		}
+		refs = []imageref.Ref{ref}
+	}
+	for _, ref := range refs {
+		if err := i.removeImage(ref); err != nil {
+			return nil, err
+		}
+	}
+	return &runtimeapi.RemoveImageResponse{}, nil
 }
 
+func (i *ImageService) removeImage(ref imageref.Ref) error {
+	unlock := i.locks.Lock(ref.String())
+	defer unlock()
+	dir := ref.StoragePath(i.opts.Root)
+	if err := i.index.remove(dir); err != nil {
+		return err
+	}
+	if err := i.deleteImageDir(dir); err != nil {
+		return err
+	}
+	// The layers of containers made from the image stay until they
+	// are removed.
+	if err := i.pruneLayers(); err != nil {
+		log.Printf("failed to prune image layers: %v", err)
+	}
+	return nil
+}
+
+// ImageFsInfo reports the space used by images and the root filesystems of
+// containers. Root filesystems on a tmpfs are reported as a filesystem of
+// their own, since they don't take up any of the image store's disk.
 func (i *ImageService) ImageFsInfo(
 	context.Context,
 	*runtimeapi.ImageFsInfoRequest,
 ) (*runtimeapi.ImageFsInfoResponse, error) {
-	return nil, nil
+	bytes, inodes, err := diskUsage(i.opts.Root)
+	if err != nil {
+		return nil, err
+	}
+	rootfs, err := i.rootfs.usage()
+	if err != nil {
+		return nil, err
+	}
+	images := &runtimeapi.FilesystemUsage{
+		Timestamp:  time.Now().UnixNano(),
+		FsId:       &runtimeapi.FilesystemIdentifier{Mountpoint: i.opts.Root},
+		UsedBytes:  &runtimeapi.UInt64Value{Value: bytes},
+		InodesUsed: &runtimeapi.UInt64Value{Value: inodes},
+	}
+	if !i.rootfs.tmpfs {
+		// The root filesystems share the disk of the state dir with
+		// the images.
+		images.UsedBytes.Value += rootfs.GetUsedBytes().GetValue()
+		images.InodesUsed.Value += rootfs.GetInodesUsed().GetValue()
+		rootfs = nil
+	}
+	response := &runtimeapi.ImageFsInfoResponse{
+		ImageFilesystems: []*runtimeapi.FilesystemUsage{images},
+	}
+	if rootfs != nil {
+		response.ImageFilesystems = append(response.ImageFilesystems, rootfs)
+	}
+	return response, nil
+}
+
+// useImage takes the read lock of an image while a container sets up its
+// root filesystem from it, and returns a function that releases the lock.
+func (i *ImageService) useImage(image string) (release func()) {
+	return i.locks.RLock(imageKey(image))
+}
+
+// imageConfig is the part of an image's configuration that containers run
+// with.
+type imageConfig struct {
+	Env        []string
+	WorkingDir string
+	Entrypoint []string
+	Cmd        []string
+	// Size is the stored size of the image's layers. They are usually
+	// compressed, so a root filesystem made from them takes up at least
+	// as much.
+	Size int64
+	// Healthcheck is the HEALTHCHECK of a Docker image, nil without one.
+	Healthcheck *healthcheck
+	// ExposedPorts are the ports the image declares, like "80/tcp",
+	// sorted. They are informational, containers share their pod's
+	// network either way.
+	ExposedPorts []string
+	// Ulimits is the image's ulimits label, empty without one.
+	Ulimits string
+	// StopSignal is the image's STOPSIGNAL, empty without one.
+	StopSignal string
+}
+
+// imageConfig reads the configuration of a pulled image. An image that
+// turns out to be corrupt is quarantined, so that pulling it again fixes it.
+func (i *ImageService) imageConfig(ctx context.Context, image string) (*imageConfig, error) {
+	parsed, err := parseImage(image)
+	if err != nil {
+		return nil, err
+	}
+	if present, err := i.imagePresent(image); err != nil || !present {
+		if err != nil {
+			return nil, err
+		}
+		return nil, status.Errorf(codes.NotFound, "image %s is not pulled", parsed)
+	}
+	dir := parsed.StoragePath(i.opts.Root)
+	if err := verifyImage(dir, false); err != nil {
+		i.health.RecordError(fmt.Errorf("image %s: %w", parsed, err))
+		if qerr := i.quarantine(dir, err); qerr != nil {
+			return nil, qerr
+		}
+		return nil, status.Errorf(codes.NotFound, "image %s is corrupt and was quarantined: %v", parsed, err)
+	}
+	ref, err := directory.NewReference(dir)
+	if err != nil {
+		return nil, err
+	}
+	img, err := ref.NewImage(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer img.Close()
+	config, err := img.OCIConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	blob, err := img.ConfigBlob(ctx)
+	if err != nil {
+		return nil, err
+	}
+	hc, err := parseHealthcheck(blob)
+	if err != nil {
+		return nil, err
+	}
+	exposed := make([]string, 0, len(config.Config.ExposedPorts))
+	for port := range config.Config.ExposedPorts {
+		exposed = append(exposed, port)
+	}
+	sort.Strings(exposed)
+	var size int64
+	for _, layer := range img.LayerInfos() {
+		if layer.Size > 0 {
+			size += layer.Size
+		}
+	}
+	return &imageConfig{
+		Env:          config.Config.Env,
+		WorkingDir:   config.Config.WorkingDir,
+		Entrypoint:   config.Config.Entrypoint,
+		Cmd:          config.Config.Cmd,
+		Size:         size,
+		Healthcheck:  hc,
+		ExposedPorts: exposed,
+		Ulimits:      config.Config.Labels[ulimitsLabel],
+		StopSignal:   config.Config.StopSignal,
+	}, nil
+}
+
+// imageRef returns the digest reference of a pulled image, the repository
+// with the digest of its manifest, which stays the same when a tag moves.
+// An image that isn't indexed is returned as it was named.
+func (i *ImageService) imageRef(image string) string {
+	ref, err := imageref.Parse(image)
+	if err != nil {
+		return image
+	}
+	entry, ok := i.index.get(ref.StoragePath(i.opts.Root))
+	if !ok {
+		return image
+	}
+	return ref.Name() + "@" + entry.Digest
+}
+
+// resolveImage returns a reference an image given by its ID was pulled by,
+// as kubelet names images by the ID ImageStatus reported. byID reports
+// whether it was an ID. Anything else is returned as it is.
+func (i *ImageService) resolveImage(image string) (resolved string, byID bool) {
+	refs := i.index.refsWithID(image)
+	if len(refs) == 0 {
+		return image, false
+	}
+	// The references all name the same image, the first in order keeps
+	// the choice the same from call to call.
+	sort.Slice(refs, func(a, b int) bool { return refs[a].String() < refs[b].String() })
+	return refs[0].String(), true
+}
+
+// parseImage validates an image reference from a request, turning errors
+// into InvalidArgument.
+func parseImage(image string) (imageref.Ref, error) {
+	ref, err := imageref.Parse(image)
+	if err != nil {
+		return imageref.Ref{}, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return ref, nil
+}
+
+// imageKey normalizes an image name so that different spellings of the same
+// image, such as "alpine" and "docker.io/library/alpine:latest", share a
+// lock.
+func imageKey(image string) string {
+	ref, err := imageref.Parse(image)
+	if err != nil {
+		return image
+	}
+	return ref.String()
 }
@@ -0,0 +1,129 @@
+package machineman
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+func TestParseImage(t *testing.T) {
+	tests := []struct {
+		image    string
+		want     string
+		wantCode codes.Code
+	}{
+		{image: "alpine", want: "docker.io/library/alpine:latest"},
+		{image: "nginx:1.25", want: "docker.io/library/nginx:1.25"},
+		{image: "quay.io/org/app:v1", want: "quay.io/org/app:v1"},
+		{image: "", wantCode: codes.InvalidArgument},
+		{image: "  ", wantCode: codes.InvalidArgument},
+		{image: "Alpine", wantCode: codes.InvalidArgument},
+		{image: "alpine:", wantCode: codes.InvalidArgument},
+		{image: "docker://alpine", wantCode: codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			ref, err := parseImage(tt.image)
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("parseImage(%q) error = %v, want code %v", tt.image, err, tt.wantCode)
+			}
+			if err == nil && ref.String() != tt.want {
+				t.Errorf("parseImage(%q) = %q, want %q", tt.image, ref, tt.want)
+			}
+		})
+	}
+}
+
+func TestImageKey(t *testing.T) {
+	tests := []struct {
+		a, b string
+		same bool
+	}{
+		{"alpine", "docker.io/library/alpine:latest", true},
+		{"alpine", "alpine:3.18", false},
+		// Unparsable names key as themselves rather than failing.
+		{"Alpine", "Alpine", true},
+	}
+	for _, tt := range tests {
+		if same := imageKey(tt.a) == imageKey(tt.b); same != tt.same {
+			t.Errorf("imageKey(%q) == imageKey(%q) is %v, want %v", tt.a, tt.b, same, tt.same)
+		}
+	}
+}
+
+func TestListImages(t *testing.T) {
+	root := t.TempDir()
+	// The same image under two tags, and by digest.
+	writeImage(t, root, "", "alpine", 1, 10)
+	writeImage(t, root, "", "alpine:3.18", 1, 10)
+	writeImage(t, root, "", "nginx:1.25", 2, 20)
+	x, err := openImageIndex(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := &ImageService{opts: ImageOptions{Root: root}, index: x}
+	alpine, nginx := testDigest(1), testDigest(2)
+	var alpineDigest string
+	for _, entry := range x.list() {
+		if entry.ID == alpine {
+			alpineDigest = entry.Digest
+		}
+	}
+
+	tests := []struct {
+		name   string
+		filter string
+		want   []string
+	}{
+		{name: "all", want: []string{alpine, nginx}},
+		{name: "familiar tag", filter: "alpine", want: []string{alpine}},
+		{name: "other tag of the same image", filter: "alpine:3.18", want: []string{alpine}},
+		{name: "full tag", filter: "docker.io/library/nginx:1.25", want: []string{nginx}},
+		{name: "ID", filter: nginx, want: []string{nginx}},
+		{name: "unprefixed ID", filter: strings.TrimPrefix(nginx, "sha256:"), want: []string{nginx}},
+		{name: "manifest digest", filter: alpineDigest, want: []string{alpine}},
+		{name: "unprefixed manifest digest", filter: strings.TrimPrefix(alpineDigest, "sha256:"), want: []string{alpine}},
+		{name: "repository digest", filter: "alpine@" + alpineDigest, want: []string{alpine}},
+		{name: "unknown tag", filter: "nginx:1.26"},
+		{name: "not an image", filter: "Nope"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &runtimeapi.ListImagesRequest{}
+			if tt.filter != "" {
+				req.Filter = &runtimeapi.ImageFilter{Image: &runtimeapi.ImageSpec{Image: tt.filter}}
+			}
+			resp, err := i.ListImages(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, image := range resp.Images {
+				got = append(got, image.Id)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ListImages(%q) = %q, want %q", tt.filter, got, tt.want)
+			}
+		})
+	}
+
+	// An image pulled under several tags is listed once, with all of them.
+	resp, err := i.ListImages(context.Background(), &runtimeapi.ListImagesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	image := resp.Images[0]
+	wantTags := []string{"docker.io/library/alpine:3.18", "docker.io/library/alpine:latest"}
+	if !reflect.DeepEqual(image.RepoTags, wantTags) {
+		t.Errorf("RepoTags = %q, want %q", image.RepoTags, wantTags)
+	}
+	wantDigests := []string{"docker.io/library/alpine@" + alpineDigest}
+	if !reflect.DeepEqual(image.RepoDigests, wantDigests) || image.Size_ != 10 {
+		t.Errorf("RepoDigests = %q, size %d, want %q, size 10", image.RepoDigests, image.Size_, wantDigests)
+	}
+}
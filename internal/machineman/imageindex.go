@@ -0,0 +1,292 @@
+package machineman
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/ananthb/systemd-cri/internal/imageref"
+	"github.com/containers/image/v5/manifest"
+)
+
+const (
+	// indexFile holds the image index, relative to the image store.
+	indexFile = "index.json"
+	// indexVersion is bumped whenever the format of indexFile changes,
+	// which has the index rebuilt.
+	indexVersion = 1
+)
+
+// imageIndex lists the images in the store, so that listing them doesn't
+// parse every manifest. It is persisted to indexFile on every change, and
+// rebuilt from the store when that is missing, corrupt or out of date.
+type imageIndex struct {
+	root string
+
+	mu sync.Mutex
+	// images is keyed by the directory of the image, relative to root.
+	images map[string]indexEntry
+}
+
+// indexEntry describes a stored image.
+type indexEntry struct {
+	// Ref is the reference the image was pulled by.
+	Ref string `json:"ref"`
+	// ID is the digest of the image's config, which identifies it.
+	ID string `json:"id"`
+	// Digest is the digest of the image's manifest.
+	Digest string `json:"digest"`
+	// Size is the stored size of the image's layers.
+	Size int64 `json:"size"`
+}
+
+type indexData struct {
+	Version int                   `json:"version"`
+	Images  map[string]indexEntry `json:"images"`
+}
+
+// openImageIndex loads the index of the image store at root, rebuilding it
+// if it doesn't list exactly the images in the store.
+func openImageIndex(root string) (*imageIndex, error) {
+	x := &imageIndex{root: root}
+	dirs, err := storedImages(root)
+	if err != nil {
+		return nil, err
+	}
+	if err := x.load(); err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("rebuilding image index: %v", err)
+		}
+	} else if x.matches(dirs) {
+		return x, nil
+	} else {
+		log.Printf("rebuilding image index: it is out of date")
+	}
+	x.images = make(map[string]indexEntry, len(dirs))
+	for _, dir := range dirs {
+		rel, entry, err := x.entry(dir, dir)
+		if err != nil {
+			log.Printf("failed to index image %s: %v", dir, err)
+			continue
+		}
+		x.images[rel] = entry
+	}
+	if err := x.save(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// storedImages returns the directories of the images in the store at root.
+func storedImages(root string) ([]string, error) {
+	var dirs []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && isStoreDir(d.Name()) {
+			return fs.SkipDir
+		}
+		if d.IsDir() || d.Name() != versionFile {
+			return nil
+		}
+		dirs = append(dirs, filepath.Dir(path))
+		return fs.SkipDir
+	})
+	return dirs, err
+}
+
+func (x *imageIndex) load() error {
+	data, err := os.ReadFile(filepath.Join(x.root, indexFile))
+	if err != nil {
+		return err
+	}
+	var index indexData
+	if err := json.Unmarshal(data, &index); err != nil {
+		return fmt.Errorf("corrupt %s: %w", indexFile, err)
+	}
+	if index.Version != indexVersion {
+		return fmt.Errorf("%s has version %d, want %d", indexFile, index.Version, indexVersion)
+	}
+	x.images = index.Images
+	if x.images == nil {
+		x.images = map[string]indexEntry{}
+	}
+	return nil
+}
+
+// matches reports whether the index lists exactly the images in dirs.
+func (x *imageIndex) matches(dirs []string) bool {
+	if len(dirs) != len(x.images) {
+		return false
+	}
+	for _, dir := range dirs {
+		rel, err := filepath.Rel(x.root, dir)
+		if err != nil {
+			return false
+		}
+		if _, ok := x.images[rel]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// save writes the index to a temporary file and renames it over indexFile,
+// so that a crash leaves either the old or the new index behind.
+func (x *imageIndex) save() error {
+	data, err := json.Marshal(indexData{Version: indexVersion, Images: x.images})
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(x.root, indexFile)
+	f, err := os.CreateTemp(x.root, indexFile+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// entry reads the description of the image in from that is to be stored
+// in dir.
+func (x *imageIndex) entry(dir, from string) (string, indexEntry, error) {
+	rel, err := filepath.Rel(x.root, dir)
+	if err != nil {
+		return "", indexEntry{}, err
+	}
+	ref, err := imageref.FromStoragePath(x.root, dir)
+	if err != nil {
+		return "", indexEntry{}, err
+	}
+	blob, err := os.ReadFile(filepath.Join(from, "manifest.json"))
+	if err != nil {
+		return "", indexEntry{}, err
+	}
+	digest, err := manifest.Digest(blob)
+	if err != nil {
+		return "", indexEntry{}, err
+	}
+	m, err := manifest.FromBlob(blob, manifest.GuessMIMEType(blob))
+	if err != nil {
+		return "", indexEntry{}, err
+	}
+	var size int64
+	for _, layer := range m.LayerInfos() {
+		if layer.Size > 0 {
+			size += layer.Size
+		}
+	}
+	return rel, indexEntry{
+		Ref:    ref.String(),
+		ID:     m.ConfigInfo().Digest.String(),
+		Digest: digest.String(),
+		Size:   size,
+	}, nil
+}
+
+// replace moves the image pulled to staged into dir, in place of the image
+// stored there, and indexes it in one step: if the index can't be saved the
+// move is undone. The image that was replaced is left in staged.
+func (x *imageIndex) replace(dir, staged string) error {
+	rel, entry, err := x.entry(dir, staged)
+	if err != nil {
+		return err
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	undo, err := swapImage(staged, dir)
+	if err != nil {
+		return err
+	}
+	old, indexed := x.images[rel]
+	x.images[rel] = entry
+	if err := x.save(); err != nil {
+		if indexed {
+			x.images[rel] = old
+		} else {
+			delete(x.images, rel)
+		}
+		if uerr := undo(); uerr != nil {
+			log.Printf("failed to restore image %s after failing to index it: %v", rel, uerr)
+		}
+		return err
+	}
+	return nil
+}
+
+// remove drops the image stored in dir from the index.
+func (x *imageIndex) remove(dir string) error {
+	rel, err := filepath.Rel(x.root, dir)
+	if err != nil {
+		return err
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	entry, ok := x.images[rel]
+	if !ok {
+		return nil
+	}
+	delete(x.images, rel)
+	if err := x.save(); err != nil {
+		x.images[rel] = entry
+		return err
+	}
+	return nil
+}
+
+// get returns the index entry of the image stored in dir.
+func (x *imageIndex) get(dir string) (indexEntry, bool) {
+	rel, err := filepath.Rel(x.root, dir)
+	if err != nil {
+		return indexEntry{}, false
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	entry, ok := x.images[rel]
+	return entry, ok
+}
+
+// list returns the indexed images.
+func (x *imageIndex) list() []indexEntry {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	entries := make([]indexEntry, 0, len(x.images))
+	for _, entry := range x.images {
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// refsWithID returns the references the image with the given ID was pulled
+// by.
+func (x *imageIndex) refsWithID(id string) []imageref.Ref {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	var refs []imageref.Ref
+	for _, entry := range x.images {
+		if entry.ID != id {
+			continue
+		}
+		if ref, err := imageref.Parse(entry.Ref); err == nil {
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
@@ -0,0 +1,218 @@
+package machineman
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/ananthb/systemd-cri/internal/imageref"
+)
+
+// testDigest returns a well-formed sha256 digest made from n.
+func testDigest(n int) string {
+	return fmt.Sprintf("sha256:%064x", n)
+}
+
+// writeImage writes an image pulled by name, with the config digest
+// testDigest(id) and a layer of size bytes, to dir, and returns the
+// directory the store keeps it in below root.
+func writeImage(tb testing.TB, root, dir, name string, id int, size int64) string {
+	tb.Helper()
+	ref, err := imageref.Parse(name)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if dir == "" {
+		dir = ref.StoragePath(root)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		tb.Fatal(err)
+	}
+	manifest := fmt.Sprintf(`{
+		"schemaVersion": 2,
+		"mediaType": "application/vnd.oci.image.manifest.v1+json",
+		"config": {"mediaType": "application/vnd.oci.image.config.v1+json", "digest": %q, "size": 2},
+		"layers": [{"mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": %q, "size": %d}]
+	}`, testDigest(id), testDigest(id+1000), size)
+	for file, data := range map[string]string{
+		"manifest.json": manifest,
+		versionFile:     "Directory Transport Version: 1.1\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, file), []byte(data), 0o644); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return ref.StoragePath(root)
+}
+
+func indexedRefs(x *imageIndex) []string {
+	var refs []string
+	for _, entry := range x.list() {
+		refs = append(refs, entry.Ref)
+	}
+	sort.Strings(refs)
+	return refs
+}
+
+func TestOpenImageIndex(t *testing.T) {
+	tests := []struct {
+		name string
+		// index is the content of the index file, if there is one.
+		index string
+		// rebuilt is whether the index is expected to be rebuilt from
+		// the store rather than loaded.
+		rebuilt bool
+	}{
+		{name: "missing", rebuilt: true},
+		{name: "corrupt", index: "{", rebuilt: true},
+		{
+			name:    "old version",
+			index:   `{"version": 0, "images": {}}`,
+			rebuilt: true,
+		},
+		{
+			name:    "missing an image",
+			index:   `{"version": 1, "images": {"docker.io/library/alpine/tags/latest": {"ref": "docker.io/library/alpine:latest", "size": 1}}}`,
+			rebuilt: true,
+		},
+		{
+			name: "up to date",
+			index: `{"version": 1, "images": {
+				"docker.io/library/alpine/tags/latest": {"ref": "docker.io/library/alpine:latest", "size": 1},
+				"docker.io/library/nginx/tags/1.25": {"ref": "docker.io/library/nginx:1.25", "size": 1}
+			}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			writeImage(t, root, "", "alpine", 1, 10)
+			writeImage(t, root, "", "nginx:1.25", 2, 20)
+			// Bookkeeping directories aren't images.
+			writeImage(t, root, filepath.Join(root, pullingDir, "x"), "busybox", 3, 30)
+			if tt.index != "" {
+				if err := os.WriteFile(filepath.Join(root, indexFile), []byte(tt.index), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			x, err := openImageIndex(root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []string{"docker.io/library/alpine:latest", "docker.io/library/nginx:1.25"}
+			if got := indexedRefs(x); !reflect.DeepEqual(got, want) {
+				t.Fatalf("index lists %q, want %q", got, want)
+			}
+			// A rebuilt index has the sizes from the manifests, a loaded
+			// one those from the index file.
+			var size int64
+			for _, entry := range x.list() {
+				size += entry.Size
+			}
+			if rebuilt := size == 30; rebuilt != tt.rebuilt {
+				t.Errorf("index rebuilt: %v, want %v", rebuilt, tt.rebuilt)
+			}
+			// Whatever was loaded, the index on disk is now current.
+			reopened, err := openImageIndex(root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(reopened.images, x.images) {
+				t.Errorf("reopened index = %v, want %v", reopened.images, x.images)
+			}
+		})
+	}
+}
+
+func TestImageIndexReplace(t *testing.T) {
+	root := t.TempDir()
+	x, err := openImageIndex(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	staged := filepath.Join(t.TempDir(), "staged")
+	dir := writeImage(t, root, staged, "alpine", 1, 10)
+	if err := x.replace(dir, staged); err != nil {
+		t.Fatal(err)
+	}
+	entry, ok := x.get(dir)
+	if !ok || entry.ID != testDigest(1) || entry.Size != 10 {
+		t.Fatalf("get() after pulling = %+v, %v", entry, ok)
+	}
+	if _, err := os.Stat(staged); !os.IsNotExist(err) {
+		t.Errorf("staged image left behind after a first pull: %v", err)
+	}
+
+	// A pull of a newer image by the same tag replaces the old one, which
+	// is left in staged.
+	writeImage(t, root, staged, "alpine", 2, 20)
+	if err := x.replace(dir, staged); err != nil {
+		t.Fatal(err)
+	}
+	if entry, _ := x.get(dir); entry.ID != testDigest(2) {
+		t.Errorf("get() after pulling again = %+v, want ID %s", entry, testDigest(2))
+	}
+	_, old, err := x.entry(dir, staged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if old.ID != testDigest(1) {
+		t.Errorf("staged holds image %s, want the replaced %s", old.ID, testDigest(1))
+	}
+	if refs := x.refsWithID(testDigest(2)); len(refs) != 1 || refs[0].String() != "docker.io/library/alpine:latest" {
+		t.Errorf("refsWithID() = %v", refs)
+	}
+	if refs := x.refsWithID(testDigest(1)); len(refs) != 0 {
+		t.Errorf("refsWithID() of the replaced image = %v", refs)
+	}
+
+	if err := x.remove(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := x.get(dir); ok {
+		t.Error("get() found a removed image")
+	}
+	reopened := &imageIndex{root: root}
+	if err := reopened.load(); err != nil {
+		t.Fatal(err)
+	}
+	if len(reopened.images) != 0 {
+		t.Errorf("saved index still lists %v", reopened.images)
+	}
+}
+
+// BenchmarkListImages compares listing the store from the index with
+// walking it and parsing every manifest, as listing did before.
+func BenchmarkListImages(b *testing.B) {
+	root := b.TempDir()
+	for n := 0; n < 200; n++ {
+		writeImage(b, root, "", fmt.Sprintf("app%d:v1", n), n, 10)
+	}
+	x, err := openImageIndex(root)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Run("index", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			if len(x.list()) != 200 {
+				b.Fatal("images missing from the index")
+			}
+		}
+	})
+	b.Run("walk", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			dirs, err := storedImages(root)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for _, dir := range dirs {
+				if _, _, err := x.entry(dir, dir); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
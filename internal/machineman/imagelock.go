@@ -0,0 +1,64 @@
+package machineman
+
+import "sync"
+
+// imageLocks hands out a read/write lock per image, so that a container
+// never sets up its root filesystem from an image that a pull or removal is
+// halfway through changing. Unrelated images don't contend with each other.
+type imageLocks struct {
+	mu    sync.Mutex
+	locks map[string]*imageLock
+}
+
+type imageLock struct {
+	sync.RWMutex
+	// refs counts the holders and waiters of the lock, so that it can be
+	// dropped from the map once nobody uses it.
+	refs int
+}
+
+// Lock takes the write lock of image and returns a function that releases it.
+func (l *imageLocks) Lock(image string) (unlock func()) {
+	lock := l.acquire(image)
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		l.release(image)
+	}
+}
+
+// RLock takes the read lock of image and returns a function that releases
+// it.
+func (l *imageLocks) RLock(image string) (unlock func()) {
+	lock := l.acquire(image)
+	lock.RLock()
+	return func() {
+		lock.RUnlock()
+		l.release(image)
+	}
+}
+
+func (l *imageLocks) acquire(image string) *imageLock {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.locks == nil {
+		l.locks = map[string]*imageLock{}
+	}
+	lock, ok := l.locks[image]
+	if !ok {
+		lock = &imageLock{}
+		l.locks[image] = lock
+	}
+	lock.refs++
+	return lock
+}
+
+func (l *imageLocks) release(image string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lock := l.locks[image]
+	lock.refs--
+	if lock.refs == 0 {
+		delete(l.locks, image)
+	}
+}
@@ -0,0 +1,324 @@
+package machineman
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ananthb/systemd-cri/internal/imageref"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/types"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// corruptDir is where images that fail verification are moved to,
+	// relative to the image store.
+	corruptDir = ".corrupt"
+	// deletingDir is where images are moved to be deleted, relative to
+	// the image store, so that one whose removal is interrupted is gone
+	// from the store all the same.
+	deletingDir = ".deleting"
+	// pullingDir is where images are pulled to, relative to the image
+	// store, before they replace the image stored under their reference.
+	pullingDir = ".pulling"
+	// runningFile is in the image store while a runtime uses it. Finding
+	// it at startup means the last one didn't shut down cleanly, and may
+	// have left blobs truncated.
+	runningFile = ".running"
+	// versionFile marks a directory as an image in the dir transport's
+	// layout: a manifest.json and the blobs it references, named by the
+	// hex of their digests.
+	versionFile = "version"
+)
+
+// isStoreDir reports whether a directory of the image store by this name
+// holds the store's own bookkeeping rather than images, or an image's
+// unpacked layers.
+func isStoreDir(name string) bool {
+	return name == corruptDir || name == deletingDir || name == pullingDir ||
+		strings.HasPrefix(name, layersDir)
+}
+
+// runnableConfigTypes are the config media types of images containers can
+// run. Schema 1 images have no config, and so an empty type.
+var runnableConfigTypes = map[string]bool{
+	"": true,
+	"application/vnd.oci.image.config.v1+json": true,
+	manifest.DockerV2Schema2ConfigMediaType:    true,
+}
+
+// checkRunnable rejects an image stored in dir that is an OCI artifact, such
+// as a Helm chart or an SBOM, rather than a container image.
+func checkRunnable(image imageref.Ref, dir string) error {
+	blob, err := os.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		return fmt.Errorf("read manifest: %w", err)
+	}
+	m, err := manifest.FromBlob(blob, manifest.GuessMIMEType(blob))
+	if err != nil {
+		return fmt.Errorf("parse manifest: %w", err)
+	}
+	if mediaType := m.ConfigInfo().MediaType; !runnableConfigTypes[mediaType] {
+		return status.Errorf(
+			codes.FailedPrecondition,
+			"%s is an artifact of type %s, not a container image",
+			image, mediaType,
+		)
+	}
+	return nil
+}
+
+// verifyImage checks that the image stored in dir is intact: its manifest
+// parses, and every blob it references is present with the size the
+// manifest gives. With full set, the contents of every blob are checked
+// against their digests too, which reads the whole image.
+func verifyImage(dir string, full bool) error {
+	blob, err := os.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		return fmt.Errorf("read manifest: %w", err)
+	}
+	m, err := manifest.FromBlob(blob, manifest.GuessMIMEType(blob))
+	if err != nil {
+		return fmt.Errorf("parse manifest: %w", err)
+	}
+	blobs := []types.BlobInfo{m.ConfigInfo()}
+	for _, layer := range m.LayerInfos() {
+		blobs = append(blobs, layer.BlobInfo)
+	}
+	for _, info := range blobs {
+		if info.Digest == "" {
+			continue
+		}
+		if err := info.Digest.Validate(); err != nil {
+			return fmt.Errorf("blob %s: %w", info.Digest, err)
+		}
+		path := filepath.Join(dir, info.Digest.Encoded())
+		if !full {
+			st, err := os.Stat(path)
+			if err != nil {
+				return fmt.Errorf("blob %s: %w", info.Digest, err)
+			}
+			if info.Size >= 0 && st.Size() != info.Size {
+				return fmt.Errorf("blob %s: size is %d, want %d", info.Digest, st.Size(), info.Size)
+			}
+			continue
+		}
+		if err := verifyBlob(path, info); err != nil {
+			return fmt.Errorf("blob %s: %w", info.Digest, err)
+		}
+	}
+	return nil
+}
+
+func verifyBlob(path string, info types.BlobInfo) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	verifier := info.Digest.Verifier()
+	if _, err := io.Copy(verifier, f); err != nil {
+		return err
+	}
+	if !verifier.Verified() {
+		return errors.New("digest mismatch")
+	}
+	return nil
+}
+
+// quarantine moves a corrupt image out of the store, so that it no longer
+// fails operations on other images and a new pull starts from scratch.
+func (i *ImageService) quarantine(dir string, reason error) error {
+	rel, err := filepath.Rel(i.opts.Root, dir)
+	if err != nil {
+		return err
+	}
+	dest := filepath.Join(
+		i.opts.Root, corruptDir,
+		time.Now().UTC().Format("20060102T150405Z")+"-"+strings.ReplaceAll(rel, string(filepath.Separator), "_"),
+	)
+	if err := os.MkdirAll(filepath.Dir(dest), 0o700); err != nil {
+		return err
+	}
+	if err := os.Rename(dir, dest); err != nil {
+		return err
+	}
+	// The store is recovered before the index is opened, which then
+	// notices the image is gone.
+	if i.index != nil {
+		if err := i.index.remove(dir); err != nil {
+			log.Printf("failed to remove quarantined image %s from the index: %v", rel, err)
+		}
+	}
+	i.quarantined.Add(1)
+	log.Printf("quarantined corrupt image %s to %s: %v", rel, dest, reason)
+	return nil
+}
+
+// recoverStore finishes the removals of images that were interrupted,
+// verifies every image in the store and quarantines the corrupt ones, such
+// as those left truncated by a power loss during a pull. Only the presence
+// and size of blobs are checked, unless full is set, which reads the whole
+// store to check their digests.
+func (i *ImageService) recoverStore(full bool) error {
+	if err := i.finishRemovals(); err != nil {
+		return err
+	}
+	var corrupt []string
+	err := filepath.WalkDir(i.opts.Root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && isStoreDir(d.Name()) {
+			return fs.SkipDir
+		}
+		if d.IsDir() || d.Name() != versionFile {
+			return nil
+		}
+		dir := filepath.Dir(path)
+		if err := verifyImage(dir, full); err != nil {
+			corrupt = append(corrupt, dir)
+			i.health.RecordError(fmt.Errorf("image %s: %w", dir, err))
+			if qerr := i.quarantine(dir, err); qerr != nil {
+				return qerr
+			}
+		}
+		return fs.SkipDir
+	})
+	if len(corrupt) > 0 {
+		log.Printf("quarantined %d corrupt images", len(corrupt))
+	}
+	return err
+}
+
+// deleteImageDir removes the image stored in dir. The image is first moved
+// out of the store in one rename, so that it is either still whole or gone
+// from it, never partly deleted. What is left of it if the runtime stops
+// before it is deleted is removed by finishRemovals.
+func (i *ImageService) deleteImageDir(dir string) error {
+	deleting := filepath.Join(i.opts.Root, deletingDir)
+	if err := os.MkdirAll(deleting, 0o700); err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(i.opts.Root, dir)
+	if err != nil {
+		return err
+	}
+	// Every removal moves the image into a directory of its own, so
+	// that removals of the same image don't collide.
+	tmp, err := os.MkdirTemp(deleting, strings.ReplaceAll(rel, string(filepath.Separator), "_")+"-")
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(dir, filepath.Join(tmp, "image")); err != nil {
+		os.Remove(tmp)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	return os.RemoveAll(tmp)
+}
+
+// finishRemovals deletes the images whose removal was interrupted after they
+// were moved out of the store, and the pulls that were interrupted.
+func (i *ImageService) finishRemovals() error {
+	for _, dir := range []struct{ name, what string }{
+		{deletingDir, "images whose removal was interrupted"},
+		{pullingDir, "interrupted pulls"},
+	} {
+		path := filepath.Join(i.opts.Root, dir.name)
+		entries, err := os.ReadDir(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := os.RemoveAll(filepath.Join(path, entry.Name())); err != nil {
+				return err
+			}
+		}
+		if len(entries) > 0 {
+			log.Printf("finished removing %d %s", len(entries), dir.what)
+		}
+	}
+	return nil
+}
+
+// stagePull creates the directory an image stored in dir is pulled to,
+// outside of the store, so that a pull that fails leaves the image that
+// is stored in dir alone.
+func (i *ImageService) stagePull(dir string) (string, error) {
+	pulling := filepath.Join(i.opts.Root, pullingDir)
+	if err := os.MkdirAll(pulling, 0o700); err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(i.opts.Root, dir)
+	if err != nil {
+		return "", err
+	}
+	return os.MkdirTemp(pulling, strings.ReplaceAll(rel, string(filepath.Separator), "_")+"-")
+}
+
+// swapImage moves the image in staged to dir. An image already stored in
+// dir is exchanged with it in one rename, and so left in staged, so that
+// dir holds either image whole at any time. It returns a function that
+// undoes the move.
+func swapImage(staged, dir string) (undo func() error, err error) {
+	if err := os.MkdirAll(filepath.Dir(dir), 0o700); err != nil {
+		return nil, err
+	}
+	err = unix.Renameat2(unix.AT_FDCWD, staged, unix.AT_FDCWD, dir, unix.RENAME_EXCHANGE)
+	if err == nil {
+		return func() error {
+			return unix.Renameat2(unix.AT_FDCWD, staged, unix.AT_FDCWD, dir, unix.RENAME_EXCHANGE)
+		}, nil
+	}
+	if !errors.Is(err, unix.ENOENT) {
+		return nil, fmt.Errorf("replace image %s: %w", dir, err)
+	}
+	if err := os.Rename(staged, dir); err != nil {
+		return nil, err
+	}
+	return func() error { return os.Rename(dir, staged) }, nil
+}
+
+// markRunning marks the image store as in use, and reports whether it
+// already was, which means the runtime that used it last didn't shut down
+// cleanly.
+func (i *ImageService) markRunning() (unclean bool, err error) {
+	path := filepath.Join(i.opts.Root, runningFile)
+	if _, err := os.Stat(path); err == nil {
+		unclean = true
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+	return unclean, os.WriteFile(path, nil, 0o600)
+}
+
+// Close marks the image store as no longer in use, so that the next
+// startup trusts the blobs in it without reading them.
+func (i *ImageService) Close() error {
+	err := os.Remove(filepath.Join(i.opts.Root, runningFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// QuarantinedImages returns how many corrupt images were moved out of the
+// store since startup.
+func (i *ImageService) QuarantinedImages() int64 {
+	return i.quarantined.Load()
+}
@@ -0,0 +1,94 @@
+package machineman
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsStoreDir(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{corruptDir, true},
+		{deletingDir, true},
+		{pullingDir, true},
+		{layersDir, true},
+		{layersDir + "-1234", true},
+		{"docker.io", false},
+		{"tags", false},
+		{"latest", false},
+	}
+	for _, tt := range tests {
+		if got := isStoreDir(tt.name); got != tt.want {
+			t.Errorf("isStoreDir(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDeleteImageDir(t *testing.T) {
+	root := t.TempDir()
+	i := &ImageService{opts: ImageOptions{Root: root}}
+	dir := writeImage(t, root, "", "alpine", 1, 10)
+	if err := i.deleteImageDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("image still stored after deleteImageDir(): %v", err)
+	}
+	entries, err := os.ReadDir(filepath.Join(root, deletingDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("%s holds %d entries after the removal finished", deletingDir, len(entries))
+	}
+	// Removing an image that is already gone is not an error.
+	if err := i.deleteImageDir(dir); err != nil {
+		t.Errorf("deleteImageDir() of a removed image = %v", err)
+	}
+}
+
+func TestFinishRemovals(t *testing.T) {
+	root := t.TempDir()
+	i := &ImageService{opts: ImageOptions{Root: root}}
+	kept := writeImage(t, root, "", "nginx", 1, 10)
+	// A removal interrupted after the image was moved out of the store,
+	// and a pull interrupted before its image was moved in.
+	removing := filepath.Join(root, deletingDir, "docker.io_library_alpine-1", "image")
+	writeImage(t, root, removing, "alpine", 2, 10)
+	pulling := filepath.Join(root, pullingDir, "docker.io_library_busybox-1")
+	writeImage(t, root, pulling, "busybox", 3, 10)
+
+	dirs, err := storedImages(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dirs) != 1 || dirs[0] != kept {
+		t.Errorf("storedImages() = %q, want only %s", dirs, kept)
+	}
+
+	if err := i.finishRemovals(); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{deletingDir, pullingDir} {
+		entries, err := os.ReadDir(filepath.Join(root, dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 0 {
+			t.Errorf("%s holds %d entries after finishRemovals()", dir, len(entries))
+		}
+	}
+	if _, err := os.Stat(filepath.Join(kept, "manifest.json")); err != nil {
+		t.Errorf("finishRemovals() touched a stored image: %v", err)
+	}
+}
+
+func TestFinishRemovalsOfNewStore(t *testing.T) {
+	i := &ImageService{opts: ImageOptions{Root: t.TempDir()}}
+	if err := i.finishRemovals(); err != nil {
+		t.Errorf("finishRemovals() of an empty store = %v", err)
+	}
+}
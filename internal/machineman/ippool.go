@@ -0,0 +1,45 @@
+package machineman
+
+import (
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ipPoolAnnotation is a sandbox annotation that names the IP pool the pod's
+// address is allocated from, e.g. a pool per zone or per tenant. Sandboxes
+// without it get the default pool.
+const ipPoolAnnotation = "systemd-cri.io/ip-pool"
+
+// ipPool returns the IP pool a sandbox's address is allocated from, given
+// its annotations. The first of RuntimeOptions.IPPools is the default one.
+// Pools that aren't configured are rejected rather than left to the network
+// plugin, which would put the pod in the wrong subnet.
+func (r *RuntimeService) ipPool(annotations map[string]string) (string, error) {
+	var pools []string
+	if p := r.ipPools.Load(); p != nil {
+		pools = *p
+	}
+	pool, ok := annotations[ipPoolAnnotation]
+	if !ok {
+		if len(pools) == 0 {
+			return "", nil
+		}
+		return pools[0], nil
+	}
+	for _, known := range pools {
+		if pool == known {
+			return pool, nil
+		}
+	}
+	return "", status.Errorf(
+		codes.InvalidArgument,
+		"annotation %s: unknown IP pool %q, want one of %q",
+		ipPoolAnnotation, pool, pools,
+	)
+}
+
+// SetIPPools replaces the IP pools of the sandboxes created from then on.
+// Sandboxes keep the address they got from a pool that is gone.
+func (r *RuntimeService) SetIPPools(pools []string) {
+	r.ipPools.Store(&pools)
+}
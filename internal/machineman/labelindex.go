@@ -0,0 +1,61 @@
+package machineman
+
+// labelIndex maps label key and value pairs to the IDs of the records that
+// carry them, so that label selector queries only look at matching records.
+type labelIndex map[string]map[string]map[string]struct{}
+
+func (idx labelIndex) add(id string, labels map[string]string) {
+	for k, v := range labels {
+		values, ok := idx[k]
+		if !ok {
+			values = map[string]map[string]struct{}{}
+			idx[k] = values
+		}
+		ids, ok := values[v]
+		if !ok {
+			ids = map[string]struct{}{}
+			values[v] = ids
+		}
+		ids[id] = struct{}{}
+	}
+}
+
+func (idx labelIndex) remove(id string, labels map[string]string) {
+	for k, v := range labels {
+		ids := idx[k][v]
+		delete(ids, id)
+		if len(ids) == 0 {
+			delete(idx[k], v)
+		}
+		if len(idx[k]) == 0 {
+			delete(idx, k)
+		}
+	}
+}
+
+// match returns the IDs of the records that carry every label in selector,
+// which must not be empty. It walks the smallest set of candidates and checks
+// them against the rest of the selector.
+func (idx labelIndex) match(selector map[string]string) []string {
+	var smallest map[string]struct{}
+	for k, v := range selector {
+		ids := idx[k][v]
+		if len(ids) == 0 {
+			return nil
+		}
+		if smallest == nil || len(ids) < len(smallest) {
+			smallest = ids
+		}
+	}
+	var matches []string
+candidates:
+	for id := range smallest {
+		for k, v := range selector {
+			if _, ok := idx[k][v][id]; !ok {
+				continue candidates
+			}
+		}
+		matches = append(matches, id)
+	}
+	return matches
+}
@@ -0,0 +1,114 @@
+package machineman
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestLabelIndexMatch(t *testing.T) {
+	records := map[string]map[string]string{
+		"a": {"app": "web", "tier": "front"},
+		"b": {"app": "web", "tier": "back"},
+		"c": {"app": "db", "tier": "back"},
+		"d": nil,
+	}
+	tests := []struct {
+		name     string
+		selector map[string]string
+		removed  []string
+		want     []string
+	}{
+		{"single label", map[string]string{"app": "web"}, nil, []string{"a", "b"}},
+		{"every label must match", map[string]string{"app": "web", "tier": "back"}, nil, []string{"b"}},
+		{"unknown value", map[string]string{"app": "cache"}, nil, nil},
+		{"unknown key", map[string]string{"zone": "a"}, nil, nil},
+		{"one label unknown", map[string]string{"app": "web", "zone": "a"}, nil, nil},
+		{"removed records", map[string]string{"tier": "back"}, []string{"b"}, []string{"c"}},
+		{"all removed", map[string]string{"app": "db"}, []string{"c"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idx := labelIndex{}
+			for id, labels := range records {
+				idx.add(id, labels)
+			}
+			for _, id := range tt.removed {
+				idx.remove(id, records[id])
+			}
+			got := idx.match(tt.selector)
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("match(%v) = %q, want %q", tt.selector, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLabelIndexRemoveDropsEmptySets(t *testing.T) {
+	idx := labelIndex{}
+	labels := map[string]string{"app": "web"}
+	idx.add("a", labels)
+	idx.remove("a", labels)
+	if len(idx) != 0 {
+		t.Errorf("index still holds %v after its only record was removed", idx)
+	}
+}
+
+func TestContainerStoreList(t *testing.T) {
+	var s containerStore
+	s.add(&containerRecord{ID: "a", Labels: map[string]string{"app": "web"}})
+	s.add(&containerRecord{ID: "b", Labels: map[string]string{"app": "db"}})
+	s.remove("b")
+	tests := []struct {
+		name     string
+		selector map[string]string
+		want     []string
+	}{
+		{"no selector lists all", nil, []string{"a"}},
+		{"matching selector", map[string]string{"app": "web"}, []string{"a"}},
+		{"removed container", map[string]string{"app": "db"}, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []string{}
+			for _, c := range s.list(tt.selector) {
+				got = append(got, c.ID)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("list(%v) = %q, want %q", tt.selector, got, tt.want)
+			}
+		})
+	}
+}
+
+// BenchmarkLabelIndexMatch looks up the containers of one pod among those
+// of many, the query kubelet makes most.
+func BenchmarkLabelIndexMatch(b *testing.B) {
+	for _, pods := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("pods=%d", pods), func(b *testing.B) {
+			idx := labelIndex{}
+			for pod := 0; pod < pods; pod++ {
+				for container := 0; container < 3; container++ {
+					idx.add(fmt.Sprintf("%d-%d", pod, container), map[string]string{
+						"io.kubernetes.pod.namespace":  "default",
+						"io.kubernetes.pod.name":       fmt.Sprintf("pod-%d", pod),
+						"io.kubernetes.container.name": fmt.Sprintf("container-%d", container),
+					})
+				}
+			}
+			selector := map[string]string{
+				"io.kubernetes.pod.namespace": "default",
+				"io.kubernetes.pod.name":      fmt.Sprintf("pod-%d", pods/2),
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if got := idx.match(selector); len(got) != 3 {
+					b.Fatalf("matched %d containers, want 3", len(got))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package machineman
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/ananthb/systemd-cri/internal/imageref"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/storage/pkg/archive"
+)
+
+// layersDir is where the layers of images are unpacked to, relative to the
+// image store, one directory per layer named after the hex of the digest
+// of its blob. Images that have a layer in common share its directory,
+// which lives on for as long as the overlay of a container stacks it, even
+// once no stored image has the layer anymore. Reference components can't
+// start with a dot, so no image is stored below a directory of that name.
+const layersDir = ".layers"
+
+// imageLayers returns the directories the layers of a pulled image are
+// unpacked to, top first, the order overlayfs stacks lower directories in.
+// Layers are unpacked the first time a container is made from an image
+// that has them. The caller holds the image's read lock, so the image can't
+// be replaced or removed meanwhile, and its layers aren't pruned.
+func (i *ImageService) imageLayers(image string) ([]string, error) {
+	ref, err := parseImage(image)
+	if err != nil {
+		return nil, err
+	}
+	dir := ref.StoragePath(i.opts.Root)
+	layers, err := manifestLayers(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read layers of %s: %w", ref, err)
+	}
+	i.layersMu.RLock()
+	defer i.layersMu.RUnlock()
+	dirs := make([]string, 0, len(layers))
+	for n := len(layers) - 1; n >= 0; n-- {
+		target, err := i.unpackLayer(dir, layers[n])
+		if err != nil {
+			return nil, fmt.Errorf("unpack %s: layer %s: %w", ref, layers[n].Digest, err)
+		}
+		dirs = append(dirs, target)
+	}
+	return dirs, nil
+}
+
+// manifestLayers returns the layers of the image stored in dir, bottom
+// first.
+func manifestLayers(dir string) ([]manifest.LayerInfo, error) {
+	blob, err := os.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		return nil, err
+	}
+	m, err := manifest.FromBlob(blob, manifest.GuessMIMEType(blob))
+	if err != nil {
+		return nil, err
+	}
+	return m.LayerInfos(), nil
+}
+
+// unpackLayer unpacks a layer of the image stored in dir, unless it
+// already is, and returns where to. It is unpacked next to its directory
+// and renamed into place, so that the directory never holds half a layer.
+// The caller holds the read lock of the layers.
+func (i *ImageService) unpackLayer(dir string, layer manifest.LayerInfo) (string, error) {
+	d := layer.Digest
+	if err := d.Validate(); err != nil {
+		return "", err
+	}
+	target := filepath.Join(i.opts.Root, layersDir, d.Encoded())
+	// Containers made from images with the layer at once share the read
+	// lock of the layers, the unpacking lock makes sure only one of them
+	// unpacks it.
+	unlock := i.locks.Lock(layersDir + "\x00" + d.String())
+	defer unlock()
+	if _, err := os.Stat(target); err == nil {
+		return target, nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0o700); err != nil {
+		return "", err
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(target), ".tmp-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+	if err := untarLayer(filepath.Join(dir, d.Encoded()), tmp); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(tmp, 0o755); err != nil {
+		return "", err
+	}
+	return target, os.Rename(tmp, target)
+}
+
+// untarLayer unpacks a layer blob, compressed or not, into dest. Its
+// whiteouts are turned into the character devices and opaque directory
+// attributes overlayfs reads them from.
+func untarLayer(path, dest string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return archive.Untar(f, dest, &archive.TarOptions{
+		WhiteoutFormat: archive.OverlayWhiteoutFormat,
+	})
+}
+
+// pruneLayers removes the unpacked layers that no stored image has and no
+// container's overlay stacks, along with unpacking that was interrupted.
+// A layer that only containers still use is removed by the pruning after
+// the last of them is removed.
+func (i *ImageService) pruneLayers() error {
+	i.layersMu.Lock()
+	defer i.layersMu.Unlock()
+	root := filepath.Join(i.opts.Root, layersDir)
+	entries, err := os.ReadDir(root)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	used := map[string]bool{}
+	for _, entry := range i.index.list() {
+		ref, err := imageref.Parse(entry.Ref)
+		if err != nil {
+			continue
+		}
+		layers, err := manifestLayers(ref.StoragePath(i.opts.Root))
+		if err != nil {
+			// Removed since it was listed.
+			continue
+		}
+		for _, layer := range layers {
+			used[layer.Digest.Encoded()] = true
+		}
+	}
+	stacked, err := i.rootfs.stackedLayers()
+	if err != nil {
+		return err
+	}
+	for _, dir := range stacked {
+		if filepath.Dir(dir) == root {
+			used[filepath.Base(dir)] = true
+		}
+	}
+	var pruned int
+	for _, entry := range entries {
+		if used[entry.Name()] {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(root, entry.Name())); err != nil {
+			return err
+		}
+		pruned++
+	}
+	if pruned > 0 {
+		log.Printf("pruned %d unused image layers", pruned)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package machineman
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ananthb/systemd-cri/internal/imageref"
+)
+
+// writeLayeredImage writes an image of one layer, with a file named file
+// holding content, to dir.
+func writeLayeredImage(t *testing.T, dir, content string) {
+	t.Helper()
+	var layer bytes.Buffer
+	tw := tar.NewWriter(&layer)
+	if err := tw.WriteHeader(&tar.Header{Name: "file", Mode: 0o644, Size: int64(len(content))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	layerSum := fmt.Sprintf("%x", sha256.Sum256(layer.Bytes()))
+	config := `{"architecture": "amd64", "os": "linux"}`
+	configSum := fmt.Sprintf("%x", sha256.Sum256([]byte(config)))
+	manifest := fmt.Sprintf(`{
+		"schemaVersion": 2,
+		"mediaType": "application/vnd.oci.image.manifest.v1+json",
+		"config": {"mediaType": "application/vnd.oci.image.config.v1+json", "digest": "sha256:%s", "size": %d},
+		"layers": [{"mediaType": "application/vnd.oci.image.layer.v1.tar", "digest": "sha256:%s", "size": %d}]
+	}`, configSum, len(config), layerSum, layer.Len())
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for file, data := range map[string]string{
+		"manifest.json": manifest,
+		configSum:       config,
+		layerSum:        layer.String(),
+		versionFile:     "Directory Transport Version: 1.1\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, file), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// pullAgain stores the image written by writeLayeredImage with content as
+// if it was pulled again to dir.
+func pullAgain(t *testing.T, i *ImageService, dir, content string) {
+	t.Helper()
+	staged, err := i.stagePull(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(staged)
+	writeLayeredImage(t, staged, content)
+	if err := i.storePulled(dir, staged); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLayersOutliveImagesWhileInUse(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("mounting the root filesystem needs root")
+	}
+	root := t.TempDir()
+	ref, err := imageref.Parse("app:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := ref.StoragePath(root)
+	writeLayeredImage(t, dir, "v1")
+	x, err := openImageIndex(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := &ImageService{
+		opts:   ImageOptions{Root: root},
+		index:  x,
+		rootfs: &rootfsStore{dir: t.TempDir()},
+	}
+	layers, err := i.imageLayers(ref.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := i.rootfs.prepare("c1", 0); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { i.rootfs.release("c1") })
+	if err := i.rootfs.mount("c1", layers); err != nil {
+		t.Fatal(err)
+	}
+	merged := filepath.Join(i.rootfs.dir, "c1", containerRootDir, "file")
+	readRootfs := func(when string) {
+		t.Helper()
+		data, err := os.ReadFile(merged)
+		if err != nil {
+			t.Fatalf("%s: %v", when, err)
+		}
+		if string(data) != "v1" {
+			t.Fatalf("%s: the container reads %q, want %q", when, data, "v1")
+		}
+	}
+
+	// The same image pulled again is left where it is.
+	before, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pullAgain(t, i, dir, "v1")
+	after, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(before, after) {
+		t.Error("pulling the same image again replaced the stored one")
+	}
+	readRootfs("after pulling the same image again")
+
+	// A new image under the tag, and then none, leave the layers of the
+	// container alone.
+	pullAgain(t, i, dir, "v2")
+	readRootfs("after pulling a new image under the tag")
+	if err := i.removeImage(ref); err != nil {
+		t.Fatal(err)
+	}
+	readRootfs("after removing the image")
+	for _, layer := range layers {
+		if _, err := os.Stat(layer); err != nil {
+			t.Errorf("layer in use: %v", err)
+		}
+	}
+
+	// Once the container is gone, so are its layers.
+	if err := i.rootfs.release("c1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.pruneLayers(); err != nil {
+		t.Fatal(err)
+	}
+	left, err := os.ReadDir(filepath.Join(root, layersDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 0 {
+		t.Errorf("%d layers left once no image or container has them", len(left))
+	}
+}
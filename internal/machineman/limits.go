@@ -0,0 +1,90 @@
+package machineman
+
+import (
+	"math"
+	"strconv"
+
+	"github.com/coreos/go-systemd/v22/dbus"
+	godbus "github.com/godbus/dbus/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// The range of cgroup v1 CPU shares, which CRI still passes, and of the
+// cgroup v2 CPU weight they are mapped to.
+const (
+	minCPUShares = 2
+	maxCPUShares = 262144
+	minCPUWeight = 1
+	maxCPUWeight = 10000
+)
+
+// pidsMaxFile is the unified resource that limits the number of tasks of a
+// container, which CRI has no field of its own for.
+const pidsMaxFile = "pids.max"
+
+// limitProperties translates the memory, CPU and task limits of a container
+// into MemoryMax, CPUQuotaPerSecUSec, CPUWeight and TasksMax. Limits that
+// aren't set are left out.
+func limitProperties(resources *runtimeapi.LinuxContainerResources) ([]dbus.Property, error) {
+	var props []dbus.Property
+	if memory := resources.GetMemoryLimitInBytes(); memory > 0 {
+		props = append(props, dbus.Property{
+			Name:  "MemoryMax",
+			Value: godbus.MakeVariant(uint64(memory)),
+		})
+	}
+	if quota := cpuQuotaPerSec(resources); quota > 0 {
+		props = append(props, dbus.Property{
+			Name:  "CPUQuotaPerSecUSec",
+			Value: godbus.MakeVariant(uint64(quota)),
+		})
+	}
+	if shares := resources.GetCpuShares(); shares > 0 {
+		props = append(props, dbus.Property{
+			Name:  "CPUWeight",
+			Value: godbus.MakeVariant(cpuWeight(shares)),
+		})
+	}
+	if value, ok := resources.GetUnified()[pidsMaxFile]; ok {
+		max, err := parsePidsMax(value)
+		if err != nil {
+			return nil, err
+		}
+		props = append(props, dbus.Property{
+			Name:  "TasksMax",
+			Value: godbus.MakeVariant(max),
+		})
+	}
+	return props, nil
+}
+
+// cpuWeight maps CPU shares to a CPU weight the way runc and kubelet do,
+// linearly from [2, 262144] to [1, 10000], so that the default of 1024
+// shares becomes a weight of 39.
+func cpuWeight(shares int64) uint64 {
+	if shares < minCPUShares {
+		shares = minCPUShares
+	}
+	if shares > maxCPUShares {
+		shares = maxCPUShares
+	}
+	return uint64(minCPUWeight + (shares-minCPUShares)*(maxCPUWeight-minCPUWeight)/(maxCPUShares-minCPUShares))
+}
+
+// parsePidsMax parses the value of pids.max, a number of tasks or "max".
+func parsePidsMax(value string) (uint64, error) {
+	if value == "max" {
+		return math.MaxUint64, nil
+	}
+	max, err := strconv.ParseUint(value, 10, 64)
+	if err != nil || max == 0 {
+		return 0, status.Errorf(
+			codes.InvalidArgument,
+			"unified resource %s: %q is not a positive number of tasks or max",
+			pidsMaxFile, value,
+		)
+	}
+	return max, nil
+}
@@ -0,0 +1,102 @@
+package machineman
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+func TestLimitProperties(t *testing.T) {
+	tests := []struct {
+		name      string
+		resources *runtimeapi.LinuxContainerResources
+		want      map[string]interface{}
+		wantCode  codes.Code
+	}{
+		{name: "no resources", want: map[string]interface{}{}},
+		{name: "no limits", resources: &runtimeapi.LinuxContainerResources{}, want: map[string]interface{}{}},
+		{
+			name: "all limits",
+			resources: &runtimeapi.LinuxContainerResources{
+				MemoryLimitInBytes: 256 << 20,
+				CpuQuota:           50000,
+				CpuPeriod:          100000,
+				CpuShares:          1024,
+				Unified:            map[string]string{pidsMaxFile: "512"},
+			},
+			want: map[string]interface{}{
+				"MemoryMax":          uint64(268435456),
+				"CPUQuotaPerSecUSec": uint64(500000),
+				"CPUWeight":          uint64(39),
+				"TasksMax":           uint64(512),
+			},
+		},
+		{
+			name:      "quota without a period",
+			resources: &runtimeapi.LinuxContainerResources{CpuQuota: 50000},
+			want:      map[string]interface{}{},
+		},
+		{
+			name:      "unlimited tasks",
+			resources: &runtimeapi.LinuxContainerResources{Unified: map[string]string{pidsMaxFile: "max"}},
+			want:      map[string]interface{}{"TasksMax": uint64(math.MaxUint64)},
+		},
+		{
+			name:      "no tasks",
+			resources: &runtimeapi.LinuxContainerResources{Unified: map[string]string{pidsMaxFile: "0"}},
+			wantCode:  codes.InvalidArgument,
+		},
+		{
+			name:      "tasks not a number",
+			resources: &runtimeapi.LinuxContainerResources{Unified: map[string]string{pidsMaxFile: "lots"}},
+			wantCode:  codes.InvalidArgument,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			props, err := limitProperties(tt.resources)
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("limitProperties() error = %v, want code %v", err, tt.wantCode)
+			}
+			if err != nil {
+				return
+			}
+			if got := propertyValues(t, props); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("limitProperties() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCPUWeight(t *testing.T) {
+	tests := []struct {
+		shares int64
+		want   uint64
+	}{
+		{0, 1},
+		{2, 1},
+		{1024, 39},
+		{262144, 10000},
+		{1 << 30, 10000},
+	}
+	for _, tt := range tests {
+		if got := cpuWeight(tt.shares); got != tt.want {
+			t.Errorf("cpuWeight(%d) = %d, want %d", tt.shares, got, tt.want)
+		}
+	}
+}
+
+func TestResourcePropertiesAllOrNothing(t *testing.T) {
+	// A valid memory limit isn't applied along with an invalid task limit.
+	props, err := resourceProperties(&runtimeapi.LinuxContainerResources{
+		MemoryLimitInBytes: 256 << 20,
+		Unified:            map[string]string{pidsMaxFile: "-1"},
+	}, nil)
+	if status.Code(err) != codes.InvalidArgument || props != nil {
+		t.Errorf("resourceProperties() = %v, %v, want no properties and InvalidArgument", props, err)
+	}
+}
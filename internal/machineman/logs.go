@@ -0,0 +1,66 @@
+package machineman
+
+import (
+	"context"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/ananthb/systemd-cri/internal/crilog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// containerLogPath resolves a container's log path, which kubelet gives
+// relative to the sandbox's log directory. Kubelet rotates the files in that
+// directory, so the path must not point outside of it.
+func containerLogPath(logDirectory, logPath string) (string, error) {
+	if logPath == "" {
+		return "", nil
+	}
+	if logDirectory == "" {
+		return "", status.Error(
+			codes.InvalidArgument,
+			"log path set for a sandbox without a log directory",
+		)
+	}
+	rel := filepath.Clean(logPath)
+	if filepath.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", status.Errorf(
+			codes.InvalidArgument,
+			"log path %q is not within the sandbox log directory",
+			logPath,
+		)
+	}
+	return filepath.Join(logDirectory, rel), nil
+}
+
+// reopenLog switches a running container's log to a new file at its log
+// path, after kubelet renamed the old file to rotate it.
+func (r *RuntimeService) reopenLog(ctx context.Context, c *containerRecord) error {
+	if c.Log == nil {
+		return status.Errorf(codes.FailedPrecondition, "container %s has no log file", c.ID)
+	}
+	times, err := r.containerTimes(ctx, c)
+	if err != nil {
+		return err
+	}
+	// No new file must be created once we return an error, so check
+	// first.
+	if times.StartedAt == 0 || times.FinishedAt != 0 {
+		return status.Errorf(codes.FailedPrecondition, "container %s is not running", c.ID)
+	}
+	if err := c.Log.Reopen(); err != nil {
+		return err
+	}
+	if r.opts.CompressRotatedLogs {
+		// Kubelet doesn't wait for the compression, but closing the
+		// runtime does, so that shutting down doesn't cut it short.
+		r.goBackground(func(context.Context) {
+			if err := crilog.CompressRotated(c.LogPath); err != nil {
+				log.Printf("failed to compress rotated logs of container %s: %v", c.ID, err)
+			}
+		})
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package machineman
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ananthb/systemd-cri/internal/crilog"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestContainerLogPath(t *testing.T) {
+	tests := []struct {
+		name     string
+		dir      string
+		path     string
+		want     string
+		wantCode codes.Code
+	}{
+		{name: "no log", dir: "/var/log/pods/a", path: ""},
+		{name: "relative", dir: "/var/log/pods/a", path: "app/0.log", want: "/var/log/pods/a/app/0.log"},
+		{name: "cleaned", dir: "/var/log/pods/a", path: "app/./x/../0.log", want: "/var/log/pods/a/app/0.log"},
+		{name: "dots in a name", dir: "/var/log/pods/a", path: "..app/0.log", want: "/var/log/pods/a/..app/0.log"},
+		{name: "no log directory", path: "app/0.log", wantCode: codes.InvalidArgument},
+		{name: "absolute", dir: "/var/log/pods/a", path: "/etc/passwd", wantCode: codes.InvalidArgument},
+		{name: "parent", dir: "/var/log/pods/a", path: "..", wantCode: codes.InvalidArgument},
+		{name: "escapes", dir: "/var/log/pods/a", path: "../b/0.log", wantCode: codes.InvalidArgument},
+		{name: "escapes after cleaning", dir: "/var/log/pods/a", path: "app/../../b/0.log", wantCode: codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := containerLogPath(tt.dir, tt.path)
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("containerLogPath(%q, %q) error = %v, want code %v", tt.dir, tt.path, err, tt.wantCode)
+			}
+			if got != tt.want {
+				t.Errorf("containerLogPath(%q, %q) = %q, want %q", tt.dir, tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReopenLogCompressesBeforeClose(t *testing.T) {
+	fake := newFakeSystemd()
+	r, sb := podRuntime(t, fake)
+	r.opts.CompressRotatedLogs = true
+	r.backgroundCtx, r.stopBackground = context.WithCancel(context.Background())
+	logPath := filepath.Join(t.TempDir(), "app.log")
+	logFile, err := crilog.OpenFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logFile.Close()
+	c := &containerRecord{
+		ID:        "c1",
+		SandboxID: sb.ID,
+		Metadata:  &runtimeapi.ContainerMetadata{Name: "app"},
+		LogPath:   logPath,
+		Log:       logFile,
+	}
+	r.containers.add(c)
+	fake.setUnit(containerUnit(c.ID), map[string]interface{}{
+		"ExecMainStartTimestampMonotonic": uint64(1),
+	})
+	// Kubelet rotates the log by renaming it, then asks for it to be
+	// reopened.
+	rotated := logPath + ".20240101-000000"
+	if err := os.Rename(logPath, rotated); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.ReopenContainerLog(context.Background(), &runtimeapi.ReopenContainerLogRequest{
+		ContainerId: c.ID,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// Once the runtime is closed, the compression is done.
+	r.Close()
+	if _, err := os.Stat(rotated + ".gz"); err != nil {
+		t.Errorf("rotated segment isn't compressed: %v", err)
+	}
+	if _, err := os.Stat(rotated); err == nil {
+		t.Errorf("rotated segment is left next to its compressed copy")
+	}
+}
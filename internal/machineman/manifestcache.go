@@ -0,0 +1,56 @@
+package machineman
+
+import (
+	"sync"
+	"time"
+)
+
+// manifestCache remembers the digest of the image a tag resolved to when it
+// was pulled, along with the digest the registry reported for the tag then.
+// Pulling the same tag again soon after, as happens with every container of
+// a rollout, still asks the registry what the tag is now, with a HEAD
+// request. If it hasn't moved, the image is pulled by digest, which for
+// multi-arch images skips fetching the manifest list again.
+type manifestCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]manifestEntry
+}
+
+type manifestEntry struct {
+	// tag is the digest the registry reported for the tag, that of the
+	// manifest list for multi-arch images.
+	tag string
+	// digest is the digest of the manifest that was pulled.
+	digest  string
+	expires time.Time
+}
+
+// get returns the digest ref was pulled at, if the tag was at tagDigest
+// then too.
+func (c *manifestCache) get(ref, tagDigest string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[ref]
+	if !ok {
+		return "", false
+	}
+	if time.Now().After(e.expires) || e.tag != tagDigest {
+		delete(c.entries, ref)
+		return "", false
+	}
+	return e.digest, true
+}
+
+func (c *manifestCache) put(ref, tagDigest, digest string) {
+	if c.ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = map[string]manifestEntry{}
+	}
+	c.entries[ref] = manifestEntry{tag: tagDigest, digest: digest, expires: time.Now().Add(c.ttl)}
+}
@@ -0,0 +1,35 @@
+package machineman
+
+import (
+	"testing"
+	"time"
+)
+
+func TestManifestCache(t *testing.T) {
+	const ref = "docker.io/library/alpine:latest"
+	c := manifestCache{ttl: time.Minute}
+	list, moved, image := testDigest(1), testDigest(2), testDigest(3)
+	c.put(ref, list, image)
+	if got, ok := c.get(ref, list); !ok || got != image {
+		t.Errorf("get() of an unchanged tag = %q, %v, want %q", got, ok, image)
+	}
+	// A tag that moved, as kubelet's Always policy must see, is pulled
+	// again.
+	if got, ok := c.get(ref, moved); ok {
+		t.Errorf("get() of a moved tag = %q, want it pulled again", got)
+	}
+	if _, ok := c.get(ref, list); ok {
+		t.Error("get() after the tag moved still has the old digest")
+	}
+
+	c.entries[ref] = manifestEntry{tag: list, digest: image, expires: time.Now().Add(-time.Second)}
+	if _, ok := c.get(ref, list); ok {
+		t.Error("get() of an expired entry succeeded")
+	}
+
+	off := manifestCache{}
+	off.put(ref, list, image)
+	if _, ok := off.get(ref, list); ok {
+		t.Error("get() without a TTL succeeded")
+	}
+}
@@ -0,0 +1,82 @@
+package machineman
+
+import (
+	"math"
+	"strconv"
+
+	"github.com/coreos/go-systemd/v22/dbus"
+	godbus "github.com/godbus/dbus/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+const (
+	// memoryHighAnnotation is a container annotation that sets the
+	// container's memory.high, in bytes or "max", for when kubelet doesn't
+	// set it with MemoryQoS.
+	memoryHighAnnotation = "systemd-cri.io/memory-high"
+	// memoryLowAnnotation is a container annotation that sets the
+	// container's memory.low, in bytes or "max".
+	memoryLowAnnotation = "systemd-cri.io/memory-low"
+)
+
+// memoryQoSLimits maps the soft memory limits of cgroup v2 to the unit
+// properties that set them, and the annotations that set them when the
+// unified resources don't.
+var memoryQoSLimits = []struct {
+	file       string
+	property   string
+	annotation string
+}{
+	{"memory.high", "MemoryHigh", memoryHighAnnotation},
+	{"memory.low", "MemoryLow", memoryLowAnnotation},
+	{"memory.min", "MemoryMin", ""},
+}
+
+// memoryQoSProperties translates a container's soft memory limits into
+// MemoryHigh, MemoryLow and MemoryMin. Processes of a container above
+// memory.high are throttled and reclaimed from before they reach the hard
+// limit and get killed, and memory below memory.low and memory.min is
+// protected from reclaim. kubelet sets memory.high and memory.min in the
+// unified resources with the MemoryQoS feature; the annotations only apply
+// without them. Limits set by neither are left unset.
+func memoryQoSProperties(
+	resources *runtimeapi.LinuxContainerResources,
+	annotations map[string]string,
+) ([]dbus.Property, error) {
+	var props []dbus.Property
+	for _, limit := range memoryQoSLimits {
+		value, ok := resources.GetUnified()[limit.file]
+		source := limit.file
+		if !ok && limit.annotation != "" {
+			value, ok = annotations[limit.annotation]
+			source = "annotation " + limit.annotation
+		}
+		if !ok {
+			continue
+		}
+		bytes, err := parseMemoryLimit(value)
+		if err != nil {
+			return nil, status.Errorf(
+				codes.InvalidArgument,
+				"%s: %q is not a number of bytes or max",
+				source, value,
+			)
+		}
+		props = append(props, dbus.Property{
+			Name:  limit.property,
+			Value: godbus.MakeVariant(bytes),
+		})
+	}
+	return props, nil
+}
+
+// parseMemoryLimit parses a memory limit in the form of cgroup interface
+// files, where "max" is no limit.
+func parseMemoryLimit(s string) (uint64, error) {
+	if s == "max" {
+		return math.MaxUint64, nil
+	}
+	return strconv.ParseUint(s, 10, 64)
+}
@@ -0,0 +1,60 @@
+package machineman
+
+import (
+	"time"
+
+	"github.com/ananthb/systemd-cri/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	sandboxCreateDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "runtime",
+		Name:      "sandbox_create_duration_seconds",
+		Help:      "Latency of RunPodSandbox calls.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 14),
+	}, []string{"handler", "result"})
+	containerCreateDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "runtime",
+		Name:      "container_create_duration_seconds",
+		Help:      "Latency of CreateContainer calls.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 14),
+	}, []string{"handler", "result"})
+	createFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "runtime",
+		Name:      "create_failures_total",
+		Help:      "Number of failed RunPodSandbox and CreateContainer calls, by the status code they failed with.",
+	}, []string{"operation", "handler", "reason"})
+	createRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "runtime",
+		Name:      "create_retries_total",
+		Help:      "Number of RunPodSandbox and CreateContainer calls that repeated an earlier call, by whether it had created what they asked for or was still in progress.",
+	}, []string{"operation", "result"})
+)
+
+func init() {
+	metrics.MustRegister(sandboxCreateDuration, containerCreateDuration, createFailures, createRetries)
+}
+
+// observeCreate records the latency and outcome of a RunPodSandbox or
+// CreateContainer call for a runtime handler that began at start. The empty
+// handler is the default one.
+func observeCreate(
+	duration *prometheus.HistogramVec,
+	operation string,
+	handler string,
+	start time.Time,
+	err error,
+) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+		createFailures.WithLabelValues(operation, handler, status.Code(err).String()).Inc()
+	}
+	duration.WithLabelValues(handler, result).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,252 @@
+package machineman
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// mountOptionsAnnotation is a container annotation holding the mount
+// options of its mounts, which CRI has no field for, as a semicolon
+// separated list of a container path, "=" and comma separated options, like
+// "/data=nosuid,nodev,noexec;/cache=noatime". The options are nosuid, nodev,
+// noexec, relatime, noatime and strictatime, and suid, dev and exec to
+// lift the defaults of tmpfs and secret mounts.
+const mountOptionsAnnotation = "systemd-cri.io/mount-options"
+
+// mountOption is the mount flag an option sets, and the setting it is an
+// option for. A mount can only have one option for each setting.
+type mountOption struct {
+	flag    uintptr
+	setting string
+}
+
+var mountOptionFlags = map[string]mountOption{
+	"nosuid":      {unix.MS_NOSUID, "suid"},
+	"suid":        {0, "suid"},
+	"nodev":       {unix.MS_NODEV, "dev"},
+	"dev":         {0, "dev"},
+	"noexec":      {unix.MS_NOEXEC, "exec"},
+	"exec":        {0, "exec"},
+	"relatime":    {unix.MS_RELATIME, "atime"},
+	"noatime":     {unix.MS_NOATIME, "atime"},
+	"strictatime": {unix.MS_STRICTATIME, "atime"},
+}
+
+// statfsFlags maps the flags of a mount as statfs reports them to the
+// mount flags that set them, and the setting they are for.
+var statfsFlags = map[int64]mountOption{
+	unix.ST_NOSUID:   {unix.MS_NOSUID, "suid"},
+	unix.ST_NODEV:    {unix.MS_NODEV, "dev"},
+	unix.ST_NOEXEC:   {unix.MS_NOEXEC, "exec"},
+	unix.ST_RELATIME: {unix.MS_RELATIME, "atime"},
+	unix.ST_NOATIME:  {unix.MS_NOATIME, "atime"},
+}
+
+// mountOptions are the options of a mount by the setting they are for.
+type mountOptions map[string]string
+
+// parseMountOptions parses a comma separated list of mount options. It
+// fails on options it doesn't know and on options that conflict, rather
+// than let one of them win.
+func parseMountOptions(value string) (mountOptions, error) {
+	options := mountOptions{}
+	for _, option := range strings.Split(value, ",") {
+		option = strings.TrimSpace(option)
+		o, ok := mountOptionFlags[option]
+		if !ok {
+			return nil, fmt.Errorf("unknown mount option %q", option)
+		}
+		if other, ok := options[o.setting]; ok && other != option {
+			return nil, fmt.Errorf("mount options %s and %s conflict", other, option)
+		}
+		options[o.setting] = option
+	}
+	return options, nil
+}
+
+// flags returns the mount flags the options set.
+func (o mountOptions) flags() uintptr {
+	var flags uintptr
+	for _, option := range o {
+		flags |= mountOptionFlags[option].flag
+	}
+	return flags
+}
+
+func (o mountOptions) String() string {
+	options := make([]string, 0, len(o))
+	for _, option := range o {
+		options = append(options, option)
+	}
+	sort.Strings(options)
+	return strings.Join(options, ",")
+}
+
+// mountOptionsConfig reads the mount options of a container's mounts from
+// its annotations, by container path. It fails on options for a path that
+// isn't mounted.
+func mountOptionsConfig(annotations map[string]string, mounts []*runtimeapi.Mount) (map[string]mountOptions, error) {
+	value, ok := annotations[mountOptionsAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	mounted := map[string]bool{}
+	for _, mount := range mounts {
+		mounted[filepath.Clean(mount.GetContainerPath())] = true
+	}
+	config := map[string]mountOptions{}
+	for _, entry := range strings.Split(value, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		path, list, ok := strings.Cut(entry, "=")
+		path = filepath.Clean(strings.TrimSpace(path))
+		if !ok {
+			return nil, status.Errorf(
+				codes.InvalidArgument,
+				"annotation %s: %q is not path=options",
+				mountOptionsAnnotation, entry,
+			)
+		}
+		if !mounted[path] {
+			return nil, status.Errorf(
+				codes.InvalidArgument,
+				"annotation %s: nothing is mounted at %s",
+				mountOptionsAnnotation, path,
+			)
+		}
+		options, err := parseMountOptions(list)
+		if err != nil {
+			return nil, status.Errorf(
+				codes.InvalidArgument,
+				"annotation %s: %s: %v",
+				mountOptionsAnnotation, path, err,
+			)
+		}
+		config[path] = options
+	}
+	return config, nil
+}
+
+// defaultMountOptions returns the options a mount gets unless its
+// annotation says otherwise. Like Kubernetes, tmpfs and secret mounts are
+// nosuid and nodev.
+func defaultMountOptions(hostPath string) mountOptions {
+	var st unix.Statfs_t
+	secret := strings.Contains(hostPath, "/volumes/kubernetes.io~secret/")
+	if secret || unix.Statfs(hostPath, &st) == nil && st.Type == unix.TMPFS_MAGIC {
+		return mountOptions{"suid": "nosuid", "dev": "nodev"}
+	}
+	return nil
+}
+
+// stagedMountsDir holds the staged mounts of a container, relative to its
+// root filesystem directory.
+const stagedMountsDir = "mounts"
+
+// stageMounts applies the mount options of a container's mounts. Since
+// systemd-nspawn binds mounts without options, each mount with options is
+// bound below dir and remounted with them first, and the container binds
+// that instead, which keeps them. Flags of the host path's own mount, such
+// as nosuid on a tmpfs, are kept unless the options change them. It
+// returns the mounts for the container to bind, and unstages the mounts it
+// staged if it fails.
+func stageMounts(
+	dir string,
+	mounts []*runtimeapi.Mount,
+	config map[string]mountOptions,
+) ([]*runtimeapi.Mount, error) {
+	binds := make([]*runtimeapi.Mount, 0, len(mounts))
+	for i, mount := range mounts {
+		options := defaultMountOptions(mount.GetHostPath())
+		for setting, option := range config[filepath.Clean(mount.GetContainerPath())] {
+			if options == nil {
+				options = mountOptions{}
+			}
+			options[setting] = option
+		}
+		if len(options) == 0 {
+			binds = append(binds, mount)
+			continue
+		}
+		target := filepath.Join(dir, stagedMountsDir, strconv.Itoa(i))
+		if err := stageMount(mount, target, options); err != nil {
+			unstageMounts(dir)
+			return nil, fmt.Errorf("apply mount options %s to %s: %w", options, mount.GetContainerPath(), err)
+		}
+		bind := *mount
+		bind.HostPath = target
+		binds = append(binds, &bind)
+	}
+	return binds, nil
+}
+
+func stageMount(mount *runtimeapi.Mount, target string, options mountOptions) error {
+	info, err := os.Stat(mount.GetHostPath())
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0o700); err != nil {
+		return err
+	}
+	if info.IsDir() {
+		err = os.Mkdir(target, 0o700)
+	} else {
+		err = os.WriteFile(target, nil, 0o600)
+	}
+	if err != nil {
+		return err
+	}
+	if err := unix.Mount(mount.GetHostPath(), target, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+		return &os.PathError{Op: "bind", Path: mount.GetHostPath(), Err: err}
+	}
+	var st unix.Statfs_t
+	if err := unix.Statfs(target, &st); err != nil {
+		return err
+	}
+	flags := options.flags()
+	for stFlag, o := range statfsFlags {
+		if _, ok := options[o.setting]; !ok && st.Flags&stFlag != 0 {
+			flags |= o.flag
+		}
+	}
+	if mount.GetReadonly() || st.Flags&unix.ST_RDONLY != 0 {
+		flags |= unix.MS_RDONLY
+	}
+	if err := unix.Mount("", target, "", unix.MS_REMOUNT|unix.MS_BIND|flags, ""); err != nil {
+		return &os.PathError{Op: "remount", Path: target, Err: err}
+	}
+	return nil
+}
+
+// unstageMounts unmounts the staged mounts of a container, so that its root
+// filesystem directory can be removed without reaching into the host paths
+// they are bound from.
+func unstageMounts(dir string) error {
+	entries, err := os.ReadDir(filepath.Join(dir, stagedMountsDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		target := filepath.Join(dir, stagedMountsDir, entry.Name())
+		err := unix.Unmount(target, unix.MNT_DETACH)
+		// EINVAL is a target that isn't mounted.
+		if err != nil && err != unix.EINVAL && err != unix.ENOENT {
+			return &os.PathError{Op: "unmount", Path: target, Err: err}
+		}
+	}
+	return nil
+}
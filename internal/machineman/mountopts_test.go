@@ -0,0 +1,154 @@
+package machineman
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+func TestParseMountOptions(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    mountOptions
+		flags   uintptr
+		wantErr bool
+	}{
+		{
+			value: "nosuid,nodev,noexec",
+			want:  mountOptions{"suid": "nosuid", "dev": "nodev", "exec": "noexec"},
+			flags: unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC,
+		},
+		{
+			value: " noatime , exec ",
+			want:  mountOptions{"atime": "noatime", "exec": "exec"},
+			flags: unix.MS_NOATIME,
+		},
+		{
+			value: "nodev,nodev",
+			want:  mountOptions{"dev": "nodev"},
+			flags: unix.MS_NODEV,
+		},
+		{value: "noatime,strictatime", wantErr: true},
+		{value: "suid,nosuid", wantErr: true},
+		{value: "ro", wantErr: true},
+		{value: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseMountOptions(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseMountOptions() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseMountOptions() = %v, want %v", got, tt.want)
+			}
+			if flags := got.flags(); flags != tt.flags {
+				t.Errorf("flags() = %#x, want %#x", flags, tt.flags)
+			}
+		})
+	}
+}
+
+func TestMountOptionsString(t *testing.T) {
+	o := mountOptions{"suid": "nosuid", "atime": "noatime", "dev": "nodev"}
+	if got, want := o.String(), "noatime,nodev,nosuid"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestMountOptionsConfig(t *testing.T) {
+	mounts := []*runtimeapi.Mount{
+		{ContainerPath: "/data", HostPath: "/srv/data"},
+		{ContainerPath: "/cache/", HostPath: "/srv/cache"},
+	}
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        map[string]mountOptions
+		wantCode    codes.Code
+	}{
+		{name: "no annotation"},
+		{
+			name:        "options by path",
+			annotations: map[string]string{mountOptionsAnnotation: "/data=nosuid,nodev;/cache=noatime"},
+			want: map[string]mountOptions{
+				"/data":  {"suid": "nosuid", "dev": "nodev"},
+				"/cache": {"atime": "noatime"},
+			},
+		},
+		{
+			name:        "paths are cleaned and empty entries skipped",
+			annotations: map[string]string{mountOptionsAnnotation: " /data/ =noexec;;"},
+			want:        map[string]mountOptions{"/data": {"exec": "noexec"}},
+		},
+		{
+			name:        "not mounted",
+			annotations: map[string]string{mountOptionsAnnotation: "/logs=noexec"},
+			wantCode:    codes.InvalidArgument,
+		},
+		{
+			name:        "no options",
+			annotations: map[string]string{mountOptionsAnnotation: "/data"},
+			wantCode:    codes.InvalidArgument,
+		},
+		{
+			name:        "bad option",
+			annotations: map[string]string{mountOptionsAnnotation: "/data=nosuid,rw"},
+			wantCode:    codes.InvalidArgument,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := mountOptionsConfig(tt.annotations, mounts)
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("mountOptionsConfig() error = %v, want code %v", err, tt.wantCode)
+			}
+			if err == nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mountOptionsConfig() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDefaultMountOptions(t *testing.T) {
+	secret := "/var/lib/kubelet/pods/u1/volumes/kubernetes.io~secret/token"
+	if got, want := defaultMountOptions(secret), (mountOptions{"suid": "nosuid", "dev": "nodev"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("defaultMountOptions(%q) = %v, want %v", secret, got, want)
+	}
+	var st unix.Statfs_t
+	dir := t.TempDir()
+	if err := unix.Statfs(dir, &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Type != unix.TMPFS_MAGIC {
+		if got := defaultMountOptions(dir); got != nil {
+			t.Errorf("defaultMountOptions(%q) = %v, want none", dir, got)
+		}
+	}
+}
+
+func TestStageMountsWithoutOptions(t *testing.T) {
+	dir := t.TempDir()
+	mounts := []*runtimeapi.Mount{{ContainerPath: "/data", HostPath: t.TempDir()}}
+	if defaultMountOptions(mounts[0].HostPath) != nil {
+		t.Skip("temporary directories are on tmpfs, which has default options")
+	}
+	got, err := stageMounts(dir, mounts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Mounts without options are bound as they are, nothing is staged.
+	if !reflect.DeepEqual(got, mounts) {
+		t.Errorf("stageMounts() = %v, want %v", got, mounts)
+	}
+	if err := unstageMounts(dir); err != nil {
+		t.Errorf("unstageMounts() with nothing staged = %v", err)
+	}
+}
@@ -0,0 +1,51 @@
+package machineman
+
+import (
+	"path"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// validateMounts rejects mounts systemd-nspawn can't bind.
+func validateMounts(mounts []*runtimeapi.Mount) error {
+	for _, mount := range mounts {
+		if !path.IsAbs(mount.GetHostPath()) {
+			return status.Errorf(
+				codes.InvalidArgument,
+				"mount host path %q is not absolute",
+				mount.GetHostPath(),
+			)
+		}
+		if !path.IsAbs(mount.GetContainerPath()) {
+			return status.Errorf(
+				codes.InvalidArgument,
+				"mount container path %q is not absolute",
+				mount.GetContainerPath(),
+			)
+		}
+	}
+	return nil
+}
+
+// mountBinds returns the systemd-nspawn arguments that bind the host paths
+// of mounts into a container.
+func mountBinds(mounts []*runtimeapi.Mount) []string {
+	args := make([]string, 0, len(mounts))
+	for _, mount := range mounts {
+		flag := "--bind="
+		if mount.GetReadonly() {
+			flag = "--bind-ro="
+		}
+		args = append(args, flag+escapeBindPath(mount.GetHostPath())+":"+escapeBindPath(mount.GetContainerPath()))
+	}
+	return args
+}
+
+// escapeBindPath escapes the colons systemd-nspawn separates the paths of a
+// bind with.
+func escapeBindPath(p string) string {
+	return strings.ReplaceAll(p, ":", `\:`)
+}
@@ -0,0 +1,180 @@
+package machineman
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// minIPCNamespaceVersion is the first systemd version that can start a unit
+// in an IPC namespace made by something else, with IPCNamespacePath=.
+const minIPCNamespaceVersion = 248
+
+// validateSandboxNamespaces rejects the namespace options of a sandbox that
+// don't make sense together, or that a pod can't have. systemd-nspawn gives
+// every container a PID namespace of its own, so the containers of a pod
+// can't share one, nor use the host's.
+func validateSandboxNamespaces(opts *runtimeapi.NamespaceOption) error {
+	network, pid, ipc := opts.GetNetwork(), opts.GetPid(), opts.GetIpc()
+	if network != runtimeapi.NamespaceMode_POD && network != runtimeapi.NamespaceMode_NODE {
+		return namespaceError("pod sandbox network namespace mode %v is not supported, want POD or NODE", network)
+	}
+	if ipc != runtimeapi.NamespaceMode_POD && ipc != runtimeapi.NamespaceMode_NODE {
+		return namespaceError("pod sandbox IPC namespace mode %v is not supported, want POD or NODE", ipc)
+	}
+	if pid == runtimeapi.NamespaceMode_TARGET || opts.GetTargetId() != "" {
+		return namespaceError("pod sandbox PID namespace can't target a container, only containers can")
+	}
+	// A user namespace owns the namespaces created in it, so a pod in
+	// one can't share the host's, as Kubernetes also enforces.
+	if userns := opts.GetUsernsOptions(); userns != nil && userns.GetMode() == runtimeapi.NamespaceMode_POD {
+		for _, ns := range []struct {
+			name string
+			mode runtimeapi.NamespaceMode
+		}{{"network", network}, {"PID", pid}, {"IPC", ipc}} {
+			if ns.mode == runtimeapi.NamespaceMode_NODE {
+				return namespaceError(
+					"pod sandbox in a user namespace can't use the host %s namespace",
+					ns.name,
+				)
+			}
+		}
+	}
+	if pid != runtimeapi.NamespaceMode_CONTAINER {
+		return status.Errorf(
+			codes.Unimplemented,
+			"pod sandbox PID namespace mode %v is not supported: systemd-nspawn gives each container "+
+				"a PID namespace of its own, want CONTAINER",
+			pid,
+		)
+	}
+	return nil
+}
+
+// validateContainerNamespaces rejects the namespace options of a container
+// that conflict with those of its sandbox. Containers share the network and
+// IPC namespaces of their pod, and get a PID namespace of their own.
+func (r *RuntimeService) validateContainerNamespaces(
+	opts *runtimeapi.NamespaceOption,
+	sb *sandboxRecord,
+) error {
+	if opts == nil {
+		return nil
+	}
+	sandbox := sb.Namespaces
+	if opts.GetNetwork() != sandbox.GetNetwork() {
+		return namespaceError(
+			"container network namespace mode %v conflicts with the pod sandbox's %v",
+			opts.GetNetwork(), sandbox.GetNetwork(),
+		)
+	}
+	if opts.GetIpc() != sandbox.GetIpc() {
+		return namespaceError(
+			"container IPC namespace mode %v conflicts with the pod sandbox's %v",
+			opts.GetIpc(), sandbox.GetIpc(),
+		)
+	}
+	pid := opts.GetPid()
+	if pid != runtimeapi.NamespaceMode_TARGET && opts.GetTargetId() != "" {
+		return namespaceError("container PID namespace target %q requires TARGET mode", opts.GetTargetId())
+	}
+	switch pid {
+	case runtimeapi.NamespaceMode_CONTAINER:
+		return nil
+	case runtimeapi.NamespaceMode_TARGET:
+		target, err := r.containers.get(opts.GetTargetId())
+		if err != nil || target.SandboxID != sb.ID {
+			return namespaceError(
+				"container PID namespace target %q is not a container of pod sandbox %s",
+				opts.GetTargetId(), sb.ID,
+			)
+		}
+		return status.Errorf(
+			codes.Unimplemented,
+			"container can't join the PID namespace of container %s: systemd-nspawn gives each "+
+				"container a PID namespace of its own",
+			target.ID,
+		)
+	default:
+		return status.Errorf(
+			codes.Unimplemented,
+			"container PID namespace mode %v is not supported: systemd-nspawn gives each container "+
+				"a PID namespace of its own, want CONTAINER",
+			pid,
+		)
+	}
+}
+
+func namespaceError(format string, args ...interface{}) error {
+	return status.Errorf(codes.InvalidArgument, format, args...)
+}
+
+// newPodIPCNS makes the IPC namespace the containers of a sandbox share. It
+// is kept next to the sandbox's state, for its containers' units to join
+// with IPCNamespacePath=, until the sandbox is removed.
+func (r *RuntimeService) newPodIPCNS(sb *sandboxRecord) error {
+	if r.sandboxStates.dir == "" || !r.ipcNamespaces {
+		return status.Errorf(
+			codes.Unimplemented,
+			"pod sandbox %s needs an IPC namespace for its containers to share, which the runtime "+
+				"only makes with systemd %d or later and a sandbox state directory: run it with the host's",
+			sb.Metadata.GetName(), minIPCNamespaceVersion,
+		)
+	}
+	path := r.sandboxStates.ipcNSPath(sb.ID)
+	if err := os.MkdirAll(r.sandboxStates.dir, 0o700); err != nil {
+		return err
+	}
+	if err := newIPCNS(path); err != nil {
+		return fmt.Errorf("make IPC namespace of pod sandbox %s: %w", sb.ID, err)
+	}
+	sb.IPCNSPath = path
+	return nil
+}
+
+// newIPCNS makes an IPC namespace and mounts it at path, which keeps it
+// around while no process is in it.
+func newIPCNS(path string) error {
+	f, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE|os.O_EXCL, 0o444)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	errc := make(chan error, 1)
+	go func() {
+		// The thread is left in the new namespace, it is never
+		// unlocked and exits with the goroutine.
+		runtime.LockOSThread()
+		if err := unix.Unshare(unix.CLONE_NEWIPC); err != nil {
+			errc <- err
+			return
+		}
+		ns := fmt.Sprintf("/proc/self/task/%d/ns/ipc", unix.Gettid())
+		errc <- unix.Mount(ns, path, "", unix.MS_BIND, "")
+	}()
+	if err := <-errc; err != nil {
+		os.Remove(path)
+		return err
+	}
+	return nil
+}
+
+// removeIPCNS unmounts the IPC namespace at path, which lives on for as
+// long as processes are still in it, and removes its mount point.
+func removeIPCNS(path string) error {
+	if err := unix.Unmount(path, unix.MNT_DETACH); err != nil &&
+		!errors.Is(err, unix.EINVAL) && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package machineman
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"testing"
+
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+const (
+	nsPod       = runtimeapi.NamespaceMode_POD
+	nsNode      = runtimeapi.NamespaceMode_NODE
+	nsTarget    = runtimeapi.NamespaceMode_TARGET
+	nsContainer = runtimeapi.NamespaceMode_CONTAINER
+)
+
+func TestValidateSandboxNamespaces(t *testing.T) {
+	userns := &runtimeapi.UserNamespace{Mode: nsPod}
+	tests := []struct {
+		name     string
+		opts     *runtimeapi.NamespaceOption
+		wantCode codes.Code
+	}{
+		{"pod namespaces", &runtimeapi.NamespaceOption{Network: nsPod, Pid: nsContainer, Ipc: nsPod}, codes.OK},
+		{"host namespaces", &runtimeapi.NamespaceOption{Network: nsNode, Pid: nsContainer, Ipc: nsNode}, codes.OK},
+		{"no options", nil, codes.Unimplemented},
+		{"pod PID namespace", &runtimeapi.NamespaceOption{Network: nsPod, Pid: nsPod, Ipc: nsPod}, codes.Unimplemented},
+		{"host PID namespace", &runtimeapi.NamespaceOption{Network: nsNode, Pid: nsNode, Ipc: nsNode}, codes.Unimplemented},
+		{"container network namespace", &runtimeapi.NamespaceOption{Network: nsContainer, Pid: nsContainer}, codes.InvalidArgument},
+		{"container IPC namespace", &runtimeapi.NamespaceOption{Pid: nsContainer, Ipc: nsContainer}, codes.InvalidArgument},
+		{"target PID namespace", &runtimeapi.NamespaceOption{Pid: nsTarget, TargetId: "a"}, codes.InvalidArgument},
+		{"target without TARGET mode", &runtimeapi.NamespaceOption{Pid: nsContainer, TargetId: "a"}, codes.InvalidArgument},
+		{
+			"user namespace",
+			&runtimeapi.NamespaceOption{Network: nsPod, Pid: nsContainer, Ipc: nsPod, UsernsOptions: userns},
+			codes.OK,
+		},
+		{
+			"user namespace with host network",
+			&runtimeapi.NamespaceOption{Network: nsNode, Pid: nsContainer, UsernsOptions: userns},
+			codes.InvalidArgument,
+		},
+		{
+			"user namespace with host PID",
+			&runtimeapi.NamespaceOption{Pid: nsNode, UsernsOptions: userns},
+			codes.InvalidArgument,
+		},
+		{
+			"user namespace with host IPC",
+			&runtimeapi.NamespaceOption{Pid: nsContainer, Ipc: nsNode, UsernsOptions: userns},
+			codes.InvalidArgument,
+		},
+		{
+			"host user namespace with host network",
+			&runtimeapi.NamespaceOption{
+				Network:       nsNode,
+				Pid:           nsContainer,
+				UsernsOptions: &runtimeapi.UserNamespace{Mode: nsNode},
+			},
+			codes.OK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateSandboxNamespaces(tt.opts)
+			if code := status.Code(err); code != tt.wantCode {
+				t.Errorf("validateSandboxNamespaces() = %v, want code %v", err, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestValidateContainerNamespaces(t *testing.T) {
+	var r RuntimeService
+	r.containers.add(&containerRecord{ID: "sibling", SandboxID: "pod"})
+	r.containers.add(&containerRecord{ID: "stranger", SandboxID: "other"})
+	podSandbox := &sandboxRecord{ID: "pod", Namespaces: &runtimeapi.NamespaceOption{Network: nsPod, Pid: nsContainer, Ipc: nsPod}}
+	hostSandbox := &sandboxRecord{ID: "pod", Namespaces: &runtimeapi.NamespaceOption{Network: nsNode, Pid: nsContainer, Ipc: nsNode}}
+	tests := []struct {
+		name     string
+		sb       *sandboxRecord
+		opts     *runtimeapi.NamespaceOption
+		wantCode codes.Code
+	}{
+		{"no options", podSandbox, nil, codes.OK},
+		{"same as the pod", podSandbox, &runtimeapi.NamespaceOption{Network: nsPod, Pid: nsContainer, Ipc: nsPod}, codes.OK},
+		{"host pod", hostSandbox, &runtimeapi.NamespaceOption{Network: nsNode, Pid: nsContainer, Ipc: nsNode}, codes.OK},
+		{"host network in a pod", podSandbox, &runtimeapi.NamespaceOption{Network: nsNode, Pid: nsContainer, Ipc: nsPod}, codes.InvalidArgument},
+		{"host IPC in a pod", podSandbox, &runtimeapi.NamespaceOption{Network: nsPod, Pid: nsContainer, Ipc: nsNode}, codes.InvalidArgument},
+		{"pod IPC in a host pod", hostSandbox, &runtimeapi.NamespaceOption{Network: nsNode, Pid: nsContainer, Ipc: nsPod}, codes.InvalidArgument},
+		{"pod PID namespace", podSandbox, &runtimeapi.NamespaceOption{Network: nsPod, Pid: nsPod, Ipc: nsPod}, codes.Unimplemented},
+		{"host PID namespace", hostSandbox, &runtimeapi.NamespaceOption{Network: nsNode, Pid: nsNode, Ipc: nsNode}, codes.Unimplemented},
+		{
+			"target in the pod",
+			podSandbox,
+			&runtimeapi.NamespaceOption{Network: nsPod, Pid: nsTarget, Ipc: nsPod, TargetId: "sibling"},
+			codes.Unimplemented,
+		},
+		{
+			"target in another pod",
+			podSandbox,
+			&runtimeapi.NamespaceOption{Network: nsPod, Pid: nsTarget, Ipc: nsPod, TargetId: "stranger"},
+			codes.InvalidArgument,
+		},
+		{
+			"unknown target",
+			podSandbox,
+			&runtimeapi.NamespaceOption{Network: nsPod, Pid: nsTarget, Ipc: nsPod, TargetId: "missing"},
+			codes.InvalidArgument,
+		},
+		{
+			"target without TARGET mode",
+			podSandbox,
+			&runtimeapi.NamespaceOption{Network: nsPod, Pid: nsContainer, Ipc: nsPod, TargetId: "sibling"},
+			codes.InvalidArgument,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := r.validateContainerNamespaces(tt.opts, tt.sb)
+			if code := status.Code(err); code != tt.wantCode {
+				t.Errorf("validateContainerNamespaces() = %v, want code %v", err, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestPodIPCNamespace(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("making IPC namespaces needs root")
+	}
+	r := &RuntimeService{sandboxStates: sandboxStates{dir: t.TempDir()}, ipcNamespaces: true}
+	sb := &sandboxRecord{ID: "pod", Metadata: &runtimeapi.PodSandboxMetadata{Name: "web"}}
+	if err := r.newPodIPCNS(sb); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { removeIPCNS(sb.IPCNSPath) })
+	f, err := os.Open(sb.IPCNSPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if kind, err := unix.IoctlRetInt(int(f.Fd()), unix.NS_GET_NSTYPE); err != nil || kind != unix.CLONE_NEWIPC {
+		t.Fatalf("%s is a namespace of type %#x, %v, want an IPC namespace", sb.IPCNSPath, kind, err)
+	}
+	var pod, host unix.Stat_t
+	if err := unix.Fstat(int(f.Fd()), &pod); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Stat("/proc/self/ns/ipc", &host); err != nil {
+		t.Fatal(err)
+	}
+	if pod.Ino == host.Ino {
+		t.Error("the pod's IPC namespace is the host's")
+	}
+	// The unit of each container joins it.
+	fakeNspawn(t)
+	c := &containerRecord{Metadata: &runtimeapi.ContainerMetadata{Name: "app"}, Command: []string{"/bin/app"}}
+	props, err := containerUnitProperties(c, sb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := propertyValues(t, props)["IPCNamespacePath"]; got != sb.IPCNSPath {
+		t.Errorf("IPCNamespacePath = %#v, want %s", got, sb.IPCNSPath)
+	}
+
+	if err := r.teardownIPC(sb); err != nil {
+		t.Fatal(err)
+	}
+	if sb.IPCNSPath != "" {
+		t.Errorf("IPC namespace path = %q after the teardown, want it cleared", sb.IPCNSPath)
+	}
+	if _, err := os.Stat(r.sandboxStates.ipcNSPath(sb.ID)); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("IPC namespace left mounted after the teardown: %v", err)
+	}
+	// Without systemd support, pods have to use the host's.
+	r.ipcNamespaces = false
+	if err := r.newPodIPCNS(sb); status.Code(err) != codes.Unimplemented {
+		t.Errorf("newPodIPCNS() without systemd support = %v, want Unimplemented", err)
+	}
+}
@@ -0,0 +1,110 @@
+package machineman
+
+import (
+	"errors"
+	"net"
+	"os"
+	"runtime"
+	"sort"
+
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// netnsPathAnnotation is a sandbox annotation that points at a network
+// namespace made by something else, such as an external network manager,
+// e.g. "/run/netns/pod-a". The sandbox joins it as it is: no network plugin
+// sets it up or tears it down, and it outlives the sandbox.
+const netnsPathAnnotation = "systemd-cri.io/netns-path"
+
+// openNetNS opens the network namespace a sandbox's annotations point at, or
+// returns nil if they don't. A path that is anything but a network namespace
+// is rejected, so that a typo can't put the pod in some other namespace or
+// on a plain file.
+func openNetNS(annotations map[string]string, hostNetwork bool) (*os.File, error) {
+	path, ok := annotations[netnsPathAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	if hostNetwork {
+		return nil, status.Errorf(
+			codes.InvalidArgument,
+			"annotation %s can't be used with the host network namespace",
+			netnsPathAnnotation,
+		)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "annotation %s: %v", netnsPathAnnotation, err)
+	}
+	if err := checkNetNS(f); err != nil {
+		f.Close()
+		return nil, status.Errorf(
+			codes.InvalidArgument,
+			"annotation %s: %s is not a network namespace: %v",
+			netnsPathAnnotation, path, err,
+		)
+	}
+	return f, nil
+}
+
+// checkNetNS checks that f is a namespace file of nsfs, and that the
+// namespace is a network namespace.
+func checkNetNS(f *os.File) error {
+	var fs unix.Statfs_t
+	if err := unix.Fstatfs(int(f.Fd()), &fs); err != nil {
+		return err
+	}
+	if fs.Type != unix.NSFS_MAGIC {
+		return errors.New("not a namespace file")
+	}
+	kind, err := unix.IoctlRetInt(int(f.Fd()), unix.NS_GET_NSTYPE)
+	if err != nil {
+		return err
+	}
+	if kind != unix.CLONE_NEWNET {
+		return errors.New("namespace is of another type")
+	}
+	return nil
+}
+
+// netnsAddresses returns the global unicast addresses of the interfaces in
+// the network namespace f, which are the pod's IPs, IPv4 first.
+func netnsAddresses(f *os.File) ([]string, error) {
+	type result struct {
+		ips []string
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		// The thread never leaves the pod's namespace: a goroutine that
+		// exits while locked to its thread takes the thread with it.
+		runtime.LockOSThread()
+		if err := unix.Setns(int(f.Fd()), unix.CLONE_NEWNET); err != nil {
+			done <- result{err: os.NewSyscallError("setns", err)}
+			return
+		}
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		var ips []net.IP
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.IsGlobalUnicast() {
+				ips = append(ips, ipnet.IP)
+			}
+		}
+		sort.SliceStable(ips, func(i, j int) bool {
+			return ips[i].To4() != nil && ips[j].To4() == nil
+		})
+		res := result{}
+		for _, ip := range ips {
+			res.ips = append(res.ips, ip.String())
+		}
+		done <- res
+	}()
+	res := <-done
+	return res.ips, res.err
+}
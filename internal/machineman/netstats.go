@@ -0,0 +1,150 @@
+package machineman
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+const (
+	// defaultInterface is the interface CNI plugins conventionally set up
+	// as a pod's primary network.
+	defaultInterface = "eth0"
+	// hostNetworkAnnotation marks the stats of host network sandboxes,
+	// whose network counters are the host's.
+	hostNetworkAnnotation = "systemd-cri.io/host-network"
+)
+
+// sandboxNetworkUsage returns the traffic counters of every non-loopback
+// interface in a sandbox's network namespace. Host network sandboxes get the
+// counters of the host's interfaces.
+func sandboxNetworkUsage(sb *sandboxRecord) (*runtimeapi.NetworkUsage, error) {
+	var interfaces []*runtimeapi.NetworkInterfaceUsage
+	var err error
+	switch {
+	case sb.HostNetwork:
+		interfaces, err = readNetDev()
+	case sb.NetNS != nil:
+		err = inNetNS(sb.NetNS, func() error {
+			interfaces, err = readNetDev()
+			return err
+		})
+	default:
+		return nil, status.Errorf(
+			codes.FailedPrecondition,
+			"pod sandbox %s has no network namespace",
+			sb.ID,
+		)
+	}
+	if err != nil {
+		return nil, err
+	}
+	usage := &runtimeapi.NetworkUsage{
+		Timestamp:  time.Now().UnixNano(),
+		Interfaces: interfaces,
+	}
+	for _, iface := range interfaces {
+		if iface.Name == defaultInterface {
+			usage.DefaultInterface = iface
+		}
+	}
+	if usage.DefaultInterface == nil && len(interfaces) > 0 {
+		usage.DefaultInterface = interfaces[0]
+	}
+	return usage, nil
+}
+
+// inNetNS runs fn on a thread that has joined the network namespace ns.
+func inNetNS(ns *os.File, fn func() error) error {
+	errc := make(chan error, 1)
+	go func() {
+		// The thread is only unlocked once it's back in its own namespace.
+		// If that fails, the goroutine exits locked and the runtime
+		// throws the thread away.
+		runtime.LockOSThread()
+		self, err := os.Open("/proc/thread-self/ns/net")
+		if err != nil {
+			runtime.UnlockOSThread()
+			errc <- err
+			return
+		}
+		defer self.Close()
+		if err := unix.Setns(int(ns.Fd()), unix.CLONE_NEWNET); err != nil {
+			runtime.UnlockOSThread()
+			errc <- fmt.Errorf("enter network namespace: %w", err)
+			return
+		}
+		err = fn()
+		if serr := unix.Setns(int(self.Fd()), unix.CLONE_NEWNET); serr != nil {
+			errc <- fmt.Errorf("leave network namespace: %w", serr)
+			return
+		}
+		runtime.UnlockOSThread()
+		errc <- err
+	}()
+	return <-errc
+}
+
+// readNetDev reads the interface counters of the calling thread's network
+// namespace. /proc/net would show the namespace of the main thread instead.
+func readNetDev() ([]*runtimeapi.NetworkInterfaceUsage, error) {
+	f, err := os.Open("/proc/thread-self/net/dev")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseNetDev(f)
+}
+
+// parseNetDev parses the format of /proc/net/dev, skipping the loopback
+// interface.
+func parseNetDev(r io.Reader) ([]*runtimeapi.NetworkInterfaceUsage, error) {
+	var interfaces []*runtimeapi.NetworkInterfaceUsage
+	scanner := bufio.NewScanner(r)
+	for line := 0; scanner.Scan(); line++ {
+		// The first two lines are headers.
+		if line < 2 {
+			continue
+		}
+		name, counters, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			return nil, fmt.Errorf("malformed /proc/net/dev line %q", scanner.Text())
+		}
+		name = strings.TrimSpace(name)
+		if name == "lo" {
+			continue
+		}
+		// Receive counters come first, then transmit counters, eight of
+		// each: bytes, packets, errs, drop, fifo, frame/colls, ...
+		fields := strings.Fields(counters)
+		if len(fields) < 16 {
+			return nil, fmt.Errorf("malformed /proc/net/dev line for %s", name)
+		}
+		values := make([]uint64, 16)
+		for i := range values {
+			v, err := strconv.ParseUint(fields[i], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("malformed /proc/net/dev line for %s: %w", name, err)
+			}
+			values[i] = v
+		}
+		interfaces = append(interfaces, &runtimeapi.NetworkInterfaceUsage{
+			Name:     name,
+			RxBytes:  &runtimeapi.UInt64Value{Value: values[0]},
+			RxErrors: &runtimeapi.UInt64Value{Value: values[2]},
+			TxBytes:  &runtimeapi.UInt64Value{Value: values[8]},
+			TxErrors: &runtimeapi.UInt64Value{Value: values[10]},
+		})
+	}
+	return interfaces, scanner.Err()
+}
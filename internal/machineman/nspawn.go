@@ -0,0 +1,118 @@
+package machineman
+
+import (
+	"os/exec"
+	"strconv"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// nspawnBinary is the program containers are run with.
+const nspawnBinary = "systemd-nspawn"
+
+// checkNspawn returns an error unless systemd-nspawn is installed, which
+// minimal hosts often leave out.
+func checkNspawn() error {
+	if _, err := exec.LookPath(nspawnBinary); err != nil {
+		return status.Errorf(
+			codes.FailedPrecondition,
+			"%s is required to run containers but was not found in PATH, "+
+				"install it (it is packaged as systemd-container on most distributions)",
+			nspawnBinary,
+		)
+	}
+	return nil
+}
+
+// hostCgroupNamespaceAnnotation is a container or sandbox annotation that
+// lets a container see the host's cgroup hierarchy, as monitoring agents
+// that read other cgroups need to. Containers get a private cgroup
+// namespace rooted at their own cgroup otherwise, like runc does.
+const hostCgroupNamespaceAnnotation = "systemd-cri.io/host-cgroup-namespace"
+
+// hostCgroupNamespace reports whether a container shares the host's cgroup
+// namespace. The container's annotation takes precedence over the
+// sandbox's.
+func hostCgroupNamespace(container, sandbox map[string]string) (bool, error) {
+	value, ok := container[hostCgroupNamespaceAnnotation]
+	if !ok {
+		value, ok = sandbox[hostCgroupNamespaceAnnotation]
+	}
+	if !ok {
+		return false, nil
+	}
+	host, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, status.Errorf(
+			codes.InvalidArgument,
+			"annotation %s: %q is not a boolean",
+			hostCgroupNamespaceAnnotation, value,
+		)
+	}
+	return host, nil
+}
+
+// initAnnotation is a container or sandbox annotation that says whether a
+// container's command runs below a minimal init as PID 1, which reaps the
+// orphaned processes the command leaves behind. Commands that are an init
+// system, or reap their children themselves, can run as PID 1 directly.
+// The container's annotation takes precedence over the sandbox's, and
+// RuntimeOptions.ContainerInit over both when neither sets it.
+const initAnnotation = "systemd-cri.io/init"
+
+// containerInit reports whether a container runs below a reaping init.
+func containerInit(container, sandbox map[string]string, fallback bool) (bool, error) {
+	value, ok := container[initAnnotation]
+	if !ok {
+		value, ok = sandbox[initAnnotation]
+	}
+	if !ok {
+		return fallback, nil
+	}
+	init, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, status.Errorf(
+			codes.InvalidArgument,
+			"annotation %s: %q is not a boolean",
+			initAnnotation, value,
+		)
+	}
+	return init, nil
+}
+
+// initArgs returns the systemd-nspawn arguments that run a container's
+// command as PID 2, below the stub init systemd-nspawn then runs as PID 1
+// to reap zombies, for containers that want one.
+func initArgs(c *containerRecord) []string {
+	if !c.Init {
+		return nil
+	}
+	return []string{"--as-pid2"}
+}
+
+// nspawnEnvironment returns the environment systemd-nspawn reads its
+// settings for a container from.
+func nspawnEnvironment(c *containerRecord) []string {
+	env := []string{
+		// Rooting /sys/fs/cgroup at the container's own cgroup keeps it
+		// from seeing the rest of the node.
+		"SYSTEMD_NSPAWN_USE_CGNS=" + boolEnv(!c.HostCgroupNamespace),
+		// Containers share the IPC namespace their unit runs in, the
+		// one of their pod or the host's, rather than get their own.
+		"SYSTEMD_NSPAWN_SHARE_NS_IPC=1",
+	}
+	// systemd-nspawn applies its own default filter unless told otherwise.
+	if c.Seccomp.GetProfileType() == runtimeapi.SecurityProfile_Unconfined {
+		env = append(env, "SYSTEMD_SECCOMP=0")
+	}
+	return env
+}
+
+func boolEnv(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
@@ -0,0 +1,125 @@
+package machineman
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+func TestContainerInit(t *testing.T) {
+	tests := []struct {
+		name      string
+		container map[string]string
+		sandbox   map[string]string
+		fallback  bool
+		want      bool
+		wantCode  codes.Code
+	}{
+		{name: "default off", want: false},
+		{name: "default on", fallback: true, want: true},
+		{
+			name:    "sandbox turns it on",
+			sandbox: map[string]string{initAnnotation: "true"},
+			want:    true,
+		},
+		{
+			name:      "container overrides the sandbox",
+			container: map[string]string{initAnnotation: "false"},
+			sandbox:   map[string]string{initAnnotation: "true"},
+			want:      false,
+		},
+		{
+			name:      "container overrides the default",
+			container: map[string]string{initAnnotation: "0"},
+			fallback:  true,
+			want:      false,
+		},
+		{
+			name:      "not a boolean",
+			container: map[string]string{initAnnotation: "tini"},
+			wantCode:  codes.InvalidArgument,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := containerInit(tt.container, tt.sandbox, tt.fallback)
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("containerInit() error = %v, want code %v", err, tt.wantCode)
+			}
+			if got != tt.want {
+				t.Errorf("containerInit() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInitArgs(t *testing.T) {
+	if got := initArgs(&containerRecord{}); got != nil {
+		t.Errorf("initArgs() without an init = %q, want none", got)
+	}
+	if got, want := initArgs(&containerRecord{Init: true}), []string{"--as-pid2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("initArgs() with an init = %q, want %q", got, want)
+	}
+}
+
+func TestContainerInitReapsOrphans(t *testing.T) {
+	nspawn, err := exec.LookPath(nspawnBinary)
+	if err != nil {
+		t.Skip("systemd-nspawn is not installed")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("systemd-nspawn needs root")
+	}
+	// The container's root is the host's /usr, which a merged /usr host
+	// has everything in.
+	if target, err := os.Readlink("/bin"); err != nil || target != "usr/bin" {
+		t.Skip("host doesn't have a merged /usr")
+	}
+	rootfs := t.TempDir()
+	root := filepath.Join(rootfs, containerRootDir)
+	if err := os.MkdirAll(filepath.Join(root, "usr"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"bin", "sbin", "lib", "lib64"} {
+		if err := os.Symlink("usr/"+dir, filepath.Join(root, dir)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The command leaves orphans behind that exit while it still runs,
+	// and counts the zombies among the container's processes.
+	script := `for i in 1 2 3; do (sleep 0.2 &); done
+sleep 1
+zombies=0
+for stat in /proc/[0-9]*/stat; do
+	read -r pid comm state rest < "$stat"
+	[ "$state" = Z ] && zombies=$((zombies + 1))
+done
+echo "zombies=$zombies"`
+	c := &containerRecord{
+		Rootfs:  rootfs,
+		Init:    true,
+		Command: []string{"/bin/sh", "-c", script},
+		Binds:   []*runtimeapi.Mount{{HostPath: "/usr", ContainerPath: "/usr", Readonly: true}},
+	}
+	var args []string
+	for _, arg := range nspawnArgs(c, &sandboxRecord{}) {
+		// The test doesn't run in a unit of its own to keep.
+		if arg != "--keep-unit" {
+			args = append(args, arg)
+		}
+	}
+	out, err := exec.Command(nspawn, args...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("systemd-nspawn: %v\n%s", err, out)
+	}
+	if !strings.Contains(string(out), "zombies=0") {
+		t.Errorf("orphans were left as zombies: %s", out)
+	}
+}
@@ -0,0 +1,159 @@
+package machineman
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+const (
+	// sysDevPath links device numbers to their devices in sysfs.
+	sysDevPath = "/sys/dev"
+	// sysDevicesPath is where sysfs's device tree is rooted.
+	sysDevicesPath = "/sys/devices"
+	// nodeCPUListPath lists the CPUs of a NUMA node.
+	nodeCPUListPath = "/sys/devices/system/node/node%d/cpulist"
+)
+
+// deviceNUMANode returns the NUMA node the device at path is attached to,
+// as found on the closest of its ancestors in sysfs that has one, such as
+// the PCI device of a GPU. It is -1 for devices without NUMA affinity.
+func deviceNUMANode(path string) (int, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return -1, err
+	}
+	var kind string
+	switch st.Mode & unix.S_IFMT {
+	case unix.S_IFCHR:
+		kind = "char"
+	case unix.S_IFBLK:
+		kind = "block"
+	default:
+		return -1, nil
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Join(
+		sysDevPath, kind, fmt.Sprintf("%d:%d", unix.Major(st.Rdev), unix.Minor(st.Rdev)),
+	))
+	if errors.Is(err, fs.ErrNotExist) {
+		return -1, nil
+	}
+	if err != nil {
+		return -1, err
+	}
+	for ; strings.HasPrefix(dir, sysDevicesPath+"/"); dir = filepath.Dir(dir) {
+		data, err := os.ReadFile(filepath.Join(dir, "numa_node"))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return -1, err
+		}
+		return strconv.Atoi(strings.TrimSpace(string(data)))
+	}
+	return -1, nil
+}
+
+// deviceNUMANodes maps the host paths of the devices of a container to the
+// NUMA nodes they are attached to. Devices without NUMA affinity are left
+// out, as are those that can't be looked up, since alignment is only a
+// hint.
+func deviceNUMANodes(devices []*runtimeapi.Device) map[string]int {
+	nodes := map[string]int{}
+	for _, device := range devices {
+		node, err := deviceNUMANode(device.GetHostPath())
+		if err != nil {
+			log.Printf("failed to find the NUMA node of device %s: %v", device.GetHostPath(), err)
+			continue
+		}
+		if node >= 0 {
+			nodes[device.GetHostPath()] = node
+		}
+	}
+	return nodes
+}
+
+// numaAlign defaults the cpusets of a container to the NUMA nodes of its
+// devices, so that an accelerator is fed from memory and CPUs close to it.
+// Cpusets given in resources, such as those of kubelet's CPU manager, are
+// kept as they are.
+func numaAlign(
+	resources *runtimeapi.LinuxContainerResources,
+	deviceNodes map[string]int,
+) (*runtimeapi.LinuxContainerResources, error) {
+	if len(deviceNodes) == 0 {
+		return resources, nil
+	}
+	seen := map[int]bool{}
+	var nodes []int
+	for _, node := range deviceNodes {
+		if !seen[node] {
+			seen[node] = true
+			nodes = append(nodes, node)
+		}
+	}
+	sort.Ints(nodes)
+	var aligned runtimeapi.LinuxContainerResources
+	if resources != nil {
+		aligned = *resources
+	}
+	if aligned.CpusetMems == "" {
+		aligned.CpusetMems = formatCPUList(nodes)
+	}
+	if aligned.CpusetCpus == "" {
+		var cpus []int
+		for _, node := range nodes {
+			data, err := os.ReadFile(fmt.Sprintf(nodeCPUListPath, node))
+			if err != nil {
+				return nil, err
+			}
+			ids, err := parseCPUList(string(data))
+			if err != nil {
+				return nil, err
+			}
+			cpus = append(cpus, ids...)
+		}
+		sort.Ints(cpus)
+		aligned.CpusetCpus = formatCPUList(cpus)
+	}
+	return &aligned, nil
+}
+
+// formatCPUList formats sorted IDs as a kernel CPU or node list, the
+// inverse of parseCPUList, e.g. "0-3,7".
+func formatCPUList(ids []int) string {
+	var parts []string
+	for i := 0; i < len(ids); {
+		j := i
+		for j+1 < len(ids) && ids[j+1] == ids[j]+1 {
+			j++
+		}
+		if i == j {
+			parts = append(parts, strconv.Itoa(ids[i]))
+		} else {
+			parts = append(parts, strconv.Itoa(ids[i])+"-"+strconv.Itoa(ids[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ",")
+}
+
+// numaInfo renders the NUMA nodes of a container's devices for verbose
+// status.
+func numaInfo(deviceNodes map[string]int) string {
+	data, err := json.Marshal(deviceNodes)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
@@ -0,0 +1,250 @@
+package machineman
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ananthb/systemd-cri/internal/crilog"
+	"github.com/coreos/go-systemd/v22/dbus"
+	godbus "github.com/godbus/dbus/v5"
+	"golang.org/x/sys/unix"
+)
+
+// The FIFOs a container with a log writes its output to, in the
+// container's rootfs directory.
+const (
+	stdoutFile = "stdout"
+	stderrFile = "stderr"
+)
+
+// outputDrainTimeout bounds how long removing a container waits for the
+// last of its output once its processes are gone.
+const outputDrainTimeout = 5 * time.Second
+
+// containerOutput forwards what a container writes to its stdout and
+// stderr into its log, one crilog.Writer per stream, and to the clients
+// attached to the container.
+type containerOutput struct {
+	stdout, stderr string
+	// stdoutTee and stderrTee pass the streams on to attached clients.
+	stdoutTee, stderrTee outputTee
+	readers              []*os.File
+	// writers are the runtime's own write ends of the FIFOs. They keep the
+	// readers from seeing the end of the output before the container
+	// opened the FIFOs, and are closed once it did.
+	writers []*os.File
+	done    sync.WaitGroup
+}
+
+// openOutput makes the output FIFOs of a container in dir and starts
+// forwarding them to sink.
+func openOutput(dir string, sink crilog.Sink) (*containerOutput, error) {
+	out := newOutput(dir)
+	for i, path := range []string{out.stdout, out.stderr} {
+		r, w, err := openFIFO(path)
+		if err != nil {
+			out.close()
+			return nil, err
+		}
+		out.readers = append(out.readers, r)
+		out.writers = append(out.writers, w)
+		out.forward(i, sink)
+	}
+	return out, nil
+}
+
+// resumeOutput forwards the output of a container that was started before
+// the runtime restarted to sink again, from the read ends of its output
+// FIFOs in dir that were kept, stdout first, and from the FIFOs opened
+// again where they weren't. The kept files are used up either way. The
+// forwarding ends once the container's processes are gone.
+func resumeOutput(dir string, kept [2]*os.File, sink crilog.Sink) (*containerOutput, error) {
+	out := newOutput(dir)
+	for i, path := range []string{out.stdout, out.stderr} {
+		r := kept[i]
+		if r == nil {
+			var err error
+			if r, err = os.OpenFile(path, os.O_RDONLY|unix.O_NONBLOCK, 0); err != nil {
+				for _, f := range kept[i+1:] {
+					if f != nil {
+						f.Close()
+					}
+				}
+				out.close()
+				return nil, err
+			}
+		}
+		out.readers = append(out.readers, r)
+		out.forward(i, sink)
+	}
+	return out, nil
+}
+
+// newOutput returns the output of a container whose FIFOs are in dir, with
+// nothing forwarded yet.
+func newOutput(dir string) *containerOutput {
+	return &containerOutput{
+		stdout: filepath.Join(dir, stdoutFile),
+		stderr: filepath.Join(dir, stderrFile),
+	}
+}
+
+// forward copies what the i-th reader, of stdout or stderr, reads to sink
+// and to the attached clients until the stream ends.
+func (o *containerOutput) forward(i int, sink crilog.Sink) {
+	name, tee := crilog.Stdout, &o.stdoutTee
+	if i == 1 {
+		name, tee = crilog.Stderr, &o.stderrTee
+	}
+	r := o.readers[i]
+	o.done.Add(1)
+	go func() {
+		defer o.done.Done()
+		defer tee.end()
+		w := crilog.NewWriter(sink, name, 0)
+		if _, err := io.Copy(io.MultiWriter(w, tee), r); err != nil && !errors.Is(err, os.ErrClosed) {
+			log.Printf("failed to forward %s of %s: %v", name, filepath.Dir(o.stdout), err)
+		}
+		w.Close()
+	}()
+}
+
+// openFIFO makes a FIFO at path and opens both of its ends.
+func openFIFO(path string) (r, w *os.File, err error) {
+	if err := unix.Mkfifo(path, 0o600); err != nil && err != unix.EEXIST {
+		return nil, nil, &os.PathError{Op: "mkfifo", Path: path, Err: err}
+	}
+	// Opening the read end without O_NONBLOCK would wait for a writer.
+	r, err = os.OpenFile(path, os.O_RDONLY|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	w, err = os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		r.Close()
+		return nil, nil, err
+	}
+	return r, w, nil
+}
+
+// properties returns the unit properties that connect the container's
+// stdout and stderr to the FIFOs.
+func (o *containerOutput) properties() []dbus.Property {
+	return []dbus.Property{
+		{Name: "StandardOutputFile", Value: godbus.MakeVariant(o.stdout)},
+		{Name: "StandardErrorFile", Value: godbus.MakeVariant(o.stderr)},
+	}
+}
+
+// started lets go of the runtime's write ends once the container holds
+// its own, so that the forwarding ends when the container's processes
+// are gone.
+func (o *containerOutput) started() {
+	for _, w := range o.writers {
+		w.Close()
+	}
+	o.writers = nil
+}
+
+// close waits for the forwarding to drain what the container wrote, up
+// to outputDrainTimeout, and then stops it.
+func (o *containerOutput) close() {
+	o.started()
+	drained := make(chan struct{})
+	go func() {
+		o.done.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(outputDrainTimeout):
+	}
+	for _, r := range o.readers {
+		r.Close()
+	}
+	o.done.Wait()
+}
+
+// attach returns readers of what the container writes to its stdout and
+// stderr from now on. They see the end of the output once the container's
+// processes are gone.
+func (o *containerOutput) attach() (stdout, stderr *io.PipeReader) {
+	return o.stdoutTee.attach(), o.stderrTee.attach()
+}
+
+// attachBacklog is how many writes of a container's output an attached
+// client may fall behind by before it is cut off, so that a client that
+// doesn't read holds up neither the container nor its log.
+const attachBacklog = 64
+
+// errAttachBehind cuts off an attached client that fell behind.
+var errAttachBehind = errors.New("attached client fell behind the container's output")
+
+// outputTee copies a stream of a container's output to the clients attached
+// to it.
+type outputTee struct {
+	mu      sync.Mutex
+	clients map[*io.PipeWriter]chan []byte
+	// ended is set once the stream ended.
+	ended bool
+}
+
+// Write passes p on to every attached client.
+func (t *outputTee) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for w, backlog := range t.clients {
+		select {
+		case backlog <- append([]byte(nil), p...):
+		default:
+			w.CloseWithError(errAttachBehind)
+			close(backlog)
+			delete(t.clients, w)
+		}
+	}
+	return len(p), nil
+}
+
+// attach returns a reader of what the stream carries from now on.
+func (t *outputTee) attach() *io.PipeReader {
+	r, w := io.Pipe()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.ended {
+		w.Close()
+		return r
+	}
+	if t.clients == nil {
+		t.clients = map[*io.PipeWriter]chan []byte{}
+	}
+	backlog := make(chan []byte, attachBacklog)
+	t.clients[w] = backlog
+	go func() {
+		defer w.Close()
+		for p := range backlog {
+			if _, err := w.Write(p); err != nil {
+				// The client went away. Its backlog fills up,
+				// and Write drops it.
+				return
+			}
+		}
+	}()
+	return r
+}
+
+// end lets the attached clients see the end of the stream once they read
+// their backlog.
+func (t *outputTee) end() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, backlog := range t.clients {
+		close(backlog)
+	}
+	t.clients = nil
+	t.ended = true
+}
@@ -0,0 +1,77 @@
+package machineman
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/dbus"
+	godbus "github.com/godbus/dbus/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// podSliceProperties returns the limits of the slice of a pod: what its
+// containers may use together, plus the overhead of its RuntimeClass, so
+// that the node's accounting of a pod matches what the scheduler reserved
+// for it. Limits the pod doesn't set are left out, a pod without any gets
+// none, whatever its overhead.
+func podSliceProperties(resources, overhead *runtimeapi.LinuxContainerResources) []dbus.Property {
+	var props []dbus.Property
+	if memory := resources.GetMemoryLimitInBytes(); memory > 0 {
+		if extra := overhead.GetMemoryLimitInBytes(); extra > 0 {
+			memory += extra
+		}
+		props = append(props, dbus.Property{
+			Name:  "MemoryMax",
+			Value: godbus.MakeVariant(uint64(memory)),
+		})
+	}
+	if quota := cpuQuotaPerSec(resources); quota > 0 {
+		props = append(props, dbus.Property{
+			Name:  "CPUQuotaPerSecUSec",
+			Value: godbus.MakeVariant(uint64(quota + cpuQuotaPerSec(overhead))),
+		})
+	}
+	return props
+}
+
+// cpuQuotaPerSec returns the CPU time resources allow per second of wall
+// clock time, in microseconds, or 0 without a quota.
+func cpuQuotaPerSec(resources *runtimeapi.LinuxContainerResources) int64 {
+	quota, period := resources.GetCpuQuota(), resources.GetCpuPeriod()
+	if quota <= 0 || period <= 0 {
+		return 0
+	}
+	return quota * int64(time.Second/time.Microsecond) / period
+}
+
+// startPodSlice creates the slice that holds the units of a sandbox, with
+// the limits in props. A slice of the same name that still holds processes
+// fails it with AlreadyExists. Otherwise it fails with Unavailable if
+// systemd can't be reached or won't create it, which kubelet retries.
+func (r *RuntimeService) startPodSlice(ctx context.Context, sb *sandboxRecord, props []dbus.Property) error {
+	err := r.startTransientUnit(ctx, sb.Slice, append([]dbus.Property{
+		dbus.PropDescription("Pod " + sb.Metadata.GetNamespace() + "/" + sb.Metadata.GetName()),
+	}, props...)...)
+	if status.Code(err) == codes.AlreadyExists {
+		return err
+	}
+	if err != nil {
+		return status.Errorf(codes.Unavailable, "create slice %s of pod sandbox: %v", sb.Slice, err)
+	}
+	return nil
+}
+
+// overheadInfo renders the overhead of a sandbox for verbose status.
+func overheadInfo(overhead *runtimeapi.LinuxContainerResources) string {
+	data, err := json.Marshal(struct {
+		MemoryLimitInBytes int64 `json:"memoryLimitInBytes"`
+		CPUQuotaPerSecUSec int64 `json:"cpuQuotaPerSecUSec"`
+	}{overhead.GetMemoryLimitInBytes(), cpuQuotaPerSec(overhead)})
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
@@ -0,0 +1,128 @@
+package machineman
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// prePullAnnotation is a sandbox annotation holding a comma separated list of
+// images to pull into the cache when the sandbox is created. It lets a
+// DaemonSet warm the image cache of every node using only CRI calls.
+const prePullAnnotation = "systemd-cri.io/pre-pull-images"
+
+// maxPrePulls is how many images PrePull pulls at the same time. A sandbox
+// can list any number of them, and each pull downloads several layers at
+// once already.
+const maxPrePulls = 4
+
+// PrePullResult is the outcome of pulling a single image ahead of time.
+type PrePullResult struct {
+	Image    string
+	ImageRef string
+	Err      error
+}
+
+// PrePull pulls images into the cache without creating any containers. Up
+// to maxPrePulls images are pulled concurrently, sharing in-flight pulls
+// with PullImage. Results are returned in the order of images.
+func (i *ImageService) PrePull(ctx context.Context, images []string) []PrePullResult {
+	results := make([]PrePullResult, len(images))
+	var g errgroup.Group
+	g.SetLimit(maxPrePulls)
+	for n, image := range images {
+		n, image := n, image
+		g.Go(func() error {
+			ref, err := i.pull(ctx, image, nil)
+			results[n] = PrePullResult{Image: image, ImageRef: ref, Err: err}
+			return nil
+		})
+	}
+	g.Wait()
+	return results
+}
+
+// prePullImages parses the value of prePullAnnotation.
+func prePullImages(annotations map[string]string) []string {
+	var images []string
+	for _, image := range strings.Split(annotations[prePullAnnotation], ",") {
+		if image = strings.TrimSpace(image); image != "" {
+			images = append(images, image)
+		}
+	}
+	return images
+}
+
+// prePull pulls the images requested by a sandbox's annotations, records
+// the outcome of each on the sandbox, and logs it. It runs in the
+// background once the sandbox was created, so that slow pulls don't hold up
+// sandbox creation and a sandbox that fails to be created pulls nothing.
+// Pulls stop when the runtime shuts down.
+func (r *RuntimeService) prePull(ctx context.Context, sb *sandboxRecord, images []string) {
+	name := sb.Metadata.GetNamespace() + "/" + sb.Metadata.GetName()
+	results := r.images.PrePull(ctx, images)
+	sb.setPrePulls(results)
+	failed := 0
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
+			log.Printf("sandbox %s: pre-pull of %s failed: %v", name, result.Image, result.Err)
+			continue
+		}
+		log.Printf("sandbox %s: pre-pulled %s as %s", name, result.Image, result.ImageRef)
+	}
+	log.Printf("sandbox %s: pre-pulled %d of %d images", name, len(images)-failed, len(images))
+}
+
+// prePullStatus is how the pre-pull of an image of a sandbox went, as
+// verbose PodSandboxStatus reports it.
+type prePullStatus struct {
+	Image string `json:"image"`
+	// State is pending until the pull finished, then pulled or failed.
+	State    string `json:"state"`
+	ImageRef string `json:"imageRef,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// startPrePulls records images as pending pre-pulls of the sandbox.
+func (sb *sandboxRecord) startPrePulls(images []string) {
+	pulls := make([]prePullStatus, len(images))
+	for n, image := range images {
+		pulls[n] = prePullStatus{Image: image, State: "pending"}
+	}
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	sb.prePulls = pulls
+}
+
+// setPrePulls records the outcome of the sandbox's pre-pulls.
+func (sb *sandboxRecord) setPrePulls(results []PrePullResult) {
+	pulls := make([]prePullStatus, len(results))
+	for n, result := range results {
+		pulls[n] = prePullStatus{Image: result.Image, State: "pulled", ImageRef: result.ImageRef}
+		if result.Err != nil {
+			pulls[n] = prePullStatus{Image: result.Image, State: "failed", Error: result.Err.Error()}
+		}
+	}
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	sb.prePulls = pulls
+}
+
+// prePullInfo renders the sandbox's pre-pulls for verbose status, empty if
+// it has none.
+func (sb *sandboxRecord) prePullInfo() string {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	if len(sb.prePulls) == 0 {
+		return ""
+	}
+	data, err := json.Marshal(sb.prePulls)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
@@ -0,0 +1,71 @@
+package machineman
+
+import (
+	"os"
+	"strconv"
+
+	"github.com/ananthb/systemd-cri/internal/streaming"
+	"golang.org/x/sys/unix"
+)
+
+// openPty opens a new pseudo-terminal and returns its controlling side and
+// the terminal processes are given.
+func openPty() (ptm, pts *os.File, err error) {
+	ptm, err = os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	fd := int(ptm.Fd())
+	if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+		ptm.Close()
+		return nil, nil, err
+	}
+	n, err := unix.IoctlGetInt(fd, unix.TIOCGPTN)
+	if err != nil {
+		ptm.Close()
+		return nil, nil, err
+	}
+	pts, err = os.OpenFile("/dev/pts/"+strconv.Itoa(n), os.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		ptm.Close()
+		return nil, nil, err
+	}
+	return ptm, pts, nil
+}
+
+// resizePty sets the size of the pseudo-terminal whose controlling side is
+// ptm.
+func resizePty(ptm *os.File, size streaming.TerminalSize) error {
+	return unix.IoctlSetWinsize(int(ptm.Fd()), unix.TIOCSWINSZ, &unix.Winsize{
+		Row: size.Height,
+		Col: size.Width,
+	})
+}
+
+// ptyOutput reads the output of a pseudo-terminal and closes it once the
+// processes on the terminal side are gone, when reading fails with EIO.
+type ptyOutput struct {
+	ptm *os.File
+}
+
+func (o ptyOutput) Read(p []byte) (int, error) {
+	n, err := o.ptm.Read(p)
+	if err != nil {
+		o.ptm.Close()
+	}
+	return n, err
+}
+
+// ptyInput writes to a pseudo-terminal. A terminal has no end of input, so
+// closing it does nothing; the output side closes the terminal.
+type ptyInput struct {
+	ptm *os.File
+}
+
+func (i ptyInput) Write(p []byte) (int, error) {
+	return i.ptm.Write(p)
+}
+
+func (ptyInput) Close() error {
+	return nil
+}
@@ -0,0 +1,81 @@
+package machineman
+
+import (
+	"context"
+	"sync"
+)
+
+// pullGroup deduplicates concurrent pulls of the same image. Unlike a plain
+// singleflight group, the shared pull isn't tied to the context of the
+// caller that started it: every caller waits only as long as its own
+// context allows, and the pull is cancelled once no caller waits for it
+// anymore.
+type pullGroup struct {
+	mu    sync.Mutex
+	calls map[string]*pullCall
+}
+
+type pullCall struct {
+	// done is closed once ref and err are set.
+	done chan struct{}
+	ref  string
+	err  error
+	// waiters counts the callers waiting for the pull.
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// do runs pull for key, or joins the pull for key that is already running,
+// and returns its result. It returns early with the context's error when
+// ctx is done before the pull is.
+func (g *pullGroup) do(
+	ctx context.Context,
+	key string,
+	pull func(context.Context) (string, error),
+) (string, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = map[string]*pullCall{}
+	}
+	c, ok := g.calls[key]
+	if !ok {
+		pullCtx, cancel := context.WithCancel(context.Background())
+		c = &pullCall{done: make(chan struct{}), cancel: cancel}
+		g.calls[key] = c
+		go func() {
+			c.ref, c.err = pull(pullCtx)
+			g.forget(key, c)
+			cancel()
+			close(c.done)
+		}()
+	}
+	c.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.ref, c.err
+	case <-ctx.Done():
+		g.mu.Lock()
+		c.waiters--
+		if c.waiters == 0 {
+			// Nobody waits for the pull anymore. Callers that come
+			// along later start a new one rather than joining this
+			// cancelled one.
+			if g.calls[key] == c {
+				delete(g.calls, key)
+			}
+			c.cancel()
+		}
+		g.mu.Unlock()
+		return "", ctx.Err()
+	}
+}
+
+func (g *pullGroup) forget(key string, c *pullCall) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.calls[key] == c {
+		delete(g.calls, key)
+	}
+}
@@ -0,0 +1,146 @@
+package machineman
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingPull returns a pull that counts its runs and blocks until release
+// is closed or its context is cancelled.
+func blockingPull(runs *int32, release <-chan struct{}, cancelled chan<- struct{}) func(context.Context) (string, error) {
+	return func(ctx context.Context) (string, error) {
+		atomic.AddInt32(runs, 1)
+		select {
+		case <-release:
+			return "sha256:abc", nil
+		case <-ctx.Done():
+			if cancelled != nil {
+				close(cancelled)
+			}
+			return "", ctx.Err()
+		}
+	}
+}
+
+// waitForWaiters waits until n callers wait for the pull of key.
+func waitForWaiters(t *testing.T, g *pullGroup, key string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		g.mu.Lock()
+		c := g.calls[key]
+		got := 0
+		if c != nil {
+			got = c.waiters
+		}
+		g.mu.Unlock()
+		if got == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d callers of %q", n, key)
+}
+
+func TestPullGroupSharesPull(t *testing.T) {
+	var g pullGroup
+	var runs int32
+	release := make(chan struct{})
+	pull := blockingPull(&runs, release, nil)
+	type result struct {
+		ref string
+		err error
+	}
+	results := make(chan result, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			ref, err := g.do(context.Background(), "alpine", pull)
+			results <- result{ref, err}
+		}()
+	}
+	waitForWaiters(t, &g, "alpine", 3)
+	close(release)
+	for i := 0; i < 3; i++ {
+		if r := <-results; r.ref != "sha256:abc" || r.err != nil {
+			t.Errorf("do() = %q, %v, want the shared result", r.ref, r.err)
+		}
+	}
+	if runs != 1 {
+		t.Errorf("pull ran %d times, want once", runs)
+	}
+	if len(g.calls) != 0 {
+		t.Errorf("%d pulls remembered after they finished", len(g.calls))
+	}
+}
+
+func TestPullGroupCallerLeaves(t *testing.T) {
+	tests := []struct {
+		name string
+		// stay is whether another caller keeps waiting for the pull.
+		stay bool
+	}{
+		{name: "others still wait", stay: true},
+		{name: "last caller", stay: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var g pullGroup
+			var runs int32
+			release := make(chan struct{})
+			cancelled := make(chan struct{})
+			pull := blockingPull(&runs, release, cancelled)
+
+			stayed := make(chan error, 1)
+			waiters := 1
+			if tt.stay {
+				waiters++
+				go func() {
+					_, err := g.do(context.Background(), "alpine", pull)
+					stayed <- err
+				}()
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			left := make(chan error, 1)
+			go func() {
+				_, err := g.do(ctx, "alpine", pull)
+				left <- err
+			}()
+			waitForWaiters(t, &g, "alpine", waiters)
+			cancel()
+			if err := <-left; !errors.Is(err, context.Canceled) {
+				t.Fatalf("do() after the caller gave up = %v, want %v", err, context.Canceled)
+			}
+
+			if !tt.stay {
+				select {
+				case <-cancelled:
+				case <-time.After(5 * time.Second):
+					t.Fatal("pull wasn't cancelled after its last caller left")
+				}
+				// A later caller starts over rather than joining the
+				// cancelled pull.
+				close(release)
+				ref, err := g.do(context.Background(), "alpine", pull)
+				if ref != "sha256:abc" || err != nil {
+					t.Errorf("do() after a cancelled pull = %q, %v", ref, err)
+				}
+				if runs != 2 {
+					t.Errorf("pull ran %d times, want twice", runs)
+				}
+				return
+			}
+			close(release)
+			if err := <-stayed; err != nil {
+				t.Errorf("do() for the caller that stayed = %v", err)
+			}
+			select {
+			case <-cancelled:
+				t.Error("pull was cancelled while a caller still waited")
+			default:
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package machineman
+
+import (
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ananthb/systemd-cri/internal/imageref"
+	"github.com/containers/image/v5/types"
+	"github.com/coreos/go-systemd/v22/journal"
+)
+
+// pullProgressInterval is how often containers/image reports the progress
+// of a layer download. Only the start and end of layers are journaled, the
+// reports in between are dropped.
+const pullProgressInterval = 10 * time.Second
+
+// journalFailure makes sure a journal that rejects entries is only
+// complained about once.
+var journalFailure sync.Once
+
+// pullJournal records an attempt to pull an image, and the layers it
+// fetched, as structured journal entries. Every entry carries IMAGE_REF, so
+// that e.g. "journalctl IMAGE_REF=docker.io/library/alpine:latest" shows
+// the pull history of an image, and PULL_ID, which tells attempts apart.
+type pullJournal struct {
+	ref   imageref.Ref
+	id    string
+	start time.Time
+	// layers holds when the download of each layer in flight started,
+	// keyed by digest.
+	layers map[string]time.Time
+}
+
+// startPull journals the start of a pull of ref.
+func startPull(ref imageref.Ref) *pullJournal {
+	j := &pullJournal{ref: ref, start: time.Now(), layers: map[string]time.Time{}}
+	if id, err := newID(); err == nil {
+		j.id = id[:16]
+	}
+	j.send("pulling image "+ref.String(), journal.PriInfo, map[string]string{
+		"PULL_EVENT": "start",
+	})
+	return j
+}
+
+// watch journals the layer progress reported on progress until it is
+// closed.
+func (j *pullJournal) watch(progress <-chan types.ProgressProperties) {
+	for p := range progress {
+		digest := p.Artifact.Digest.String()
+		switch p.Event {
+		case types.ProgressEventNewArtifact:
+			j.layers[digest] = time.Now()
+		case types.ProgressEventDone:
+			started, ok := j.layers[digest]
+			delete(j.layers, digest)
+			fields := map[string]string{
+				"PULL_EVENT":   "layer",
+				"LAYER_DIGEST": digest,
+				"LAYER_BYTES":  strconv.FormatUint(p.Offset, 10),
+			}
+			if ok {
+				fields["DURATION_MS"] = strconv.FormatInt(time.Since(started).Milliseconds(), 10)
+			}
+			j.send("fetched layer "+digest+" of "+j.ref.String(), journal.PriDebug, fields)
+		case types.ProgressEventSkipped:
+			j.send("layer "+digest+" of "+j.ref.String()+" is already present", journal.PriDebug, map[string]string{
+				"PULL_EVENT":   "layer-skipped",
+				"LAYER_DIGEST": digest,
+			})
+		}
+	}
+}
+
+// done journals the outcome of the pull.
+func (j *pullJournal) done(err error) {
+	fields := map[string]string{
+		"PULL_EVENT":  "done",
+		"DURATION_MS": strconv.FormatInt(time.Since(j.start).Milliseconds(), 10),
+	}
+	if err != nil {
+		fields["PULL_EVENT"] = "failed"
+		fields["ERROR"] = err.Error()
+		j.send("failed to pull image "+j.ref.String()+": "+err.Error(), journal.PriErr, fields)
+		return
+	}
+	j.send("pulled image "+j.ref.String(), journal.PriInfo, fields)
+}
+
+func (j *pullJournal) send(message string, priority journal.Priority, fields map[string]string) {
+	if !journal.Enabled() {
+		return
+	}
+	fields["IMAGE_REF"] = j.ref.String()
+	fields["IMAGE_REGISTRY"] = j.ref.Domain()
+	fields["PULL_ID"] = j.id
+	fields["SYSLOG_IDENTIFIER"] = "systemd-cri"
+	if err := journal.Send(message, priority, fields); err != nil {
+		journalFailure.Do(func() {
+			log.Printf("failed to write pull history to the journal: %v", err)
+		})
+	}
+}
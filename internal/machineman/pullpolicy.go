@@ -0,0 +1,82 @@
+package machineman
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// imagePullPolicyAnnotation is a container or sandbox annotation that has
+// the runtime enforce an image pull policy on its own, on top of kubelet's:
+// Always, IfNotPresent or Never, as in the pod spec. The container's
+// annotation takes precedence over the sandbox's.
+const imagePullPolicyAnnotation = "systemd-cri.io/image-pull-policy"
+
+const (
+	pullAlways       = "Always"
+	pullIfNotPresent = "IfNotPresent"
+	pullNever        = "Never"
+)
+
+// imagePullPolicy returns the pull policy set by the annotations of a
+// container and its sandbox, empty if there is none.
+func imagePullPolicy(container, sandbox map[string]string) (string, error) {
+	policy, ok := container[imagePullPolicyAnnotation]
+	if !ok {
+		policy = sandbox[imagePullPolicyAnnotation]
+	}
+	switch policy {
+	case "", pullAlways, pullIfNotPresent, pullNever:
+		return policy, nil
+	}
+	return "", status.Errorf(
+		codes.InvalidArgument,
+		"annotation %s: unknown pull policy %q, want %s, %s or %s",
+		imagePullPolicyAnnotation, policy, pullAlways, pullIfNotPresent, pullNever,
+	)
+}
+
+// enforcePullPolicy makes sure the image of a container is present as its
+// pull policy demands, pulling it if needed. CreateContainer carries no
+// registry credentials, so only images that can be pulled without any are
+// pulled here.
+func (i *ImageService) enforcePullPolicy(ctx context.Context, image, policy string) error {
+	switch policy {
+	case pullAlways:
+		_, err := i.pull(ctx, image, nil)
+		return err
+	case pullIfNotPresent, pullNever:
+		present, err := i.imagePresent(image)
+		if err != nil || present {
+			return err
+		}
+		if policy == pullNever {
+			return status.Errorf(
+				codes.FailedPrecondition,
+				"image %s is not present and pull policy is %s",
+				image, pullNever,
+			)
+		}
+		_, err = i.pull(ctx, image, nil)
+		return err
+	}
+	return nil
+}
+
+// imagePresent reports whether an image has been pulled into the store.
+func (i *ImageService) imagePresent(image string) (bool, error) {
+	ref, err := parseImage(image)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(filepath.Join(ref.StoragePath(i.opts.Root), versionFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
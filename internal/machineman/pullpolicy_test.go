@@ -0,0 +1,88 @@
+package machineman
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestImagePullPolicy(t *testing.T) {
+	tests := []struct {
+		name      string
+		container map[string]string
+		sandbox   map[string]string
+		want      string
+		wantCode  codes.Code
+	}{
+		{"none", nil, nil, "", codes.OK},
+		{"container", map[string]string{imagePullPolicyAnnotation: pullNever}, nil, pullNever, codes.OK},
+		{"sandbox", nil, map[string]string{imagePullPolicyAnnotation: pullAlways}, pullAlways, codes.OK},
+		{
+			"container over sandbox",
+			map[string]string{imagePullPolicyAnnotation: pullIfNotPresent},
+			map[string]string{imagePullPolicyAnnotation: pullNever},
+			pullIfNotPresent, codes.OK,
+		},
+		{
+			"empty container annotation over sandbox",
+			map[string]string{imagePullPolicyAnnotation: ""},
+			map[string]string{imagePullPolicyAnnotation: pullNever},
+			"", codes.OK,
+		},
+		{"unknown", map[string]string{imagePullPolicyAnnotation: "never"}, nil, "", codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := imagePullPolicy(tt.container, tt.sandbox)
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("imagePullPolicy() = %v, want code %v", err, tt.wantCode)
+			}
+			if got != tt.want {
+				t.Errorf("imagePullPolicy() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnforcePullPolicy(t *testing.T) {
+	const (
+		present = "registry.example.com/present:1.0"
+		missing = "registry.example.com/missing:1.0"
+	)
+	root := t.TempDir()
+	writeImage(t, root, "", present, 1, 10)
+	i := &ImageService{opts: ImageOptions{Root: root}}
+	// Every pull is refused by policy before it reaches a registry, so
+	// that the tests see which policies pull.
+	policy, err := newRegistryPolicy(nil, []string{"*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.registries.Store(&policy)
+
+	tests := []struct {
+		name     string
+		image    string
+		policy   string
+		wantCode codes.Code
+	}{
+		{"no policy", missing, "", codes.OK},
+		{"Never present", present, pullNever, codes.OK},
+		{"Never missing", missing, pullNever, codes.FailedPrecondition},
+		{"IfNotPresent present", present, pullIfNotPresent, codes.OK},
+		{"IfNotPresent missing pulls", missing, pullIfNotPresent, codes.PermissionDenied},
+		{"Always pulls present", present, pullAlways, codes.PermissionDenied},
+		{"Always pulls missing", missing, pullAlways, codes.PermissionDenied},
+		{"invalid image", "Invalid Image", pullNever, codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := i.enforcePullPolicy(context.Background(), tt.image, tt.policy)
+			if code := status.Code(err); code != tt.wantCode {
+				t.Errorf("enforcePullPolicy(%s, %q) = %v, want code %v", tt.image, tt.policy, err, tt.wantCode)
+			}
+		})
+	}
+}
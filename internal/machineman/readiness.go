@@ -0,0 +1,131 @@
+package machineman
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/dbus"
+	godbus "github.com/godbus/dbus/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// readyNotifyAnnotation is a container annotation that has the
+	// container tell systemd when it is ready, with sd_notify(3) READY=1,
+	// like a Type=notify service. StartContainer returns once it did.
+	readyNotifyAnnotation = "systemd-cri.io/ready-notify"
+	// readyCommandAnnotation is a container annotation holding a command,
+	// as a JSON array, that is run in the container after it started until
+	// it succeeds. StartContainer returns once it did.
+	readyCommandAnnotation = "systemd-cri.io/ready-command"
+	// readyTimeoutAnnotation is a container annotation that bounds how long
+	// StartContainer waits for the container to become ready, as a
+	// duration like "90s".
+	readyTimeoutAnnotation = "systemd-cri.io/ready-timeout"
+)
+
+const (
+	// defaultReadyTimeout is how long a container is given to become ready
+	// without readyTimeoutAnnotation.
+	defaultReadyTimeout = 2 * time.Minute
+	// readyCommandInterval is how often the ready command is retried.
+	readyCommandInterval = time.Second
+)
+
+// readiness is how a container signals that it finished starting.
+type readiness struct {
+	Notify  bool
+	Command []string
+	Timeout time.Duration
+}
+
+// readinessConfig reads the readiness gate of a container from its
+// annotations. A container without one is ready as soon as it started.
+func readinessConfig(annotations map[string]string) (readiness, error) {
+	rd := readiness{Timeout: defaultReadyTimeout}
+	if value, ok := annotations[readyNotifyAnnotation]; ok {
+		notify, err := strconv.ParseBool(value)
+		if err != nil {
+			return readiness{}, status.Errorf(
+				codes.InvalidArgument,
+				"annotation %s: %q is not a boolean",
+				readyNotifyAnnotation, value,
+			)
+		}
+		rd.Notify = notify
+	}
+	if value, ok := annotations[readyCommandAnnotation]; ok {
+		if err := json.Unmarshal([]byte(value), &rd.Command); err != nil || len(rd.Command) == 0 {
+			return readiness{}, status.Errorf(
+				codes.InvalidArgument,
+				"annotation %s: %q is not a non-empty JSON array of strings",
+				readyCommandAnnotation, value,
+			)
+		}
+	}
+	if value, ok := annotations[readyTimeoutAnnotation]; ok {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			return readiness{}, status.Errorf(
+				codes.InvalidArgument,
+				"annotation %s: %q is not a positive duration",
+				readyTimeoutAnnotation, value,
+			)
+		}
+		rd.Timeout = timeout
+	}
+	return rd, nil
+}
+
+// readinessProperties returns the unit properties and systemd-nspawn
+// arguments that have systemd wait for a container to notify readiness.
+// The start job, and with it StartTransientUnit, then only finishes once
+// the container sent READY=1, or fails when it didn't within the timeout.
+func readinessProperties(rd readiness) ([]dbus.Property, []string) {
+	if !rd.Notify {
+		return nil, nil
+	}
+	props := []dbus.Property{
+		{Name: "Type", Value: godbus.MakeVariant("notify")},
+		{Name: "TimeoutStartUSec", Value: godbus.MakeVariant(uint64(rd.Timeout / time.Microsecond))},
+	}
+	return props, []string{"--notify-ready=yes"}
+}
+
+// waitReady runs the ready command of a started container until it
+// succeeds. A container that doesn't get there within its timeout is
+// marked as not ready, which its status reports.
+func (r *RuntimeService) waitReady(ctx context.Context, c *containerRecord) error {
+	if len(c.Readiness.Command) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.Readiness.Timeout)
+	defer cancel()
+	ticker := time.NewTicker(readyCommandInterval)
+	defer ticker.Stop()
+	var last string
+	for {
+		resp, err := r.execSync(ctx, c, c.Readiness.Command, 0)
+		switch {
+		case err == nil && resp.GetExitCode() == 0:
+			return nil
+		case err == nil:
+			last = "exit code " + strconv.Itoa(int(resp.GetExitCode())) + ": " + string(resp.GetStderr())
+		default:
+			last = err.Error()
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			c.setNotReady("ready command did not succeed within " + c.Readiness.Timeout.String() + ", last attempt: " + last)
+			return status.Errorf(
+				codes.DeadlineExceeded,
+				"container %s did not become ready within %v: %s",
+				c.ID, c.Readiness.Timeout, last,
+			)
+		}
+	}
+}
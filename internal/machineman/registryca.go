@@ -0,0 +1,53 @@
+package machineman
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/containers/image/v5/types"
+)
+
+// checkRegistryCADir makes sure the directory of registry CAs exists, so
+// that a typo in it fails at startup rather than as TLS errors on pulls.
+func checkRegistryCADir(dir string) error {
+	if dir == "" {
+		return nil
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("registry CA directory %s is not a directory", dir)
+	}
+	return nil
+}
+
+// withRegistryCAs makes a pull trust the CAs in the directory of registry
+// CAs for the registries they were put there for, in addition to the
+// system's. The directory has a subdirectory per registry, named after its
+// host and port if any, holding *.crt CA certificates, and optionally a
+// *.cert and *.key client certificate, like /etc/containers/certs.d.
+// Certificates are still verified, whatever the directory holds.
+func (i *ImageService) withRegistryCAs(sys *types.SystemContext) *types.SystemContext {
+	dir := i.registryCADir.Load()
+	if dir == nil || *dir == "" {
+		return sys
+	}
+	if sys == nil {
+		sys = &types.SystemContext{}
+	}
+	sys.DockerPerHostCertDirPath = *dir
+	return sys
+}
+
+// SetRegistryCADir replaces the directory of registry CAs for the pulls
+// that start from then on. The certificates in the directory are read by
+// each pull, so adding some to it needs no reload.
+func (i *ImageService) SetRegistryCADir(dir string) error {
+	if err := checkRegistryCADir(dir); err != nil {
+		return err
+	}
+	i.registryCADir.Store(&dir)
+	return nil
+}
@@ -0,0 +1,95 @@
+package machineman
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/containers/image/v5/types"
+)
+
+// registryLimits caps how many blobs are downloaded from each registry at
+// once, across all pulls, so that the parallel layer downloads of several
+// large images don't add up to more than a registry's rate limit allows.
+type registryLimits struct {
+	mu sync.Mutex
+	// max is the number of downloads per registry, zero for no limit.
+	max   uint
+	slots map[string]chan struct{}
+}
+
+// setMax replaces the number of downloads per registry for the pulls that
+// start from then on. Downloads already running keep to the old number.
+func (l *registryLimits) setMax(max uint) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.max, l.slots = max, nil
+}
+
+// reference wraps the source of a pull from the registry at host so that
+// its blobs are downloaded within the registry's limit.
+func (l *registryLimits) reference(ref types.ImageReference, host string) types.ImageReference {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.max == 0 {
+		return ref
+	}
+	if l.slots == nil {
+		l.slots = map[string]chan struct{}{}
+	}
+	slots, ok := l.slots[host]
+	if !ok {
+		slots = make(chan struct{}, l.max)
+		l.slots[host] = slots
+	}
+	return limitedReference{ImageReference: ref, slots: slots}
+}
+
+type limitedReference struct {
+	types.ImageReference
+	slots chan struct{}
+}
+
+func (r limitedReference) NewImageSource(ctx context.Context, sys *types.SystemContext) (types.ImageSource, error) {
+	src, err := r.ImageReference.NewImageSource(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	return limitedSource{ImageSource: src, slots: r.slots}, nil
+}
+
+// limitedSource holds one of its registry's slots from the start of a blob
+// download until the blob is closed.
+type limitedSource struct {
+	types.ImageSource
+	slots chan struct{}
+}
+
+func (s limitedSource) GetBlob(
+	ctx context.Context,
+	info types.BlobInfo,
+	cache types.BlobInfoCache,
+) (io.ReadCloser, int64, error) {
+	select {
+	case s.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, 0, ctx.Err()
+	}
+	blob, size, err := s.ImageSource.GetBlob(ctx, info, cache)
+	if err != nil {
+		<-s.slots
+		return nil, 0, err
+	}
+	return &slotReader{ReadCloser: blob, slots: s.slots}, size, nil
+}
+
+type slotReader struct {
+	io.ReadCloser
+	slots    chan struct{}
+	released sync.Once
+}
+
+func (r *slotReader) Close() error {
+	r.released.Do(func() { <-r.slots })
+	return r.ReadCloser.Close()
+}
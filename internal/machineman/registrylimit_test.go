@@ -0,0 +1,173 @@
+package machineman
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containers/image/v5/types"
+)
+
+// fakeReference is an image reference whose source is src.
+type fakeReference struct {
+	types.ImageReference
+	src types.ImageSource
+}
+
+func (r fakeReference) NewImageSource(context.Context, *types.SystemContext) (types.ImageSource, error) {
+	return r.src, nil
+}
+
+// fakeSource serves blobs that take latency to download. Blobs are told
+// apart by their size, and it fails to serve those whose size is in fail.
+type fakeSource struct {
+	types.ImageSource
+	latency time.Duration
+	fail    map[int64]bool
+}
+
+func (s fakeSource) GetBlob(_ context.Context, info types.BlobInfo, _ types.BlobInfoCache) (io.ReadCloser, int64, error) {
+	if s.fail[info.Size] {
+		return nil, 0, errors.New("blob unknown to registry")
+	}
+	time.Sleep(s.latency)
+	return io.NopCloser(strings.NewReader("layer")), 5, nil
+}
+
+func limitedSourceFor(t testing.TB, l *registryLimits, host string, src fakeSource) types.ImageSource {
+	t.Helper()
+	s, err := l.reference(fakeReference{src: src}, host).NewImageSource(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestRegistryLimitsUnlimited(t *testing.T) {
+	var l registryLimits
+	ref := fakeReference{}
+	if got := l.reference(ref, "docker.io"); got != types.ImageReference(ref) {
+		t.Errorf("reference() without a limit = %#v, want the reference unwrapped", got)
+	}
+}
+
+func TestRegistryLimits(t *testing.T) {
+	l := registryLimits{max: 2}
+	src := fakeSource{fail: map[int64]bool{9: true}}
+	quay := limitedSourceFor(t, &l, "quay.io", src)
+	docker := limitedSourceFor(t, &l, "docker.io", src)
+	ctx := context.Background()
+	blob := func(n int) types.BlobInfo {
+		return types.BlobInfo{Size: int64(n)}
+	}
+
+	first, _, err := quay.GetBlob(ctx, blob(1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Another pull from the same registry shares its slots.
+	second, _, err := limitedSourceFor(t, &l, "quay.io", src).GetBlob(ctx, blob(2), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		src  types.ImageSource
+		// timeout cuts the wait for a slot short, zero to not wait.
+		timeout time.Duration
+		wantErr error
+	}{
+		{name: "registry at its limit", src: quay, timeout: 20 * time.Millisecond, wantErr: context.DeadlineExceeded},
+		{name: "other registry", src: docker},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+			r, _, err := tt.src.GetBlob(ctx, blob(3), nil)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("GetBlob() = %v, want %v", err, tt.wantErr)
+			}
+			if r != nil {
+				r.Close()
+			}
+		})
+	}
+
+	// Closing a blob twice frees its slot only once.
+	first.Close()
+	first.Close()
+	third, _, err := quay.GetBlob(ctx, blob(3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctxTimeout, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, _, err := quay.GetBlob(ctxTimeout, blob(4), nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("GetBlob() with both slots taken = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// A failed download frees its slot right away.
+	second.Close()
+	if _, _, err := quay.GetBlob(ctx, blob(9), nil); err == nil {
+		t.Fatal("GetBlob() of a missing blob succeeded")
+	}
+	fourth, _, err := quay.GetBlob(ctx, blob(4), nil)
+	if err != nil {
+		t.Fatalf("GetBlob() after a failed download = %v", err)
+	}
+	third.Close()
+	fourth.Close()
+}
+
+// BenchmarkLayerDownloads downloads the 20 layers of an image from blobs
+// that take a millisecond each, with as many downloads at once as the pull
+// allows, and as its registry's limit allows.
+func BenchmarkLayerDownloads(b *testing.B) {
+	const layers = 20
+	for _, parallel := range []int{1, 4, layers} {
+		for _, limit := range []uint{0, 2} {
+			name := "parallel=" + strconv.Itoa(parallel) + "/registry-limit=" + strconv.Itoa(int(limit))
+			b.Run(name, func(b *testing.B) {
+				l := registryLimits{max: limit}
+				src := limitedSourceFor(b, &l, "docker.io", fakeSource{latency: time.Millisecond})
+				for n := 0; n < b.N; n++ {
+					pullLayers(b, src, layers, parallel)
+				}
+			})
+		}
+	}
+}
+
+// pullLayers downloads layers blobs from src, parallel at a time, the way
+// copy.Image does with MaxParallelDownloads.
+func pullLayers(b *testing.B, src types.ImageSource, layers, parallel int) {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, parallel)
+	for i := 0; i < layers; i++ {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			blob, _, err := src.GetBlob(context.Background(), types.BlobInfo{Size: int64(i)}, nil)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			io.Copy(io.Discard, blob)
+			blob.Close()
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,72 @@
+package machineman
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/ananthb/systemd-cri/internal/imageref"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// registryPolicy decides which registries images may be pulled from. Hosts
+// are matched against shell patterns, so "*.example.com" covers every
+// subdomain of example.com. Blocked registries win over allowed ones.
+type registryPolicy struct {
+	// allowed lists the registries that can be pulled from, all of them if
+	// empty.
+	allowed []string
+	blocked []string
+}
+
+func newRegistryPolicy(allowed, blocked []string) (registryPolicy, error) {
+	var p registryPolicy
+	for _, list := range []struct {
+		patterns []string
+		dst      *[]string
+	}{{allowed, &p.allowed}, {blocked, &p.blocked}} {
+		for _, pattern := range list.patterns {
+			pattern = strings.ToLower(strings.TrimSpace(pattern))
+			if pattern == "" {
+				continue
+			}
+			if _, err := path.Match(pattern, ""); err != nil {
+				return registryPolicy{}, fmt.Errorf("registry pattern %q: %w", pattern, err)
+			}
+			*list.dst = append(*list.dst, pattern)
+		}
+	}
+	return p, nil
+}
+
+// check returns PermissionDenied if ref is from a registry the policy
+// doesn't allow pulls from.
+func (p registryPolicy) check(ref imageref.Ref) error {
+	registry := strings.ToLower(ref.Domain())
+	if matchRegistry(p.blocked, registry) {
+		return status.Errorf(
+			codes.PermissionDenied,
+			"pulling %s: registry %s is blocked",
+			ref, registry,
+		)
+	}
+	if len(p.allowed) > 0 && !matchRegistry(p.allowed, registry) {
+		return status.Errorf(
+			codes.PermissionDenied,
+			"pulling %s: registry %s is not allowed",
+			ref, registry,
+		)
+	}
+	return nil
+}
+
+func matchRegistry(patterns []string, registry string) bool {
+	for _, pattern := range patterns {
+		// The patterns were checked when the policy was made.
+		if ok, _ := path.Match(pattern, registry); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package machineman
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ananthb/systemd-cri/internal/imageref"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRegistryPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		blocked []string
+		image   string
+		// wantCode is the code of the check, and wantRegistry the
+		// registry a refusal names.
+		wantCode     codes.Code
+		wantRegistry string
+	}{
+		{"no lists", nil, nil, "alpine", codes.OK, ""},
+		{"allowed", []string{"registry.example.com"}, nil, "registry.example.com/app", codes.OK, ""},
+		{
+			"not allowed",
+			[]string{"registry.example.com"}, nil,
+			"quay.io/app", codes.PermissionDenied, "quay.io",
+		},
+		{"Docker Hub", []string{"docker.io"}, nil, "alpine", codes.OK, ""},
+		{"wildcard", []string{"*.example.com"}, nil, "eu.registry.example.com/app", codes.OK, ""},
+		{
+			"wildcard doesn't match the domain",
+			[]string{"*.example.com"}, nil,
+			"example.com/app", codes.PermissionDenied, "example.com",
+		},
+		{
+			"wildcard doesn't match another domain",
+			[]string{"*.example.com"}, nil,
+			"registry.example.org/app", codes.PermissionDenied, "registry.example.org",
+		},
+		{"case", []string{"Registry.Example.COM"}, nil, "registry.example.com/app", codes.OK, ""},
+		{"port", []string{"localhost:*"}, nil, "localhost:5000/app", codes.OK, ""},
+		{
+			"blocked",
+			nil, []string{"quay.io"},
+			"quay.io/app", codes.PermissionDenied, "quay.io",
+		},
+		{"not blocked", nil, []string{"quay.io"}, "ghcr.io/app", codes.OK, ""},
+		{
+			"blocked beats allowed",
+			[]string{"*.example.com"}, []string{"untrusted.example.com"},
+			"untrusted.example.com/app", codes.PermissionDenied, "untrusted.example.com",
+		},
+		{
+			"blocked wildcard beats allowed",
+			[]string{"registry.example.com"}, []string{"*.example.com"},
+			"registry.example.com/app", codes.PermissionDenied, "registry.example.com",
+		},
+		{"blank patterns", []string{" ", ""}, []string{""}, "alpine", codes.OK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := newRegistryPolicy(tt.allowed, tt.blocked)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ref, err := imageref.Parse(tt.image)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = p.check(ref)
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("check(%s) = %v, want code %v", tt.image, err, tt.wantCode)
+			}
+			if err != nil && !strings.Contains(status.Convert(err).Message(), "registry "+tt.wantRegistry+" ") {
+				t.Errorf("check(%s) = %v, want it to name registry %s", tt.image, err, tt.wantRegistry)
+			}
+		})
+	}
+}
+
+func TestNewRegistryPolicyRejectsBadPatterns(t *testing.T) {
+	if _, err := newRegistryPolicy([]string{"[example.com"}, nil); err == nil {
+		t.Error("newRegistryPolicy() of an allowed pattern with an unclosed [ succeeded")
+	}
+	if _, err := newRegistryPolicy(nil, []string{"example.com\\"}); err == nil {
+		t.Error("newRegistryPolicy() of a blocked pattern with a trailing \\ succeeded")
+	}
+}
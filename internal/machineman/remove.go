@@ -0,0 +1,158 @@
+package machineman
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/ananthb/systemd-cri/internal/crilog"
+)
+
+// removeContainer kills a container, waits for systemd to let go of its unit
+// and forgets the container, along with its log.
+func (r *RuntimeService) removeContainer(ctx context.Context, c *containerRecord) error {
+	c.lifecycle.Lock()
+	defer c.lifecycle.Unlock()
+	if _, err := r.containers.get(c.ID); err != nil {
+		// Removed by a call that held the lock before this one.
+		return nil
+	}
+	unit := containerUnit(c.ID)
+	var exited bool
+	if c.RetainRootfs > 0 {
+		times, err := r.containerTimes(ctx, c)
+		exited = err == nil && times.FinishedAt != 0
+	}
+	if err := r.stopUnit(ctx, unit, 0); err != nil {
+		return fmt.Errorf("stop container %s: %w", c.ID, err)
+	}
+	if err := r.releaseUnit(ctx, unit); err != nil {
+		return fmt.Errorf("remove container %s: %w", c.ID, err)
+	}
+	if c.output != nil {
+		c.output.close()
+		r.forgetOutput(c.ID)
+	}
+	r.dropResumedOutput(c.ID)
+	if c.Log != nil {
+		c.Log.Close()
+	}
+	if c.Stdin != nil {
+		c.Stdin.close()
+	}
+	if exited {
+		if _, err := r.images.rootfs.retain(c.ID, c.SandboxID, c.Metadata.GetName(), c.RetainRootfs); err != nil {
+			log.Printf("failed to retain the writable layer of container %s: %v", c.ID, err)
+		}
+	}
+	if err := r.images.rootfs.release(c.ID); err != nil {
+		return fmt.Errorf("remove root filesystem of container %s: %w", c.ID, err)
+	}
+	// The layers of images removed while the container used them are
+	// left for nothing else now.
+	if err := r.images.pruneLayers(); err != nil {
+		log.Printf("failed to prune image layers: %v", err)
+	}
+	if c.LogPath != "" {
+		if err := crilog.Remove(c.LogPath); err != nil {
+			return fmt.Errorf("remove log of container %s: %w", c.ID, err)
+		}
+	}
+	if err := r.containerUnits.remove(c.ID); err != nil {
+		return fmt.Errorf("remove state of container %s: %w", c.ID, err)
+	}
+	r.containers.remove(c.ID)
+	r.stats.invalidate(c.ID)
+	return nil
+}
+
+// dropLeftoverContainer cleans up after a container that was created
+// before the runtime restarted and is no longer known: its unit, should it
+// have been started, and its root filesystem.
+func (r *RuntimeService) dropLeftoverContainer(ctx context.Context, id string) error {
+	unit := containerUnit(id)
+	if err := r.stopUnit(ctx, unit, 0); err != nil {
+		return fmt.Errorf("stop leftover container %s: %w", id, err)
+	}
+	if err := r.releaseUnit(ctx, unit); err != nil {
+		return fmt.Errorf("remove leftover container %s: %w", id, err)
+	}
+	r.dropResumedOutput(id)
+	if err := r.images.rootfs.release(id); err != nil {
+		return fmt.Errorf("remove root filesystem of leftover container %s: %w", id, err)
+	}
+	// The layers of images removed while the container used them are
+	// left for nothing else now.
+	if err := r.images.pruneLayers(); err != nil {
+		log.Printf("failed to prune image layers: %v", err)
+	}
+	return r.containerUnits.remove(id)
+}
+
+// removeSandbox tears a sandbox down in a fixed order: first its containers,
+// then its network and IPC namespaces, then its slice. Stopping the slice
+// while container units are still around would have systemd stop them behind
+// our back, and a unit that is restarted in the meantime would bring the
+// pod's cgroup back. The network goes before the slice so that nothing in the
+// pod can still use it.
+// The sandbox is only forgotten once every step succeeded, so that a failed
+// removal can be retried.
+func (r *RuntimeService) removeSandbox(ctx context.Context, sb *sandboxRecord) error {
+	for _, c := range r.containers.list(nil) {
+		if c.SandboxID != sb.ID {
+			continue
+		}
+		if err := r.removeContainer(ctx, c); err != nil {
+			return err
+		}
+	}
+	if err := r.images.rootfs.dropRetained(sb.ID); err != nil {
+		return fmt.Errorf("remove retained root filesystems of pod sandbox %s: %w", sb.ID, err)
+	}
+	if err := r.teardownNetwork(sb); err != nil {
+		return fmt.Errorf("tear down network of pod sandbox %s: %w", sb.ID, err)
+	}
+	if err := r.teardownIPC(sb); err != nil {
+		return fmt.Errorf("tear down IPC namespace of pod sandbox %s: %w", sb.ID, err)
+	}
+	unit := sb.Slice
+	if err := r.stopUnit(ctx, unit, 0); err != nil {
+		return fmt.Errorf("stop pod sandbox %s: %w", sb.ID, err)
+	}
+	if err := r.releaseUnit(ctx, unit); err != nil {
+		return fmt.Errorf("remove pod sandbox %s: %w", sb.ID, err)
+	}
+	if err := r.sandboxStates.remove(sb.ID); err != nil {
+		return fmt.Errorf("remove state of pod sandbox %s: %w", sb.ID, err)
+	}
+	r.execs.forget(sb.ID)
+	r.sandboxes.remove(sb.ID)
+	return nil
+}
+
+// teardownNetwork releases the network namespace of a sandbox. A namespace
+// made by something else is only let go of, it is up to its owner to tear
+// it down.
+func (r *RuntimeService) teardownNetwork(sb *sandboxRecord) error {
+	if sb.NetNS == nil {
+		return nil
+	}
+	if err := sb.NetNS.Close(); err != nil {
+		return err
+	}
+	sb.NetNS = nil
+	return nil
+}
+
+// teardownIPC releases the IPC namespace the containers of a sandbox
+// shared.
+func (r *RuntimeService) teardownIPC(sb *sandboxRecord) error {
+	if sb.IPCNSPath == "" {
+		return nil
+	}
+	if err := removeIPCNS(sb.IPCNSPath); err != nil {
+		return err
+	}
+	sb.IPCNSPath = ""
+	return nil
+}
@@ -0,0 +1,181 @@
+package machineman
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+func TestRemoveContainerRemovedMeanwhile(t *testing.T) {
+	// A removal that waited for the lifecycle lock while another one
+	// removed the container finds nothing left to do.
+	var r RuntimeService
+	c := &containerRecord{ID: "c1"}
+	if err := r.removeContainer(context.Background(), c); err != nil {
+		t.Errorf("removeContainer() of a removed container = %v", err)
+	}
+}
+
+func TestRemoveContainer(t *testing.T) {
+	tests := []struct {
+		name string
+		// props are those of the container's unit, nil if it isn't
+		// loaded.
+		props map[string]interface{}
+		calls []string
+	}{
+		{
+			// A running container is killed without a grace period.
+			name:  "running",
+			props: map[string]interface{}{"ActiveState": "active"},
+			calls: []string{"KillUnit " + containerUnit("c1"), "StopUnit " + containerUnit("c1")},
+		},
+		{
+			name:  "exited",
+			props: map[string]interface{}{"ActiveState": "inactive"},
+		},
+		{
+			name:  "failed",
+			props: map[string]interface{}{"ActiveState": "failed"},
+			calls: []string{"ResetFailedUnit " + containerUnit("c1")},
+		},
+		{name: "unit gone"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeSystemd()
+			r, sb := podRuntime(t, fake)
+			r.containerUnits = containerUnits{dir: t.TempDir()}
+			logPath := filepath.Join(t.TempDir(), "0.log")
+			c := &containerRecord{
+				ID:        "c1",
+				SandboxID: sb.ID,
+				Metadata:  &runtimeapi.ContainerMetadata{Name: "app"},
+				LogPath:   logPath,
+			}
+			r.containers.add(c)
+			if err := r.containerUnits.save(c); err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range []string{logPath, logPath + ".20161006-001709.gz"} {
+				if err := os.WriteFile(name, nil, 0o640); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.props != nil {
+				fake.setUnit(containerUnit(c.ID), tt.props)
+			}
+			ctx := context.Background()
+			req := &runtimeapi.RemoveContainerRequest{ContainerId: c.ID}
+			if _, err := r.RemoveContainer(ctx, req); err != nil {
+				t.Fatal(err)
+			}
+			if calls := fake.callsMade(); !reflect.DeepEqual(calls, tt.calls) {
+				t.Errorf("calls = %q, want %q", calls, tt.calls)
+			}
+			if _, err := r.containers.get(c.ID); status.Code(err) != codes.NotFound {
+				t.Errorf("container is still known: %v", err)
+			}
+			if r.containerUnits.saved(c.ID) {
+				t.Error("container's state is still saved")
+			}
+			for _, name := range []string{logPath, logPath + ".20161006-001709.gz"} {
+				if _, err := os.Stat(name); !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("log file %s is left: %v", filepath.Base(name), err)
+				}
+			}
+			// Removing it again does nothing.
+			if _, err := r.RemoveContainer(ctx, req); err != nil {
+				t.Errorf("RemoveContainer() of a removed container = %v", err)
+			}
+			if calls := fake.callsMade(); len(calls) != len(tt.calls) {
+				t.Errorf("second RemoveContainer() made calls %q", calls[len(tt.calls):])
+			}
+		})
+	}
+}
+
+func TestRemoveContainerNotFound(t *testing.T) {
+	fake := newFakeSystemd()
+	r, _ := podRuntime(t, fake)
+	if _, err := r.RemoveContainer(context.Background(), &runtimeapi.RemoveContainerRequest{
+		ContainerId: "unknown",
+	}); err != nil {
+		t.Errorf("RemoveContainer() of an unknown container = %v", err)
+	}
+	if calls := fake.callsMade(); len(calls) != 0 {
+		t.Errorf("RemoveContainer() of an unknown container made calls %q", calls)
+	}
+}
+
+func TestRemoveContainerWhileStarting(t *testing.T) {
+	fake := newFakeSystemd()
+	r, sb := podRuntime(t, fake)
+	addRunningContainer(r, fake, sb, "c1", 0)
+	c, err := r.containers.get("c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A start holds the lifecycle lock until it is done.
+	c.lifecycle.Lock()
+	done := make(chan error, 1)
+	go func() {
+		_, err := r.RemoveContainer(context.Background(), &runtimeapi.RemoveContainerRequest{ContainerId: "c1"})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		c.lifecycle.Unlock()
+		t.Fatalf("RemoveContainer() = %v while the container was starting", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	c.lifecycle.Unlock()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("RemoveContainer() did not return once the start was done")
+	}
+	if _, err := r.containers.get("c1"); status.Code(err) != codes.NotFound {
+		t.Errorf("container is still known: %v", err)
+	}
+}
+
+func TestRemovePodSandboxOrder(t *testing.T) {
+	fake := newFakeSystemd()
+	r, sb := podRuntime(t, fake)
+	addRunningContainer(r, fake, sb, "app", 0)
+	addRunningContainer(r, fake, sb, "proxy", 0)
+	ctx := context.Background()
+	if _, err := r.RemovePodSandbox(ctx, &runtimeapi.RemovePodSandboxRequest{PodSandboxId: sb.ID}); err != nil {
+		t.Fatal(err)
+	}
+	calls := fake.callsMade()
+	slice := callIndex(t, calls, "StopUnit "+sb.Slice)
+	for _, id := range []string{"app", "proxy"} {
+		// Each container is killed and gone before the slice stops.
+		if i := callIndex(t, calls, "StopUnit "+containerUnit(id)); i > slice {
+			t.Errorf("container %s stopped after the slice: %q", id, calls)
+		}
+		if _, err := r.containers.get(id); status.Code(err) != codes.NotFound {
+			t.Errorf("container %s is still known: %v", id, err)
+		}
+	}
+	if _, err := r.sandboxes.get(sb.ID); status.Code(err) != codes.NotFound {
+		t.Errorf("sandbox is still known: %v", err)
+	}
+	if _, err := r.RemovePodSandbox(ctx, &runtimeapi.RemovePodSandboxRequest{PodSandboxId: sb.ID}); err != nil {
+		t.Errorf("RemovePodSandbox() of a removed sandbox = %v", err)
+	}
+}
@@ -0,0 +1,154 @@
+package machineman
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-systemd/v22/dbus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// resourceCheck compares a limit asked of systemd with what the cgroup of
+// the unit ended up with.
+type resourceCheck struct {
+	Property  string `json:"property"`
+	File      string `json:"file"`
+	Requested string `json:"requested"`
+	Effective string `json:"effective"`
+}
+
+func (c resourceCheck) ok() bool {
+	return c.Requested == c.Effective
+}
+
+// resourceFiles maps the unit properties resourceProperties sets to the
+// cgroup interface files they end up in. The cpuset files are the effective
+// ones, which are narrowed by the cpusets of parent slices.
+var resourceFiles = map[string]string{
+	"AllowedCPUs":        "cpuset.cpus.effective",
+	"AllowedMemoryNodes": "cpuset.mems.effective",
+	"MemoryHigh":         "memory.high",
+	"MemoryLow":          "memory.low",
+	"MemoryMax":          "memory.max",
+	"MemoryMin":          "memory.min",
+	"MemorySwapMax":      "memory.swap.max",
+}
+
+// checkResources reads back the cgroup values that props were meant to set,
+// in the form the kernel reports them. Hugetlb limits aren't included, the
+// runtime writes them to the cgroup itself.
+func checkResources(cgroup string, props []dbus.Property) ([]resourceCheck, error) {
+	var checks []resourceCheck
+	for _, prop := range props {
+		file, ok := resourceFiles[prop.Name]
+		if !ok {
+			continue
+		}
+		requested, err := cgroupValue(prop)
+		if err != nil {
+			return nil, err
+		}
+		data, err := os.ReadFile(filepath.Join(cgroupRoot, cgroup, file))
+		if err != nil {
+			return nil, err
+		}
+		effective := strings.TrimSpace(string(data))
+		if ids, err := parseCPUList(effective); err == nil && strings.HasPrefix(file, "cpuset.") {
+			effective = formatCPUList(ids)
+		}
+		checks = append(checks, resourceCheck{
+			Property:  prop.Name,
+			File:      file,
+			Requested: requested,
+			Effective: effective,
+		})
+	}
+	return checks, nil
+}
+
+// cgroupValue formats the value of a resource property the way its cgroup
+// interface file reads. Memory limits are kept by the kernel in whole pages.
+func cgroupValue(prop dbus.Property) (string, error) {
+	switch value := prop.Value.Value().(type) {
+	case []byte:
+		var ids []int
+		for i, b := range value {
+			for bit := 0; bit < 8; bit++ {
+				if b&(1<<bit) != 0 {
+					ids = append(ids, i*8+bit)
+				}
+			}
+		}
+		return formatCPUList(ids), nil
+	case uint64:
+		if value == math.MaxUint64 {
+			return "max", nil
+		}
+		page := uint64(os.Getpagesize())
+		return strconv.FormatUint(value/page*page, 10), nil
+	}
+	return "", fmt.Errorf("unit property %s has unexpected type %T", prop.Name, prop.Value.Value())
+}
+
+// verifyResources fails with the limits that the cgroup of a unit doesn't
+// have after they were set, such as those systemd ignored or a parent slice
+// narrowed.
+func verifyResources(cgroup string, props []dbus.Property) error {
+	checks, err := checkResources(cgroup, props)
+	if err != nil {
+		return err
+	}
+	var mismatched []string
+	for _, check := range checks {
+		if !check.ok() {
+			mismatched = append(mismatched, fmt.Sprintf(
+				"%s: requested %s, %s is %s",
+				check.Property, check.Requested, check.File, check.Effective,
+			))
+		}
+	}
+	if len(mismatched) > 0 {
+		return status.Errorf(
+			codes.FailedPrecondition,
+			"resource limits did not take effect: %s",
+			strings.Join(mismatched, "; "),
+		)
+	}
+	return nil
+}
+
+// resourceChecks compares the limits a container was given with those its
+// cgroup has, nil if it has none or they can't be read.
+func (r *RuntimeService) resourceChecks(ctx context.Context, c *containerRecord) []resourceCheck {
+	resources, annotations := c.resources()
+	props, err := resourceProperties(resources, annotations)
+	if err != nil || len(props) == 0 {
+		return nil
+	}
+	cgroup, err := r.unitCgroup(ctx, containerUnit(c.ID))
+	if err != nil {
+		return nil
+	}
+	checks, err := checkResources(cgroup, props)
+	if err != nil {
+		return nil
+	}
+	return checks
+}
+
+// resourcesInfo renders the requested and effective values of a container's
+// limits for verbose status.
+func resourcesInfo(checks []resourceCheck) string {
+	data, err := json.Marshal(checks)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
@@ -0,0 +1,69 @@
+package machineman
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+func TestStartContainerVerifiesResources(t *testing.T) {
+	resources := &runtimeapi.LinuxContainerResources{MemoryLimitInBytes: 64 << 20}
+	props, err := resourceProperties(resources, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		// narrowed overrides what the cgroup has of some limits.
+		narrowed map[string]string
+		code     codes.Code
+	}{
+		{name: "limits took effect"},
+		{
+			name:     "limit ignored",
+			narrowed: map[string]string{"memory.max": "max"},
+			code:     codes.FailedPrecondition,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeCgroupRoot(t)
+			fake := newFakeSystemd()
+			r := &RuntimeService{systemd: fake}
+			cgroup := startableContainer(t, r, resources)
+			for _, prop := range props {
+				file, ok := resourceFiles[prop.Name]
+				if !ok {
+					continue
+				}
+				value, err := cgroupValue(prop)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if narrowed, ok := tt.narrowed[file]; ok {
+					value = narrowed
+				}
+				if err := os.WriteFile(filepath.Join(cgroup, file), []byte(value+"\n"), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, err := r.StartContainer(context.Background(), &runtimeapi.StartContainerRequest{ContainerId: "c1"})
+			if status.Code(err) != tt.code {
+				t.Fatalf("StartContainer() = %v, want code %v", err, tt.code)
+			}
+			unit := fake.unitProperties(containerUnit("c1"))
+			want := "active"
+			if tt.code != codes.OK {
+				want = "inactive"
+			}
+			if unit["ActiveState"] != want {
+				t.Errorf("unit is %v, want it %s", unit["ActiveState"], want)
+			}
+		})
+	}
+}
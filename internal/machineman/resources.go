@@ -0,0 +1,130 @@
+package machineman
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/coreos/go-systemd/v22/dbus"
+	godbus "github.com/godbus/dbus/v5"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// resourceProperties translates container resources, and the annotations
+// that tune them, into the unit properties that enforce them. It validates
+// every requested value before returning so that nothing is applied for a
+// request that is partly invalid.
+func resourceProperties(
+	resources *runtimeapi.LinuxContainerResources,
+	annotations map[string]string,
+) ([]dbus.Property, error) {
+	if err := validateHugepageLimits(resources.GetHugepageLimits()); err != nil {
+		return nil, err
+	}
+	props, err := limitProperties(resources)
+	if err != nil {
+		return nil, err
+	}
+	cpuset, err := cpusetProperties(resources)
+	if err != nil {
+		return nil, err
+	}
+	props = append(props, cpuset...)
+	swap, err := swapProperties(resources)
+	if err != nil {
+		return nil, err
+	}
+	memoryQoS, err := memoryQoSProperties(resources, annotations)
+	if err != nil {
+		return nil, err
+	}
+	props = append(props, swap...)
+	return append(props, memoryQoS...), nil
+}
+
+// containerResources returns the resources a container whose devices are on
+// deviceNodes runs with for those requested, and the unit properties that
+// enforce them. Containers are created and updated through it alike, so that
+// an update keeps the NUMA defaults of the container's cpusets.
+func containerResources(
+	requested *runtimeapi.LinuxContainerResources,
+	annotations map[string]string,
+	deviceNodes map[string]int,
+) (*runtimeapi.LinuxContainerResources, []dbus.Property, error) {
+	resources, err := numaAlign(requested, deviceNodes)
+	if err != nil {
+		return nil, nil, err
+	}
+	props, err := resourceProperties(resources, annotations)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resources, props, nil
+}
+
+// updateUnitResources sets props on a running unit and then calls apply for
+// any limits that systemd doesn't manage. If systemd rejects the properties
+// or apply fails, the properties are restored to their previous values so
+// the update is all or nothing, and the original error is returned.
+func (r *RuntimeService) updateUnitResources(
+	ctx context.Context,
+	unit string,
+	props []dbus.Property,
+	apply func() error,
+) error {
+	if len(props) == 0 {
+		return apply()
+	}
+	previous, err := r.systemd.UnitTypeProperties(ctx, unit, "Service")
+	if err != nil {
+		return err
+	}
+	// systemd checks every property before it applies any, but one that
+	// fails to apply can still leave those before it set.
+	err = r.systemd.SetUnitProperties(ctx, unit, props...)
+	if err == nil {
+		err = apply()
+	}
+	if err != nil {
+		rollback := make([]dbus.Property, 0, len(props))
+		for _, prop := range props {
+			if value, ok := previous[prop.Name]; ok {
+				rollback = append(rollback, dbus.Property{
+					Name:  prop.Name,
+					Value: godbus.MakeVariant(value),
+				})
+			}
+		}
+		if rerr := r.systemd.SetUnitProperties(ctx, unit, rollback...); rerr != nil {
+			return fmt.Errorf("%w, and restoring unit properties failed: %v", err, rerr)
+		}
+		return err
+	}
+	return nil
+}
+
+// applyStartedResources sets the limits of a container that systemd doesn't
+// manage once its unit is up and has a cgroup, and then checks that the
+// cgroup has all of the container's limits.
+func (r *RuntimeService) applyStartedResources(ctx context.Context, c *containerRecord) error {
+	resources, annotations := c.resources()
+	props, err := resourceProperties(resources, annotations)
+	if err != nil {
+		return err
+	}
+	limits := resources.GetHugepageLimits()
+	if len(props) == 0 && len(limits) == 0 {
+		return nil
+	}
+	if r.cgroupErr != nil {
+		return r.cgroupErr
+	}
+	cgroup, err := r.unitCgroup(ctx, containerUnit(c.ID))
+	if err != nil {
+		return err
+	}
+	// A container that fails to start is stopped, its limits go with it.
+	if _, err := applyHugepageLimits(cgroup, limits); err != nil {
+		return err
+	}
+	return verifyResources(cgroup, props)
+}
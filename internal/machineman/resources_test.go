@@ -0,0 +1,99 @@
+package machineman
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+func TestUpdateContainerResourcesNotFound(t *testing.T) {
+	fake := newFakeSystemd()
+	r := &RuntimeService{systemd: fake}
+	_, err := r.UpdateContainerResources(context.Background(), &runtimeapi.UpdateContainerResourcesRequest{
+		ContainerId: "missing",
+		Linux:       &runtimeapi.LinuxContainerResources{MemoryLimitInBytes: 64 << 20},
+	})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("UpdateContainerResources() = %v, want NotFound", err)
+	}
+	if calls := fake.callsMade(); len(calls) != 0 {
+		t.Errorf("calls = %q, want none", calls)
+	}
+}
+
+func TestUpdateContainerResourcesCreated(t *testing.T) {
+	fakeCgroupRoot(t)
+	fake := newFakeSystemd()
+	r := &RuntimeService{systemd: fake}
+	startableContainer(t, r, nil)
+	update := &runtimeapi.LinuxContainerResources{MemoryLimitInBytes: 64 << 20}
+	if _, err := r.UpdateContainerResources(context.Background(), &runtimeapi.UpdateContainerResourcesRequest{
+		ContainerId: "c1",
+		Linux:       update,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// A container that hasn't started has no unit yet, it starts with the
+	// update.
+	if calls := fake.callsMade(); len(calls) != 0 {
+		t.Errorf("calls = %q, want none", calls)
+	}
+	c, _ := r.containers.get("c1")
+	if got, _ := c.resources(); !reflect.DeepEqual(got, update) {
+		t.Errorf("resources = %v, want %v", got, update)
+	}
+}
+
+func TestUpdateContainerResourcesNUMA(t *testing.T) {
+	data, err := os.ReadFile(fmt.Sprintf(nodeCPUListPath, 0))
+	if err != nil {
+		t.Skip("host has no NUMA node 0")
+	}
+	nodeCPUs := strings.TrimSpace(string(data))
+	fakeCgroupRoot(t)
+	fake := newFakeSystemd()
+	r := &RuntimeService{systemd: fake}
+	cgroup := startableContainer(t, r, nil)
+	c, _ := r.containers.get("c1")
+	c.DeviceNUMANodes = map[string]int{"/dev/accel0": 0}
+	c.setStarted(1)
+	fake.setUnit(containerUnit(c.ID), map[string]interface{}{
+		"ControlGroup": strings.TrimPrefix(cgroup, cgroupRoot),
+	})
+	for file, value := range map[string]string{
+		"cpuset.cpus.effective": nodeCPUs,
+		"cpuset.mems.effective": "0",
+		"memory.max":            "67108864",
+	} {
+		if err := os.WriteFile(filepath.Join(cgroup, file), []byte(value+"\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := r.UpdateContainerResources(context.Background(), &runtimeapi.UpdateContainerResourcesRequest{
+		ContainerId: c.ID,
+		Linux:       &runtimeapi.LinuxContainerResources{MemoryLimitInBytes: 64 << 20},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// The update keeps the cpusets on the node of the container's device,
+	// like the ones it started with.
+	unit := fake.unitProperties(containerUnit(c.ID))
+	for _, name := range []string{"AllowedCPUs", "AllowedMemoryNodes", "MemoryMax"} {
+		if _, ok := unit[name]; !ok {
+			t.Errorf("%s is unset", name)
+		}
+	}
+	resources, _ := c.resources()
+	if resources.GetCpusetCpus() != nodeCPUs || resources.GetCpusetMems() != "0" {
+		t.Errorf("cpusets = %q and %q, want %q and %q",
+			resources.GetCpusetCpus(), resources.GetCpusetMems(), nodeCPUs, "0")
+	}
+}
@@ -0,0 +1,65 @@
+package machineman
+
+import (
+	"context"
+	"log"
+
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// restoreRecords rebuilds the records of the sandboxes and containers the
+// runtime created before it restarted from what sandboxStates and
+// containerUnits kept of them. Kubelet finds them listed again, and its
+// retries of the calls that created them get them back rather than
+// colliding with their units. A sandbox whose slice is gone, as after a
+// reboot, or whose network namespace can't be opened again comes back not
+// ready, for kubelet to stop and remove.
+func (r *RuntimeService) restoreRecords(ctx context.Context) {
+	sandboxes, err := r.sandboxStates.list()
+	if err != nil {
+		log.Printf("failed to restore pod sandboxes: %v", err)
+		return
+	}
+	for id, saved := range sandboxes {
+		sb := saved.record(id)
+		if path := sb.Annotations[netnsPathAnnotation]; path != "" {
+			netns, err := openNetNS(sb.Annotations, sb.HostNetwork)
+			if err != nil {
+				log.Printf("failed to restore the network of pod sandbox %s: %v", id, err)
+				if transition, changed := sb.setState(runtimeapi.PodSandboxState_SANDBOX_NOTREADY); changed {
+					if err := r.sandboxStates.save(sb, transition); err != nil {
+						log.Printf("failed to record that pod sandbox %s is not ready: %v", id, err)
+					}
+				}
+			} else {
+				sb.NetNS, sb.NetNSPath = netns, path
+			}
+		}
+		r.sandboxes.add(sb)
+		unit, err := r.systemd.UnitProperties(ctx, sb.Slice)
+		if err != nil {
+			log.Printf("failed to check the slice of pod sandbox %s: %v", id, err)
+			continue
+		}
+		r.checkSandboxUnit(sb, unit)
+	}
+	containers, err := r.containerUnits.list()
+	if err != nil {
+		log.Printf("failed to restore containers: %v", err)
+		return
+	}
+	var restored int
+	for id, saved := range containers {
+		if _, err := r.sandboxes.get(saved.SandboxID); err != nil {
+			// What's left of it is dropped if kubelet creates it
+			// again.
+			log.Printf("not restoring container %s of unknown pod sandbox %s", id, saved.SandboxID)
+			continue
+		}
+		r.containers.add(saved.record(id))
+		restored++
+	}
+	if len(sandboxes)+restored > 0 {
+		log.Printf("restored %d pod sandboxes and %d containers", len(sandboxes), restored)
+	}
+}
@@ -0,0 +1,104 @@
+package machineman
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+func TestRestoreRecordsAfterRestart(t *testing.T) {
+	states := sandboxStates{dir: t.TempDir()}
+	units := containerUnits{dir: t.TempDir()}
+	// Before the restart: a ready sandbox with a container, and one whose
+	// slice went away while the runtime was down.
+	running := &runtimeapi.PodSandboxMetadata{Namespace: "default", Name: "web", Uid: "u1"}
+	gone := &runtimeapi.PodSandboxMetadata{Namespace: "default", Name: "batch", Uid: "u2"}
+	var slices []string
+	for _, m := range []*runtimeapi.PodSandboxMetadata{running, gone} {
+		id := keyID(sandboxKey(m))
+		sb := &sandboxRecord{
+			ID:        id,
+			Metadata:  m,
+			Labels:    map[string]string{"app": m.GetName()},
+			CreatedAt: 1,
+			Slice:     podSlice(id, ""),
+		}
+		transition, _ := sb.setState(runtimeapi.PodSandboxState_SANDBOX_READY)
+		if err := states.save(sb, transition); err != nil {
+			t.Fatal(err)
+		}
+		slices = append(slices, sb.Slice)
+	}
+	runningID := keyID(sandboxKey(running))
+	c := &containerRecord{
+		ID:        "c1",
+		SandboxID: runningID,
+		Metadata:  &runtimeapi.ContainerMetadata{Name: "app"},
+		Image:     "docker.io/library/nginx:1.25",
+		Labels:    map[string]string{"app": "web"},
+		Env:       []string{"A=1"},
+		User:      &containerUser{UID: 1000, GID: 1000},
+	}
+	if err := units.save(c); err != nil {
+		t.Fatal(err)
+	}
+	// A container whose sandbox wasn't kept isn't restored.
+	if err := units.save(&containerRecord{ID: "c2", SandboxID: "unknown"}); err != nil {
+		t.Fatal(err)
+	}
+
+	fake := newFakeSystemd()
+	fake.setUnit(slices[0], nil)
+	fake.setUnit(containerUnit(c.ID), nil)
+	r := &RuntimeService{systemd: fake, sandboxStates: states, containerUnits: units}
+	r.restoreRecords(context.Background())
+
+	ctx := context.Background()
+	sandboxes, err := r.ListPodSandbox(ctx, &runtimeapi.ListPodSandboxRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]runtimeapi.PodSandboxState{}
+	for _, sb := range sandboxes.GetItems() {
+		got[sb.GetMetadata().GetName()] = sb.GetState()
+	}
+	want := map[string]runtimeapi.PodSandboxState{
+		"web":   runtimeapi.PodSandboxState_SANDBOX_READY,
+		"batch": runtimeapi.PodSandboxState_SANDBOX_NOTREADY,
+	}
+	if len(got) != len(want) || got["web"] != want["web"] || got["batch"] != want["batch"] {
+		t.Errorf("sandboxes after the restart = %v, want %v", got, want)
+	}
+	containers, err := r.ListContainers(ctx, &runtimeapi.ListContainersRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, c := range containers.GetContainers() {
+		ids = append(ids, c.GetId())
+	}
+	sort.Strings(ids)
+	if len(ids) != 1 || ids[0] != c.ID {
+		t.Errorf("containers after the restart = %q, want %q", ids, []string{c.ID})
+	}
+	restored, err := r.containers.get(c.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.User == nil || restored.User.UID != 1000 || restored.Image != c.Image {
+		t.Errorf("restored container %+v lost what exec and status need", restored)
+	}
+
+	// Kubelet retrying the call that created the sandbox gets it back.
+	resp, err := r.RunPodSandbox(ctx, &runtimeapi.RunPodSandboxRequest{
+		Config: &runtimeapi.PodSandboxConfig{Metadata: running},
+	})
+	if err != nil {
+		t.Fatalf("RunPodSandbox() retried after a restart: %v", err)
+	}
+	if resp.GetPodSandboxId() != runningID {
+		t.Errorf("RunPodSandbox() retried after a restart = %s, want %s", resp.GetPodSandboxId(), runningID)
+	}
+}
@@ -0,0 +1,125 @@
+package machineman
+
+import (
+	"context"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/ananthb/systemd-cri/internal/crilog"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// resumedOutputs holds the forwarding of the output of containers started
+// before the runtime restarted, whose records were restored without it, by
+// container ID.
+type resumedOutputs struct {
+	mu      sync.Mutex
+	outputs map[string]*containerOutput
+}
+
+// keepOutput hands the read ends of a started container's output FIFOs to
+// the service manager, so that the container can go on writing while the
+// runtime restarts, and its output is forwarded again afterwards.
+func (r *RuntimeService) keepOutput(id string, o *containerOutput) {
+	for i, stream := range []string{stdoutFile, stderrFile} {
+		if err := r.fdStore.add(outputFDName(id, stream), o.readers[i]); err != nil {
+			log.Printf("failed to keep %s of container %s across restarts: %v", stream, id, err)
+		}
+	}
+}
+
+// forgetOutput drops the read ends keepOutput kept of a container.
+func (r *RuntimeService) forgetOutput(id string) {
+	for _, stream := range []string{stdoutFile, stderrFile} {
+		if err := r.fdStore.remove(outputFDName(id, stream)); err != nil {
+			log.Printf("failed to drop kept %s of container %s: %v", stream, id, err)
+		}
+	}
+}
+
+// resumeOutputs forwards the output of the containers that were running
+// before the runtime restarted to their logs again, from the read ends of
+// their output FIFOs in kept, the files the service manager passed back by
+// name. The forwarding of a container lasts until it exits or is dropped.
+// What's left of kept is closed.
+func (r *RuntimeService) resumeOutputs(ctx context.Context, kept map[string]*os.File) {
+	defer func() {
+		for name, f := range kept {
+			f.Close()
+			if err := r.fdStore.remove(name); err != nil {
+				log.Printf("failed to drop kept %s: %v", name, err)
+			}
+		}
+	}()
+	saved, err := r.containerUnits.list()
+	if err != nil {
+		log.Printf("failed to list containers to resume the output of: %v", err)
+		return
+	}
+	if len(saved) == 0 {
+		return
+	}
+	states, err := r.containerStates(ctx)
+	if err != nil {
+		log.Printf("failed to list containers to resume the output of: %v", err)
+		return
+	}
+	for id, c := range saved {
+		if c.LogPath == "" || states[c.Unit] != runtimeapi.ContainerState_CONTAINER_RUNNING {
+			continue
+		}
+		logFile, err := crilog.OpenFile(c.LogPath)
+		if err != nil {
+			log.Printf("failed to resume the output of container %s: %v", id, err)
+			continue
+		}
+		var files [2]*os.File
+		for i, stream := range []string{stdoutFile, stderrFile} {
+			name := outputFDName(id, stream)
+			files[i] = kept[name]
+			delete(kept, name)
+		}
+		output, err := resumeOutput(c.Rootfs, files, logFile)
+		if err != nil {
+			logFile.Close()
+			r.forgetOutput(id)
+			log.Printf("failed to resume the output of container %s: %v", id, err)
+			continue
+		}
+		// The FIFOs opened again weren't kept yet.
+		for i, stream := range []string{stdoutFile, stderrFile} {
+			if files[i] != nil {
+				continue
+			}
+			if err := r.fdStore.add(outputFDName(id, stream), output.readers[i]); err != nil {
+				log.Printf("failed to keep %s of container %s across restarts: %v", stream, id, err)
+			}
+		}
+		r.resumed.mu.Lock()
+		if r.resumed.outputs == nil {
+			r.resumed.outputs = map[string]*containerOutput{}
+		}
+		r.resumed.outputs[id] = output
+		r.resumed.mu.Unlock()
+		go func(id string) {
+			output.done.Wait()
+			logFile.Close()
+			r.dropResumedOutput(id)
+		}(id)
+	}
+}
+
+// dropResumedOutput stops forwarding the output of a container resumed
+// after a restart, and drops its kept read ends.
+func (r *RuntimeService) dropResumedOutput(id string) {
+	r.resumed.mu.Lock()
+	output, ok := r.resumed.outputs[id]
+	delete(r.resumed.outputs, id)
+	r.resumed.mu.Unlock()
+	if !ok {
+		return
+	}
+	output.close()
+	r.forgetOutput(id)
+}
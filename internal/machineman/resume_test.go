@@ -0,0 +1,176 @@
+package machineman
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ananthb/systemd-cri/internal/crilog"
+	"golang.org/x/sys/unix"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// fakeNotifySocket listens for notifications in place of systemd. They
+// arrive on the returned channel on a single line, followed by the number
+// of files passed with them.
+func fakeNotifySocket(t *testing.T) (string, <-chan string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	messages := make(chan string, 16)
+	go func() {
+		for {
+			buf, oob := make([]byte, 512), make([]byte, 512)
+			n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+			if err != nil {
+				return
+			}
+			var files int
+			msgs, _ := unix.ParseSocketControlMessage(oob[:oobn])
+			for _, msg := range msgs {
+				fds, _ := unix.ParseUnixRights(&msg)
+				for _, fd := range fds {
+					unix.Close(fd)
+				}
+				files += len(fds)
+			}
+			messages <- fmt.Sprintf("%s files=%d", strings.ReplaceAll(string(buf[:n]), "\n", " "), files)
+		}
+	}()
+	return path, messages
+}
+
+// receive returns the next n notifications, sorted.
+func receive(t *testing.T, messages <-chan string, n int) []string {
+	t.Helper()
+	var got []string
+	for len(got) < n {
+		select {
+		case msg := <-messages:
+			got = append(got, msg)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got notifications %q, want %d", got, n)
+		}
+	}
+	sort.Strings(got)
+	return got
+}
+
+func TestResumeOutputsAfterRestart(t *testing.T) {
+	fake := newFakeSystemd()
+	r, sb := podRuntime(t, fake)
+	socket, messages := fakeNotifySocket(t)
+	r.fdStore = fdStore{socket: socket}
+	r.containerUnits = containerUnits{dir: t.TempDir()}
+	rootfs := t.TempDir()
+	logPath := filepath.Join(t.TempDir(), "app.log")
+	c := &containerRecord{
+		ID:        "c1",
+		SandboxID: sb.ID,
+		Metadata:  &runtimeapi.ContainerMetadata{Name: "app"},
+		Rootfs:    rootfs,
+		LogPath:   logPath,
+	}
+	if err := r.containerUnits.save(c); err != nil {
+		t.Fatal(err)
+	}
+	fake.setUnit(containerUnit(c.ID), nil)
+	// Before the restart, the runtime read the FIFOs the container
+	// writes to. The read end of stdout was kept, the one of stderr was
+	// lost.
+	stdout, stdoutWriter, err := openFIFO(filepath.Join(rootfs, stdoutFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr, stderrWriter, err := openFIFO(filepath.Join(rootfs, stderrFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr.Close()
+	gone, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.resumeOutputs(context.Background(), map[string]*os.File{
+		outputFDName(c.ID, stdoutFile):   stdout,
+		outputFDName("gone", stdoutFile): gone,
+	})
+	// The FIFO opened again is kept, what belongs to no running
+	// container is dropped.
+	if got, want := receive(t, messages, 2), []string{
+		"FDSTORE=1 FDNAME=output-c1-stderr files=1",
+		"FDSTOREREMOVE=1 FDNAME=output-gone-stdout files=0",
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("notifications = %q, want %q", got, want)
+	}
+	if _, err := gone.Stat(); err == nil {
+		t.Error("file of no running container is still open")
+	}
+	// What the container writes from now on reaches its log, until it
+	// exits.
+	if _, err := stdoutWriter.Write([]byte("out\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stderrWriter.Write([]byte("err\n")); err != nil {
+		t.Fatal(err)
+	}
+	stdoutWriter.Close()
+	stderrWriter.Close()
+	if got, want := receive(t, messages, 2), []string{
+		"FDSTOREREMOVE=1 FDNAME=output-c1-stderr files=0",
+		"FDSTOREREMOVE=1 FDNAME=output-c1-stdout files=0",
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("notifications once the container exited = %q, want %q", got, want)
+	}
+	r.resumed.mu.Lock()
+	left := len(r.resumed.outputs)
+	r.resumed.mu.Unlock()
+	if left != 0 {
+		t.Errorf("%d outputs still resumed once the container exited", left)
+	}
+	logged := map[string]string{}
+	if err := crilog.Read(logPath, crilog.ReadOptions{}, func(e crilog.Entry) error {
+		logged[string(e.Stream)] = string(e.Content)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"stdout": "out", "stderr": "err"}; !reflect.DeepEqual(logged, want) {
+		t.Errorf("logged %q, want %q", logged, want)
+	}
+}
+
+func TestResumeOutputsSkipsExitedContainers(t *testing.T) {
+	fake := newFakeSystemd()
+	r, sb := podRuntime(t, fake)
+	r.containerUnits = containerUnits{dir: t.TempDir()}
+	c := &containerRecord{
+		ID:        "c1",
+		SandboxID: sb.ID,
+		Metadata:  &runtimeapi.ContainerMetadata{Name: "app"},
+		Rootfs:    t.TempDir(),
+		LogPath:   filepath.Join(t.TempDir(), "app.log"),
+	}
+	if err := r.containerUnits.save(c); err != nil {
+		t.Fatal(err)
+	}
+	fake.setUnit(containerUnit(c.ID), map[string]interface{}{"ActiveState": "failed"})
+	r.resumeOutputs(context.Background(), nil)
+	if len(r.resumed.outputs) != 0 {
+		t.Errorf("resumed the output of an exited container")
+	}
+	if _, err := os.Stat(c.LogPath); err == nil {
+		t.Errorf("opened the log of an exited container")
+	}
+}
@@ -0,0 +1,51 @@
+package machineman
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// retainRootfsAnnotation is a container annotation that keeps the writable
+// layers of this many exited instances of the container around after they
+// are removed, so that the files of a crash-looping container can be looked
+// at. It is capped by RuntimeOptions.MaxRetainedRootfs, and the layers are
+// dropped along with the sandbox.
+const retainRootfsAnnotation = "systemd-cri.io/retain-rootfs"
+
+// retainRootfs returns how many writable layers of exited instances of a
+// container to keep, from its annotations.
+func (r *RuntimeService) retainRootfs(annotations map[string]string) (int, error) {
+	value, ok := annotations[retainRootfsAnnotation]
+	if !ok {
+		return 0, nil
+	}
+	keep, err := strconv.Atoi(value)
+	if err != nil || keep < 0 {
+		return 0, status.Errorf(
+			codes.InvalidArgument,
+			"annotation %s: %q is not a non-negative number",
+			retainRootfsAnnotation, value,
+		)
+	}
+	if keep > r.opts.MaxRetainedRootfs {
+		keep = r.opts.MaxRetainedRootfs
+	}
+	return keep, nil
+}
+
+// retainedRootfsInfo renders the writable layers kept for earlier instances
+// of a container for verbose status, empty if there are none.
+func (r *RuntimeService) retainedRootfsInfo(c *containerRecord) string {
+	paths, err := r.images.rootfs.retained(c.SandboxID, c.Metadata.GetName())
+	if err != nil || len(paths) == 0 {
+		return ""
+	}
+	data, err := json.Marshal(paths)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
@@ -0,0 +1,301 @@
+package machineman
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// rootfsStore holds the root filesystems of containers, each a directory
+// with the upper, work and merged directories of the overlay the container
+// runs on.
+// On ephemeral nodes it lives on a size-limited tmpfs, so that container
+// writes never touch the disk and can't grow past the limit.
+type rootfsStore struct {
+	dir string
+	// tmpfs is set when dir is a tmpfs mounted for the store.
+	tmpfs bool
+}
+
+// newRootfsStore sets up the root filesystem store at dir. With tmpfsSize
+// set, dir is a tmpfs of that size, in any form the size= mount option
+// takes, like "8G" or "50%". A tmpfs left mounted there by an earlier run is
+// kept, along with the containers on it, and resized.
+func newRootfsStore(dir, tmpfsSize string) (*rootfsStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	if tmpfsSize == "" {
+		return &rootfsStore{dir: dir}, nil
+	}
+	data := "mode=0700,size=" + tmpfsSize
+	var flags uintptr = unix.MS_NODEV | unix.MS_NOSUID
+	if isTmpfs(dir) {
+		flags |= unix.MS_REMOUNT
+	}
+	if err := unix.Mount("tmpfs", dir, "tmpfs", flags, data); err != nil {
+		return nil, fmt.Errorf("mount tmpfs of size %s on %s: %w", tmpfsSize, dir, err)
+	}
+	return &rootfsStore{dir: dir, tmpfs: true}, nil
+}
+
+func isTmpfs(dir string) bool {
+	var st unix.Statfs_t
+	return unix.Statfs(dir, &st) == nil && st.Type == unix.TMPFS_MAGIC
+}
+
+// prepare creates the root filesystem directories of a container whose
+// image takes up size bytes. On a tmpfs the container must fit into the
+// space that is left, a container that doesn't is refused rather than
+// filling up memory.
+func (s *rootfsStore) prepare(id string, size int64) (string, error) {
+	if s.tmpfs {
+		var st unix.Statfs_t
+		if err := unix.Statfs(s.dir, &st); err != nil {
+			return "", err
+		}
+		available := int64(st.Bavail) * st.Bsize
+		if size > available {
+			return "", status.Errorf(
+				codes.ResourceExhausted,
+				"container root filesystem needs %d bytes, the rootfs tmpfs has %d left",
+				size, available,
+			)
+		}
+	}
+	dir := filepath.Join(s.dir, id)
+	for _, sub := range []string{"upper", "work", containerRootDir} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o700); err != nil {
+			os.RemoveAll(dir)
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// lowerDirsFile lists the layers the overlay of a container stacks, one
+// per line. The image store keeps them for as long as it is there.
+const lowerDirsFile = "lowerdirs"
+
+// mount stacks the writable layer of a container on the layers of its
+// image, top first, at the directory systemd-nspawn runs it in.
+func (s *rootfsStore) mount(id string, layers []string) error {
+	dir := filepath.Join(s.dir, id)
+	// Recorded before the layers are in use, so that they aren't pruned
+	// while they are.
+	record := strings.Join(layers, "\n")
+	if err := os.WriteFile(filepath.Join(dir, lowerDirsFile), []byte(record), 0o600); err != nil {
+		return err
+	}
+	if len(layers) == 0 {
+		// overlayfs needs a lower directory, an image without layers
+		// gets an empty one.
+		empty := filepath.Join(dir, "empty")
+		if err := os.MkdirAll(empty, 0o755); err != nil {
+			return err
+		}
+		layers = []string{empty}
+	}
+	data := fmt.Sprintf(
+		"lowerdir=%s,upperdir=%s,workdir=%s",
+		strings.Join(layers, ":"), filepath.Join(dir, "upper"), filepath.Join(dir, "work"),
+	)
+	if len(data) >= unix.Getpagesize() {
+		return fmt.Errorf("container %s: the image has too many layers to mount", id)
+	}
+	target := filepath.Join(dir, containerRootDir)
+	if err := unix.Mount("overlay", target, "overlay", 0, data); err != nil {
+		return &os.PathError{Op: "mount overlay", Path: target, Err: err}
+	}
+	return nil
+}
+
+// stackedLayers returns the layers the overlays of the containers in the
+// store stack, mounted or about to be.
+func (s *rootfsStore) stackedLayers() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var layers []string
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(s.dir, entry.Name(), lowerDirsFile))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > 0 {
+			layers = append(layers, strings.Split(string(data), "\n")...)
+		}
+	}
+	return layers, nil
+}
+
+// unmount unmounts the overlay of a container, if it is mounted.
+func (s *rootfsStore) unmount(id string) error {
+	target := filepath.Join(s.dir, id, containerRootDir)
+	err := unix.Unmount(target, unix.MNT_DETACH)
+	// EINVAL is a target that isn't mounted.
+	if err != nil && err != unix.EINVAL && err != unix.ENOENT {
+		return &os.PathError{Op: "unmount", Path: target, Err: err}
+	}
+	return nil
+}
+
+// release removes the root filesystem of a container, once its overlay and
+// staged mounts are unmounted.
+func (s *rootfsStore) release(id string) error {
+	dir := filepath.Join(s.dir, id)
+	if err := s.unmount(id); err != nil {
+		return err
+	}
+	if err := unstageMounts(dir); err != nil {
+		return err
+	}
+	if err := wipeSecrets(dir); err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// retainedDir holds the writable layers of exited containers kept for
+// inspection, relative to the store.
+const retainedDir = ".retained"
+
+// retain keeps the writable layer of an exited container for inspection,
+// below its sandbox and name, and drops the oldest layers kept for them
+// beyond keep. It returns where the layer was moved to.
+func (s *rootfsStore) retain(id, sandboxID, name string, keep int) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\x00") {
+		return "", fmt.Errorf("container name %q can't name a directory", name)
+	}
+	parent := filepath.Join(s.dir, retainedDir, sandboxID, name)
+	if err := os.MkdirAll(parent, 0o700); err != nil {
+		return "", err
+	}
+	if err := s.unmount(id); err != nil {
+		return "", err
+	}
+	dest := filepath.Join(parent, strconv.FormatInt(time.Now().UnixNano(), 10)+"-"+id)
+	if err := os.Rename(filepath.Join(s.dir, id, "upper"), dest); err != nil {
+		return "", err
+	}
+	kept, err := s.retained(sandboxID, name)
+	if err != nil {
+		return "", err
+	}
+	for ; len(kept) > keep; kept = kept[1:] {
+		if err := os.RemoveAll(kept[0]); err != nil {
+			return "", err
+		}
+	}
+	return dest, nil
+}
+
+// retained returns the writable layers kept for the containers of a sandbox
+// with a name, oldest first.
+func (s *rootfsStore) retained(sandboxID, name string) ([]string, error) {
+	parent := filepath.Join(s.dir, retainedDir, sandboxID, name)
+	entries, err := os.ReadDir(parent)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Entries are named after the time they were kept, which has the same
+	// number of digits for centuries, and ReadDir sorts them.
+	paths := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		paths = append(paths, filepath.Join(parent, entry.Name()))
+	}
+	return paths, nil
+}
+
+// dropRetained removes the writable layers kept for the containers of a
+// sandbox.
+func (s *rootfsStore) dropRetained(sandboxID string) error {
+	return os.RemoveAll(filepath.Join(s.dir, retainedDir, sandboxID))
+}
+
+// usage returns how much of the store's filesystem is in use. On a tmpfs
+// that is all of it, elsewhere the store shares the filesystem with other
+// data and only counts the containers' files.
+func (s *rootfsStore) usage() (*runtimeapi.FilesystemUsage, error) {
+	u := &runtimeapi.FilesystemUsage{
+		Timestamp: time.Now().UnixNano(),
+		FsId:      &runtimeapi.FilesystemIdentifier{Mountpoint: s.dir},
+	}
+	if s.tmpfs {
+		var st unix.Statfs_t
+		if err := unix.Statfs(s.dir, &st); err != nil {
+			return nil, err
+		}
+		u.UsedBytes = &runtimeapi.UInt64Value{Value: (st.Blocks - st.Bfree) * uint64(st.Bsize)}
+		u.InodesUsed = &runtimeapi.UInt64Value{Value: st.Files - st.Ffree}
+		return u, nil
+	}
+	bytes, inodes, err := diskUsage(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	u.UsedBytes = &runtimeapi.UInt64Value{Value: bytes}
+	u.InodesUsed = &runtimeapi.UInt64Value{Value: inodes}
+	return u, nil
+}
+
+// writableLayer returns how much a container wrote to its root filesystem.
+func (s *rootfsStore) writableLayer(id string) (*runtimeapi.FilesystemUsage, error) {
+	dir := filepath.Join(s.dir, id, "upper")
+	bytes, inodes, err := diskUsage(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &runtimeapi.FilesystemUsage{
+		Timestamp:  time.Now().UnixNano(),
+		FsId:       &runtimeapi.FilesystemIdentifier{Mountpoint: s.dir},
+		UsedBytes:  &runtimeapi.UInt64Value{Value: bytes},
+		InodesUsed: &runtimeapi.UInt64Value{Value: inodes},
+	}, nil
+}
+
+// diskUsage adds up the space and inodes used by the files below dir.
+// Files that disappear during the walk are skipped.
+func diskUsage(dir string) (bytes, inodes uint64, err error) {
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		inodes++
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			bytes += uint64(st.Blocks) * 512
+		} else {
+			bytes += uint64(info.Size())
+		}
+		return nil
+	})
+	return bytes, inodes, err
+}
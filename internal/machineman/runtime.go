@@ -2,32 +2,433 @@ package machineman
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/ananthb/systemd-cri/internal/crilog"
+	"github.com/ananthb/systemd-cri/internal/health"
+	"github.com/ananthb/systemd-cri/internal/streaming"
+	"github.com/ananthb/systemd-cri/internal/systemd"
+	"github.com/coreos/go-systemd/v22/dbus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
 )
 
-func NewRuntimeService() (runtimeapi.RuntimeServiceServer, error) {
-	return &RuntimeService{}, nil
+// RuntimeOptions configures a RuntimeService.
+type RuntimeOptions struct {
+	// DefaultStopGracePeriod is how long a container is given to exit when
+	// it's stopped along with its pod sandbox, which has no timeout of its
+	// own.
+	DefaultStopGracePeriod time.Duration
+	// MaxStopGracePeriod caps the timeout a container can be stopped with.
+	// Zero means no cap.
+	MaxStopGracePeriod time.Duration
+	// CgroupKill kills containers that outlive their stop grace period
+	// through cgroup.kill, which no process in the container can escape.
+	// Otherwise systemd sends SIGKILL to each process it finds.
+	CgroupKill bool
+	// ImageHealthchecks runs the HEALTHCHECK of the images of containers,
+	// unless their annotations say otherwise.
+	ImageHealthchecks bool
+	// ContainerInit runs the commands of containers below a minimal init
+	// that reaps orphaned processes, unless their annotations say
+	// otherwise.
+	ContainerInit bool
+	// ExecBudgetWindow is the sliding window MaxPodExecs and
+	// MaxPodExecOutput are counted over.
+	ExecBudgetWindow time.Duration
+	// MaxPodExecs caps how many commands the containers of a pod sandbox
+	// can exec within ExecBudgetWindow. Zero doesn't.
+	MaxPodExecs int
+	// MaxPodExecOutput caps the bytes of output the execs of a pod sandbox
+	// can produce within ExecBudgetWindow. Zero doesn't.
+	MaxPodExecOutput int64
+	// DeviceResolvers resolve the container annotations that ask for
+	// devices into the device nodes containers get.
+	DeviceResolvers []DeviceResolver
+	// Debug logs details that help diagnose problems, such as the create
+	// calls kubelet retries.
+	Debug bool
+	// ExitedContainerRetention is how long an exited container is kept
+	// before the runtime reclaims it on its own. Zero leaves exited
+	// containers to kubelet. RemoveContainer always removes right away.
+	ExitedContainerRetention time.Duration
+	// CompressRotatedLogs gzips the segments kubelet rotates container
+	// logs into. The live log file stays uncompressed.
+	CompressRotatedLogs bool
+	// StreamingIdleTimeout is how long an exec or attach session may go
+	// without any input or output before it is torn down. Zero means
+	// never.
+	StreamingIdleTimeout time.Duration
+	// StreamingURL is the base URL of the server that serves
+	// StreamingHandler, which the URLs of exec and attach sessions are
+	// made from. Empty leaves exec and attach unsupported.
+	StreamingURL string
+	// StreamingSessionsFile is where the tokens of live exec and attach
+	// sessions are kept, so that the sessions a restart ended are reported
+	// as expired rather than unknown. Empty keeps them in memory only.
+	StreamingSessionsFile string
+	// StatsCacheTTL is how long the cgroup counters read for container
+	// stats are reused by later stats calls. Zero reads them every time.
+	StatsCacheTTL time.Duration
+	// MaxRetainedRootfs caps how many writable layers of exited instances
+	// of a container are kept for inspection when they are removed.
+	MaxRetainedRootfs int
+	// SandboxStateDir is where the last state transition of each sandbox
+	// is kept across restarts. Empty keeps them in memory only.
+	SandboxStateDir string
+	// ContainerStateDir is where the unit and sandbox of each container
+	// are kept across restarts. Empty keeps them in memory only.
+	ContainerStateDir string
+	// CheckpointDir is the directory containers can be restored from the
+	// checkpoint archives in. Archives anywhere else are refused, and all
+	// of them if it is empty.
+	CheckpointDir string
+	// NotifySocket is the notification socket of the systemd service the
+	// runtime runs as, whose file descriptor store keeps the output of
+	// containers flowing while the runtime restarts. Empty keeps nothing.
+	NotifySocket string
+	// KeptFiles are the files the service manager kept for the runtime
+	// while it restarted and passed back to it, by name.
+	KeptFiles map[string]*os.File
+	// IPPools names the IP pools sandboxes can allocate their address
+	// from, the first being the one used when a sandbox doesn't pick one.
+	// Empty leaves the pool to the network plugin.
+	IPPools []string
+	// RuntimeHandlers lists the runtime handlers sandboxes can be created
+	// with, as "name" or "name:feature+feature". Empty accepts any handler
+	// as the default one.
+	RuntimeHandlers []string
+	// DefaultUlimits are the resource limits of containers whose image
+	// and annotations don't set them, as "name=soft:hard" or
+	// "name=limit", like "nofile=1024:524288".
+	DefaultUlimits []string
+}
+
+func NewRuntimeService(images *ImageService, opts RuntimeOptions) (*RuntimeService, error) {
+	handlers, err := parseRuntimeHandlers(opts.RuntimeHandlers)
+	if err != nil {
+		return nil, err
+	}
+	ulimits, err := parseUlimits(opts.DefaultUlimits)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := systemd.New(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	stateHealth := health.Register("state-store", func() error {
+		return checkStateDirs(opts.SandboxStateDir, opts.ContainerStateDir)
+	})
+	r := &RuntimeService{
+		opts:           opts,
+		handlers:       handlers,
+		ulimits:        ulimits,
+		systemd:        conn,
+		images:         images,
+		cgroupErr:      checkCgroupVersion(),
+		nspawnErr:      checkNspawn(),
+		stats:          statsCache{ttl: opts.StatsCacheTTL},
+		sandboxStates:  sandboxStates{dir: opts.SandboxStateDir, health: stateHealth},
+		containerUnits: containerUnits{dir: opts.ContainerStateDir, health: stateHealth},
+		fdStore:        fdStore{socket: opts.NotifySocket},
+		execs: &execBudget{
+			window:    opts.ExecBudgetWindow,
+			maxExecs:  opts.MaxPodExecs,
+			maxOutput: opts.MaxPodExecOutput,
+		},
+		sessions: streaming.NewSessions(
+			streaming.DefaultReconnectGrace,
+			opts.StreamingIdleTimeout,
+		),
+	}
+	r.debug.Store(opts.Debug)
+	r.ipPools.Store(&opts.IPPools)
+	if opts.StreamingSessionsFile != "" {
+		if err := r.sessions.Restore(opts.StreamingSessionsFile); err != nil {
+			log.Printf("failed to restore streaming sessions: %v", err)
+		}
+	}
+	if r.cgroupErr != nil {
+		log.Printf("runtime is not ready: %v", r.cgroupErr)
+	}
+	if r.nspawnErr != nil {
+		log.Printf("runtime is not ready: %v", r.nspawnErr)
+	}
+	if version, err := conn.Version(); err != nil {
+		log.Printf("failed to read systemd version: %v", err)
+	} else {
+		r.credentials = version >= minCredentialsVersion
+		r.ipcNamespaces = version >= minIPCNamespaceVersion
+	}
+	health.Register("dbus", func() error {
+		if !conn.Connected() {
+			return errors.New("disconnected from systemd")
+		}
+		return nil
+	})
+	health.Register("cgroup", func() error { return r.cgroupErr })
+	health.Register("nspawn", func() error { return r.nspawnErr })
+	r.restoreRecords(context.Background())
+	r.resumeOutputs(context.Background(), opts.KeptFiles)
+	r.backgroundCtx, r.stopBackground = context.WithCancel(context.Background())
+	if opts.ExitedContainerRetention > 0 {
+		r.goBackground(r.collectGarbage)
+	}
+	return r, nil
+}
+
+// goBackground runs f in the background until the runtime is closed.
+func (r *RuntimeService) goBackground(f func(context.Context)) {
+	r.background.Add(1)
+	go func() {
+		defer r.background.Done()
+		f(r.backgroundCtx)
+	}()
+}
+
+// DrainSessions waits for the exec and attach sessions to end, and kills the
+// ones still running when ctx is done.
+func (r *RuntimeService) DrainSessions(ctx context.Context) error {
+	return r.sessions.Drain(ctx)
+}
+
+// StreamingHandler serves the exec and attach sessions the runtime hands out
+// URLs for under StreamingURL.
+func (r *RuntimeService) StreamingHandler() http.Handler {
+	return r.sessions.Handler()
+}
+
+// streamingURL returns the URL a client joins the session issued token
+// with.
+func (r *RuntimeService) streamingURL(kind, token string) string {
+	return strings.TrimSuffix(r.opts.StreamingURL, "/") + "/" + kind + "/" + token
+}
+
+// Close stops the runtime's background work, waits for it to return and
+// disconnects from systemd. Containers keep running.
+func (r *RuntimeService) Close() {
+	r.stopBackground()
+	r.background.Wait()
+	r.systemd.Close()
+}
+
+// systemdManager is what the runtime asks of systemd, which tests stand in
+// for. *systemd.Conn implements it.
+type systemdManager interface {
+	StartTransientUnit(ctx context.Context, name string, props ...dbus.Property) error
+	StopUnit(ctx context.Context, name string) error
+	KillUnit(ctx context.Context, name string, sig syscall.Signal) error
+	ResetFailedUnit(ctx context.Context, name string) error
+	SetUnitProperties(ctx context.Context, name string, props ...dbus.Property) error
+	UnitProperties(ctx context.Context, name string) (map[string]interface{}, error)
+	UnitTypeProperties(ctx context.Context, name, unitType string) (map[string]interface{}, error)
+	ListUnitsByPatterns(ctx context.Context, patterns ...string) ([]dbus.UnitStatus, error)
+	Close()
 }
 
 type RuntimeService struct {
 	runtimeClient runtimeapi.RuntimeServiceClient
+	opts          RuntimeOptions
+	systemd       systemdManager
+	images        *ImageService
+	// handlers are the known runtime handlers, nil if any is accepted.
+	handlers map[string]runtimeHandler
+	// ulimits are the default resource limits of containers.
+	ulimits map[string]ulimit
+	// cgroupErr is set when the host's cgroup setup can't run containers.
+	cgroupErr error
+	// nspawnErr is set when systemd-nspawn isn't installed.
+	nspawnErr error
+	// credentials is set when systemd can pass credentials to containers.
+	credentials bool
+	// ipcNamespaces is set when systemd can start containers in the IPC
+	// namespace of their pod.
+	ipcNamespaces bool
+	// sandboxes holds the records of created pod sandboxes.
+	sandboxes sandboxStore
+	// sandboxStates persists the last state transition of each sandbox.
+	sandboxStates sandboxStates
+	// containers holds the records of created containers.
+	containers containerStore
+	// containerUnits persists the unit and sandbox of each container.
+	containerUnits containerUnits
+	// fdStore keeps the output of containers across restarts.
+	fdStore fdStore
+	// resumed forwards the output of containers started before the
+	// runtime restarted.
+	resumed resumedOutputs
+	// stats caches the cgroup counters of containers between stats calls.
+	stats statsCache
+	// sessions holds the exec and attach sessions of the streaming server,
+	// so that clients can reconnect to them.
+	sessions *streaming.Sessions
+	// backgroundCtx is done once the runtime's background work is to
+	// stop, stopBackground stops it, and background waits for it to
+	// return.
+	backgroundCtx  context.Context
+	stopBackground context.CancelFunc
+	background     sync.WaitGroup
+	// execs holds what each pod sandbox used of its exec budget.
+	execs *execBudget
+	// kubeletCgroupDriver is the style of the last cgroup parent kubelet
+	// passed for a sandbox.
+	kubeletCgroupDriver atomic.Pointer[string]
+	// creating reserves the sandboxes and containers being created
+	// against retries of the calls creating them.
+	creating createReservations
+	// debug is set while the runtime logs with debug logging.
+	debug atomic.Bool
+	// ipPools are the IP pools sandboxes can pick, the first being the
+	// default one.
+	ipPools atomic.Pointer[[]string]
 }
 
+// Version returns the runtime name, runtime version and runtime API version.
 func (r *RuntimeService) Version(
 	context.Context,
 	*runtimeapi.VersionRequest,
 ) (*runtimeapi.VersionResponse, error) {
-	return nil, nil
+	version := "unknown"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		version = info.Main.Version
+	}
+	return &runtimeapi.VersionResponse{
+		Version:           "0.1.0",
+		RuntimeName:       "systemd-cri",
+		RuntimeVersion:    version,
+		RuntimeApiVersion: "v1",
+	}, nil
 }
 
 // RunPodSandbox creates and starts a pod-level sandbox. Runtimes must ensure
 // the sandbox is in the ready state on success.
 func (r *RuntimeService) RunPodSandbox(
-	context.Context,
-	*runtimeapi.RunPodSandboxRequest,
-) (*runtimeapi.RunPodSandboxResponse, error) {
-	return nil, nil
+	ctx context.Context,
+	req *runtimeapi.RunPodSandboxRequest,
+) (_ *runtimeapi.RunPodSandboxResponse, err error) {
+	defer func(start time.Time) {
+		observeCreate(sandboxCreateDuration, "RunPodSandbox", req.GetRuntimeHandler(), start, err)
+	}(time.Now())
+	config := req.GetConfig()
+	if err := r.validateRuntimeHandler(req.GetRuntimeHandler(), config); err != nil {
+		return nil, err
+	}
+	metadata := config.GetMetadata()
+	key := sandboxKey(metadata)
+	if sb := r.retriedSandbox(key); sb != nil {
+		r.deduplicated("RunPodSandbox", key, sb.ID)
+		return &runtimeapi.RunPodSandboxResponse{PodSandboxId: sb.ID}, nil
+	}
+	unreserve, ok := r.creating.reserve(key)
+	if !ok {
+		return nil, r.inProgress("RunPodSandbox", key)
+	}
+	defer unreserve()
+	id := keyID(key)
+	security := config.GetLinux().GetSecurityContext()
+	namespaces := security.GetNamespaceOptions()
+	if err := validateSandboxNamespaces(namespaces); err != nil {
+		return nil, err
+	}
+	level, err := sandboxSELinuxLevel(security.GetSelinuxOptions())
+	if err != nil {
+		return nil, err
+	}
+	pool, err := r.ipPool(config.GetAnnotations())
+	if err != nil {
+		return nil, err
+	}
+	hostNetwork := namespaces.GetNetwork() == runtimeapi.NamespaceMode_NODE
+	netns, err := openNetNS(config.GetAnnotations(), hostNetwork)
+	if err != nil {
+		return nil, err
+	}
+	var ips []string
+	switch {
+	case hostNetwork:
+	case netns == nil:
+		// systemd-nspawn would run the pod's containers in the host's
+		// network namespace.
+		return nil, status.Errorf(
+			codes.Unimplemented,
+			"pod sandbox %s needs a network namespace, which the runtime can't set up: "+
+				"run it on the host network or give it one with annotation %s",
+			metadata.GetName(), netnsPathAnnotation,
+		)
+	default:
+		if ips, err = netnsAddresses(netns); err == nil && len(ips) == 0 {
+			err = status.Errorf(
+				codes.FailedPrecondition,
+				"network namespace %s has no address yet",
+				config.GetAnnotations()[netnsPathAnnotation],
+			)
+		}
+		if err != nil {
+			netns.Close()
+			return nil, err
+		}
+	}
+	sb := &sandboxRecord{
+		ID:             id,
+		Metadata:       metadata,
+		Labels:         config.GetLabels(),
+		Annotations:    config.GetAnnotations(),
+		LogDirectory:   config.GetLogDirectory(),
+		Seccomp:        security.GetSeccomp(),
+		CreatedAt:      time.Now().UnixNano(),
+		HostNetwork:    hostNetwork,
+		Namespaces:     namespaces,
+		RuntimeHandler: req.GetRuntimeHandler(),
+		SELinuxLevel:   level,
+		IPPool:         pool,
+		NetNS:          netns,
+		IPs:            ips,
+		Overhead:       config.GetLinux().GetOverhead(),
+		CgroupParent:   r.checkCgroupParent(config.GetLinux().GetCgroupParent()),
+	}
+	sb.Slice = podSlice(id, sb.CgroupParent)
+	if netns != nil {
+		sb.NetNSPath = config.GetAnnotations()[netnsPathAnnotation]
+	}
+	if namespaces.GetIpc() == runtimeapi.NamespaceMode_POD {
+		if err := r.newPodIPCNS(sb); err != nil {
+			r.teardownNetwork(sb)
+			return nil, err
+		}
+	}
+	slice := podSliceProperties(config.GetLinux().GetResources(), sb.Overhead)
+	if err := r.startPodSlice(ctx, sb, slice); err != nil {
+		r.teardownIPC(sb)
+		r.teardownNetwork(sb)
+		return nil, err
+	}
+	transition, _ := sb.setState(runtimeapi.PodSandboxState_SANDBOX_READY)
+	if err := r.sandboxStates.save(sb, transition); err != nil {
+		r.stopUnit(ctx, sb.Slice, 0)
+		r.teardownIPC(sb)
+		r.teardownNetwork(sb)
+		return nil, err
+	}
+	r.sandboxes.add(sb)
+	if images := prePullImages(config.GetAnnotations()); len(images) > 0 {
+		sb.startPrePulls(images)
+		r.goBackground(func(ctx context.Context) { r.prePull(ctx, sb, images) })
+	}
+	return &runtimeapi.RunPodSandboxResponse{PodSandboxId: id}, nil
 }
 
 // StopPodSandbox stops any running process that is part of the sandbox and
@@ -40,10 +441,37 @@ func (r *RuntimeService) RunPodSandbox(
 // reclaim resources eagerly, as soon as a sandbox is not needed. Hence,
 // multiple StopPodSandbox calls are expected.
 func (r *RuntimeService) StopPodSandbox(
-	context.Context,
-	*runtimeapi.StopPodSandboxRequest,
+	ctx context.Context,
+	req *runtimeapi.StopPodSandboxRequest,
 ) (*runtimeapi.StopPodSandboxResponse, error) {
-	return nil, nil
+	sb, err := r.sandboxes.get(req.GetPodSandboxId())
+	if status.Code(err) == codes.NotFound {
+		return &runtimeapi.StopPodSandboxResponse{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sb.lifecycle.Lock()
+	defer sb.lifecycle.Unlock()
+	// Kubelet stops the containers of a pod with their own grace periods
+	// first, those still running here get the default one.
+	if err := r.stopSandboxContainers(ctx, sb, r.opts.DefaultStopGracePeriod); err != nil {
+		return nil, err
+	}
+	if err := r.teardownNetwork(sb); err != nil {
+		return nil, fmt.Errorf("tear down network of pod sandbox %s: %w", sb.ID, err)
+	}
+	// Whatever is left in the pod's cgroup outside of container units is
+	// killed with the slice.
+	if err := r.stopUnit(ctx, sb.Slice, 0); err != nil {
+		return nil, fmt.Errorf("stop pod sandbox %s: %w", sb.ID, err)
+	}
+	if transition, changed := sb.setState(runtimeapi.PodSandboxState_SANDBOX_NOTREADY); changed {
+		if err := r.sandboxStates.save(sb, transition); err != nil {
+			log.Printf("failed to record that pod sandbox %s stopped: %v", sb.ID, err)
+		}
+	}
+	return &runtimeapi.StopPodSandboxResponse{}, nil
 }
 
 // RemovePodSandbox removes the sandbox. If there are any running containers
@@ -51,43 +479,453 @@ func (r *RuntimeService) StopPodSandbox(
 // This call is idempotent, and must not return an error if the sandbox has
 // already been removed.
 func (r *RuntimeService) RemovePodSandbox(
-	context.Context,
-	*runtimeapi.RemovePodSandboxRequest,
+	ctx context.Context,
+	req *runtimeapi.RemovePodSandboxRequest,
 ) (*runtimeapi.RemovePodSandboxResponse, error) {
-	return nil, nil
+	sb, err := r.sandboxes.get(req.GetPodSandboxId())
+	if status.Code(err) == codes.NotFound {
+		return &runtimeapi.RemovePodSandboxResponse{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sb.lifecycle.Lock()
+	defer sb.lifecycle.Unlock()
+	if err := r.removeSandbox(ctx, sb); err != nil {
+		return nil, err
+	}
+	return &runtimeapi.RemovePodSandboxResponse{}, nil
 }
 
 // PodSandboxStatus  the status of the PodSandbox. If the PodSandbox is not
 // present,  an error.
 func (r *RuntimeService) PodSandboxStatus(
-	context.Context,
-	*runtimeapi.PodSandboxStatusRequest,
+	ctx context.Context,
+	req *runtimeapi.PodSandboxStatusRequest,
 ) (*runtimeapi.PodSandboxStatusResponse, error) {
-	return nil, nil
+	sb, err := r.sandboxes.get(req.GetPodSandboxId())
+	if err != nil {
+		return nil, err
+	}
+	unit, err := r.systemd.UnitProperties(ctx, sb.Slice)
+	if err != nil {
+		return nil, err
+	}
+	transition := r.checkSandboxUnit(sb, unit)
+	response := &runtimeapi.PodSandboxStatusResponse{
+		Status: &runtimeapi.PodSandboxStatus{
+			Id:             sb.ID,
+			Metadata:       sb.Metadata,
+			State:          transition.State,
+			CreatedAt:      sb.CreatedAt,
+			Labels:         sb.Labels,
+			Annotations:    sb.Annotations,
+			RuntimeHandler: sb.RuntimeHandler,
+			Linux: &runtimeapi.LinuxPodSandboxStatus{
+				Namespaces: &runtimeapi.Namespace{Options: sb.Namespaces},
+			},
+		},
+	}
+	if len(sb.IPs) > 0 {
+		network := &runtimeapi.PodSandboxNetworkStatus{Ip: sb.IPs[0]}
+		for _, ip := range sb.IPs[1:] {
+			network.AdditionalIps = append(network.AdditionalIps, &runtimeapi.PodIP{Ip: ip})
+		}
+		response.Status.Network = network
+	}
+	if req.GetVerbose() {
+		response.Info = map[string]string{"lastTransition": transitionInfo(transition)}
+		if sb.IPPool != "" {
+			response.Info["ipPool"] = sb.IPPool
+		}
+		if sb.NetNSPath != "" {
+			response.Info["netnsPath"] = sb.NetNSPath
+		}
+		response.Info["overhead"] = overheadInfo(sb.Overhead)
+		if sb.CgroupParent != "" {
+			response.Info["cgroupParent"] = sb.CgroupParent
+		}
+		response.Info["unit"] = sb.Slice
+		if pulls := sb.prePullInfo(); pulls != "" {
+			response.Info["prePull"] = pulls
+		}
+		if cgroup, _ := unit["ControlGroup"].(string); cgroup != "" {
+			response.Info["cgroup"] = cgroup
+		}
+	}
+	return response, nil
 }
 
 // ListPodSandbox  a list of PodSandboxes.
 func (r *RuntimeService) ListPodSandbox(
-	context.Context,
-	*runtimeapi.ListPodSandboxRequest,
+	_ context.Context,
+	req *runtimeapi.ListPodSandboxRequest,
 ) (*runtimeapi.ListPodSandboxResponse, error) {
-	return nil, nil
+	filter := req.GetFilter()
+	response := &runtimeapi.ListPodSandboxResponse{}
+	// The list is a snapshot of the store, sandboxes created or removed
+	// while it is built don't affect it.
+	for _, sb := range r.sandboxes.list(filter.GetLabelSelector()) {
+		if id := filter.GetId(); id != "" && sb.ID != id {
+			continue
+		}
+		state := sb.state().State
+		if filter.GetState() != nil && filter.GetState().GetState() != state {
+			continue
+		}
+		response.Items = append(response.Items, &runtimeapi.PodSandbox{
+			Id:             sb.ID,
+			Metadata:       sb.Metadata,
+			State:          state,
+			CreatedAt:      sb.CreatedAt,
+			Labels:         sb.Labels,
+			Annotations:    sb.Annotations,
+			RuntimeHandler: sb.RuntimeHandler,
+		})
+	}
+	return response, nil
 }
 
 // CreateContainer creates a new container in specified PodSandbox
 func (r *RuntimeService) CreateContainer(
-	context.Context,
-	*runtimeapi.CreateContainerRequest,
-) (*runtimeapi.CreateContainerResponse, error) {
-	return nil, nil
+	ctx context.Context,
+	req *runtimeapi.CreateContainerRequest,
+) (_ *runtimeapi.CreateContainerResponse, err error) {
+	defer func(start time.Time) {
+		err = r.images.diskFull("create container", err)
+		var handler string
+		if sb, lookupErr := r.sandboxes.get(req.GetPodSandboxId()); lookupErr == nil {
+			handler = sb.RuntimeHandler
+		}
+		observeCreate(containerCreateDuration, "CreateContainer", handler, start, err)
+	}(time.Now())
+	if r.cgroupErr != nil {
+		return nil, r.cgroupErr
+	}
+	if r.nspawnErr != nil {
+		return nil, r.nspawnErr
+	}
+	config := req.GetConfig()
+	key := containerKey(req.GetPodSandboxId(), config.GetMetadata())
+	if c := r.retriedContainer(key); c != nil {
+		r.deduplicated("CreateContainer", key, c.ID)
+		return &runtimeapi.CreateContainerResponse{ContainerId: c.ID}, nil
+	}
+	unreserve, ok := r.creating.reserve(key)
+	if !ok {
+		return nil, r.inProgress("CreateContainer", key)
+	}
+	defer unreserve()
+	devices, err := r.resolveDevices(config.GetDevices(), config.GetAnnotations())
+	if err != nil {
+		return nil, err
+	}
+	deviceNodes := deviceNUMANodes(devices)
+	resources, _, err := containerResources(config.GetLinux().GetResources(), config.GetAnnotations(), deviceNodes)
+	if err != nil {
+		return nil, err
+	}
+	sb, err := r.sandboxes.get(req.GetPodSandboxId())
+	if err != nil {
+		return nil, err
+	}
+	if err := r.validateContainerNamespaces(config.GetLinux().GetSecurityContext().GetNamespaceOptions(), sb); err != nil {
+		return nil, err
+	}
+	seccomp, err := seccompProfile(config.GetLinux().GetSecurityContext().GetSeccomp(), sb.Seccomp)
+	if err != nil {
+		return nil, err
+	}
+	hostCgroupNS, err := hostCgroupNamespace(config.GetAnnotations(), sb.Annotations)
+	if err != nil {
+		return nil, err
+	}
+	init, err := containerInit(config.GetAnnotations(), sb.Annotations, r.opts.ContainerInit)
+	if err != nil {
+		return nil, err
+	}
+	runHealthcheck, err := imageHealthcheck(config.GetAnnotations(), sb.Annotations, r.opts.ImageHealthchecks)
+	if err != nil {
+		return nil, err
+	}
+	ready, err := readinessConfig(config.GetAnnotations())
+	if err != nil {
+		return nil, err
+	}
+	stopOrder, err := stopPriority(config.GetAnnotations())
+	if err != nil {
+		return nil, err
+	}
+	retainRootfs, err := r.retainRootfs(config.GetAnnotations())
+	if err != nil {
+		return nil, err
+	}
+	group, err := fsGroupConfig(config.GetAnnotations())
+	if err != nil {
+		return nil, err
+	}
+	groups, err := supplementalGroups(config.GetLinux().GetSecurityContext(), group)
+	if err != nil {
+		return nil, err
+	}
+	if archive := config.GetImage().GetImage(); isCheckpointArchive(archive) {
+		if _, err := verifyCheckpoint(r.opts.CheckpointDir, archive); err != nil {
+			return nil, err
+		}
+		return nil, status.Errorf(
+			codes.Unimplemented,
+			"restoring container from checkpoint %s is not supported",
+			archive,
+		)
+	}
+	policy, err := imagePullPolicy(config.GetAnnotations(), sb.Annotations)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateMounts(config.GetMounts()); err != nil {
+		return nil, err
+	}
+	mountOpts, err := mountOptionsConfig(config.GetAnnotations(), config.GetMounts())
+	if err != nil {
+		return nil, err
+	}
+	imageName, byID := r.images.resolveImage(config.GetImage().GetImage())
+	// An ID names the content of an image already in the store, no pull
+	// policy has anything to pull for it.
+	if !byID {
+		if err := r.images.enforcePullPolicy(ctx, imageName, policy); err != nil {
+			return nil, err
+		}
+	}
+	release := r.images.useImage(imageName)
+	defer release()
+	image, err := r.images.imageConfig(ctx, imageName)
+	if err != nil {
+		return nil, err
+	}
+	layers, err := r.images.imageLayers(imageName)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := config.GetAnnotations()[credentialEnvAnnotation]; ok && !r.credentials {
+		log.Printf(
+			"container %s: systemd lacks credentials support, passing secrets in the environment",
+			config.GetMetadata().GetName(),
+		)
+	}
+	ulimits, err := r.containerUlimits(config.GetMetadata().GetName(), image.Ulimits, config.GetAnnotations())
+	if err != nil {
+		return nil, err
+	}
+	stopSignal, err := imageStopSignal(image.StopSignal)
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "image stop signal: %v", err)
+	}
+	fullEnv := containerEnv(image.Env, config.GetEnvs())
+	env, creds, err := splitCredentials(fullEnv, config.GetAnnotations(), r.credentials)
+	if err != nil {
+		return nil, err
+	}
+	env, secretEnv, err := splitSecretEnv(env, config.GetAnnotations())
+	if err != nil {
+		return nil, err
+	}
+	secret, err := secretMounts(config.GetAnnotations(), config.GetMounts())
+	if err != nil {
+		return nil, err
+	}
+	var hc *healthcheck
+	if runHealthcheck {
+		hc = image.Healthcheck
+	}
+	command := containerCommand(image.Entrypoint, image.Cmd, config.GetCommand(), config.GetArgs(), fullEnv)
+	id := keyID(key)
+	if r.containerUnits.saved(id) {
+		// A call before the runtime restarted got this far, what it
+		// left behind is replaced.
+		log.Printf("container %s was created before a restart, creating it again", id)
+		if err := r.dropLeftoverContainer(ctx, id); err != nil {
+			return nil, err
+		}
+	}
+	logPath, err := containerLogPath(sb.LogDirectory, config.GetLogPath())
+	if err != nil {
+		return nil, err
+	}
+	if err := relabelMounts(config.GetMounts(), sb.SELinuxLevel); err != nil {
+		return nil, err
+	}
+	if err := applyFSGroup(config.GetMounts(), group); err != nil {
+		return nil, err
+	}
+	rootfs, err := r.images.rootfs.prepare(id, image.Size)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.images.rootfs.mount(id, layers); err != nil {
+		r.images.rootfs.release(id)
+		return nil, err
+	}
+	user, err := userConfig(config.GetLinux().GetSecurityContext(), groups, filepath.Join(rootfs, containerRootDir))
+	if err != nil {
+		r.images.rootfs.release(id)
+		return nil, err
+	}
+	runAsUser, runAsGroup := -1, -1
+	if user != nil {
+		runAsUser, runAsGroup = int(user.UID), int(user.GID)
+	}
+	mounts, err := mountSecrets(rootfs, secretEnv, config.GetMounts(), secret, runAsUser, runAsGroup)
+	if err != nil {
+		r.images.rootfs.release(id)
+		return nil, err
+	}
+	binds, err := stageMounts(rootfs, mounts, mountOpts)
+	if err != nil {
+		r.images.rootfs.release(id)
+		return nil, err
+	}
+	var stdin *stdinPipe
+	if config.GetStdin() {
+		if stdin, err = newStdinPipe(rootfs, config.GetStdinOnce()); err != nil {
+			r.images.rootfs.release(id)
+			return nil, err
+		}
+	}
+	var logFile *crilog.File
+	if logPath != "" {
+		if logFile, err = crilog.OpenFile(logPath); err != nil {
+			if stdin != nil {
+				stdin.close()
+			}
+			r.images.rootfs.release(id)
+			return nil, err
+		}
+	}
+	c := &containerRecord{
+		ID:                  id,
+		SandboxID:           req.GetPodSandboxId(),
+		Metadata:            config.GetMetadata(),
+		Image:               config.GetImage().GetImage(),
+		ImageRef:            r.images.imageRef(imageName),
+		Labels:              config.GetLabels(),
+		Annotations:         config.GetAnnotations(),
+		Command:             command,
+		Env:                 env,
+		Credentials:         creds,
+		WorkingDir:          containerWorkingDir(image.WorkingDir, config.GetWorkingDir()),
+		Rootfs:              rootfs,
+		LogPath:             logPath,
+		Log:                 logFile,
+		Stdin:               stdin,
+		Seccomp:             seccomp,
+		CreatedAt:           time.Now().UnixNano(),
+		HostCgroupNamespace: hostCgroupNS,
+		Init:                init,
+		Readiness:           ready,
+		Mounts:              config.GetMounts(),
+		Binds:               binds,
+		Resources:           resources,
+		Devices:             devices,
+		DeviceNUMANodes:     deviceNodes,
+		Healthcheck:         hc,
+		ExposedPorts:        image.ExposedPorts,
+		RetainRootfs:        retainRootfs,
+		User:                user,
+		StopPriority:        stopOrder,
+		Ulimits:             ulimits,
+		StopSignal:          stopSignal,
+	}
+	// The unit is only created when the container starts, its definition
+	// is checked now so that a container that can't run fails to create.
+	_, err = containerUnitProperties(c, sb)
+	if err == nil {
+		err = writeUserBundle(c)
+	}
+	if err == nil {
+		err = r.containerUnits.save(c)
+	}
+	if err != nil {
+		if logFile != nil {
+			logFile.Close()
+		}
+		if stdin != nil {
+			stdin.close()
+		}
+		r.images.rootfs.release(id)
+		return nil, err
+	}
+	r.containers.add(c)
+	return &runtimeapi.CreateContainerResponse{ContainerId: id}, nil
 }
 
 // StartContainer starts the container.
 func (r *RuntimeService) StartContainer(
-	context.Context,
-	*runtimeapi.StartContainerRequest,
+	ctx context.Context,
+	req *runtimeapi.StartContainerRequest,
 ) (*runtimeapi.StartContainerResponse, error) {
-	return nil, nil
+	c, err := r.containers.get(req.GetContainerId())
+	if err != nil {
+		return nil, err
+	}
+	c.lifecycle.Lock()
+	defer c.lifecycle.Unlock()
+	if c.startedTime() != 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "container %s was already started", c.ID)
+	}
+	sb, err := r.sandboxes.get(c.SandboxID)
+	if err != nil {
+		return nil, err
+	}
+	props, err := containerUnitProperties(c, sb)
+	if err != nil {
+		return nil, err
+	}
+	var output *containerOutput
+	if c.Log != nil {
+		if output, err = openOutput(c.Rootfs, c.Log); err != nil {
+			return nil, fmt.Errorf("open output of container %s: %w", c.ID, err)
+		}
+		props = append(props, output.properties()...)
+	}
+	err = r.startTransientUnit(ctx, containerUnit(c.ID), props...)
+	if output != nil {
+		if err != nil {
+			output.close()
+		} else {
+			output.started()
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("start container %s: %w", c.ID, err)
+	}
+	if err := r.applyStartedResources(ctx, c); err != nil {
+		// The container mustn't run without its limits. Its unit is left
+		// stopped, which a retry replaces.
+		if err := r.stopUnit(ctx, containerUnit(c.ID), 0); err != nil {
+			log.Printf("failed to stop container %s without its limits: %v", c.ID, err)
+		}
+		if output != nil {
+			output.close()
+		}
+		return nil, err
+	}
+	c.output = output
+	if output != nil {
+		r.keepOutput(c.ID, output)
+	}
+	started := time.Now().UnixNano()
+	if times, err := r.unitTimestamps(ctx, containerUnit(c.ID)); err == nil && times.StartedAt != 0 {
+		started = times.StartedAt
+	}
+	c.setStarted(started)
+	if c.Healthcheck != nil {
+		r.goBackground(func(ctx context.Context) { r.runHealthcheck(ctx, c) })
+	}
+	if err := r.waitReady(ctx, c); err != nil {
+		return nil, err
+	}
+	return &runtimeapi.StartContainerResponse{}, nil
 }
 
 // StopContainer stops a running container with a grace period (i.e., timeout).
@@ -96,10 +934,19 @@ func (r *RuntimeService) StartContainer(
 // The runtime must forcibly kill the container after the grace period is
 // reached.
 func (r *RuntimeService) StopContainer(
-	context.Context,
-	*runtimeapi.StopContainerRequest,
+	ctx context.Context,
+	req *runtimeapi.StopContainerRequest,
 ) (*runtimeapi.StopContainerResponse, error) {
-	return nil, nil
+	c, err := r.containers.get(req.GetContainerId())
+	if err != nil {
+		return nil, err
+	}
+	c.lifecycle.Lock()
+	defer c.lifecycle.Unlock()
+	if err := r.stopContainer(ctx, c, r.stopGracePeriod(c.ID, req.GetTimeout())); err != nil {
+		return nil, err
+	}
+	return &runtimeapi.StopContainerResponse{}, nil
 }
 
 // RemoveContainer removes the container. If the container is running, the
@@ -107,35 +954,197 @@ func (r *RuntimeService) StopContainer(
 // This call is idempotent, and must not return an error if the container has
 // already been removed.
 func (r *RuntimeService) RemoveContainer(
-	context.Context,
-	*runtimeapi.RemoveContainerRequest,
+	ctx context.Context,
+	req *runtimeapi.RemoveContainerRequest,
 ) (*runtimeapi.RemoveContainerResponse, error) {
-	return nil, nil
+	c, err := r.containers.get(req.GetContainerId())
+	if status.Code(err) == codes.NotFound {
+		return &runtimeapi.RemoveContainerResponse{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := r.removeContainer(ctx, c); err != nil {
+		return nil, err
+	}
+	return &runtimeapi.RemoveContainerResponse{}, nil
 }
 
 // ListContainers lists all containers by filters.
 func (r *RuntimeService) ListContainers(
-	context.Context,
-	*runtimeapi.ListContainersRequest,
+	ctx context.Context,
+	req *runtimeapi.ListContainersRequest,
 ) (*runtimeapi.ListContainersResponse, error) {
-	return nil, nil
+	filter := req.GetFilter()
+	response := &runtimeapi.ListContainersResponse{}
+	// The list is a snapshot of the store, containers created while it is
+	// built don't show up, and those removed meanwhile are left out.
+	var containers []*containerRecord
+	for _, c := range r.containers.list(filter.GetLabelSelector()) {
+		if id := filter.GetId(); id != "" && c.ID != id {
+			continue
+		}
+		if id := filter.GetPodSandboxId(); id != "" && c.SandboxID != id {
+			continue
+		}
+		containers = append(containers, c)
+	}
+	if len(containers) == 0 {
+		return response, nil
+	}
+	states, err := r.containerStates(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range containers {
+		state, ok := states[containerUnit(c.ID)]
+		switch {
+		case ok:
+		case c.startedTime() != 0:
+			state = runtimeapi.ContainerState_CONTAINER_EXITED
+		default:
+			state = runtimeapi.ContainerState_CONTAINER_CREATED
+		}
+		if filter.GetState() != nil && filter.GetState().GetState() != state {
+			continue
+		}
+		response.Containers = append(response.Containers, &runtimeapi.Container{
+			Id:           c.ID,
+			PodSandboxId: c.SandboxID,
+			Metadata:     c.Metadata,
+			Image:        &runtimeapi.ImageSpec{Image: c.Image},
+			ImageRef:     c.ImageRef,
+			State:        state,
+			CreatedAt:    c.CreatedAt,
+			Labels:       c.Labels,
+			Annotations:  c.Annotations,
+		})
+	}
+	return response, nil
 }
 
 // ContainerStatus  status of the container. If the container is not
 // present,  an error.
 func (r *RuntimeService) ContainerStatus(
-	context.Context,
-	*runtimeapi.ContainerStatusRequest,
+	ctx context.Context,
+	req *runtimeapi.ContainerStatusRequest,
 ) (*runtimeapi.ContainerStatusResponse, error) {
-	return nil, nil
+	c, err := r.containers.get(req.GetContainerId())
+	if err != nil {
+		return nil, err
+	}
+	times, err := r.containerTimes(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	state := containerState(times)
+	var reason string
+	message := c.notReadyReason()
+	if message != "" {
+		reason = "ReadinessGateFailed"
+	}
+	var exitCode int32
+	if state == runtimeapi.ContainerState_CONTAINER_EXITED {
+		exitCode = times.ExitCode
+		reason, message = exitReason(times)
+	}
+	health := c.healthStatus()
+	if reason == "" && health != nil && health.Status == healthUnhealthy {
+		reason = "Unhealthy"
+		message = "image healthcheck failed " + strconv.Itoa(health.FailingStreak) + " times in a row: " + health.LastOutput
+	}
+	response := &runtimeapi.ContainerStatusResponse{
+		Status: &runtimeapi.ContainerStatus{
+			Id:          c.ID,
+			Metadata:    c.Metadata,
+			State:       state,
+			CreatedAt:   c.CreatedAt,
+			StartedAt:   times.StartedAt,
+			FinishedAt:  times.FinishedAt,
+			ExitCode:    exitCode,
+			Image:       &runtimeapi.ImageSpec{Image: c.Image},
+			ImageRef:    c.ImageRef,
+			Reason:      reason,
+			Message:     message,
+			Labels:      c.Labels,
+			Annotations: c.Annotations,
+			Mounts:      c.Mounts,
+			LogPath:     c.LogPath,
+		},
+	}
+	if req.GetVerbose() {
+		response.Info = map[string]string{"unit": containerUnit(c.ID)}
+		if cgroup, err := r.unitCgroup(ctx, containerUnit(c.ID)); err == nil {
+			response.Info["cgroup"] = cgroup
+		}
+		if len(c.DeviceNUMANodes) > 0 {
+			response.Info["deviceNUMANodes"] = numaInfo(c.DeviceNUMANodes)
+		}
+		if retained := r.retainedRootfsInfo(c); retained != "" {
+			response.Info["retainedRootfs"] = retained
+		}
+		if checks := r.resourceChecks(ctx, c); len(checks) > 0 {
+			response.Info["resources"] = resourcesInfo(checks)
+		}
+		if health != nil {
+			response.Info["health"] = healthInfo(health)
+		}
+		if len(c.ExposedPorts) > 0 {
+			response.Info["exposedPorts"] = exposedPortsInfo(c.ExposedPorts)
+		}
+	}
+	return response, nil
 }
 
 // UpdateContainerResources updates ContainerConfig of the container synchronously.
 // If runtime fails to transactionally update the requested resources, an error is returned.
-func (r *RuntimeService) UpdateContainerResources(context.Context,
-	*runtimeapi.UpdateContainerResourcesRequest,
+func (r *RuntimeService) UpdateContainerResources(
+	ctx context.Context,
+	req *runtimeapi.UpdateContainerResourcesRequest,
 ) (*runtimeapi.UpdateContainerResourcesResponse, error) {
-	return nil, nil
+	if r.cgroupErr != nil {
+		return nil, r.cgroupErr
+	}
+	c, err := r.containers.get(req.GetContainerId())
+	if err != nil {
+		return nil, err
+	}
+	// The update mustn't interleave with the container starting or
+	// stopping, or with another update.
+	c.lifecycle.Lock()
+	defer c.lifecycle.Unlock()
+	resources, props, err := containerResources(req.GetLinux(), req.GetAnnotations(), c.DeviceNUMANodes)
+	if err != nil {
+		return nil, err
+	}
+	if c.startedTime() == 0 {
+		// The container gets its resources when it starts.
+		c.setResources(resources, req.GetAnnotations())
+		return &runtimeapi.UpdateContainerResourcesResponse{}, nil
+	}
+	unit := containerUnit(c.ID)
+	cgroup, err := r.unitCgroup(ctx, unit)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.updateUnitResources(ctx, unit, props, func() error {
+		undo, err := applyHugepageLimits(cgroup, resources.GetHugepageLimits())
+		if err != nil {
+			return err
+		}
+		// The hugetlb limits go back along with the unit's properties.
+		if err := verifyResources(cgroup, props); err != nil {
+			if uerr := undo(); uerr != nil {
+				return fmt.Errorf("%w, and %v", err, uerr)
+			}
+			return err
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	c.setResources(resources, req.GetAnnotations())
+	return &runtimeapi.UpdateContainerResourcesResponse{}, nil
 }
 
 // ReopenContainerLog asks runtime to reopen the stdout/stderr log file
@@ -144,31 +1153,115 @@ func (r *RuntimeService) UpdateContainerResources(context.Context,
 // to either create a new log file and return nil, or return an error.
 // Once it  error, new container log file MUST NOT be created.
 func (r *RuntimeService) ReopenContainerLog(
-	context.Context,
-	*runtimeapi.ReopenContainerLogRequest,
+	ctx context.Context,
+	req *runtimeapi.ReopenContainerLogRequest,
 ) (*runtimeapi.ReopenContainerLogResponse, error) {
-	return nil, nil
+	c, err := r.containers.get(req.GetContainerId())
+	if err != nil {
+		return nil, err
+	}
+	if err := r.reopenLog(ctx, c); err != nil {
+		return nil, err
+	}
+	return &runtimeapi.ReopenContainerLogResponse{}, nil
 }
 
 // ExecSync runs a command in a container synchronously.
 func (r *RuntimeService) ExecSync(
-	context.Context,
-	*runtimeapi.ExecSyncRequest,
+	ctx context.Context,
+	req *runtimeapi.ExecSyncRequest,
 ) (*runtimeapi.ExecSyncResponse, error) {
-	return nil, nil
+	c, err := r.containers.get(req.GetContainerId())
+	if err != nil {
+		return nil, err
+	}
+	sb, err := r.sandboxes.get(c.SandboxID)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.execs.admit(sb, time.Now()); err != nil {
+		return nil, err
+	}
+	timeout := time.Duration(req.GetTimeout()) * time.Second
+	response, err := r.execSync(ctx, c, req.GetCmd(), timeout)
+	if err != nil {
+		return nil, err
+	}
+	r.execs.charge(sb.ID, int64(len(response.Stdout)+len(response.Stderr)), time.Now())
+	return response, nil
 }
 
 // Exec prepares a streaming endpoint to execute a command in the container.
-func (r *RuntimeService) Exec(context.Context, *runtimeapi.ExecRequest) (*runtimeapi.ExecResponse, error) {
-	return nil, nil
+// The command starts right away, and is killed unless a client attaches to
+// it within the reconnect grace period. Execs count towards the exec budget
+// of the container's pod sandbox, their output doesn't.
+func (r *RuntimeService) Exec(
+	ctx context.Context,
+	req *runtimeapi.ExecRequest,
+) (*runtimeapi.ExecResponse, error) {
+	if r.opts.StreamingURL == "" {
+		return nil, status.Error(codes.Unimplemented, "exec requires a streaming server")
+	}
+	c, err := r.containers.get(req.GetContainerId())
+	if err != nil {
+		return nil, err
+	}
+	sb, err := r.sandboxes.get(c.SandboxID)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.execs.admit(sb, time.Now()); err != nil {
+		return nil, err
+	}
+	proc, err := r.execProcess(ctx, c, req)
+	if err != nil {
+		return nil, err
+	}
+	proc = auditSession(ctx, proc, "exec", c.ID, req.GetCmd())
+	proc.Streams = streaming.Streams{
+		Stdin:  req.GetStdin(),
+		Stdout: req.GetStdout(),
+		Stderr: req.GetStderr(),
+		TTY:    req.GetTty(),
+	}
+	token, err := r.sessions.Add(proc)
+	if err != nil {
+		proc.Kill()
+		return nil, err
+	}
+	return &runtimeapi.ExecResponse{Url: r.streamingURL("exec", token)}, nil
 }
 
-// Attach prepares a streaming endpoint to attach to a running container.
+// Attach prepares a streaming endpoint to attach to a container. Attaching
+// to a running container connects to its stdin and its live output,
+// attaching to one that isn't replays its logged output.
 func (r *RuntimeService) Attach(
-	context.Context,
-	*runtimeapi.AttachRequest,
+	ctx context.Context,
+	req *runtimeapi.AttachRequest,
 ) (*runtimeapi.AttachResponse, error) {
-	return nil, nil
+	if r.opts.StreamingURL == "" {
+		return nil, status.Error(codes.Unimplemented, "attach requires a streaming server")
+	}
+	c, err := r.containers.get(req.GetContainerId())
+	if err != nil {
+		return nil, err
+	}
+	proc, err := r.attachProcess(ctx, c, req)
+	if err != nil {
+		return nil, err
+	}
+	proc.Streams = streaming.Streams{
+		Stdin:  req.GetStdin(),
+		Stdout: req.GetStdout(),
+		Stderr: req.GetStderr(),
+		TTY:    req.GetTty(),
+	}
+	token, err := r.sessions.Add(proc)
+	if err != nil {
+		proc.Kill()
+		return nil, err
+	}
+	return &runtimeapi.AttachResponse{Url: r.streamingURL("attach", token)}, nil
 }
 
 // PortForward prepares a streaming endpoint to forward ports from a PodSandbox.
@@ -176,33 +1269,154 @@ func (r *RuntimeService) PortForward(
 	context.Context,
 	*runtimeapi.PortForwardRequest,
 ) (*runtimeapi.PortForwardResponse, error) {
-	return nil, nil
+	return nil, status.Error(codes.Unimplemented, "port forwarding is not supported yet")
 }
 
 // ContainerStats  stats of the container. If the container does not
 // exist, the call  an error.
 func (r *RuntimeService) ContainerStats(
-	context.Context,
-	*runtimeapi.ContainerStatsRequest,
+	ctx context.Context,
+	req *runtimeapi.ContainerStatsRequest,
 ) (*runtimeapi.ContainerStatsResponse, error) {
-	return nil, nil
+	c, err := r.containers.get(req.GetContainerId())
+	if err != nil {
+		return nil, err
+	}
+	stats, timestamp, ok := r.stats.get(c.ID)
+	if !ok {
+		s, err := r.containerCgroupStats(ctx, c.ID)
+		if err != nil {
+			return nil, err
+		}
+		timestamp = time.Now().UnixNano()
+		if s != nil {
+			stats = *s
+			r.stats.put(c.ID, stats, timestamp)
+		}
+	}
+	response := &runtimeapi.ContainerStatsResponse{
+		Stats: containerStats(c, stats, timestamp),
+	}
+	if response.Stats.WritableLayer, err = r.images.rootfs.writableLayer(c.ID); err != nil {
+		return nil, err
+	}
+	return response, nil
 }
 
 // ListContainerStats  stats of all running containers.
 func (r *RuntimeService) ListContainerStats(
-	context.Context,
-	*runtimeapi.ListContainerStatsRequest,
+	ctx context.Context,
+	req *runtimeapi.ListContainerStatsRequest,
 ) (*runtimeapi.ListContainerStatsResponse, error) {
-	return nil, nil
+	filter := req.GetFilter()
+	var containers []*containerRecord
+	want := map[string]bool{}
+	slices := map[string]bool{}
+	for _, c := range r.containers.list(filter.GetLabelSelector()) {
+		if filter.GetId() != "" && c.ID != filter.GetId() {
+			continue
+		}
+		if filter.GetPodSandboxId() != "" && c.SandboxID != filter.GetPodSandboxId() {
+			continue
+		}
+		containers = append(containers, c)
+		if _, _, ok := r.stats.get(c.ID); !ok {
+			want[c.ID] = true
+			if sb, err := r.sandboxes.get(c.SandboxID); err == nil {
+				slices[sb.Slice] = true
+			}
+		}
+	}
+	walked, err := walkContainerStats(cgroupRoot, slices, want)
+	if err != nil {
+		return nil, err
+	}
+	timestamp := time.Now().UnixNano()
+	response := &runtimeapi.ListContainerStatsResponse{}
+	for _, c := range containers {
+		if !want[c.ID] {
+			if stats, cachedAt, ok := r.stats.get(c.ID); ok {
+				if err := r.addContainerStats(response, c, stats, cachedAt); err != nil {
+					return nil, err
+				}
+				continue
+			}
+		}
+		stats, ok := walked[c.ID]
+		if !ok {
+			// The container isn't below systemd-cri.slice, or has no
+			// processes.
+			s, err := r.containerCgroupStats(ctx, c.ID)
+			if err != nil {
+				return nil, err
+			}
+			if s == nil {
+				continue
+			}
+			stats = *s
+		}
+		r.stats.put(c.ID, stats, timestamp)
+		if err := r.addContainerStats(response, c, stats, timestamp); err != nil {
+			return nil, err
+		}
+	}
+	return response, nil
+}
+
+// addContainerStats adds the stats of a container, including its writable
+// layer, to a ListContainerStats response.
+func (r *RuntimeService) addContainerStats(
+	response *runtimeapi.ListContainerStatsResponse,
+	c *containerRecord,
+	stats cgroupStats,
+	timestamp int64,
+) error {
+	s := containerStats(c, stats, timestamp)
+	var err error
+	if s.WritableLayer, err = r.images.rootfs.writableLayer(c.ID); err != nil {
+		return err
+	}
+	response.Stats = append(response.Stats, s)
+	return nil
 }
 
 // PodSandboxStats  stats of the pod sandbox. If the pod sandbox does not
 // exist, the call  an error.
 func (r *RuntimeService) PodSandboxStats(
-	context.Context,
-	*runtimeapi.PodSandboxStatsRequest,
+	ctx context.Context,
+	req *runtimeapi.PodSandboxStatsRequest,
 ) (*runtimeapi.PodSandboxStatsResponse, error) {
-	return nil, nil
+	sb, err := r.sandboxes.get(req.GetPodSandboxId())
+	if err != nil {
+		return nil, err
+	}
+	network, err := sandboxNetworkUsage(sb)
+	if err != nil {
+		return nil, err
+	}
+	annotations := sb.Annotations
+	if sb.HostNetwork {
+		// Say so, since the counters cover all of the host's traffic
+		// rather than the pod's.
+		annotations = make(map[string]string, len(sb.Annotations)+1)
+		for k, v := range sb.Annotations {
+			annotations[k] = v
+		}
+		annotations[hostNetworkAnnotation] = "true"
+	}
+	return &runtimeapi.PodSandboxStatsResponse{
+		Stats: &runtimeapi.PodSandboxStats{
+			Attributes: &runtimeapi.PodSandboxAttributes{
+				Id:          sb.ID,
+				Metadata:    sb.Metadata,
+				Labels:      sb.Labels,
+				Annotations: annotations,
+			},
+			Linux: &runtimeapi.LinuxPodSandboxStats{
+				Network: network,
+			},
+		},
+	}, nil
 }
 
 // ListPodSandboxStats  stats of the pod sandboxes matching a filter.
@@ -210,7 +1424,7 @@ func (r *RuntimeService) ListPodSandboxStats(
 	context.Context,
 	*runtimeapi.ListPodSandboxStatsRequest,
 ) (*runtimeapi.ListPodSandboxStatsResponse, error) {
-	return nil, nil
+	return nil, status.Error(codes.Unimplemented, "listing pod sandbox stats is not supported yet")
 }
 
 // UpdateRuntimeConfig updates the runtime configuration based on the given request.
@@ -218,23 +1432,74 @@ func (r *RuntimeService) UpdateRuntimeConfig(
 	context.Context,
 	*runtimeapi.UpdateRuntimeConfigRequest,
 ) (*runtimeapi.UpdateRuntimeConfigResponse, error) {
-	return nil, nil
+	return nil, status.Error(codes.Unimplemented, "updating the runtime config is not supported")
 }
 
 // Status  the status of the runtime.
 func (r *RuntimeService) Status(
-	context.Context,
-	*runtimeapi.StatusRequest,
+	ctx context.Context,
+	req *runtimeapi.StatusRequest,
 ) (*runtimeapi.StatusResponse, error) {
-	return nil, nil
+	runtimeReady := &runtimeapi.RuntimeCondition{
+		Type:   runtimeapi.RuntimeReady,
+		Status: true,
+	}
+	if r.cgroupErr != nil {
+		runtimeReady.Status = false
+		runtimeReady.Reason = "CgroupV2Required"
+		runtimeReady.Message = status.Convert(r.cgroupErr).Message()
+	} else if r.nspawnErr != nil {
+		runtimeReady.Status = false
+		runtimeReady.Reason = "NspawnNotFound"
+		runtimeReady.Message = status.Convert(r.nspawnErr).Message()
+	}
+	networkReady := &runtimeapi.RuntimeCondition{
+		Type:    runtimeapi.NetworkReady,
+		Status:  false,
+		Reason:  "NetworkPluginNotReady",
+		Message: "no network plugin is configured",
+	}
+	// Kubelet only acts on the conditions above, this one explains the
+	// ResourceExhausted errors of pulls and creates.
+	diskPressure := &runtimeapi.RuntimeCondition{
+		Type:   imageFilesystemPressure,
+		Status: r.images.DiskPressure(),
+	}
+	if diskPressure.Status {
+		diskPressure.Reason = "DiskFull"
+		diskPressure.Message = "the image filesystem is out of space"
+	}
+	response := &runtimeapi.StatusResponse{
+		Status: &runtimeapi.RuntimeStatus{
+			Conditions: []*runtimeapi.RuntimeCondition{runtimeReady, networkReady, diskPressure},
+		},
+	}
+	if req.GetVerbose() {
+		response.Info = map[string]string{
+			"quarantinedImages":   strconv.FormatInt(r.images.QuarantinedImages(), 10),
+			"cgroupDriver":        runtimeCgroupDriver,
+			"kubeletCgroupDriver": r.kubeletCgroupDriverInfo(),
+		}
+	}
+	return response, nil
 }
 
 // CheckpointContainer checkpoints a container
 func (r *RuntimeService) CheckpointContainer(
-	context.Context,
-	*runtimeapi.CheckpointContainerRequest,
+	_ context.Context,
+	req *runtimeapi.CheckpointContainerRequest,
 ) (*runtimeapi.CheckpointContainerResponse, error) {
-	return nil, nil
+	c, err := r.containers.get(req.GetContainerId())
+	if err != nil {
+		return nil, err
+	}
+	if req.GetLocation() == "" {
+		return nil, status.Error(codes.InvalidArgument, "checkpoint location is required")
+	}
+	// Archives are written with checkpoint.NewWriter, which adds the
+	// manifest that verifyCheckpoint checks on restore, once there is a
+	// CRIU dump to put in them.
+	return nil, status.Errorf(codes.Unimplemented, "checkpointing container %s is not supported", c.ID)
 }
 
 // GetContainerEvents gets container events from the CRI runtime
@@ -242,7 +1507,7 @@ func (r *RuntimeService) GetContainerEvents(
 	*runtimeapi.GetEventsRequest,
 	runtimeapi.RuntimeService_GetContainerEventsServer,
 ) error {
-	return nil
+	return status.Error(codes.Unimplemented, "container events are not supported yet")
 }
 
 // ListMetricDescriptors gets the descriptors for the metrics that will be returned in ListPodSandboxMetrics.
@@ -254,11 +1519,11 @@ func (r *RuntimeService) ListMetricDescriptors(
 	context.Context,
 	*runtimeapi.ListMetricDescriptorsRequest,
 ) (*runtimeapi.ListMetricDescriptorsResponse, error) {
-	return nil, nil
+	return nil, status.Error(codes.Unimplemented, "pod sandbox metrics are not supported")
 }
 
 // ListPodSandboxMetrics gets pod sandbox metrics from CRI Runtime
 func (r *RuntimeService) ListPodSandboxMetrics(context.Context, *runtimeapi.ListPodSandboxMetricsRequest,
 ) (*runtimeapi.ListPodSandboxMetricsResponse, error) {
-	return nil, nil
+	return nil, status.Error(codes.Unimplemented, "pod sandbox metrics are not supported")
 }
@@ -0,0 +1,415 @@
+package machineman
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/ananthb/systemd-cri/internal/imageref"
+	"github.com/ananthb/systemd-cri/internal/systemd"
+	"github.com/coreos/go-systemd/v22/dbus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+func TestVersion(t *testing.T) {
+	var r RuntimeService
+	resp, err := r.Version(context.Background(), &runtimeapi.VersionRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.RuntimeName != "systemd-cri" || resp.RuntimeApiVersion != "v1" || resp.RuntimeVersion == "" {
+		t.Errorf("Version() = %+v", resp)
+	}
+}
+
+func TestUnsupportedMethods(t *testing.T) {
+	var r RuntimeService
+	ctx := context.Background()
+	tests := []struct {
+		name string
+		call func() error
+	}{
+		{"Exec", func() error {
+			_, err := r.Exec(ctx, &runtimeapi.ExecRequest{})
+			return err
+		}},
+		{"PortForward", func() error {
+			_, err := r.PortForward(ctx, &runtimeapi.PortForwardRequest{})
+			return err
+		}},
+		{"ListPodSandboxStats", func() error {
+			_, err := r.ListPodSandboxStats(ctx, &runtimeapi.ListPodSandboxStatsRequest{})
+			return err
+		}},
+		{"UpdateRuntimeConfig", func() error {
+			_, err := r.UpdateRuntimeConfig(ctx, &runtimeapi.UpdateRuntimeConfigRequest{})
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Kubelet must not mistake an unsupported call for one that
+			// succeeded with an empty response.
+			if err := tt.call(); status.Code(err) != codes.Unimplemented {
+				t.Errorf("%s() = %v, want Unimplemented", tt.name, err)
+			}
+		})
+	}
+}
+
+// fakeSystemd stands in for systemd. It keeps the properties of the units
+// it was told about or started, and records the calls that change units.
+type fakeSystemd struct {
+	mu sync.Mutex
+	// units holds the properties of each loaded unit, the generic and
+	// the type specific ones alike.
+	units map[string]map[string]interface{}
+	// calls lists the calls that changed units, as "StopUnit name".
+	calls []string
+	// stopped, if set, is called by StopUnit before it returns, to play
+	// the part of systemd stopping the unit's processes.
+	stopped func(name string)
+}
+
+func newFakeSystemd() *fakeSystemd {
+	return &fakeSystemd{units: map[string]map[string]interface{}{}}
+}
+
+// setUnit loads a unit with props, which default to an active unit.
+func (f *fakeSystemd) setUnit(name string, props map[string]interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	unit := map[string]interface{}{"LoadState": "loaded", "ActiveState": "active"}
+	for k, v := range props {
+		unit[k] = v
+	}
+	f.units[name] = unit
+}
+
+// callsMade returns the calls made so far.
+func (f *fakeSystemd) callsMade() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.calls...)
+}
+
+func (f *fakeSystemd) record(call, name string) {
+	f.calls = append(f.calls, call+" "+name)
+}
+
+// StartTransientUnit starts a unit in the cgroup of its slice, as
+// "/slice/name".
+func (f *fakeSystemd) StartTransientUnit(_ context.Context, name string, props ...dbus.Property) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("StartTransientUnit", name)
+	if _, ok := f.units[name]; ok {
+		return systemd.ErrUnitExists
+	}
+	slice := "-.slice"
+	for _, prop := range props {
+		if prop.Name == "Slice" {
+			slice, _ = prop.Value.Value().(string)
+		}
+	}
+	f.units[name] = map[string]interface{}{
+		"LoadState":    "loaded",
+		"ActiveState":  "active",
+		"ControlGroup": "/" + slice + "/" + name,
+	}
+	return nil
+}
+
+func (f *fakeSystemd) StopUnit(_ context.Context, name string) error {
+	f.mu.Lock()
+	f.record("StopUnit", name)
+	stopped := f.stopped
+	f.mu.Unlock()
+	if stopped != nil {
+		stopped(name)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if unit, ok := f.units[name]; ok {
+		unit["ActiveState"] = "inactive"
+	}
+	return nil
+}
+
+func (f *fakeSystemd) KillUnit(_ context.Context, name string, _ syscall.Signal) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("KillUnit", name)
+	return nil
+}
+
+func (f *fakeSystemd) ResetFailedUnit(_ context.Context, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("ResetFailedUnit", name)
+	return nil
+}
+
+// SetUnitProperties sets props on a loaded unit.
+func (f *fakeSystemd) SetUnitProperties(_ context.Context, name string, props ...dbus.Property) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("SetUnitProperties", name)
+	if unit, ok := f.units[name]; ok {
+		for _, prop := range props {
+			unit[prop.Name] = prop.Value.Value()
+		}
+	}
+	return nil
+}
+
+func (f *fakeSystemd) UnitProperties(_ context.Context, name string) (map[string]interface{}, error) {
+	return f.unitProperties(name), nil
+}
+
+func (f *fakeSystemd) UnitTypeProperties(_ context.Context, name, _ string) (map[string]interface{}, error) {
+	return f.unitProperties(name), nil
+}
+
+func (f *fakeSystemd) unitProperties(name string) map[string]interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	unit, ok := f.units[name]
+	if !ok {
+		// Like systemd, a unit that isn't loaded has properties too.
+		return map[string]interface{}{"LoadState": "not-found", "ActiveState": "inactive"}
+	}
+	props := make(map[string]interface{}, len(unit))
+	for k, v := range unit {
+		props[k] = v
+	}
+	return props
+}
+
+func (f *fakeSystemd) ListUnitsByPatterns(_ context.Context, patterns ...string) ([]dbus.UnitStatus, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var units []dbus.UnitStatus
+	for name, unit := range f.units {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, name); ok {
+				load, _ := unit["LoadState"].(string)
+				active, _ := unit["ActiveState"].(string)
+				units = append(units, dbus.UnitStatus{Name: name, LoadState: load, ActiveState: active})
+				break
+			}
+		}
+	}
+	return units, nil
+}
+
+func (f *fakeSystemd) Close() {}
+
+func TestListContainersConcurrently(t *testing.T) {
+	fake := newFakeSystemd()
+	r, sb := podRuntime(t, fake)
+	ctx := context.Background()
+	const containers = 50
+	// Creations and removals race the lists, which must only ever see
+	// whole records, and those with the label they select by.
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		for i := 0; i < containers; i++ {
+			id := fmt.Sprintf("c%d", i)
+			r.containers.add(&containerRecord{
+				ID:        id,
+				SandboxID: sb.ID,
+				Metadata:  &runtimeapi.ContainerMetadata{Name: id},
+				Labels:    map[string]string{"app": "web"},
+			})
+			fake.setUnit(containerUnit(id), nil)
+			if i%2 == 0 {
+				continue
+			}
+			if _, err := r.RemoveContainer(ctx, &runtimeapi.RemoveContainerRequest{
+				ContainerId: id,
+			}); err != nil {
+				t.Errorf("RemoveContainer(%s) = %v", id, err)
+			}
+		}
+	}()
+	for _, selector := range []map[string]string{nil, {"app": "web"}} {
+		selector := selector
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				resp, err := r.ListContainers(ctx, &runtimeapi.ListContainersRequest{
+					Filter: &runtimeapi.ContainerFilter{LabelSelector: selector},
+				})
+				if err != nil {
+					t.Errorf("ListContainers() = %v", err)
+					return
+				}
+				for _, c := range resp.GetContainers() {
+					if c.GetId() == "" || c.GetMetadata().GetName() != c.GetId() {
+						t.Errorf("ListContainers() returned a torn container %+v", c)
+					}
+					if selector != nil && c.GetLabels()["app"] != "web" {
+						t.Errorf("ListContainers(%v) returned %s with labels %v", selector, c.GetId(), c.GetLabels())
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	resp, err := r.ListContainers(ctx, &runtimeapi.ListContainersRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(resp.GetContainers()); got != containers/2 {
+		t.Errorf("ListContainers() once done = %d containers, want %d", got, containers/2)
+	}
+}
+
+// writeRunnableImage writes an image without layers pulled by name to the
+// store below root, with a config that sets env, and returns its ID.
+func writeRunnableImage(t *testing.T, root, name string, env ...string) string {
+	t.Helper()
+	ref, err := imageref.Parse(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := json.Marshal(map[string]interface{}{
+		"architecture": "amd64",
+		"os":           "linux",
+		"config":       map[string]interface{}{"Env": env, "Cmd": []string{"/bin/true"}},
+		"rootfs":       map[string]interface{}{"type": "layers", "diff_ids": []string{}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := fmt.Sprintf("%x", sha256.Sum256(config))
+	manifest := fmt.Sprintf(`{
+		"schemaVersion": 2,
+		"mediaType": "application/vnd.oci.image.manifest.v1+json",
+		"config": {"mediaType": "application/vnd.oci.image.config.v1+json", "digest": "sha256:%s", "size": %d},
+		"layers": []
+	}`, sum, len(config))
+	dir := ref.StoragePath(root)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for file, data := range map[string]string{
+		"manifest.json": manifest,
+		sum:             string(config),
+		versionFile:     "Directory Transport Version: 1.1\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, file), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return "sha256:" + sum
+}
+
+func TestCreateContainerByImageID(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("mounting the root filesystem needs root")
+	}
+	fakeNspawn(t)
+	fake := newFakeSystemd()
+	r, sb := podRuntime(t, fake)
+	root := t.TempDir()
+	id := writeRunnableImage(t, root, "registry.example.com/app:1.0", "FROM_IMAGE=yes")
+	index, err := openImageIndex(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.images.opts.Root = root
+	r.images.index = index
+	r.containerUnits = containerUnits{dir: t.TempDir()}
+	// Kubelet names the image by the ID ImageStatus reported. Pulling
+	// it would fail, there is no registry, so the policy must be met
+	// by the image in the store.
+	resp, err := r.CreateContainer(context.Background(), &runtimeapi.CreateContainerRequest{
+		PodSandboxId: sb.ID,
+		Config: &runtimeapi.ContainerConfig{
+			Metadata:    &runtimeapi.ContainerMetadata{Name: "app"},
+			Image:       &runtimeapi.ImageSpec{Image: id},
+			Annotations: map[string]string{imagePullPolicyAnnotation: pullAlways},
+		},
+	})
+	if err != nil {
+		t.Fatalf("CreateContainer(%s) = %v", id, err)
+	}
+	c, err := r.containers.get(resp.GetContainerId())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.images.rootfs.release(c.ID) })
+	if !reflect.DeepEqual(c.Env, []string{"FROM_IMAGE=yes"}) {
+		t.Errorf("env = %q, want the image's", c.Env)
+	}
+	if c.Image != id || !strings.HasPrefix(c.ImageRef, "registry.example.com/app@sha256:") {
+		t.Errorf("image = %q, image ref = %q", c.Image, c.ImageRef)
+	}
+}
+
+func TestPodSandboxStatusPrePulls(t *testing.T) {
+	fake := newFakeSystemd()
+	r, sb := podRuntime(t, fake)
+	prePulls := func() []prePullStatus {
+		t.Helper()
+		resp, err := r.PodSandboxStatus(context.Background(), &runtimeapi.PodSandboxStatusRequest{
+			PodSandboxId: sb.ID,
+			Verbose:      true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, ok := resp.GetInfo()["prePull"]
+		if !ok {
+			return nil
+		}
+		var pulls []prePullStatus
+		if err := json.Unmarshal([]byte(info), &pulls); err != nil {
+			t.Fatalf("prePull info %q: %v", info, err)
+		}
+		return pulls
+	}
+	if got := prePulls(); got != nil {
+		t.Errorf("prePull of a sandbox without pre-pulls = %+v", got)
+	}
+	sb.startPrePulls([]string{"alpine", "nope"})
+	want := []prePullStatus{{Image: "alpine", State: "pending"}, {Image: "nope", State: "pending"}}
+	if got := prePulls(); !reflect.DeepEqual(got, want) {
+		t.Errorf("prePull while pulling = %+v, want %+v", got, want)
+	}
+	sb.setPrePulls([]PrePullResult{
+		{Image: "alpine", ImageRef: "docker.io/library/alpine:latest"},
+		{Image: "nope", Err: errors.New("not found")},
+	})
+	want = []prePullStatus{
+		{Image: "alpine", State: "pulled", ImageRef: "docker.io/library/alpine:latest"},
+		{Image: "nope", State: "failed", Error: "not found"},
+	}
+	if got := prePulls(); !reflect.DeepEqual(got, want) {
+		t.Errorf("prePull once done = %+v, want %+v", got, want)
+	}
+}
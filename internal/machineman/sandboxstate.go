@@ -0,0 +1,277 @@
+package machineman
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ananthb/systemd-cri/internal/health"
+	"golang.org/x/sys/unix"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// sandboxTransition is the state of a sandbox and when it entered it.
+type sandboxTransition struct {
+	State runtimeapi.PodSandboxState `json:"state"`
+	// At is when the sandbox entered State, in nanoseconds since the
+	// epoch.
+	At int64 `json:"at"`
+}
+
+// setState moves the sandbox to state, and reports whether it wasn't in it
+// already. The time of the transition is only updated when it was not.
+func (sb *sandboxRecord) setState(state runtimeapi.PodSandboxState) (sandboxTransition, bool) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	if sb.transition.State == state && sb.transition.At != 0 {
+		return sb.transition, false
+	}
+	sb.transition = sandboxTransition{State: state, At: time.Now().UnixNano()}
+	return sb.transition, true
+}
+
+func (sb *sandboxRecord) state() sandboxTransition {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.transition
+}
+
+// checkSandboxUnit returns the state of a sandbox, given the properties of
+// its slice. A ready sandbox whose slice is no longer active, because it
+// failed or was stopped behind the runtime's back, is not ready anymore,
+// which is recorded.
+func (r *RuntimeService) checkSandboxUnit(sb *sandboxRecord, unit map[string]interface{}) sandboxTransition {
+	transition := sb.state()
+	if transition.State != runtimeapi.PodSandboxState_SANDBOX_READY {
+		return transition
+	}
+	switch unit["ActiveState"] {
+	case "active", "activating", "reloading":
+		return transition
+	}
+	transition, changed := sb.setState(runtimeapi.PodSandboxState_SANDBOX_NOTREADY)
+	if changed {
+		log.Printf("pod sandbox %s is no longer ready, its slice is %v", sb.ID, unit["ActiveState"])
+		if err := r.sandboxStates.save(sb, transition); err != nil {
+			log.Printf("failed to record that pod sandbox %s is not ready: %v", sb.ID, err)
+		}
+	}
+	return transition
+}
+
+// sandboxStates keeps the last transition of each sandbox in a file of its
+// own below dir, along with the slice that holds it and its metadata, so
+// that how long a sandbox has been stuck in a state, and where it is, are
+// still known after the runtime restarts. An empty dir keeps nothing.
+type sandboxStates struct {
+	dir string
+	// health records the last failed write, if set.
+	health *health.Subsystem
+}
+
+func (s sandboxStates) path(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+// ipcNSPath returns where the IPC namespace of a sandbox is mounted.
+func (s sandboxStates) ipcNSPath(id string) string {
+	return filepath.Join(s.dir, id+".ipc")
+}
+
+// savedSandbox is what sandboxStates keeps of a sandbox: enough to list
+// it, report its status, and run, stop and remove its containers after a
+// restart.
+type savedSandbox struct {
+	sandboxTransition
+	Slice          string                              `json:"slice"`
+	Metadata       *runtimeapi.PodSandboxMetadata      `json:"metadata"`
+	Labels         map[string]string                   `json:"labels,omitempty"`
+	Annotations    map[string]string                   `json:"annotations,omitempty"`
+	CreatedAt      int64                               `json:"createdAt,omitempty"`
+	LogDirectory   string                              `json:"logDirectory,omitempty"`
+	Seccomp        *runtimeapi.SecurityProfile         `json:"seccomp,omitempty"`
+	HostNetwork    bool                                `json:"hostNetwork,omitempty"`
+	Namespaces     *runtimeapi.NamespaceOption         `json:"namespaces,omitempty"`
+	RuntimeHandler string                              `json:"runtimeHandler,omitempty"`
+	SELinuxLevel   string                              `json:"selinuxLevel,omitempty"`
+	Overhead       *runtimeapi.LinuxContainerResources `json:"overhead,omitempty"`
+	IPs            []string                            `json:"ips,omitempty"`
+	CgroupParent   string                              `json:"cgroupParent,omitempty"`
+	IPPool         string                              `json:"ipPool,omitempty"`
+	IPCNSPath      string                              `json:"ipcNSPath,omitempty"`
+}
+
+// record returns the record of the sandbox with the given ID that sb was
+// saved from, without its network namespace.
+func (sb savedSandbox) record(id string) *sandboxRecord {
+	return &sandboxRecord{
+		ID:             id,
+		Metadata:       sb.Metadata,
+		Labels:         sb.Labels,
+		Annotations:    sb.Annotations,
+		CreatedAt:      sb.CreatedAt,
+		LogDirectory:   sb.LogDirectory,
+		Seccomp:        sb.Seccomp,
+		HostNetwork:    sb.HostNetwork,
+		Namespaces:     sb.Namespaces,
+		RuntimeHandler: sb.RuntimeHandler,
+		SELinuxLevel:   sb.SELinuxLevel,
+		Overhead:       sb.Overhead,
+		IPs:            sb.IPs,
+		CgroupParent:   sb.CgroupParent,
+		Slice:          sb.Slice,
+		IPPool:         sb.IPPool,
+		IPCNSPath:      sb.IPCNSPath,
+		transition:     sb.sandboxTransition,
+	}
+}
+
+// save replaces the recorded transition of a sandbox atomically, so that a
+// crash leaves either the old or the new one.
+func (s sandboxStates) save(sb *sandboxRecord, t sandboxTransition) error {
+	if s.dir == "" {
+		return nil
+	}
+	id := sb.ID
+	data, err := json.Marshal(savedSandbox{
+		sandboxTransition: t,
+		Slice:             sb.Slice,
+		Metadata:          sb.Metadata,
+		Labels:            sb.Labels,
+		Annotations:       sb.Annotations,
+		CreatedAt:         sb.CreatedAt,
+		LogDirectory:      sb.LogDirectory,
+		Seccomp:           sb.Seccomp,
+		HostNetwork:       sb.HostNetwork,
+		Namespaces:        sb.Namespaces,
+		RuntimeHandler:    sb.RuntimeHandler,
+		SELinuxLevel:      sb.SELinuxLevel,
+		Overhead:          sb.Overhead,
+		IPs:               sb.IPs,
+		CgroupParent:      sb.CgroupParent,
+		IPPool:            sb.IPPool,
+		IPCNSPath:         sb.IPCNSPath,
+	})
+	if err != nil {
+		return err
+	}
+	return recordStateError(s.health, writeFileAtomic(s.dir, id+".json", data))
+}
+
+// writeFileAtomic replaces the file name in dir with data, so that a crash
+// leaves either the old or the new contents.
+func writeFileAtomic(dir, name string, data []byte) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".tmp-"+name+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(dir, name))
+}
+
+// list returns the recorded sandboxes by ID.
+func (s sandboxStates) list() (map[string]savedSandbox, error) {
+	if s.dir == "" {
+		return nil, nil
+	}
+	entries, err := os.ReadDir(s.dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	saved := make(map[string]savedSandbox, len(entries))
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(s.dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var sb savedSandbox
+		if err := json.Unmarshal(data, &sb); err != nil {
+			return nil, fmt.Errorf("read state of pod sandbox %s: %w", id, err)
+		}
+		saved[id] = sb
+	}
+	return saved, nil
+}
+
+// remove forgets the transition of a removed sandbox.
+func (s sandboxStates) remove(id string) error {
+	if s.dir == "" {
+		return nil
+	}
+	err := os.Remove(s.path(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return recordStateError(s.health, err)
+}
+
+// recordStateError records err as the last error of the state store h, if
+// it is set, and returns it.
+func recordStateError(h *health.Subsystem, err error) error {
+	if h != nil {
+		h.RecordError(err)
+	}
+	return err
+}
+
+// checkStateDirs reports whether the runtime can write its state to dirs.
+// A dir that doesn't exist yet is made by the first write, which needs the
+// closest of its parents that does to be writable.
+func checkStateDirs(dirs ...string) error {
+	for _, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+		for {
+			_, err := os.Stat(dir)
+			if !errors.Is(err, fs.ErrNotExist) || dir == filepath.Dir(dir) {
+				break
+			}
+			dir = filepath.Dir(dir)
+		}
+		if err := unix.Access(dir, unix.W_OK); err != nil {
+			return fmt.Errorf("state dir %s is not writable: %w", dir, err)
+		}
+	}
+	return nil
+}
+
+// transitionInfo renders the last transition of a sandbox for verbose
+// status.
+func transitionInfo(t sandboxTransition) string {
+	data, err := json.Marshal(struct {
+		State string `json:"state"`
+		At    string `json:"at"`
+	}{t.State.String(), time.Unix(0, t.At).UTC().Format(time.RFC3339Nano)})
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
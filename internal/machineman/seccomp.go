@@ -0,0 +1,168 @@
+package machineman
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// seccompProfile returns the seccomp profile a container runs with: its own
+// if it sets one, the profile of its sandbox otherwise, and unconfined if
+// neither does, as the CRI defines.
+func seccompProfile(container, sandbox *runtimeapi.SecurityProfile) (*runtimeapi.SecurityProfile, error) {
+	profile := container
+	if profile == nil {
+		profile = sandbox
+	}
+	if profile == nil {
+		return &runtimeapi.SecurityProfile{
+			ProfileType: runtimeapi.SecurityProfile_Unconfined,
+		}, nil
+	}
+	switch profile.GetProfileType() {
+	case runtimeapi.SecurityProfile_RuntimeDefault, runtimeapi.SecurityProfile_Unconfined:
+		return profile, nil
+	case runtimeapi.SecurityProfile_Localhost:
+		if profile.GetLocalhostRef() == "" {
+			return nil, status.Error(
+				codes.InvalidArgument,
+				"localhost seccomp profile requires a localhost_ref",
+			)
+		}
+		return nil, status.Errorf(
+			codes.Unimplemented,
+			"localhost seccomp profile %s is not supported",
+			profile.GetLocalhostRef(),
+		)
+	}
+	return nil, status.Errorf(
+		codes.InvalidArgument,
+		"unknown seccomp profile type %v",
+		profile.GetProfileType(),
+	)
+}
+
+// execDeniedSyscalls are the system calls that commands exec'd into a
+// container with the runtime default profile can't make. They don't
+// inherit the filter systemd-nspawn puts the container's own processes
+// under, and nsenter leaves them the runtime's capabilities, so these stand
+// in for it: the calls that change the system's mounts, clock, kernel,
+// keys and swap, reboot it, or look into other processes. setns is left
+// to nsenter, which enters the container under the filter.
+var execDeniedSyscalls = []uintptr{
+	unix.SYS_ACCT,
+	unix.SYS_ADD_KEY,
+	unix.SYS_BPF,
+	unix.SYS_CLOCK_ADJTIME,
+	unix.SYS_CLOCK_SETTIME,
+	unix.SYS_DELETE_MODULE,
+	unix.SYS_FINIT_MODULE,
+	unix.SYS_FSCONFIG,
+	unix.SYS_FSMOUNT,
+	unix.SYS_FSOPEN,
+	unix.SYS_FSPICK,
+	unix.SYS_INIT_MODULE,
+	unix.SYS_KCMP,
+	unix.SYS_KEXEC_FILE_LOAD,
+	unix.SYS_KEXEC_LOAD,
+	unix.SYS_KEYCTL,
+	unix.SYS_LOOKUP_DCOOKIE,
+	unix.SYS_MOUNT,
+	unix.SYS_MOVE_MOUNT,
+	unix.SYS_NAME_TO_HANDLE_AT,
+	unix.SYS_OPEN_BY_HANDLE_AT,
+	unix.SYS_OPEN_TREE,
+	unix.SYS_PERF_EVENT_OPEN,
+	unix.SYS_PIVOT_ROOT,
+	unix.SYS_PROCESS_VM_READV,
+	unix.SYS_PROCESS_VM_WRITEV,
+	unix.SYS_PTRACE,
+	unix.SYS_QUOTACTL,
+	unix.SYS_REBOOT,
+	unix.SYS_REQUEST_KEY,
+	unix.SYS_SETTIMEOFDAY,
+	unix.SYS_SWAPOFF,
+	unix.SYS_SWAPON,
+	unix.SYS_UMOUNT2,
+	unix.SYS_UNSHARE,
+	unix.SYS_USERFAULTFD,
+}
+
+// Seccomp filter return values, from linux/seccomp.h.
+const (
+	seccompRetErrno = 0x00050000
+	seccompRetAllow = 0x7fff0000
+)
+
+// x32SyscallBit marks the system calls of the x32 ABI, which share the
+// architecture of x86-64 but not its numbers.
+const x32SyscallBit = 0x40000000
+
+// execSeccompFilter returns the seccomp filter that denies
+// execDeniedSyscalls with EPERM, along with every call of an ABI other
+// than the runtime's own, whose numbers differ.
+func execSeccompFilter() ([]unix.SockFilter, error) {
+	var arch uint32
+	switch runtime.GOARCH {
+	case "amd64":
+		arch = unix.AUDIT_ARCH_X86_64
+	case "arm64":
+		arch = unix.AUDIT_ARCH_AARCH64
+	default:
+		return nil, status.Errorf(codes.Unimplemented, "seccomp profiles for exec are not supported on %s", runtime.GOARCH)
+	}
+	deny := unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetErrno | uint32(unix.EPERM)}
+	// The arch and nr fields of struct seccomp_data.
+	loadArch := unix.SockFilter{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: 4}
+	loadNr := unix.SockFilter{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: 0}
+	filter := []unix.SockFilter{
+		loadArch,
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 1, K: arch},
+		deny,
+		loadNr,
+		{Code: unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K, Jf: 1, K: x32SyscallBit},
+		deny,
+	}
+	for _, nr := range execDeniedSyscalls {
+		filter = append(filter,
+			unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jf: 1, K: uint32(nr)},
+			deny,
+		)
+	}
+	return append(filter, unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetAllow}), nil
+}
+
+// startSeccomp starts cmd confined by a container's seccomp profile. The
+// filter of the runtime default profile is installed on a thread set aside
+// for it, which the command is forked from and inherits the filter of. The
+// thread ends with its goroutine rather than going back to running others.
+func startSeccomp(cmd *exec.Cmd, profile *runtimeapi.SecurityProfile) error {
+	if profile.GetProfileType() != runtimeapi.SecurityProfile_RuntimeDefault {
+		return cmd.Start()
+	}
+	filter, err := execSeccompFilter()
+	if err != nil {
+		return err
+	}
+	started := make(chan error, 1)
+	go func() {
+		// Never unlocked, so that the thread exits.
+		runtime.LockOSThread()
+		prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+		if err := unix.Prctl(
+			unix.PR_SET_SECCOMP, unix.SECCOMP_MODE_FILTER,
+			uintptr(unsafe.Pointer(&prog)), 0, 0,
+		); err != nil {
+			started <- os.NewSyscallError("prctl", err)
+			return
+		}
+		started <- cmd.Start()
+	}()
+	return <-started
+}
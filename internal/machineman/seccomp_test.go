@@ -0,0 +1,86 @@
+package machineman
+
+import (
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+func TestSeccompProfile(t *testing.T) {
+	runtimeDefault := &runtimeapi.SecurityProfile{ProfileType: runtimeapi.SecurityProfile_RuntimeDefault}
+	unconfined := &runtimeapi.SecurityProfile{ProfileType: runtimeapi.SecurityProfile_Unconfined}
+	tests := []struct {
+		name      string
+		container *runtimeapi.SecurityProfile
+		sandbox   *runtimeapi.SecurityProfile
+		want      runtimeapi.SecurityProfile_ProfileType
+		wantCode  codes.Code
+	}{
+		{
+			name: "neither sets one",
+			want: runtimeapi.SecurityProfile_Unconfined,
+		},
+		{
+			name:    "inherited from the sandbox",
+			sandbox: runtimeDefault,
+			want:    runtimeapi.SecurityProfile_RuntimeDefault,
+		},
+		{
+			name:      "container overrides the sandbox",
+			container: unconfined,
+			sandbox:   runtimeDefault,
+			want:      runtimeapi.SecurityProfile_Unconfined,
+		},
+		{
+			name:      "localhost profile",
+			container: &runtimeapi.SecurityProfile{ProfileType: runtimeapi.SecurityProfile_Localhost, LocalhostRef: "profile.json"},
+			wantCode:  codes.Unimplemented,
+		},
+		{
+			name:     "localhost profile without a reference",
+			sandbox:  &runtimeapi.SecurityProfile{ProfileType: runtimeapi.SecurityProfile_Localhost},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:      "unknown type",
+			container: &runtimeapi.SecurityProfile{ProfileType: 42},
+			wantCode:  codes.InvalidArgument,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := seccompProfile(tt.container, tt.sandbox)
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("seccompProfile() error = %v, want code %v", err, tt.wantCode)
+			}
+			if err == nil && got.GetProfileType() != tt.want {
+				t.Errorf("seccompProfile() = %v, want %v", got.GetProfileType(), tt.want)
+			}
+		})
+	}
+}
+
+func TestNspawnEnvironmentSeccomp(t *testing.T) {
+	tests := []struct {
+		profile *runtimeapi.SecurityProfile
+		want    bool
+	}{
+		{&runtimeapi.SecurityProfile{ProfileType: runtimeapi.SecurityProfile_RuntimeDefault}, false},
+		{&runtimeapi.SecurityProfile{ProfileType: runtimeapi.SecurityProfile_Unconfined}, true},
+	}
+	for _, tt := range tests {
+		env := nspawnEnvironment(&containerRecord{Seccomp: tt.profile})
+		got := false
+		for _, e := range env {
+			if e == "SYSTEMD_SECCOMP=0" {
+				got = true
+			}
+		}
+		if got != tt.want {
+			t.Errorf("%v profile: environment %q turns off the nspawn filter: %v, want %v",
+				tt.profile.GetProfileType(), env, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package machineman
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+const (
+	// secretEnvAnnotation is a container annotation that lists, separated
+	// by commas, environment variables that hold secrets. They are left out
+	// of the container's environment, which ends up in its unit and every
+	// process it starts, and are instead files on a tmpfs, at
+	// secretsContainerPath/env/NAME.
+	secretEnvAnnotation = "systemd-cri.io/secret-env"
+	// secretMountsAnnotation is a container annotation that lists,
+	// separated by commas, the container paths of mounts that hold
+	// secrets. Their contents are copied to the tmpfs, and the container
+	// binds the copy rather than the host path.
+	secretMountsAnnotation = "systemd-cri.io/secret-mounts"
+)
+
+// secretsContainerPath is where a container finds its secret files.
+const secretsContainerPath = "/run/secrets/systemd-cri"
+
+// secretsDir is where the tmpfs of a container's secrets is mounted,
+// relative to its root filesystem directory.
+const secretsDir = "secrets"
+
+// splitSecretEnv moves the variables that the annotations of a container
+// name out of its environment.
+func splitSecretEnv(env []string, annotations map[string]string) ([]string, map[string]string, error) {
+	value, ok := annotations[secretEnvAnnotation]
+	if !ok {
+		return env, nil, nil
+	}
+	names := map[string]bool{}
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\x00") {
+			return nil, nil, status.Errorf(
+				codes.InvalidArgument,
+				"annotation %s: %q can't name a file",
+				secretEnvAnnotation, name,
+			)
+		}
+		names[name] = true
+	}
+	rest := make([]string, 0, len(env))
+	secrets := make(map[string]string, len(names))
+	for _, kv := range env {
+		key, value, _ := strings.Cut(kv, "=")
+		if names[key] {
+			secrets[key] = value
+			continue
+		}
+		rest = append(rest, kv)
+	}
+	for name := range names {
+		if _, ok := secrets[name]; !ok {
+			return nil, nil, status.Errorf(
+				codes.InvalidArgument,
+				"annotation %s: container has no environment variable %s",
+				secretEnvAnnotation, name,
+			)
+		}
+	}
+	return rest, secrets, nil
+}
+
+// secretMounts returns the container paths of the mounts the annotations
+// of a container mark as secret.
+func secretMounts(annotations map[string]string, mounts []*runtimeapi.Mount) (map[string]bool, error) {
+	value, ok := annotations[secretMountsAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	mounted := map[string]bool{}
+	for _, mount := range mounts {
+		mounted[filepath.Clean(mount.GetContainerPath())] = true
+	}
+	secret := map[string]bool{}
+	for _, path := range strings.Split(value, ",") {
+		path = filepath.Clean(strings.TrimSpace(path))
+		if !mounted[path] {
+			return nil, status.Errorf(
+				codes.InvalidArgument,
+				"annotation %s: nothing is mounted at %s",
+				secretMountsAnnotation, path,
+			)
+		}
+		secret[path] = true
+	}
+	return secret, nil
+}
+
+// mountSecrets puts the secrets of a container on a tmpfs below dir that is
+// nosuid, nodev and noexec, so that they never touch the disk and are gone
+// once it is unmounted. The files are given to the user and group the
+// container runs as, -1 for the runtime's. It returns the mounts the
+// container gets: the secret ones bind their copy, and the tmpfs is bound
+// read-only at secretsContainerPath for the secret variables.
+func mountSecrets(
+	dir string,
+	env map[string]string,
+	mounts []*runtimeapi.Mount,
+	secret map[string]bool,
+	uid, gid int,
+) (_ []*runtimeapi.Mount, err error) {
+	if len(env) == 0 && len(secret) == 0 {
+		return mounts, nil
+	}
+	target := filepath.Join(dir, secretsDir)
+	if err := os.Mkdir(target, 0o700); err != nil {
+		return nil, err
+	}
+	flags := uintptr(unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC)
+	if err := unix.Mount("tmpfs", target, "tmpfs", flags, "mode=0755"); err != nil {
+		return nil, &os.PathError{Op: "mount tmpfs", Path: target, Err: err}
+	}
+	defer func() {
+		if err != nil {
+			wipeSecrets(dir)
+		}
+	}()
+	result := make([]*runtimeapi.Mount, 0, len(mounts)+1)
+	for i, mount := range mounts {
+		if !secret[filepath.Clean(mount.GetContainerPath())] {
+			result = append(result, mount)
+			continue
+		}
+		copied := filepath.Join(target, "mounts", strconv.Itoa(i))
+		if err := os.MkdirAll(filepath.Dir(copied), 0o755); err != nil {
+			return nil, err
+		}
+		if err := copyTree(mount.GetHostPath(), copied); err != nil {
+			return nil, err
+		}
+		bind := *mount
+		bind.HostPath = copied
+		result = append(result, &bind)
+	}
+	if len(env) > 0 {
+		envDir := filepath.Join(target, "env")
+		if err := os.Mkdir(envDir, 0o755); err != nil {
+			return nil, err
+		}
+		for name, value := range env {
+			path := filepath.Join(envDir, name)
+			if err := os.WriteFile(path, []byte(value), 0o400); err != nil {
+				return nil, err
+			}
+			if err := os.Lchown(path, uid, gid); err != nil {
+				return nil, err
+			}
+		}
+		result = append(result, &runtimeapi.Mount{
+			ContainerPath: secretsContainerPath,
+			HostPath:      target,
+			Readonly:      true,
+		})
+	}
+	return result, nil
+}
+
+// copyTree copies the files, directories and symbolic links below src to
+// dst, with their permissions and owners. Secret volumes of kubelet are
+// trees of symbolic links into a timestamped directory, which are copied
+// as they are.
+func copyTree(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			err = os.Mkdir(target, info.Mode().Perm())
+		case d.Type()&fs.ModeSymlink != 0:
+			var link string
+			if link, err = os.Readlink(path); err == nil {
+				err = os.Symlink(link, target)
+			}
+		case d.Type().IsRegular():
+			err = copyFile(path, target, info.Mode().Perm())
+		default:
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			return os.Lchown(target, int(st.Uid), int(st.Gid))
+		}
+		return nil
+	})
+}
+
+func copyFile(src, dst string, perm fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// wipeSecrets removes the secrets of a container and unmounts their tmpfs.
+// The files are removed first, since binds of them, such as staged mounts,
+// would keep the tmpfs alive past the unmount.
+func wipeSecrets(dir string) error {
+	target := filepath.Join(dir, secretsDir)
+	entries, err := os.ReadDir(target)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(target, entry.Name())); err != nil {
+			return err
+		}
+	}
+	// EINVAL is a secrets directory that isn't mounted.
+	if err := unix.Unmount(target, unix.MNT_DETACH); err != nil && err != unix.EINVAL {
+		return &os.PathError{Op: "unmount", Path: target, Err: err}
+	}
+	return nil
+}
+
+// wipeSecretsScript returns the sh command that does what wipeSecrets does,
+// for the unit of a container to run once it stopped.
+func wipeSecretsScript(dir string) string {
+	target := shellQuote(filepath.Join(dir, secretsDir))
+	return "if [ -d " + target + " ]; then find " + target + " -mindepth 1 -delete && umount -l " + target + "; fi"
+}
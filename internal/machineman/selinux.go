@@ -0,0 +1,143 @@
+package machineman
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/big"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+const (
+	// selinuxEnforceFile exists when selinuxfs is mounted, which is how
+	// libselinux tells whether SELinux is enabled.
+	selinuxEnforceFile = "/sys/fs/selinux/enforce"
+	// selinuxXattr holds the SELinux label of a file.
+	selinuxXattr = "security.selinux"
+	// containerFileLabel is the label of files containers may use, without
+	// its level.
+	containerFileLabel = "system_u:object_r:container_file_t"
+	// sharedLevel is the level of files all containers may use.
+	sharedLevel = "s0"
+	// mcsCategories is the number of MCS categories levels are picked from.
+	mcsCategories = 1024
+)
+
+// relabelDenylist holds host paths that are never relabeled, since
+// relabeling them for a container would lock the host out of them.
+var relabelDenylist = map[string]bool{
+	"/":     true,
+	"/bin":  true,
+	"/boot": true,
+	"/dev":  true,
+	"/etc":  true,
+	"/home": true,
+	"/lib":  true,
+	"/proc": true,
+	"/root": true,
+	"/run":  true,
+	"/sbin": true,
+	"/sys":  true,
+	"/usr":  true,
+	"/var":  true,
+}
+
+// selinuxEnabled reports whether the host runs SELinux.
+func selinuxEnabled() bool {
+	_, err := os.Stat(selinuxEnforceFile)
+	return err == nil
+}
+
+// sandboxSELinuxLevel returns the MCS level the containers of a sandbox
+// run with and their private volumes are labeled with: the one the sandbox
+// asks for, or a random pair of categories like "s0:c12,c345". It is empty
+// when SELinux is disabled.
+func sandboxSELinuxLevel(options *runtimeapi.SELinuxOption) (string, error) {
+	if !selinuxEnabled() {
+		return "", nil
+	}
+	if level := options.GetLevel(); level != "" {
+		return level, nil
+	}
+	c1, err := rand.Int(rand.Reader, big.NewInt(mcsCategories))
+	if err != nil {
+		return "", err
+	}
+	c2, err := rand.Int(rand.Reader, big.NewInt(mcsCategories-1))
+	if err != nil {
+		return "", err
+	}
+	// Skipping c1 keeps the categories distinct, and ordering them gives
+	// the canonical form of the level.
+	if c2.Cmp(c1) >= 0 {
+		c2.Add(c2, big.NewInt(1))
+	} else {
+		c1, c2 = c2, c1
+	}
+	return fmt.Sprintf("s0:c%d,c%d", c1, c2), nil
+}
+
+// relabelMounts relabels the host paths of the mounts that ask for it, so
+// that a container may use them on a host enforcing SELinux. Mounts that
+// are read-only are shared with all containers, like ":z" does, the others
+// are private to the sandbox's level, like ":Z" does. Nothing is relabeled
+// when SELinux is disabled.
+func relabelMounts(mounts []*runtimeapi.Mount, level string) error {
+	if !selinuxEnabled() {
+		return nil
+	}
+	for _, mount := range mounts {
+		if !mount.GetSelinuxRelabel() {
+			continue
+		}
+		label := containerFileLabel + ":" + sharedLevel
+		if !mount.GetReadonly() && level != "" {
+			label = containerFileLabel + ":" + level
+		}
+		if err := relabel(mount.GetHostPath(), label); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// relabel sets the SELinux label of path and everything below it.
+func relabel(path, label string) error {
+	path = filepath.Clean(path)
+	if relabelDenylist[path] {
+		return status.Errorf(
+			codes.InvalidArgument,
+			"relabeling host path %s is not allowed",
+			path,
+		)
+	}
+	err := filepath.WalkDir(path, func(name string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		err = unix.Lsetxattr(name, selinuxXattr, []byte(label), 0)
+		if errors.Is(err, unix.ENOTSUP) {
+			// The filesystem has no labels of its own, as with NFS
+			// without security labels, so its mount's label applies.
+			return fs.SkipAll
+		}
+		if err != nil {
+			return &fs.PathError{Op: "relabel", Path: name, Err: err}
+		}
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return status.Errorf(codes.NotFound, "host path %s does not exist", path)
+	}
+	if err != nil {
+		return fmt.Errorf("relabel %s as %s: %w", path, label, err)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package machineman
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/ananthb/systemd-cri/internal/streaming"
+	"github.com/coreos/go-systemd/v22/journal"
+	"google.golang.org/grpc/peer"
+)
+
+// auditSession makes a streaming session into a container auditable: the
+// journal gets an entry whenever a client attaches to it and when it ends.
+// Entries carry AUDIT_EVENT, CONTAINER_ID, SESSION_KIND ("exec" or
+// "attach"), the full command of exec sessions as a JSON list in COMMAND,
+// and PEER, the address of the client that asked for the session. What
+// flows over the streams is never recorded.
+func auditSession(
+	ctx context.Context,
+	proc streaming.Process,
+	kind, containerID string,
+	command []string,
+) streaming.Process {
+	fields := map[string]string{
+		"SESSION_KIND": kind,
+		"CONTAINER_ID": containerID,
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		fields["PEER"] = p.Addr.String()
+	}
+	if command != nil {
+		if data, err := json.Marshal(command); err == nil {
+			fields["COMMAND"] = string(data)
+		}
+	}
+	proc.OnAttach = func() {
+		sendAudit(kind+" session into container "+containerID+" established", fields, map[string]string{
+			"AUDIT_EVENT": "session-established",
+		})
+	}
+	proc.OnEnd = func(lasted time.Duration) {
+		sendAudit(kind+" session into container "+containerID+" closed", fields, map[string]string{
+			"AUDIT_EVENT": "session-closed",
+			"DURATION_MS": strconv.FormatInt(lasted.Milliseconds(), 10),
+		})
+	}
+	return proc
+}
+
+func sendAudit(message string, session, event map[string]string) {
+	fields := map[string]string{"SYSLOG_IDENTIFIER": "systemd-cri"}
+	for k, v := range session {
+		fields[k] = v
+	}
+	for k, v := range event {
+		fields[k] = v
+	}
+	writeAudit(message, fields)
+}
+
+// writeAudit writes an audit event to the journal. Tests replace it to see
+// the events sent.
+var writeAudit = func(message string, fields map[string]string) {
+	if !journal.Enabled() {
+		return
+	}
+	if err := journal.Send(message, journal.PriNotice, fields); err != nil {
+		journalFailure.Do(func() {
+			log.Printf("failed to write audit events to the journal: %v", err)
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package machineman
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ananthb/systemd-cri/internal/streaming"
+	"google.golang.org/grpc/peer"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// recordAudit captures the audit events sent until the test ends, and
+// returns a function that reports them.
+func recordAudit(t *testing.T) func() []map[string]string {
+	var mu sync.Mutex
+	var events []map[string]string
+	saved := writeAudit
+	writeAudit = func(message string, fields map[string]string) {
+		mu.Lock()
+		defer mu.Unlock()
+		fields["MESSAGE"] = message
+		events = append(events, fields)
+	}
+	t.Cleanup(func() { writeAudit = saved })
+	return func() []map[string]string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]map[string]string(nil), events...)
+	}
+}
+
+func TestAuditAttachSession(t *testing.T) {
+	events := recordAudit(t)
+	fake := newFakeSystemd()
+	fake.setUnit(containerUnit("c1"), map[string]interface{}{"ActiveState": "inactive"})
+	r := streamingRuntime(t, fake)
+	r.containers.add(&containerRecord{ID: "c1"})
+	ctx := peer.NewContext(context.Background(), &peer.Peer{
+		Addr: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 4000},
+	})
+	resp, err := r.Attach(ctx, &runtimeapi.AttachRequest{ContainerId: "c1", Stdout: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := events(); len(got) != 0 {
+		t.Errorf("events before a client attached: %v", got)
+	}
+	readSession(t, resp.Url)
+
+	got := events()
+	if len(got) != 2 {
+		t.Fatalf("got %d events, want 2: %v", len(got), got)
+	}
+	if _, ok := got[1]["DURATION_MS"]; !ok {
+		t.Errorf("closing event lacks DURATION_MS: %v", got[1])
+	}
+	delete(got[1], "DURATION_MS")
+	session := map[string]string{
+		"SYSLOG_IDENTIFIER": "systemd-cri",
+		"SESSION_KIND":      "attach",
+		"CONTAINER_ID":      "c1",
+		"PEER":              "10.0.0.1:4000",
+	}
+	for i, want := range []map[string]string{
+		{"AUDIT_EVENT": "session-established", "MESSAGE": "attach session into container c1 established"},
+		{"AUDIT_EVENT": "session-closed", "MESSAGE": "attach session into container c1 closed"},
+	} {
+		for k, v := range session {
+			want[k] = v
+		}
+		if !reflect.DeepEqual(got[i], want) {
+			t.Errorf("event %d = %v, want %v", i, got[i], want)
+		}
+	}
+}
+
+func TestAuditExecCommand(t *testing.T) {
+	events := recordAudit(t)
+	proc := auditSession(
+		context.Background(),
+		streaming.Process{},
+		"exec",
+		"c1",
+		[]string{"sh", "-c", "echo \"hi\""},
+	)
+	proc.OnAttach()
+	proc.OnEnd(1500 * time.Millisecond)
+	got := events()
+	if len(got) != 2 {
+		t.Fatalf("got %d events, want 2: %v", len(got), got)
+	}
+	for _, e := range got {
+		if want := `["sh","-c","echo \"hi\""]`; e["COMMAND"] != want {
+			t.Errorf("COMMAND = %s, want %s", e["COMMAND"], want)
+		}
+		if _, ok := e["PEER"]; ok {
+			t.Errorf("event of a call without a peer has PEER %s", e["PEER"])
+		}
+	}
+	if got := got[1]["DURATION_MS"]; got != "1500" {
+		t.Errorf("DURATION_MS = %s, want 1500", got)
+	}
+}
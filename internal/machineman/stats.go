@@ -0,0 +1,161 @@
+package machineman
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// cgroupStats holds the counters of a cgroup that container stats are made
+// of.
+type cgroupStats struct {
+	// CPUUsage is the CPU time used, in microseconds.
+	CPUUsage      uint64
+	MemoryCurrent uint64
+	Anon          uint64
+	InactiveFile  uint64
+	PageFaults    uint64
+	MajorFaults   uint64
+}
+
+// readCgroupStats reads the counters of the cgroup at dir, an absolute path.
+func readCgroupStats(dir string) (cgroupStats, error) {
+	var stats cgroupStats
+	cpu, err := readKeyedFile(filepath.Join(dir, "cpu.stat"))
+	if err != nil {
+		return stats, err
+	}
+	stats.CPUUsage = cpu["usage_usec"]
+	current, err := os.ReadFile(filepath.Join(dir, "memory.current"))
+	if err != nil {
+		return stats, err
+	}
+	stats.MemoryCurrent, err = strconv.ParseUint(string(bytes.TrimSpace(current)), 10, 64)
+	if err != nil {
+		return stats, err
+	}
+	memory, err := readKeyedFile(filepath.Join(dir, "memory.stat"))
+	if err != nil {
+		return stats, err
+	}
+	stats.Anon = memory["anon"]
+	stats.InactiveFile = memory["inactive_file"]
+	stats.PageFaults = memory["pgfault"]
+	stats.MajorFaults = memory["pgmajfault"]
+	return stats, nil
+}
+
+// readKeyedFile reads a cgroup interface file of "key value" lines.
+func readKeyedFile(path string) (map[string]uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	values := map[string]uint64{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			continue
+		}
+		if n, err := strconv.ParseUint(value, 10, 64); err == nil {
+			values[key] = n
+		}
+	}
+	return values, scanner.Err()
+}
+
+// walkContainerStats reads the counters of the wanted containers that run
+// in the given pod slices by listing the cgroups of the slices in the
+// hierarchy at root, instead of asking systemd for every container's cgroup.
+// Containers that aren't found there are left out.
+func walkContainerStats(root string, slices, want map[string]bool) (map[string]cgroupStats, error) {
+	stats := make(map[string]cgroupStats, len(want))
+	for slice := range slices {
+		pod := filepath.Join(root, sliceCgroup(slice))
+		units, err := os.ReadDir(pod)
+		if err != nil {
+			// The pod is gone, or went away during the walk.
+			continue
+		}
+		for _, unit := range units {
+			id, ok := strings.CutPrefix(unit.Name(), "systemd-cri-")
+			if !ok {
+				continue
+			}
+			id, ok = strings.CutSuffix(id, ".service")
+			if !ok || !want[id] {
+				continue
+			}
+			s, err := readCgroupStats(filepath.Join(pod, unit.Name()))
+			if err != nil {
+				continue
+			}
+			stats[id] = s
+		}
+	}
+	return stats, nil
+}
+
+// containerCgroupStats reads the counters of a single container, finding its
+// cgroup through systemd. It returns nil stats for containers that aren't
+// running.
+func (r *RuntimeService) containerCgroupStats(ctx context.Context, id string) (*cgroupStats, error) {
+	cgroup, err := r.unitCgroup(ctx, containerUnit(id))
+	if errors.Is(err, errNoCgroup) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	stats, err := readCgroupStats(filepath.Join(cgroupRoot, cgroup))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// containerStats turns the counters of a container's cgroup into CRI stats.
+func containerStats(c *containerRecord, stats cgroupStats, timestamp int64) *runtimeapi.ContainerStats {
+	workingSet := stats.MemoryCurrent
+	if stats.InactiveFile < workingSet {
+		workingSet -= stats.InactiveFile
+	} else {
+		workingSet = 0
+	}
+	return &runtimeapi.ContainerStats{
+		Attributes: &runtimeapi.ContainerAttributes{
+			Id:          c.ID,
+			Metadata:    c.Metadata,
+			Labels:      c.Labels,
+			Annotations: c.Annotations,
+		},
+		Cpu: &runtimeapi.CpuUsage{
+			Timestamp: timestamp,
+			UsageCoreNanoSeconds: &runtimeapi.UInt64Value{
+				Value: stats.CPUUsage * uint64(time.Microsecond),
+			},
+		},
+		Memory: &runtimeapi.MemoryUsage{
+			Timestamp:       timestamp,
+			WorkingSetBytes: &runtimeapi.UInt64Value{Value: workingSet},
+			UsageBytes:      &runtimeapi.UInt64Value{Value: stats.MemoryCurrent},
+			RssBytes:        &runtimeapi.UInt64Value{Value: stats.Anon},
+			PageFaults:      &runtimeapi.UInt64Value{Value: stats.PageFaults},
+			MajorPageFaults: &runtimeapi.UInt64Value{Value: stats.MajorFaults},
+		},
+	}
+}
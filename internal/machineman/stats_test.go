@@ -0,0 +1,143 @@
+package machineman
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeCgroup makes a cgroup directory below root with the interface files
+// stats are read from.
+func writeCgroup(t testing.TB, root, cgroup string, stats cgroupStats) {
+	t.Helper()
+	dir := filepath.Join(root, cgroup)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"cpu.stat":       fmt.Sprintf("usage_usec %d\nuser_usec 1\nsystem_usec 2\n", stats.CPUUsage),
+		"memory.current": fmt.Sprintf("%d\n", stats.MemoryCurrent),
+		"memory.stat": fmt.Sprintf(
+			"anon %d\nfile 7\ninactive_file %d\npgfault %d\npgmajfault %d\n",
+			stats.Anon, stats.InactiveFile, stats.PageFaults, stats.MajorFaults,
+		),
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWalkContainerStats(t *testing.T) {
+	root := t.TempDir()
+	a := cgroupStats{CPUUsage: 10, MemoryCurrent: 100, Anon: 50, InactiveFile: 20, PageFaults: 3, MajorFaults: 1}
+	b := cgroupStats{CPUUsage: 20, MemoryCurrent: 200}
+	slice := podSlice("pod", "kubepods-pod1.slice")
+	writeCgroup(t, root, filepath.Join(sliceCgroup(slice), containerUnit("a")), a)
+	writeCgroup(t, root, filepath.Join(sliceCgroup(slice), containerUnit("b")), b)
+	writeCgroup(t, root, filepath.Join(sliceCgroup(slice), "other.service"), b)
+	// A cgroup whose files are gone, as when it is removed during the
+	// walk.
+	if err := os.MkdirAll(filepath.Join(root, sliceCgroup(slice), containerUnit("c")), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		slices []string
+		want   []string
+		stats  map[string]cgroupStats
+	}{
+		{
+			name:   "wanted containers",
+			slices: []string{slice},
+			want:   []string{"a", "b"},
+			stats:  map[string]cgroupStats{"a": a, "b": b},
+		},
+		{
+			name:   "unwanted containers are skipped",
+			slices: []string{slice},
+			want:   []string{"a"},
+			stats:  map[string]cgroupStats{"a": a},
+		},
+		{
+			name:   "unreadable cgroups are left out",
+			slices: []string{slice},
+			want:   []string{"c"},
+			stats:  map[string]cgroupStats{},
+		},
+		{
+			name:   "pods that are gone",
+			slices: []string{slice, sandboxUnit("gone")},
+			want:   []string{"a"},
+			stats:  map[string]cgroupStats{"a": a},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			slices := map[string]bool{}
+			for _, s := range tt.slices {
+				slices[s] = true
+			}
+			want := map[string]bool{}
+			for _, id := range tt.want {
+				want[id] = true
+			}
+			got, err := walkContainerStats(root, slices, want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.stats) {
+				t.Errorf("walkContainerStats() = %+v, want %+v", got, tt.stats)
+			}
+		})
+	}
+}
+
+func TestContainerStatsWorkingSet(t *testing.T) {
+	tests := []struct {
+		name  string
+		stats cgroupStats
+		want  uint64
+	}{
+		{"inactive file pages are left out", cgroupStats{MemoryCurrent: 100, InactiveFile: 30}, 70},
+		{"never below zero", cgroupStats{MemoryCurrent: 10, InactiveFile: 30}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := containerStats(&containerRecord{ID: "a"}, tt.stats, 1).GetMemory().GetWorkingSetBytes().GetValue()
+			if got != tt.want {
+				t.Errorf("working set = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// BenchmarkWalkContainerStats reads the stats of every container on a node
+// with a pod slice per pod and a few containers in each.
+func BenchmarkWalkContainerStats(b *testing.B) {
+	for _, pods := range []int{10, 100} {
+		b.Run(fmt.Sprintf("pods=%d", pods), func(b *testing.B) {
+			root := b.TempDir()
+			slices, want := map[string]bool{}, map[string]bool{}
+			for pod := 0; pod < pods; pod++ {
+				slice := sandboxUnit(fmt.Sprintf("pod%d", pod))
+				slices[slice] = true
+				for container := 0; container < 3; container++ {
+					id := fmt.Sprintf("pod%dc%d", pod, container)
+					want[id] = true
+					writeCgroup(b, root, filepath.Join(sliceCgroup(slice), containerUnit(id)), cgroupStats{})
+				}
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				stats, err := walkContainerStats(root, slices, want)
+				if err != nil || len(stats) != len(want) {
+					b.Fatalf("read stats of %d containers, want %d: %v", len(stats), len(want), err)
+				}
+			}
+		})
+	}
+}
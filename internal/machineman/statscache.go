@@ -0,0 +1,73 @@
+package machineman
+
+import (
+	"sync"
+	"time"
+)
+
+// statsCache keeps the cgroup counters of containers for a short while, so
+// that stats calls that come in right after each other, as kubelet's
+// housekeeping and the metrics endpoints do, share a single read of every
+// container's cgroup files.
+type statsCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]cachedStats
+	// swept is when expired entries were last dropped.
+	swept time.Time
+}
+
+type cachedStats struct {
+	stats cgroupStats
+	// timestamp is when the counters were read, in nanoseconds since the
+	// epoch.
+	timestamp int64
+	expires   time.Time
+}
+
+// get returns the cached counters of a container and when they were read.
+func (c *statsCache) get(id string) (cgroupStats, int64, bool) {
+	if c.ttl <= 0 {
+		return cgroupStats{}, 0, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[id]
+	if !ok || time.Now().After(e.expires) {
+		return cgroupStats{}, 0, false
+	}
+	return e.stats, e.timestamp, true
+}
+
+// put caches the counters of a container read at timestamp.
+func (c *statsCache) put(id string, stats cgroupStats, timestamp int64) {
+	if c.ttl <= 0 {
+		return
+	}
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = map[string]cachedStats{}
+	}
+	// Containers that were removed while their counters were read can
+	// end up here after they were invalidated, drop them eventually.
+	if now.Sub(c.swept) > c.ttl {
+		for id, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, id)
+			}
+		}
+		c.swept = now
+	}
+	c.entries[id] = cachedStats{stats: stats, timestamp: timestamp, expires: now.Add(c.ttl)}
+}
+
+// invalidate drops the cached counters of a container, after it changed
+// state.
+func (c *statsCache) invalidate(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, id)
+}
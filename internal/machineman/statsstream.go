@@ -0,0 +1,116 @@
+package machineman
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// Metrics a stats stream can include.
+const (
+	streamMetricCPU           = "cpu"
+	streamMetricMemory        = "memory"
+	streamMetricWritableLayer = "writable_layer"
+)
+
+// StatsStreamOptions configures StatsStreamHandler.
+type StatsStreamOptions struct {
+	// Interval is how often snapshots are pushed, and the shortest
+	// interval clients can ask for.
+	Interval time.Duration
+	// Metrics are the metrics snapshots include unless a client asks for
+	// others, out of cpu, memory and writable_layer.
+	Metrics []string
+}
+
+// ValidateStreamMetrics fails on metrics a stats stream can't include.
+func ValidateStreamMetrics(metrics []string) error {
+	for _, metric := range metrics {
+		switch metric {
+		case streamMetricCPU, streamMetricMemory, streamMetricWritableLayer:
+		default:
+			return fmt.Errorf("unknown stats metric %q", metric)
+		}
+	}
+	return nil
+}
+
+// StatsStreamHandler returns an HTTP handler that pushes the stats of the
+// runtime's containers to each client until it disconnects, so that a
+// metrics agent on the node doesn't have to poll ListContainerStats. Each
+// snapshot is a ListContainerStatsResponse as a line of JSON. Clients can
+// pass a longer interval, the metrics to include, separated by commas, and
+// a pod sandbox ID to limit the stream to its containers, as the query
+// parameters interval, metrics and pod.
+func (r *RuntimeService) StatsStreamHandler(opts StatsStreamOptions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		query := req.URL.Query()
+		interval := opts.Interval
+		if value := query.Get("interval"); value != "" {
+			requested, err := time.ParseDuration(value)
+			if err != nil {
+				http.Error(w, "interval: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if requested > interval {
+				interval = requested
+			}
+		}
+		metrics := opts.Metrics
+		if value := query.Get("metrics"); value != "" {
+			metrics = strings.Split(value, ",")
+			if err := ValidateStreamMetrics(metrics); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		include := map[string]bool{}
+		for _, metric := range metrics {
+			include[metric] = true
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+			return
+		}
+		filter := &runtimeapi.ContainerStatsFilter{PodSandboxId: query.Get("pod")}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		ctx := req.Context()
+		enc := json.NewEncoder(w)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			resp, err := r.ListContainerStats(ctx, &runtimeapi.ListContainerStatsRequest{Filter: filter})
+			if err != nil {
+				if ctx.Err() == nil {
+					fmt.Fprintf(w, "{\"error\":%q}\n", err.Error())
+				}
+				return
+			}
+			for _, stats := range resp.GetStats() {
+				if !include[streamMetricCPU] {
+					stats.Cpu = nil
+				}
+				if !include[streamMetricMemory] {
+					stats.Memory = nil
+				}
+				if !include[streamMetricWritableLayer] {
+					stats.WritableLayer = nil
+				}
+			}
+			if err := enc.Encode(resp); err != nil {
+				return
+			}
+			flusher.Flush()
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+}
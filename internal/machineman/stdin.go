@@ -0,0 +1,76 @@
+package machineman
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// stdinFile is the name of the FIFO a container with stdin reads it from,
+// in the container's rootfs directory.
+const stdinFile = "stdin"
+
+// stdinPipe is the stdin of a container created with Stdin set: a FIFO the
+// container's process reads, which clients that attach write to. The
+// runtime holds the FIFO open itself, so that the process doesn't see the
+// end of its input between clients. With StdinOnce, it lets go after the
+// first client is done, and the process gets EOF.
+type stdinPipe struct {
+	// Path is where the FIFO is.
+	Path string
+	// Once closes stdin after the first client detaches.
+	Once bool
+
+	mu sync.Mutex
+	// f is the runtime's end of the FIFO, nil once closed.
+	f *os.File
+}
+
+// newStdinPipe makes the stdin FIFO of a container in dir.
+func newStdinPipe(dir string, once bool) (*stdinPipe, error) {
+	path := filepath.Join(dir, stdinFile)
+	if err := unix.Mkfifo(path, 0o600); err != nil {
+		return nil, &os.PathError{Op: "mkfifo", Path: path, Err: err}
+	}
+	// Opening for reading and writing doesn't wait for the other end, and
+	// keeps the FIFO from ever having no writer.
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	return &stdinPipe{Path: path, Once: once, f: f}, nil
+}
+
+// Write writes to the container's stdin.
+func (p *stdinPipe) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	f := p.f
+	p.mu.Unlock()
+	if f == nil {
+		return 0, os.ErrClosed
+	}
+	return f.Write(b)
+}
+
+// Close ends a client's use of stdin. Stdin itself is only closed for
+// containers created with StdinOnce.
+func (p *stdinPipe) Close() error {
+	if !p.Once {
+		return nil
+	}
+	return p.close()
+}
+
+func (p *stdinPipe) close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.f == nil {
+		return nil
+	}
+	err := p.f.Close()
+	p.f = nil
+	return err
+}
@@ -0,0 +1,281 @@
+package machineman
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/dbus"
+	godbus "github.com/godbus/dbus/v5"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// imageStopSignal returns the name of the signal a container is stopped
+// with for its image's STOPSIGNAL, which names a signal with or without the
+// SIG prefix, or numbers it. An image without one is stopped with SIGTERM.
+func imageStopSignal(stopSignal string) (string, error) {
+	if stopSignal == "" {
+		return "SIGTERM", nil
+	}
+	if n, err := strconv.Atoi(stopSignal); err == nil {
+		if name := unix.SignalName(syscall.Signal(n)); name != "" {
+			return name, nil
+		}
+		return "", fmt.Errorf("unknown signal %s", stopSignal)
+	}
+	name := strings.ToUpper(stopSignal)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	// Real-time signals, like the SIGRTMIN+3 systemd stops on, have no
+	// name of their own.
+	if offset, ok := strings.CutPrefix(name, "SIGRTMIN+"); ok {
+		if n, err := strconv.Atoi(offset); err == nil && n >= 0 && n <= 30 {
+			return name, nil
+		}
+	} else if unix.SignalNum(name) != 0 {
+		return name, nil
+	}
+	return "", fmt.Errorf("unknown signal %s", stopSignal)
+}
+
+// cgroupKillMargin is how long after the grace period systemd kills a unit
+// whose cgroup couldn't be killed.
+const cgroupKillMargin = 5 * time.Second
+
+// stopGracePeriod returns how long a container is given to exit after it's
+// asked to stop, for a requested timeout in seconds. A timeout of zero kills
+// it right away, and no container gets more than the maximum.
+func (r *RuntimeService) stopGracePeriod(containerID string, timeout int64) time.Duration {
+	var grace time.Duration
+	if timeout > 0 {
+		grace = time.Duration(math.MaxInt64)
+		if timeout < int64(math.MaxInt64/time.Second) {
+			grace = time.Duration(timeout) * time.Second
+		}
+	}
+	if max := r.opts.MaxStopGracePeriod; max > 0 && grace > max {
+		log.Printf(
+			"container %s: clamping stop grace period of %v to %v",
+			containerID, grace, max,
+		)
+		grace = max
+	}
+	return grace
+}
+
+// unitStop is how a unit is stopped.
+type unitStop struct {
+	// skip is set for units that are already stopped or gone.
+	skip bool
+	// kill is set for units that are killed right away rather than asked
+	// to stop.
+	kill bool
+	// timeout is the TimeoutStopUSec systemd kills the unit after.
+	timeout time.Duration
+	// cgroup is the cgroup of the unit, killed through cgroup.kill once
+	// the grace period is up, empty to leave killing to systemd.
+	cgroup string
+}
+
+// planStop decides how a unit with the given properties is stopped with a
+// grace period, and whether its cgroup is killed through cgroup.kill.
+func planStop(props map[string]interface{}, grace time.Duration, cgroupKill bool) unitStop {
+	if props["LoadState"] == "not-found" {
+		return unitStop{skip: true}
+	}
+	switch props["ActiveState"] {
+	case "inactive", "failed":
+		return unitStop{skip: true}
+	}
+	var plan unitStop
+	if cgroupKill {
+		plan.cgroup, _ = props["ControlGroup"].(string)
+	}
+	// A TimeoutStopUSec of zero would mean no timeout at all.
+	if grace < time.Microsecond {
+		plan.kill = true
+		return plan
+	}
+	plan.timeout = grace
+	if plan.cgroup != "" {
+		// The cgroup is killed once the grace period is up, systemd's
+		// own SIGKILL only comes into play if that fails.
+		plan.timeout += cgroupKillMargin
+	}
+	return plan
+}
+
+// stopUnit stops a unit, killing it if it is still running after grace, or
+// right away if grace is zero. Units that are already stopped or gone are
+// left alone.
+func (r *RuntimeService) stopUnit(ctx context.Context, unit string, grace time.Duration) error {
+	props, err := r.systemd.UnitProperties(ctx, unit)
+	if err != nil {
+		return err
+	}
+	plan := planStop(props, grace, r.opts.CgroupKill)
+	switch {
+	case plan.skip:
+		return nil
+	case plan.kill:
+		if err := r.killUnit(ctx, unit, plan.cgroup); err != nil {
+			return err
+		}
+		return r.systemd.StopUnit(ctx, unit)
+	}
+	if plan.cgroup != "" {
+		timer := time.AfterFunc(grace, func() {
+			ctx, cancel := context.WithTimeout(context.Background(), cgroupKillMargin)
+			defer cancel()
+			if err := r.killUnit(ctx, unit, plan.cgroup); err != nil {
+				log.Printf("failed to kill unit %s after its grace period: %v", unit, err)
+			}
+		})
+		defer timer.Stop()
+	}
+	if err := r.systemd.SetUnitProperties(ctx, unit, dbus.Property{
+		Name:  "TimeoutStopUSec",
+		Value: godbus.MakeVariant(uint64(plan.timeout / time.Microsecond)),
+	}); err != nil {
+		return err
+	}
+	return r.systemd.StopUnit(ctx, unit)
+}
+
+// stopPriorityAnnotation is a container annotation that orders how the
+// containers of a pod are stopped with it: those with a higher priority are
+// stopped first, and have exited before the next are asked to stop, like an
+// app before the sidecar proxy it sends its traffic through. Containers
+// without it have priority 0, containers of the same priority are stopped
+// together.
+const stopPriorityAnnotation = "systemd-cri.io/stop-priority"
+
+// stopPriority returns the stop priority a container's annotations give it.
+func stopPriority(annotations map[string]string) (int, error) {
+	value, ok := annotations[stopPriorityAnnotation]
+	if !ok {
+		return 0, nil
+	}
+	priority, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, status.Errorf(
+			codes.InvalidArgument,
+			"annotation %s: %q is not an integer",
+			stopPriorityAnnotation, value,
+		)
+	}
+	return priority, nil
+}
+
+// stopSandboxContainers stops the containers of a sandbox in the order of
+// their stop priority, all at once if none has one. It returns the first
+// error of those that failed to stop, after trying to stop the rest.
+func (r *RuntimeService) stopSandboxContainers(ctx context.Context, sb *sandboxRecord, grace time.Duration) error {
+	tiers := map[int][]*containerRecord{}
+	for _, c := range r.containers.list(nil) {
+		if c.SandboxID == sb.ID {
+			tiers[c.StopPriority] = append(tiers[c.StopPriority], c)
+		}
+	}
+	priorities := make([]int, 0, len(tiers))
+	for priority := range tiers {
+		priorities = append(priorities, priority)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(priorities)))
+	var firstErr error
+	for _, priority := range priorities {
+		if err := r.stopContainers(ctx, tiers[priority], grace); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// stopContainers stops containers all at once: each is sent SIGTERM, and
+// killed if it is still running after grace. It returns once all of them
+// are stopped, with the first error of those that failed to stop.
+func (r *RuntimeService) stopContainers(ctx context.Context, containers []*containerRecord, grace time.Duration) error {
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	for _, c := range containers {
+		wg.Add(1)
+		go func(c *containerRecord) {
+			defer wg.Done()
+			c.lifecycle.Lock()
+			defer c.lifecycle.Unlock()
+			if err := r.stopContainer(ctx, c, grace); err != nil {
+				mu.Lock()
+				defer mu.Unlock()
+				if firstErr == nil {
+					firstErr = fmt.Errorf("stop container %s: %w", c.ID, err)
+				}
+			}
+		}(c)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// stopContainer stops a container whose lifecycle lock is held, the way
+// stopContainers does, and wipes its secrets once it stopped.
+func (r *RuntimeService) stopContainer(ctx context.Context, c *containerRecord, grace time.Duration) error {
+	defer r.stats.invalidate(c.ID)
+	if err := r.stopUnit(ctx, containerUnit(c.ID), grace); err != nil {
+		return err
+	}
+	if err := wipeSecrets(c.Rootfs); err != nil {
+		log.Printf("failed to wipe the secrets of container %s: %v", c.ID, err)
+	}
+	return nil
+}
+
+// killUnit kills all processes of a unit, at once through cgroup.kill if
+// its cgroup is given and the kernel supports it, by signaling each of them
+// with SIGKILL otherwise.
+func (r *RuntimeService) killUnit(ctx context.Context, unit, cgroup string) error {
+	if cgroup != "" {
+		err := killCgroup(cgroup)
+		if !errors.Is(err, errNoCgroupKill) {
+			return err
+		}
+	}
+	return r.systemd.KillUnit(ctx, unit, syscall.SIGKILL)
+}
+
+// releaseUnit makes sure systemd has let go of a stopped transient unit, so
+// that nothing of it is left to come back. Failed units are kept around by
+// systemd until their failure is reset.
+func (r *RuntimeService) releaseUnit(ctx context.Context, unit string) error {
+	props, err := r.systemd.UnitProperties(ctx, unit)
+	if err != nil {
+		return err
+	}
+	if props["LoadState"] == "not-found" {
+		return nil
+	}
+	switch props["ActiveState"] {
+	case "inactive":
+		return nil
+	case "failed":
+		return r.systemd.ResetFailedUnit(ctx, unit)
+	}
+	return status.Errorf(
+		codes.FailedPrecondition,
+		"unit %s is still %v",
+		unit, props["ActiveState"],
+	)
+}
@@ -0,0 +1,377 @@
+package machineman
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+func TestImageStopSignal(t *testing.T) {
+	tests := []struct {
+		stopSignal string
+		want       string
+		wantErr    bool
+	}{
+		{stopSignal: "", want: "SIGTERM"},
+		{stopSignal: "SIGQUIT", want: "SIGQUIT"},
+		{stopSignal: "quit", want: "SIGQUIT"},
+		{stopSignal: "2", want: "SIGINT"},
+		{stopSignal: "SIGRTMIN+3", want: "SIGRTMIN+3"},
+		{stopSignal: "SIGRTMIN+31", wantErr: true},
+		{stopSignal: "SIGNOPE", wantErr: true},
+		{stopSignal: "99", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := imageStopSignal(tt.stopSignal)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("imageStopSignal(%q) error = %v, want error %v", tt.stopSignal, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("imageStopSignal(%q) = %q, want %q", tt.stopSignal, got, tt.want)
+		}
+	}
+}
+
+func TestPlanStop(t *testing.T) {
+	running := map[string]interface{}{
+		"LoadState":    "loaded",
+		"ActiveState":  "active",
+		"ControlGroup": "/systemd.slice/systemd-cri-a.service",
+	}
+	tests := []struct {
+		name       string
+		props      map[string]interface{}
+		grace      time.Duration
+		cgroupKill bool
+		want       unitStop
+	}{
+		{
+			name:  "gone",
+			props: map[string]interface{}{"LoadState": "not-found", "ActiveState": "inactive"},
+			grace: time.Second,
+			want:  unitStop{skip: true},
+		},
+		{
+			name:  "stopped",
+			props: map[string]interface{}{"LoadState": "loaded", "ActiveState": "inactive"},
+			grace: time.Second,
+			want:  unitStop{skip: true},
+		},
+		{
+			name:  "failed",
+			props: map[string]interface{}{"LoadState": "loaded", "ActiveState": "failed"},
+			grace: time.Second,
+			want:  unitStop{skip: true},
+		},
+		{
+			name:  "grace period",
+			props: running,
+			grace: 30 * time.Second,
+			want:  unitStop{timeout: 30 * time.Second},
+		},
+		{
+			name:  "zero grace period kills",
+			props: running,
+			want:  unitStop{kill: true},
+		},
+		{
+			// It would be a TimeoutStopUSec of zero, no timeout at
+			// all.
+			name:  "grace period below a microsecond kills",
+			props: running,
+			grace: time.Nanosecond,
+			want:  unitStop{kill: true},
+		},
+		{
+			name:  "deactivating unit",
+			props: map[string]interface{}{"LoadState": "loaded", "ActiveState": "deactivating"},
+			grace: time.Second,
+			want:  unitStop{timeout: time.Second},
+		},
+		{
+			// systemd's own SIGKILL is held back until the cgroup
+			// kill had its chance.
+			name:       "grace period with cgroup kill",
+			props:      running,
+			grace:      30 * time.Second,
+			cgroupKill: true,
+			want: unitStop{
+				timeout: 30*time.Second + cgroupKillMargin,
+				cgroup:  "/systemd.slice/systemd-cri-a.service",
+			},
+		},
+		{
+			name:       "zero grace period with cgroup kill",
+			props:      running,
+			cgroupKill: true,
+			want:       unitStop{kill: true, cgroup: "/systemd.slice/systemd-cri-a.service"},
+		},
+		{
+			name:       "cgroup kill without a cgroup",
+			props:      map[string]interface{}{"LoadState": "loaded", "ActiveState": "active"},
+			grace:      time.Second,
+			cgroupKill: true,
+			want:       unitStop{timeout: time.Second},
+		},
+		{
+			name:       "cgroup kill of a stopped unit",
+			props:      map[string]interface{}{"LoadState": "loaded", "ActiveState": "inactive", "ControlGroup": "/x"},
+			grace:      time.Second,
+			cgroupKill: true,
+			want:       unitStop{skip: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := planStop(tt.props, tt.grace, tt.cgroupKill); got != tt.want {
+				t.Errorf("planStop() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// podRuntime returns a runtime on fake systemd with a running pod sandbox.
+func podRuntime(t *testing.T, fake *fakeSystemd) (*RuntimeService, *sandboxRecord) {
+	t.Helper()
+	r := &RuntimeService{
+		systemd: fake,
+		images:  &ImageService{rootfs: &rootfsStore{dir: t.TempDir()}},
+		execs:   &execBudget{},
+	}
+	sb := &sandboxRecord{
+		ID:       "sb1",
+		Metadata: &runtimeapi.PodSandboxMetadata{Namespace: "default", Name: "web"},
+		Slice:    "systemd-cri-pod-sb1.slice",
+	}
+	r.sandboxes.add(sb)
+	fake.setUnit(sb.Slice, nil)
+	return r, sb
+}
+
+// addRunningContainer adds a running container with a stop priority to the
+// sandbox.
+func addRunningContainer(r *RuntimeService, fake *fakeSystemd, sb *sandboxRecord, id string, priority int) {
+	r.containers.add(&containerRecord{
+		ID:           id,
+		SandboxID:    sb.ID,
+		Metadata:     &runtimeapi.ContainerMetadata{Name: id},
+		StopPriority: priority,
+	})
+	fake.setUnit(containerUnit(id), nil)
+}
+
+// callIndex returns where call is among calls, failing the test if it is
+// missing.
+func callIndex(t *testing.T, calls []string, call string) int {
+	t.Helper()
+	for i, c := range calls {
+		if c == call {
+			return i
+		}
+	}
+	t.Fatalf("%s is not among the calls %q", call, calls)
+	return -1
+}
+
+func TestStopPodSandboxOrder(t *testing.T) {
+	fake := newFakeSystemd()
+	r, sb := podRuntime(t, fake)
+	r.opts.DefaultStopGracePeriod = 10 * time.Second
+	addRunningContainer(r, fake, sb, "app", 1)
+	addRunningContainer(r, fake, sb, "proxy", 0)
+	addRunningContainer(r, fake, sb, "logger", 0)
+	if _, err := r.StopPodSandbox(context.Background(), &runtimeapi.StopPodSandboxRequest{
+		PodSandboxId: sb.ID,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	calls := fake.callsMade()
+	app := callIndex(t, calls, "StopUnit "+containerUnit("app"))
+	proxy := callIndex(t, calls, "StopUnit "+containerUnit("proxy"))
+	logger := callIndex(t, calls, "StopUnit "+containerUnit("logger"))
+	slice := callIndex(t, calls, "StopUnit "+sb.Slice)
+	// The container with the higher stop priority has stopped before the
+	// others are asked to, and the slice goes last.
+	if app > proxy || app > logger {
+		t.Errorf("app stopped after the containers of lower priority: %q", calls)
+	}
+	if slice < proxy || slice < logger {
+		t.Errorf("slice stopped before the containers: %q", calls)
+	}
+	if state := sb.state().State; state != runtimeapi.PodSandboxState_SANDBOX_NOTREADY {
+		t.Errorf("sandbox is %v, want %v", state, runtimeapi.PodSandboxState_SANDBOX_NOTREADY)
+	}
+	// Stopping again finds everything stopped.
+	if _, err := r.StopPodSandbox(context.Background(), &runtimeapi.StopPodSandboxRequest{
+		PodSandboxId: sb.ID,
+	}); err != nil {
+		t.Errorf("second StopPodSandbox() = %v", err)
+	}
+	if again := fake.callsMade(); len(again) != len(calls) {
+		t.Errorf("second StopPodSandbox() made calls %q", again[len(calls):])
+	}
+}
+
+func TestStopPodSandboxWipesSecrets(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("mounting the secrets tmpfs needs root")
+	}
+	fake := newFakeSystemd()
+	r, sb := podRuntime(t, fake)
+	addRunningContainer(r, fake, sb, "app", 0)
+	c, err := r.containers.get("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Rootfs = t.TempDir()
+	if _, err := mountSecrets(c.Rootfs, map[string]string{"TOKEN": "hunter2"}, nil, nil, -1, -1); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { wipeSecrets(c.Rootfs) })
+	if _, err := r.StopPodSandbox(context.Background(), &runtimeapi.StopPodSandboxRequest{
+		PodSandboxId: sb.ID,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	secrets := filepath.Join(c.Rootfs, secretsDir)
+	if entries, err := os.ReadDir(secrets); err != nil || len(entries) != 0 {
+		t.Errorf("secrets of a stopped container = %v, %v, want none", entries, err)
+	}
+	mounts, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(mounts), " "+secrets+" ") {
+		t.Errorf("secrets tmpfs of a stopped container is still mounted")
+	}
+}
+
+// testCgroup makes a cgroup for the test on the host's cgroup v2 hierarchy,
+// which cgroupRoot is pointed at, and returns its path below it. The test
+// is skipped where there is none it may write to.
+func testCgroup(t *testing.T) string {
+	t.Helper()
+	mounts, err := os.ReadFile("/proc/self/mounts")
+	if err != nil {
+		t.Skip(err)
+	}
+	var root string
+	for _, line := range strings.Split(string(mounts), "\n") {
+		if fields := strings.Fields(line); len(fields) > 2 && fields[2] == "cgroup2" {
+			root = fields[1]
+			break
+		}
+	}
+	if root == "" {
+		t.Skip("no cgroup v2 hierarchy")
+	}
+	cgroup := fmt.Sprintf("/systemd-cri-test-%d", os.Getpid())
+	if err := os.Mkdir(filepath.Join(root, cgroup), 0o755); err != nil {
+		t.Skipf("cannot make a cgroup: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, cgroup, "cgroup.kill")); err != nil {
+		os.Remove(filepath.Join(root, cgroup))
+		t.Skip("cgroup.kill is not supported")
+	}
+	saved := cgroupRoot
+	cgroupRoot = root
+	t.Cleanup(func() {
+		cgroupRoot = saved
+		os.Remove(filepath.Join(root, cgroup))
+	})
+	return cgroup
+}
+
+func TestStopContainerKillsCgroupAfterGrace(t *testing.T) {
+	cgroup := testCgroup(t)
+	dir, err := os.Open(filepath.Join(cgroupRoot, cgroup))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dir.Close()
+	// A container whose process and its children ignore SIGTERM.
+	cmd := exec.Command("sh", "-c", `trap "" TERM; sleep 60 & sleep 60 & wait`)
+	cmd.SysProcAttr = &syscall.SysProcAttr{UseCgroupFD: true, CgroupFD: int(dir.Fd())}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	defer func() {
+		cmd.Process.Kill()
+		<-exited
+	}()
+	procs := func() []string {
+		data, _ := os.ReadFile(filepath.Join(cgroupRoot, cgroup, "cgroup.procs"))
+		return strings.Fields(string(data))
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(procs()) < 3; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("container did not start its children, cgroup has %q", procs())
+		}
+	}
+
+	fake := newFakeSystemd()
+	r, sb := podRuntime(t, fake)
+	r.opts.CgroupKill = true
+	addRunningContainer(r, fake, sb, "c1", 0)
+	fake.setUnit(containerUnit("c1"), map[string]interface{}{"ControlGroup": cgroup})
+	// Like systemd with KillMode=mixed, stopping sends SIGTERM to the
+	// main process alone and waits for the processes to be gone, up to a
+	// timeout well past the grace period.
+	survivedTerm := make(chan bool, 1)
+	fake.stopped = func(string) {
+		syscall.Kill(cmd.Process.Pid, syscall.SIGTERM)
+		time.Sleep(100 * time.Millisecond)
+		survivedTerm <- len(procs()) == 3
+		for deadline := time.Now().Add(cgroupKillMargin); len(procs()) > 0 && time.Now().Before(deadline); {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	const grace = time.Second
+	start := time.Now()
+	if _, err := r.StopContainer(context.Background(), &runtimeapi.StopContainerRequest{
+		ContainerId: "c1",
+		Timeout:     int64(grace / time.Second),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+	if !<-survivedTerm {
+		t.Fatal("container did not survive SIGTERM")
+	}
+	if left := procs(); len(left) != 0 {
+		t.Errorf("processes %q outlived the stop", left)
+	}
+	if elapsed < grace {
+		t.Errorf("container was killed after %v, before its grace period of %v", elapsed, grace)
+	}
+	if elapsed >= grace+cgroupKillMargin {
+		t.Errorf("container was only gone after %v, past the point systemd kills it", elapsed)
+	}
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("container's process did not exit")
+	}
+	if ws, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); !ok || ws.Signal() != syscall.SIGKILL {
+		t.Errorf("container's process ended with %v, want SIGKILL", cmd.ProcessState)
+	}
+	for _, call := range fake.callsMade() {
+		if strings.HasPrefix(call, "KillUnit") {
+			t.Errorf("container was killed through systemd rather than cgroup.kill: %q", fake.callsMade())
+		}
+	}
+}
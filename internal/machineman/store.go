@@ -0,0 +1,349 @@
+package machineman
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"sync"
+
+	"github.com/ananthb/systemd-cri/internal/crilog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// containerRecord is what the runtime remembers about a container beyond
+// what its unit tells.
+type containerRecord struct {
+	ID          string
+	SandboxID   string
+	Metadata    *runtimeapi.ContainerMetadata
+	Image       string
+	Labels      map[string]string
+	Annotations map[string]string
+	// ImageRef is the digest reference of the image the container was
+	// created from, as in "docker.io/library/alpine@sha256:...".
+	ImageRef string
+	// Command is the command line of the container's process, with its
+	// $(VAR) references expanded.
+	Command []string
+	// Env is the environment of the container's processes, the image's
+	// merged with the config's.
+	Env []string
+	// Credentials holds the secrets passed to the container as systemd
+	// credentials rather than in Env, keyed by credential name.
+	Credentials map[string]string
+	// WorkingDir is where the container's processes start.
+	WorkingDir string
+	// Rootfs is the directory holding the upper, work and merged
+	// directories of the overlay the container's root filesystem is.
+	Rootfs string
+	// LogPath is the absolute path of the container's log file, below the
+	// sandbox's log directory. It is empty if kubelet didn't ask for one.
+	LogPath string
+	// Log is the open log file at LogPath, nil without one.
+	Log *crilog.File
+	// Stdin is the container's stdin, nil unless it was created with one.
+	Stdin *stdinPipe
+	// Seccomp is the seccomp profile the container runs with.
+	Seccomp *runtimeapi.SecurityProfile
+	// HostCgroupNamespace is set for containers that see the host's
+	// cgroup hierarchy.
+	HostCgroupNamespace bool
+	// Init is set for containers whose command runs below an init that
+	// reaps orphaned processes, rather than as PID 1.
+	Init bool
+	// CreatedAt is when the container was created, in nanoseconds since
+	// the epoch.
+	CreatedAt int64
+	// Readiness is how the container signals that it finished starting.
+	Readiness readiness
+	// Mounts are the host paths bound into the container.
+	Mounts []*runtimeapi.Mount
+	// Resources are the resources the container runs with, its config's
+	// with cpusets aligned to the NUMA nodes of its devices.
+	Resources *runtimeapi.LinuxContainerResources
+	// User is who the container's processes run as, their supplementary
+	// groups including its fsGroup. It is nil for root without any.
+	User *containerUser
+	// RetainRootfs is how many writable layers of exited instances of the
+	// container are kept when they are removed.
+	RetainRootfs int
+	// Binds are the mounts as the container binds them: those with mount
+	// options bind their staged copy rather than their host path.
+	Binds []*runtimeapi.Mount
+	// Devices are the devices of the container, including those its
+	// annotations asked DeviceResolvers for.
+	Devices []*runtimeapi.Device
+	// DeviceNUMANodes maps the host paths of the container's devices to
+	// their NUMA nodes, for those that have one.
+	DeviceNUMANodes map[string]int
+	// Healthcheck is the image's healthcheck the container runs, nil if
+	// it runs none.
+	Healthcheck *healthcheck
+	// ExposedPorts are the ports the container's image declares.
+	ExposedPorts []string
+	// StopPriority orders the container among those of its pod when the
+	// pod is stopped, higher first.
+	StopPriority int
+	// Ulimits are the resource limits of the container's processes, by
+	// name.
+	Ulimits map[string]ulimit
+	// StopSignal is the signal the container's process is asked to stop
+	// with, by name. Empty is SIGTERM.
+	StopSignal string
+
+	// lifecycle serializes starting, stopping and removing the container,
+	// so that a removal waits for a start or stop that is in progress.
+	lifecycle sync.Mutex
+	// output forwards the container's stdout and stderr to its log, nil
+	// without a log or before the container started. It is guarded by
+	// lifecycle.
+	output *containerOutput
+
+	mu sync.Mutex
+	// notReady says why the container never became ready, empty if it
+	// did or hasn't been started.
+	notReady string
+	// updated holds the resources of the last UpdateContainerResources,
+	// and updatedAnnotations its annotations, nil before one.
+	updated            *runtimeapi.LinuxContainerResources
+	updatedAnnotations map[string]string
+	// health is the outcome of the container's healthchecks, nil before
+	// the first one.
+	health *healthState
+	// startedAt is when the container was started, in nanoseconds since
+	// the epoch, zero before. It outlives the container's unit.
+	startedAt int64
+}
+
+func (c *containerRecord) setStarted(at int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.startedAt = at
+}
+
+func (c *containerRecord) startedTime() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.startedAt
+}
+
+func (c *containerRecord) setResources(resources *runtimeapi.LinuxContainerResources, annotations map[string]string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.updated, c.updatedAnnotations = resources, annotations
+}
+
+// resources returns the resources the container currently runs with, and
+// the annotations that tune them.
+func (c *containerRecord) resources() (*runtimeapi.LinuxContainerResources, map[string]string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.updated != nil {
+		return c.updated, c.updatedAnnotations
+	}
+	return c.Resources, c.Annotations
+}
+
+func (c *containerRecord) setNotReady(reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.notReady = reason
+}
+
+func (c *containerRecord) notReadyReason() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.notReady
+}
+
+// containerStore holds the records of the containers the runtime created.
+type containerStore struct {
+	mu         sync.RWMutex
+	containers map[string]*containerRecord
+	labels     labelIndex
+}
+
+func (s *containerStore) add(c *containerRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.containers == nil {
+		s.containers = map[string]*containerRecord{}
+		s.labels = labelIndex{}
+	}
+	s.containers[c.ID] = c
+	s.labels.add(c.ID, c.Labels)
+}
+
+// get returns the record of a container, or a NotFound error.
+func (s *containerStore) get(id string) (*containerRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	c, ok := s.containers[id]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "container %q not found", id)
+	}
+	return c, nil
+}
+
+func (s *containerStore) remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.containers[id]; ok {
+		s.labels.remove(id, c.Labels)
+		delete(s.containers, id)
+	}
+}
+
+// list returns the containers that carry every label in selector, or all
+// containers if selector is empty.
+func (s *containerStore) list(selector map[string]string) []*containerRecord {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(selector) == 0 {
+		containers := make([]*containerRecord, 0, len(s.containers))
+		for _, c := range s.containers {
+			containers = append(containers, c)
+		}
+		return containers
+	}
+	ids := s.labels.match(selector)
+	containers := make([]*containerRecord, 0, len(ids))
+	for _, id := range ids {
+		containers = append(containers, s.containers[id])
+	}
+	return containers
+}
+
+// sandboxRecord is what the runtime remembers about a pod sandbox.
+type sandboxRecord struct {
+	ID          string
+	Metadata    *runtimeapi.PodSandboxMetadata
+	Labels      map[string]string
+	Annotations map[string]string
+	// CreatedAt is when the sandbox was created, in nanoseconds since the
+	// epoch.
+	CreatedAt int64
+	// LogDirectory is where the logs of the sandbox's containers go.
+	LogDirectory string
+	// Seccomp is the seccomp profile containers of the sandbox inherit
+	// unless they set their own.
+	Seccomp *runtimeapi.SecurityProfile
+	// HostNetwork is set for sandboxes that share the host's network
+	// namespace.
+	HostNetwork bool
+	// Namespaces are the namespace options of the sandbox, which its
+	// containers must agree with.
+	Namespaces *runtimeapi.NamespaceOption
+	// RuntimeHandler is the runtime handler of the sandbox's runtime
+	// class, empty for the default one.
+	RuntimeHandler string
+	// SELinuxLevel is the MCS level the sandbox's containers run with and
+	// their private volumes are labeled with, empty without SELinux.
+	SELinuxLevel string
+	// Overhead is what the sandbox's RuntimeClass takes on top of its
+	// containers, which its slice is given on top of their limits. Nil
+	// means no overhead.
+	Overhead *runtimeapi.LinuxContainerResources
+	// IPs are the addresses of the sandbox's network namespace, the
+	// first of them its pod IP. Sandboxes on the host network have none.
+	IPs []string
+	// CgroupParent is the slice kubelet asked for the sandbox's cgroups to
+	// be put below, translated to a slice if kubelet passed a cgroupfs
+	// path.
+	CgroupParent string
+	// Slice is the slice that holds the units of the sandbox, below
+	// CgroupParent.
+	Slice string
+	// IPPool is the IP pool the sandbox's address is allocated from, and
+	// released to, empty for the network plugin's default.
+	IPPool string
+	// NetNS is the sandbox's network namespace, nil for host network
+	// sandboxes and sandboxes whose network isn't set up.
+	NetNS *os.File
+	// NetNSPath is where the network namespace of a sandbox that joined
+	// one made by something else is, empty for namespaces of our own.
+	NetNSPath string
+	// IPCNSPath is where the IPC namespace the sandbox's containers share
+	// is mounted, empty for sandboxes that share the host's.
+	IPCNSPath string
+
+	mu sync.Mutex
+	// transition is the state of the sandbox and when it entered it.
+	transition sandboxTransition
+	// prePulls are the images its annotations asked to pre-pull, and how
+	// that went.
+	prePulls []prePullStatus
+	// lifecycle serializes stopping and removing the sandbox, so that
+	// concurrent calls for it don't race each other tearing it down.
+	lifecycle sync.Mutex
+}
+
+// sandboxStore holds the records of the sandboxes the runtime created.
+type sandboxStore struct {
+	mu        sync.RWMutex
+	sandboxes map[string]*sandboxRecord
+	labels    labelIndex
+}
+
+func (s *sandboxStore) add(sb *sandboxRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sandboxes == nil {
+		s.sandboxes = map[string]*sandboxRecord{}
+		s.labels = labelIndex{}
+	}
+	s.sandboxes[sb.ID] = sb
+	s.labels.add(sb.ID, sb.Labels)
+}
+
+// get returns the record of a sandbox, or a NotFound error.
+func (s *sandboxStore) get(id string) (*sandboxRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sb, ok := s.sandboxes[id]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "pod sandbox %q not found", id)
+	}
+	return sb, nil
+}
+
+func (s *sandboxStore) remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sb, ok := s.sandboxes[id]; ok {
+		s.labels.remove(id, sb.Labels)
+		delete(s.sandboxes, id)
+	}
+}
+
+// list returns the sandboxes that carry every label in selector, or all
+// sandboxes if selector is empty.
+func (s *sandboxStore) list(selector map[string]string) []*sandboxRecord {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(selector) == 0 {
+		sandboxes := make([]*sandboxRecord, 0, len(s.sandboxes))
+		for _, sb := range s.sandboxes {
+			sandboxes = append(sandboxes, sb)
+		}
+		return sandboxes
+	}
+	ids := s.labels.match(selector)
+	sandboxes := make([]*sandboxRecord, 0, len(ids))
+	for _, id := range ids {
+		sandboxes = append(sandboxes, s.sandboxes[id])
+	}
+	return sandboxes
+}
+
+// newID returns a random 64 character hex identifier for a container or
+// sandbox.
+func newID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,47 @@
+package machineman
+
+import (
+	"math"
+
+	"github.com/coreos/go-systemd/v22/dbus"
+	godbus "github.com/godbus/dbus/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// swapProperties translates a container's swap limit into MemorySwapMax.
+//
+// The CRI limit covers memory and swap together, the way cgroup v1 did,
+// while memory.swap.max only covers swap, so the memory limit is subtracted.
+// A swap limit equal to the memory limit means no swap at all, and -1 means
+// unlimited swap. Zero leaves swap alone.
+func swapProperties(resources *runtimeapi.LinuxContainerResources) ([]dbus.Property, error) {
+	memory, swap := resources.GetMemoryLimitInBytes(), resources.GetMemorySwapLimitInBytes()
+	var max uint64
+	switch {
+	case swap == 0:
+		return nil, nil
+	case swap == -1:
+		max = math.MaxUint64
+	case memory <= 0:
+		return nil, status.Errorf(
+			codes.InvalidArgument,
+			"memory swap limit %d requires a memory limit",
+			swap,
+		)
+	case swap < memory:
+		return nil, status.Errorf(
+			codes.InvalidArgument,
+			"memory swap limit %d is below the memory limit %d, "+
+				"it must cover memory and swap together",
+			swap, memory,
+		)
+	default:
+		max = uint64(swap - memory)
+	}
+	return []dbus.Property{{
+		Name:  "MemorySwapMax",
+		Value: godbus.MakeVariant(max),
+	}}, nil
+}
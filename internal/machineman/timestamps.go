@@ -0,0 +1,242 @@
+package machineman
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/dbus"
+	"golang.org/x/sys/unix"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// unitTimes holds when a unit's main process started and exited, in
+// nanoseconds since the epoch, and how it exited. The times are zero until
+// the event happened.
+type unitTimes struct {
+	StartedAt  int64
+	FinishedAt int64
+	// ExitCode is the exit status of the main process, or 128 plus the
+	// signal that killed it, like a shell reports it.
+	ExitCode int32
+	// Signal is the signal that killed the main process, zero if it
+	// exited.
+	Signal syscall.Signal
+	// Result is how systemd sums up the unit's last run, like "success",
+	// "exit-code", "signal" or "oom-kill".
+	Result string
+}
+
+// unitTimestamps reads the start and exit times of a service's main process,
+// and how it exited.
+func (r *RuntimeService) unitTimestamps(ctx context.Context, unit string) (unitTimes, error) {
+	props, err := r.systemd.UnitTypeProperties(ctx, unit, "Service")
+	if err != nil {
+		return unitTimes{}, err
+	}
+	var times unitTimes
+	// The monotonic start time is immune to the wall clock being stepped
+	// between the start and now, e.g. by NTP early in boot.
+	if usec, ok := props["ExecMainStartTimestampMonotonic"].(uint64); ok && usec != 0 {
+		times.StartedAt = monotonicToWall(time.Duration(usec) * time.Microsecond).UnixNano()
+	}
+	if usec, ok := props["ExecMainExitTimestamp"].(uint64); ok && usec != 0 {
+		times.FinishedAt = int64(usec) * int64(time.Microsecond)
+	}
+	code, _ := props["ExecMainCode"].(int32)
+	status, _ := props["ExecMainStatus"].(int32)
+	switch code {
+	case cldKilled, cldDumped:
+		times.Signal = syscall.Signal(status)
+		times.ExitCode = 128 + status
+	default:
+		times.ExitCode = status
+	}
+	times.Result, _ = props["Result"].(string)
+	return times, nil
+}
+
+// The si_code values of SIGCHLD that systemd reports as ExecMainCode for a
+// main process a signal ended.
+const (
+	cldKilled = 2
+	cldDumped = 3
+)
+
+// exitFile is where the unit of a container records how the container
+// exited, in the container's rootfs directory. systemd garbage collects a
+// transient unit once it is inactive, and with it the exit status of its
+// main process.
+const exitFile = "exit"
+
+// exitRecordProperty returns the ExecStopPost command that records how a
+// container with its rootfs in dir exited. systemd runs it with the
+// outcome in SERVICE_RESULT, EXIT_CODE and EXIT_STATUS, whichever way the
+// unit stopped, and it writes them to exitFile along with the rest of its
+// environment. It also wipes the container's secrets, which a container
+// that exits on its own has no more use for either; how that goes doesn't
+// change the command's status.
+func exitRecordProperty(dir string) dbus.Property {
+	path := filepath.Join(dir, exitFile)
+	tmp := path + ".tmp"
+	script := "env > " + shellQuote(tmp) + " && mv " + shellQuote(tmp) + " " + shellQuote(path) +
+		"; status=$?; " + wipeSecretsScript(dir) + " 2>/dev/null; exit $status"
+	// systemd expands $VARIABLES in command lines itself, $$ is a dollar
+	// sign.
+	script = strings.ReplaceAll(script, "$", "$$")
+	prop := dbus.PropExecStart([]string{"/bin/sh", "-c", script}, false)
+	prop.Name = "ExecStopPost"
+	return prop
+}
+
+// shellQuote quotes s as a single word for sh.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// readExitRecord reads how a container with its rootfs in dir exited from
+// the record its unit wrote. FinishedAt is when the record was written.
+func readExitRecord(dir string) (unitTimes, error) {
+	f, err := os.Open(filepath.Join(dir, exitFile))
+	if err != nil {
+		return unitTimes{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return unitTimes{}, err
+	}
+	times := unitTimes{FinishedAt: info.ModTime().UnixNano()}
+	var code, exitStatus string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), "=")
+		switch key {
+		case "SERVICE_RESULT":
+			times.Result = value
+		case "EXIT_CODE":
+			code = value
+		case "EXIT_STATUS":
+			exitStatus = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return unitTimes{}, err
+	}
+	switch code {
+	case "killed", "dumped":
+		// EXIT_STATUS names the signal, without its SIG prefix.
+		times.Signal = unix.SignalNum("SIG" + exitStatus)
+		if times.Signal == 0 {
+			return unitTimes{}, fmt.Errorf("exit record: unknown signal %q", exitStatus)
+		}
+		times.ExitCode = 128 + int32(times.Signal)
+	case "exited":
+		n, err := strconv.ParseInt(exitStatus, 10, 32)
+		if err != nil {
+			return unitTimes{}, fmt.Errorf("exit record: exit status %q: %w", exitStatus, err)
+		}
+		times.ExitCode = int32(n)
+	}
+	return times, nil
+}
+
+// containerTimes returns when a container started and exited, and how. They
+// come from its unit while systemd has it loaded, and from the record the
+// unit left behind once it was garbage collected.
+func (r *RuntimeService) containerTimes(ctx context.Context, c *containerRecord) (unitTimes, error) {
+	times, err := r.unitTimestamps(ctx, containerUnit(c.ID))
+	if err != nil {
+		return unitTimes{}, err
+	}
+	started := c.startedTime()
+	if times.StartedAt != 0 || started == 0 {
+		return times, nil
+	}
+	times, err = readExitRecord(c.Rootfs)
+	if errors.Is(err, fs.ErrNotExist) {
+		// The unit is gone without a record, as when the command
+		// recording it failed to run.
+		return unitTimes{StartedAt: started, FinishedAt: started, Result: "unknown"}, nil
+	}
+	if err != nil {
+		return unitTimes{}, err
+	}
+	times.StartedAt = started
+	return times, nil
+}
+
+// exitReason returns the reason and message ContainerStatus gives for a
+// container that exited, in the terms kubelet uses.
+func exitReason(times unitTimes) (string, string) {
+	message := "exited with code " + strconv.Itoa(int(times.ExitCode))
+	if times.Signal != 0 {
+		message = "killed by " + unix.SignalName(times.Signal)
+	}
+	switch times.Result {
+	case "oom-kill":
+		return "OOMKilled", "killed by the kernel for running out of memory"
+	case "success":
+		return "Completed", message
+	case "", "exit-code", "signal", "core-dump":
+		if times.ExitCode == 0 {
+			return "Completed", message
+		}
+		return "Error", message
+	}
+	return "Error", message + ", systemd reports " + times.Result
+}
+
+// containerState derives the state of a container from the times of its
+// unit.
+func containerState(times unitTimes) runtimeapi.ContainerState {
+	switch {
+	case times.FinishedAt != 0:
+		return runtimeapi.ContainerState_CONTAINER_EXITED
+	case times.StartedAt != 0:
+		return runtimeapi.ContainerState_CONTAINER_RUNNING
+	}
+	return runtimeapi.ContainerState_CONTAINER_CREATED
+}
+
+// containerStates returns the states of the containers whose units systemd
+// has loaded, keyed by unit, in a single call rather than one per
+// container. A container whose unit isn't loaded either hasn't been
+// started, its unit only exists once it is, or exited and had its unit
+// garbage collected.
+func (r *RuntimeService) containerStates(ctx context.Context) (map[string]runtimeapi.ContainerState, error) {
+	units, err := r.systemd.ListUnitsByPatterns(ctx, containerUnit("*"))
+	if err != nil {
+		return nil, err
+	}
+	states := make(map[string]runtimeapi.ContainerState, len(units))
+	for _, unit := range units {
+		switch unit.ActiveState {
+		case "inactive", "failed":
+			states[unit.Name] = runtimeapi.ContainerState_CONTAINER_EXITED
+		default:
+			states[unit.Name] = runtimeapi.ContainerState_CONTAINER_RUNNING
+		}
+	}
+	return states, nil
+}
+
+// monotonicToWall converts a CLOCK_MONOTONIC reading, which counts from boot,
+// into wall clock time by adding the wall clock time of boot.
+func monotonicToWall(mono time.Duration) time.Time {
+	var realtime, monotonic unix.Timespec
+	// Read the clocks back to back so that the offset between them, the
+	// boot time, is as exact as possible.
+	_ = unix.ClockGettime(unix.CLOCK_REALTIME, &realtime)
+	_ = unix.ClockGettime(unix.CLOCK_MONOTONIC, &monotonic)
+	boot := time.Duration(realtime.Nano() - monotonic.Nano())
+	return time.Unix(0, 0).Add(boot + mono)
+}
@@ -0,0 +1,227 @@
+package machineman
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+func TestContainerState(t *testing.T) {
+	tests := []struct {
+		name  string
+		times unitTimes
+		want  runtimeapi.ContainerState
+	}{
+		{"not started", unitTimes{}, runtimeapi.ContainerState_CONTAINER_CREATED},
+		{"running", unitTimes{StartedAt: 1}, runtimeapi.ContainerState_CONTAINER_RUNNING},
+		{"exited", unitTimes{StartedAt: 1, FinishedAt: 2}, runtimeapi.ContainerState_CONTAINER_EXITED},
+		// A unit that failed to exec its command never starts.
+		{"exited without starting", unitTimes{FinishedAt: 2}, runtimeapi.ContainerState_CONTAINER_EXITED},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := containerState(tt.times); got != tt.want {
+				t.Errorf("containerState(%+v) = %v, want %v", tt.times, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExitReason(t *testing.T) {
+	tests := []struct {
+		name        string
+		times       unitTimes
+		reason, msg string
+	}{
+		{
+			name:   "success",
+			times:  unitTimes{Result: "success"},
+			reason: "Completed",
+			msg:    "exited with code 0",
+		},
+		{
+			name:   "exit code",
+			times:  unitTimes{Result: "exit-code", ExitCode: 2},
+			reason: "Error",
+			msg:    "exited with code 2",
+		},
+		{
+			name:   "signal",
+			times:  unitTimes{Result: "signal", ExitCode: 137, Signal: syscall.SIGKILL},
+			reason: "Error",
+			msg:    "killed by SIGKILL",
+		},
+		{
+			name:   "core dump",
+			times:  unitTimes{Result: "core-dump", ExitCode: 139, Signal: syscall.SIGSEGV},
+			reason: "Error",
+			msg:    "killed by SIGSEGV",
+		},
+		{
+			name:   "oom kill",
+			times:  unitTimes{Result: "oom-kill", ExitCode: 137, Signal: syscall.SIGKILL},
+			reason: "OOMKilled",
+			msg:    "killed by the kernel for running out of memory",
+		},
+		{
+			// Units stopped by a signal that exit cleanly on it
+			// report a result of "signal" with a zero status.
+			name:   "clean exit on a stop",
+			times:  unitTimes{Result: "signal"},
+			reason: "Completed",
+			msg:    "exited with code 0",
+		},
+		{
+			name:   "no result",
+			times:  unitTimes{ExitCode: 1},
+			reason: "Error",
+			msg:    "exited with code 1",
+		},
+		{
+			name:   "other result",
+			times:  unitTimes{Result: "timeout", ExitCode: 137, Signal: syscall.SIGKILL},
+			reason: "Error",
+			msg:    "killed by SIGKILL, systemd reports timeout",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reason, msg := exitReason(tt.times)
+			if reason != tt.reason || msg != tt.msg {
+				t.Errorf("exitReason() = %q, %q, want %q, %q", reason, msg, tt.reason, tt.msg)
+			}
+		})
+	}
+}
+
+func TestReadExitRecord(t *testing.T) {
+	tests := []struct {
+		name    string
+		record  string
+		want    unitTimes
+		wantErr bool
+	}{
+		{
+			name:   "exited",
+			record: "PATH=/bin\nSERVICE_RESULT=exit-code\nEXIT_CODE=exited\nEXIT_STATUS=3\n",
+			want:   unitTimes{Result: "exit-code", ExitCode: 3},
+		},
+		{
+			name:   "killed",
+			record: "SERVICE_RESULT=signal\nEXIT_CODE=killed\nEXIT_STATUS=TERM\n",
+			want:   unitTimes{Result: "signal", ExitCode: 143, Signal: syscall.SIGTERM},
+		},
+		{
+			name:   "dumped",
+			record: "SERVICE_RESULT=core-dump\nEXIT_CODE=dumped\nEXIT_STATUS=SEGV\n",
+			want:   unitTimes{Result: "core-dump", ExitCode: 139, Signal: syscall.SIGSEGV},
+		},
+		{
+			// The main process never ran, as when its executable
+			// is missing.
+			name:   "no exit status",
+			record: "SERVICE_RESULT=exit-code\n",
+			want:   unitTimes{Result: "exit-code"},
+		},
+		{
+			name:   "value with an equals sign",
+			record: "SERVICE_RESULT=success\nOPTS=a=b\nEXIT_CODE=exited\nEXIT_STATUS=0\n",
+			want:   unitTimes{Result: "success"},
+		},
+		{
+			name:    "unknown signal",
+			record:  "EXIT_CODE=killed\nEXIT_STATUS=NOPE\n",
+			wantErr: true,
+		},
+		{
+			name:    "bad exit status",
+			record:  "EXIT_CODE=exited\nEXIT_STATUS=three\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, exitFile)
+			if err := os.WriteFile(path, []byte(tt.record), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := readExitRecord(dir)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readExitRecord() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.want.FinishedAt = info.ModTime().UnixNano()
+			if got != tt.want {
+				t.Errorf("readExitRecord() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadExitRecordMissing(t *testing.T) {
+	if _, err := readExitRecord(t.TempDir()); !os.IsNotExist(err) {
+		t.Errorf("readExitRecord() without a record = %v, want a not exist error", err)
+	}
+}
+
+// TestExitRecordProperty runs the command the property holds the way systemd
+// would, and reads back the record it writes.
+func TestExitRecordProperty(t *testing.T) {
+	// The quote and dollar sign must survive both systemd and sh.
+	dir := filepath.Join(t.TempDir(), "it's $HOME")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	prop := exitRecordProperty(dir)
+	if prop.Name != "ExecStopPost" {
+		t.Fatalf("property is %s, want ExecStopPost", prop.Name)
+	}
+	_, argv := execArgv(t, prop.Value.Value())
+	// systemd turns $$ into $ before running the command.
+	for i := range argv {
+		argv[i] = strings.ReplaceAll(argv[i], "$$", "$")
+	}
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Env = []string{"SERVICE_RESULT=exit-code", "EXIT_CODE=exited", "EXIT_STATUS=3"}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("running %q: %v: %s", argv, err, out)
+	}
+	got, err := readExitRecord(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Result != "exit-code" || got.ExitCode != 3 || got.FinishedAt == 0 {
+		t.Errorf("record written by %q reads %+v", argv, got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, exitFile+".tmp")); !os.IsNotExist(err) {
+		t.Errorf("temporary record left behind: %v", err)
+	}
+	// A container that exited on its own has its secrets wiped too.
+	secret := filepath.Join(dir, secretsDir, "env", "TOKEN")
+	if err := os.MkdirAll(filepath.Dir(secret), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(secret, []byte("hunter2"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cmd = exec.Command(argv[0], argv[1:]...)
+	cmd.Env = []string{"PATH=" + os.Getenv("PATH"), "SERVICE_RESULT=success", "EXIT_CODE=exited", "EXIT_STATUS=0"}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("running %q with secrets: %v: %s", argv, err, out)
+	}
+	if entries, err := os.ReadDir(filepath.Join(dir, secretsDir)); err != nil || len(entries) != 0 {
+		t.Errorf("secrets left after the container exited: %v, %v", entries, err)
+	}
+}
@@ -0,0 +1,166 @@
+package machineman
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-systemd/v22/dbus"
+	godbus "github.com/godbus/dbus/v5"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ulimitsAnnotation is a container annotation, and ulimitsLabel an image
+// label, that set resource limits of a container's processes, as
+// comma-separated "name=soft:hard" or "name=limit" for both, like
+// "nofile=65536:65536,nproc=4096". Names are those of ulimit -a, in lower
+// case, and "unlimited" lifts a limit. The annotation takes precedence over
+// the image's label, and both over RuntimeOptions.DefaultUlimits.
+const (
+	ulimitsAnnotation = "systemd-cri.io/ulimits"
+	ulimitsLabel      = "io.systemd-cri.ulimits"
+)
+
+// ulimitResources maps the names of ulimits to their resource and the unit
+// property systemd sets their hard limit with. The soft limit's property has
+// "Soft" appended.
+var ulimitResources = map[string]struct {
+	resource int
+	property string
+}{
+	"as":         {unix.RLIMIT_AS, "LimitAS"},
+	"core":       {unix.RLIMIT_CORE, "LimitCORE"},
+	"cpu":        {unix.RLIMIT_CPU, "LimitCPU"},
+	"data":       {unix.RLIMIT_DATA, "LimitDATA"},
+	"fsize":      {unix.RLIMIT_FSIZE, "LimitFSIZE"},
+	"locks":      {unix.RLIMIT_LOCKS, "LimitLOCKS"},
+	"memlock":    {unix.RLIMIT_MEMLOCK, "LimitMEMLOCK"},
+	"msgqueue":   {unix.RLIMIT_MSGQUEUE, "LimitMSGQUEUE"},
+	"nice":       {unix.RLIMIT_NICE, "LimitNICE"},
+	"nofile":     {unix.RLIMIT_NOFILE, "LimitNOFILE"},
+	"nproc":      {unix.RLIMIT_NPROC, "LimitNPROC"},
+	"rss":        {unix.RLIMIT_RSS, "LimitRSS"},
+	"rtprio":     {unix.RLIMIT_RTPRIO, "LimitRTPRIO"},
+	"rttime":     {unix.RLIMIT_RTTIME, "LimitRTTIME"},
+	"sigpending": {unix.RLIMIT_SIGPENDING, "LimitSIGPENDING"},
+	"stack":      {unix.RLIMIT_STACK, "LimitSTACK"},
+}
+
+// ulimit is the soft and hard value of a resource limit.
+type ulimit struct {
+	Soft uint64
+	Hard uint64
+}
+
+// parseUlimits parses ulimits given as "name=soft:hard" or "name=limit".
+func parseUlimits(specs []string) (map[string]ulimit, error) {
+	ulimits := map[string]ulimit{}
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(spec, "=")
+		if _, known := ulimitResources[name]; !ok || !known {
+			return nil, fmt.Errorf("ulimit %q: want name=soft:hard with a name like nofile", spec)
+		}
+		soft, hard, both := strings.Cut(value, ":")
+		if !both {
+			hard = soft
+		}
+		var limit ulimit
+		var err error
+		if limit.Soft, err = parseUlimitValue(soft); err != nil {
+			return nil, fmt.Errorf("ulimit %q: %w", spec, err)
+		}
+		if limit.Hard, err = parseUlimitValue(hard); err != nil {
+			return nil, fmt.Errorf("ulimit %q: %w", spec, err)
+		}
+		if limit.Soft > limit.Hard {
+			return nil, fmt.Errorf("ulimit %q: soft limit is above the hard limit", spec)
+		}
+		ulimits[name] = limit
+	}
+	return ulimits, nil
+}
+
+func parseUlimitValue(value string) (uint64, error) {
+	if value == "unlimited" {
+		return math.MaxUint64, nil
+	}
+	return strconv.ParseUint(value, 10, 64)
+}
+
+// containerUlimits returns the ulimits of a container: the node's defaults,
+// overridden by those its image's label hints at, overridden by those its
+// annotation sets. Limits above the hard limits of the host's init, which
+// the container's unit is started by, are lowered to them.
+func (r *RuntimeService) containerUlimits(containerName, imageLabel string, annotations map[string]string) (map[string]ulimit, error) {
+	ulimits := map[string]ulimit{}
+	for name, limit := range r.ulimits {
+		ulimits[name] = limit
+	}
+	image, err := parseUlimits(strings.Split(imageLabel, ","))
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "image label %s: %v", ulimitsLabel, err)
+	}
+	for name, limit := range image {
+		ulimits[name] = limit
+	}
+	config, err := parseUlimits(strings.Split(annotations[ulimitsAnnotation], ","))
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "annotation %s: %v", ulimitsAnnotation, err)
+	}
+	for name, limit := range config {
+		ulimits[name] = limit
+	}
+	for name, limit := range ulimits {
+		var host unix.Rlimit
+		if err := unix.Prlimit(1, ulimitResources[name].resource, nil, &host); err != nil {
+			return nil, fmt.Errorf("read the host's %s limit: %w", name, err)
+		}
+		if limit.Hard <= host.Max {
+			continue
+		}
+		log.Printf(
+			"container %s: lowering the %s limit of %s to the host's hard limit of %s",
+			containerName, name, formatUlimitValue(limit.Hard), formatUlimitValue(host.Max),
+		)
+		limit.Hard = host.Max
+		if limit.Soft > limit.Hard {
+			limit.Soft = limit.Hard
+		}
+		ulimits[name] = limit
+	}
+	return ulimits, nil
+}
+
+func formatUlimitValue(value uint64) string {
+	if value == math.MaxUint64 {
+		return "unlimited"
+	}
+	return strconv.FormatUint(value, 10)
+}
+
+// ulimitProperties returns the Limit* properties that set ulimits on a unit.
+func ulimitProperties(ulimits map[string]ulimit) []dbus.Property {
+	names := make([]string, 0, len(ulimits))
+	for name := range ulimits {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	props := make([]dbus.Property, 0, 2*len(names))
+	for _, name := range names {
+		property := ulimitResources[name].property
+		props = append(props,
+			dbus.Property{Name: property, Value: godbus.MakeVariant(ulimits[name].Hard)},
+			dbus.Property{Name: property + "Soft", Value: godbus.MakeVariant(ulimits[name].Soft)},
+		)
+	}
+	return props
+}
@@ -0,0 +1,200 @@
+package machineman
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseUlimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		specs   []string
+		want    map[string]ulimit
+		wantErr bool
+	}{
+		{"none", nil, map[string]ulimit{}, false},
+		{"blank", []string{"", " "}, map[string]ulimit{}, false},
+		{
+			"soft and hard",
+			[]string{"nofile=1024:4096"},
+			map[string]ulimit{"nofile": {Soft: 1024, Hard: 4096}},
+			false,
+		},
+		{
+			"one limit for both",
+			[]string{" nproc=512 "},
+			map[string]ulimit{"nproc": {Soft: 512, Hard: 512}},
+			false,
+		},
+		{
+			"unlimited",
+			[]string{"core=0:unlimited", "memlock=unlimited"},
+			map[string]ulimit{
+				"core":    {Soft: 0, Hard: math.MaxUint64},
+				"memlock": {Soft: math.MaxUint64, Hard: math.MaxUint64},
+			},
+			false,
+		},
+		{
+			"later wins",
+			[]string{"nofile=1024", "nofile=2048"},
+			map[string]ulimit{"nofile": {Soft: 2048, Hard: 2048}},
+			false,
+		},
+		{"unknown name", []string{"files=1024"}, nil, true},
+		{"upper case name", []string{"NOFILE=1024"}, nil, true},
+		{"no value", []string{"nofile"}, nil, true},
+		{"empty value", []string{"nofile="}, nil, true},
+		{"negative", []string{"nofile=-1"}, nil, true},
+		{"not a number", []string{"nofile=many"}, nil, true},
+		{"bad hard limit", []string{"nofile=1024:many"}, nil, true},
+		{"soft above hard", []string{"nofile=4096:1024"}, nil, true},
+		{"soft unlimited above hard", []string{"nofile=unlimited:1024"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseUlimits(tt.specs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseUlimits(%q) = %v, want error %v", tt.specs, err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseUlimits(%q) = %v, want %v", tt.specs, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContainerUlimits(t *testing.T) {
+	r := &RuntimeService{ulimits: map[string]ulimit{
+		"nofile": {Soft: 1024, Hard: 1024},
+		"core":   {Soft: 0, Hard: 0},
+	}}
+	tests := []struct {
+		name       string
+		label      string
+		annotation string
+		want       map[string]ulimit
+		wantCode   codes.Code
+	}{
+		{
+			name: "node defaults",
+			want: map[string]ulimit{"nofile": {Soft: 1024, Hard: 1024}, "core": {}},
+		},
+		{
+			name:  "image label over defaults",
+			label: "nofile=512:2048,nproc=64",
+			want: map[string]ulimit{
+				"nofile": {Soft: 512, Hard: 2048},
+				"core":   {},
+				"nproc":  {Soft: 64, Hard: 64},
+			},
+		},
+		{
+			name:       "annotation over image label",
+			label:      "nofile=512:2048,nproc=64",
+			annotation: "nofile=256,core=0:0",
+			want: map[string]ulimit{
+				"nofile": {Soft: 256, Hard: 256},
+				"core":   {},
+				"nproc":  {Soft: 64, Hard: 64},
+			},
+		},
+		{
+			name:     "bad image label",
+			label:    "nofile=lots",
+			wantCode: codes.FailedPrecondition,
+		},
+		{
+			name:       "bad annotation",
+			annotation: "nofile=2048:1024",
+			wantCode:   codes.InvalidArgument,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var annotations map[string]string
+			if tt.annotation != "" {
+				annotations = map[string]string{ulimitsAnnotation: tt.annotation}
+			}
+			got, err := r.containerUlimits("app", tt.label, annotations)
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("containerUlimits() = %v, want code %v", err, tt.wantCode)
+			}
+			if err == nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("containerUlimits() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if len(r.ulimits) != 2 || r.ulimits["nofile"].Hard != 1024 {
+		t.Errorf("containerUlimits() changed the node defaults to %v", r.ulimits)
+	}
+}
+
+func TestContainerUlimitsClampsToHost(t *testing.T) {
+	var host unix.Rlimit
+	if err := unix.Prlimit(1, unix.RLIMIT_NOFILE, nil, &host); err != nil {
+		t.Skip(err)
+	}
+	if host.Max == unix.RLIM_INFINITY || host.Max < 2 {
+		t.Skipf("init's hard limit of open files is %d, nothing to clamp to", host.Max)
+	}
+	r := &RuntimeService{}
+	tests := []struct {
+		name       string
+		annotation string
+		want       ulimit
+	}{
+		{
+			name:       "within the host's",
+			annotation: "nofile=1:" + formatUlimitValue(host.Max),
+			want:       ulimit{Soft: 1, Hard: host.Max},
+		},
+		{
+			name:       "hard above the host's",
+			annotation: "nofile=1:" + formatUlimitValue(host.Max+1),
+			want:       ulimit{Soft: 1, Hard: host.Max},
+		},
+		{
+			name:       "both unlimited",
+			annotation: "nofile=unlimited",
+			want:       ulimit{Soft: host.Max, Hard: host.Max},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := r.containerUlimits("app", "", map[string]string{ulimitsAnnotation: tt.annotation})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got["nofile"] != tt.want {
+				t.Errorf("nofile limit = %+v, want %+v", got["nofile"], tt.want)
+			}
+		})
+	}
+}
+
+func TestUlimitProperties(t *testing.T) {
+	props := ulimitProperties(map[string]ulimit{
+		"nproc":  {Soft: 64, Hard: 128},
+		"nofile": {Soft: 1024, Hard: math.MaxUint64},
+	})
+	var got []string
+	for _, prop := range props {
+		got = append(got, prop.Name+"="+prop.Value.String())
+	}
+	want := []string{
+		"LimitNOFILE=@t 18446744073709551615",
+		"LimitNOFILESoft=@t 1024",
+		"LimitNPROC=@t 128",
+		"LimitNPROCSoft=@t 64",
+	}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("ulimitProperties() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,74 @@
+package machineman
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ananthb/systemd-cri/internal/systemd"
+	"github.com/coreos/go-systemd/v22/dbus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// startTransientUnit starts a transient unit, taking its name over from a
+// unit of the same name that an earlier run of the runtime left behind, as
+// when it crashed between creating a unit and recording it. The leftover is
+// only stopped and reset if none of its processes are alive; otherwise
+// creation fails with AlreadyExists naming the unit, rather than disturbing
+// a workload the runtime doesn't know about. Starting is retried once.
+func (r *RuntimeService) startTransientUnit(ctx context.Context, unit string, props ...dbus.Property) error {
+	err := r.systemd.StartTransientUnit(ctx, unit, props...)
+	if !errors.Is(err, systemd.ErrUnitExists) {
+		return err
+	}
+	live, err := r.unitPopulated(ctx, unit)
+	if err != nil {
+		return fmt.Errorf("inspect existing unit %s: %w", unit, err)
+	}
+	if live {
+		return status.Errorf(
+			codes.AlreadyExists,
+			"unit %s already exists and still has running processes, stop it or remove it with systemctl stop %s",
+			unit, unit,
+		)
+	}
+	log.Printf("unit %s is left over from an earlier run and has no processes, replacing it", unit)
+	if err := r.stopUnit(ctx, unit, 0); err != nil {
+		return fmt.Errorf("stop stale unit %s: %w", unit, err)
+	}
+	if err := r.releaseUnit(ctx, unit); err != nil {
+		return fmt.Errorf("reset stale unit %s: %w", unit, err)
+	}
+	return r.systemd.StartTransientUnit(ctx, unit, props...)
+}
+
+// unitPopulated reports whether any process runs in the cgroup of a unit or
+// below it. A unit without a cgroup has none.
+func (r *RuntimeService) unitPopulated(ctx context.Context, unit string) (bool, error) {
+	cgroup, err := r.unitCgroup(ctx, unit)
+	if errors.Is(err, errNoCgroup) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	data, err := os.ReadFile(filepath.Join(cgroupRoot, cgroup, "cgroup.events"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if key, value, ok := strings.Cut(line, " "); ok && key == "populated" {
+			return value == "1", nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,114 @@
+package machineman
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ananthb/systemd-cri/internal/systemd"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestStartTransientUnit(t *testing.T) {
+	const unit = "systemd-cri-c1.service"
+	start := "StartTransientUnit " + unit
+	replace := []string{start, "KillUnit " + unit, "StopUnit " + unit, start}
+	tests := []struct {
+		name string
+		// existing holds the properties of the unit left behind, if any.
+		existing map[string]interface{}
+		// events is the cgroup.events of its cgroup, if it has one.
+		events string
+		// unloads makes systemd unload the unit once it is stopped, as
+		// it does with inactive transient units.
+		unloads  bool
+		wantCode codes.Code
+		// wantExists is whether starting fails with ErrUnitExists.
+		wantExists bool
+		wantCalls  []string
+	}{
+		{
+			name:      "no collision",
+			wantCalls: []string{start},
+		},
+		{
+			name:      "stale unit",
+			existing:  map[string]interface{}{"ControlGroup": "/stale.slice/" + unit},
+			events:    "populated 0\nfrozen 0\n",
+			unloads:   true,
+			wantCalls: replace,
+		},
+		{
+			name:      "stale unit without a cgroup",
+			existing:  map[string]interface{}{},
+			unloads:   true,
+			wantCalls: replace,
+		},
+		{
+			name:      "stale unit whose cgroup is gone",
+			existing:  map[string]interface{}{"ControlGroup": "/stale.slice/" + unit},
+			unloads:   true,
+			wantCalls: replace,
+		},
+		{
+			name:      "populated unit",
+			existing:  map[string]interface{}{"ControlGroup": "/live.slice/" + unit},
+			events:    "populated 1\nfrozen 0\n",
+			wantCode:  codes.AlreadyExists,
+			wantCalls: []string{start},
+		},
+		{
+			name:       "collision after the retry",
+			existing:   map[string]interface{}{"ControlGroup": "/stale.slice/" + unit},
+			events:     "populated 0\nfrozen 0\n",
+			wantCode:   codes.Unknown,
+			wantExists: true,
+			wantCalls:  replace,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := fakeCgroupRoot(t)
+			fake := newFakeSystemd()
+			r := &RuntimeService{systemd: fake}
+			if tt.existing != nil {
+				fake.setUnit(unit, tt.existing)
+			}
+			if cgroup, ok := tt.existing["ControlGroup"].(string); ok && tt.events != "" {
+				dir := filepath.Join(root, cgroup)
+				if err := os.MkdirAll(dir, 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filepath.Join(dir, "cgroup.events"), []byte(tt.events), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.unloads {
+				fake.stopped = func(name string) {
+					fake.mu.Lock()
+					defer fake.mu.Unlock()
+					delete(fake.units, name)
+				}
+			}
+
+			err := r.startTransientUnit(context.Background(), unit)
+			if code := status.Code(err); code != tt.wantCode {
+				t.Errorf("startTransientUnit() = %v, want code %v", err, tt.wantCode)
+			}
+			if exists := errors.Is(err, systemd.ErrUnitExists); exists != tt.wantExists {
+				t.Errorf("startTransientUnit() = %v, want ErrUnitExists %v", err, tt.wantExists)
+			}
+			if tt.wantCode == codes.AlreadyExists && !strings.Contains(status.Convert(err).Message(), unit) {
+				t.Errorf("startTransientUnit() = %v, want it to name %s", err, unit)
+			}
+			if got := fake.callsMade(); !reflect.DeepEqual(got, tt.wantCalls) {
+				t.Errorf("calls = %q, want %q", got, tt.wantCalls)
+			}
+		})
+	}
+}
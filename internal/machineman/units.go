@@ -0,0 +1,46 @@
+package machineman
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// containerUnit returns the name of the transient service a container runs
+// in.
+func containerUnit(containerID string) string {
+	return "systemd-cri-" + containerID + ".service"
+}
+
+// sandboxUnit returns the name of the slice that holds the units of a pod
+// sandbox kubelet passed no cgroup parent for. The dash puts it below
+// systemd-cri.slice.
+func sandboxUnit(sandboxID string) string {
+	return "systemd-cri-" + sandboxID + ".slice"
+}
+
+// podSlice returns the name of the slice that holds the units of a pod
+// sandbox: below cgroupParent, the slice kubelet made for the pod, so that
+// the pod is accounted to its QoS class, or below systemd-cri.slice without
+// one. Dashes in slice names nest them, the underscores keep the sandbox's
+// slice a single level below its parent.
+func podSlice(sandboxID, cgroupParent string) string {
+	parent := strings.TrimSuffix(cgroupParent, ".slice")
+	if parent == "" || parent == "-" {
+		return sandboxUnit(sandboxID)
+	}
+	return parent + "-systemd_cri_" + sandboxID + ".slice"
+}
+
+// sliceCgroup returns the cgroup of a slice relative to the root of the
+// hierarchy. Every dash in its name is a level: "a-b.slice" is below
+// "a.slice".
+func sliceCgroup(slice string) string {
+	name := strings.TrimSuffix(slice, ".slice")
+	var cgroup []string
+	for i, c := range name {
+		if c == '-' {
+			cgroup = append(cgroup, name[:i]+".slice")
+		}
+	}
+	return filepath.Join(append(cgroup, slice)...)
+}
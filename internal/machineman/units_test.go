@@ -0,0 +1,54 @@
+package machineman
+
+import "testing"
+
+func TestPodSlice(t *testing.T) {
+	tests := []struct {
+		name         string
+		cgroupParent string
+		want         string
+		wantCgroup   string
+	}{
+		{
+			name:       "no cgroup parent",
+			want:       "systemd-cri-abc.slice",
+			wantCgroup: "systemd.slice/systemd-cri.slice/systemd-cri-abc.slice",
+		},
+		{
+			name:         "root cgroup parent",
+			cgroupParent: "-",
+			want:         "systemd-cri-abc.slice",
+			wantCgroup:   "systemd.slice/systemd-cri.slice/systemd-cri-abc.slice",
+		},
+		{
+			name:         "kubelet pod slice",
+			cgroupParent: "kubepods-besteffort-pod1234.slice",
+			want:         "kubepods-besteffort-pod1234-systemd_cri_abc.slice",
+			wantCgroup: "kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod1234.slice/" +
+				"kubepods-besteffort-pod1234-systemd_cri_abc.slice",
+		},
+		{
+			name:         "cgroup parent without suffix",
+			cgroupParent: "kubepods-pod1234",
+			want:         "kubepods-pod1234-systemd_cri_abc.slice",
+			wantCgroup:   "kubepods.slice/kubepods-pod1234.slice/kubepods-pod1234-systemd_cri_abc.slice",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := podSlice("abc", tt.cgroupParent)
+			if got != tt.want {
+				t.Fatalf("podSlice(%q) = %q, want %q", tt.cgroupParent, got, tt.want)
+			}
+			if cgroup := sliceCgroup(got); cgroup != tt.wantCgroup {
+				t.Errorf("sliceCgroup(%q) = %q, want %q", got, cgroup, tt.wantCgroup)
+			}
+		})
+	}
+}
+
+func TestContainerUnit(t *testing.T) {
+	if got, want := containerUnit("abc"), "systemd-cri-abc.service"; got != want {
+		t.Errorf("containerUnit() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,189 @@
+package machineman
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// containerUser is who a container's command runs as: a user, its primary
+// group and its supplementary groups. It marshals to the user of an OCI
+// runtime config.
+type containerUser struct {
+	UID    uint32   `json:"uid"`
+	GID    uint32   `json:"gid"`
+	Groups []uint32 `json:"additionalGids,omitempty"`
+}
+
+// userConfig returns who a container whose root filesystem is root runs as,
+// with groups as its supplementary groups. It is nil for root without any,
+// which is how systemd-nspawn runs commands anyway. A user given by name,
+// and the primary group of one given by UID without a group, are looked up
+// in the container's /etc/passwd; a UID it doesn't list gets group 0.
+func userConfig(
+	security *runtimeapi.LinuxContainerSecurityContext,
+	groups []int64,
+	root string,
+) (*containerUser, error) {
+	var u containerUser
+	switch {
+	case security.GetRunAsUser() != nil:
+		uid, err := idValue("user", security.GetRunAsUser().GetValue())
+		if err != nil {
+			return nil, err
+		}
+		u.UID = uid
+		if security.GetRunAsGroup() == nil {
+			entry, _, err := lookupPasswd(root, func(e passwdEntry) bool { return e.uid == uid })
+			if err != nil {
+				return nil, err
+			}
+			u.GID = entry.gid
+		}
+	case security.GetRunAsUsername() != "":
+		name := security.GetRunAsUsername()
+		entry, ok, err := lookupPasswd(root, func(e passwdEntry) bool { return e.name == name })
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, status.Errorf(codes.InvalidArgument, "user %q is not in the container's /etc/passwd", name)
+		}
+		u.UID, u.GID = entry.uid, entry.gid
+	case security.GetRunAsGroup() != nil:
+		return nil, status.Error(codes.InvalidArgument, "a group to run as needs a user to run as")
+	}
+	if group := security.GetRunAsGroup(); group != nil {
+		gid, err := idValue("group", group.GetValue())
+		if err != nil {
+			return nil, err
+		}
+		u.GID = gid
+	}
+	for _, gid := range groups {
+		u.Groups = append(u.Groups, uint32(gid))
+	}
+	if u.UID == 0 && u.GID == 0 && len(u.Groups) == 0 {
+		return nil, nil
+	}
+	return &u, nil
+}
+
+// idValue checks that value is a user or group ID.
+func idValue(kind string, value int64) (uint32, error) {
+	if value < 0 || value > int64(^uint32(0)) {
+		return 0, status.Errorf(codes.InvalidArgument, "%d is not a %s ID", value, kind)
+	}
+	return uint32(value), nil
+}
+
+type passwdEntry struct {
+	name     string
+	uid, gid uint32
+}
+
+// lookupPasswd returns the first entry of the /etc/passwd below root that
+// match accepts. A container without the file has no entries.
+func lookupPasswd(root string, match func(passwdEntry) bool) (passwdEntry, bool, error) {
+	f, err := openInRoot(root, "/etc/passwd")
+	if errors.Is(err, fs.ErrNotExist) {
+		return passwdEntry{}, false, nil
+	}
+	if err != nil {
+		return passwdEntry{}, false, err
+	}
+	defer f.Close()
+	lines := bufio.NewScanner(f)
+	for lines.Scan() {
+		fields := strings.Split(lines.Text(), ":")
+		if len(fields) < 4 {
+			continue
+		}
+		uid, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			continue
+		}
+		gid, err := strconv.ParseUint(fields[3], 10, 32)
+		if err != nil {
+			continue
+		}
+		if entry := (passwdEntry{fields[0], uint32(uid), uint32(gid)}); match(entry) {
+			return entry, true, nil
+		}
+	}
+	return passwdEntry{}, false, lines.Err()
+}
+
+// openInRoot opens the file at name as if root was the root directory, so
+// that symbolic links in the container's filesystem can't lead to the
+// host's files.
+func openInRoot(root, name string) (*os.File, error) {
+	dir, err := unix.Open(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: root, Err: err}
+	}
+	defer unix.Close(dir)
+	fd, err := unix.Openat2(dir, name, &unix.OpenHow{
+		Flags:   unix.O_RDONLY | unix.O_CLOEXEC,
+		Resolve: unix.RESOLVE_IN_ROOT,
+	})
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: filepath.Join(root, name), Err: err}
+	}
+	return os.NewFile(uintptr(fd), filepath.Join(root, name)), nil
+}
+
+// userBundleConfig is the file of a container's rootfs directory that makes
+// it an OCI runtime bundle, whose root is containerRootDir.
+const userBundleConfig = "config.json"
+
+// writeUserBundle writes the OCI runtime config systemd-nspawn reads the
+// user of a container from, for containers that don't run as root. Its
+// command line has no way to give numeric IDs or supplementary groups. The
+// config only repeats the rest of what the command line sets, which takes
+// precedence.
+func writeUserBundle(c *containerRecord) error {
+	if c.User == nil {
+		return nil
+	}
+	var config struct {
+		OCIVersion string `json:"ociVersion"`
+		Root       struct {
+			Path string `json:"path"`
+		} `json:"root"`
+		Process struct {
+			Cwd  string        `json:"cwd"`
+			Args []string      `json:"args"`
+			User containerUser `json:"user"`
+		} `json:"process"`
+	}
+	config.OCIVersion = "1.0.2"
+	config.Root.Path = containerRootDir
+	config.Process.Cwd = c.WorkingDir
+	config.Process.Args = c.Command
+	config.Process.User = *c.User
+	data, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(c.Rootfs, userBundleConfig, data)
+}
+
+// userArgs returns the systemd-nspawn arguments that run a container's
+// command as its user.
+func userArgs(c *containerRecord) []string {
+	if c.User == nil {
+		return nil
+	}
+	return []string{"--oci-bundle=" + c.Rootfs}
+}
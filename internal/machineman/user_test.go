@@ -0,0 +1,174 @@
+package machineman
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+func TestUserConfig(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "etc"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	passwd := "root:x:0:0:root:/root:/bin/sh\napp:x:1000:1001::/home/app:/bin/sh\n"
+	if err := os.WriteFile(filepath.Join(root, "etc", "passwd"), []byte(passwd), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	id := func(v int64) *runtimeapi.Int64Value { return &runtimeapi.Int64Value{Value: v} }
+	tests := []struct {
+		name     string
+		security *runtimeapi.LinuxContainerSecurityContext
+		groups   []int64
+		root     string
+		want     *containerUser
+		code     codes.Code
+	}{
+		{
+			name:     "root",
+			security: &runtimeapi.LinuxContainerSecurityContext{RunAsUser: id(0)},
+			root:     root,
+		},
+		{
+			name:     "root with groups",
+			security: &runtimeapi.LinuxContainerSecurityContext{},
+			groups:   []int64{2000, 3000},
+			root:     root,
+			want:     &containerUser{Groups: []uint32{2000, 3000}},
+		},
+		{
+			name: "user and group",
+			security: &runtimeapi.LinuxContainerSecurityContext{
+				RunAsUser:  id(1000),
+				RunAsGroup: id(3000),
+			},
+			groups: []int64{2000},
+			root:   root,
+			want:   &containerUser{UID: 1000, GID: 3000, Groups: []uint32{2000}},
+		},
+		{
+			name:     "group of the user",
+			security: &runtimeapi.LinuxContainerSecurityContext{RunAsUser: id(1000)},
+			root:     root,
+			want:     &containerUser{UID: 1000, GID: 1001},
+		},
+		{
+			name:     "user the container doesn't list",
+			security: &runtimeapi.LinuxContainerSecurityContext{RunAsUser: id(1234)},
+			root:     root,
+			want:     &containerUser{UID: 1234},
+		},
+		{
+			name:     "container without passwd",
+			security: &runtimeapi.LinuxContainerSecurityContext{RunAsUser: id(1000)},
+			root:     t.TempDir(),
+			want:     &containerUser{UID: 1000},
+		},
+		{
+			name:     "user by name",
+			security: &runtimeapi.LinuxContainerSecurityContext{RunAsUsername: "app"},
+			root:     root,
+			want:     &containerUser{UID: 1000, GID: 1001},
+		},
+		{
+			name:     "unknown user name",
+			security: &runtimeapi.LinuxContainerSecurityContext{RunAsUsername: "nobody"},
+			root:     root,
+			code:     codes.InvalidArgument,
+		},
+		{
+			name:     "group without user",
+			security: &runtimeapi.LinuxContainerSecurityContext{RunAsGroup: id(1000)},
+			root:     root,
+			code:     codes.InvalidArgument,
+		},
+		{
+			name:     "negative user",
+			security: &runtimeapi.LinuxContainerSecurityContext{RunAsUser: id(-1)},
+			root:     root,
+			code:     codes.InvalidArgument,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := userConfig(tt.security, tt.groups, tt.root)
+			if status.Code(err) != tt.code {
+				t.Fatalf("userConfig() error = %v, want code %v", err, tt.code)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("userConfig() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLookupPasswdInRoot(t *testing.T) {
+	// An /etc/passwd that links to a host's file resolves inside the
+	// container, where there is none.
+	host := filepath.Join(t.TempDir(), "passwd")
+	if err := os.WriteFile(host, []byte("app:x:1000:1000::/:/bin/sh\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "etc"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(host, filepath.Join(root, "etc", "passwd")); err != nil {
+		t.Fatal(err)
+	}
+	_, ok, err := lookupPasswd(root, func(passwdEntry) bool { return true })
+	if err != nil || ok {
+		t.Errorf("lookupPasswd() = %v, %v, want no entry", ok, err)
+	}
+}
+
+func TestWriteUserBundle(t *testing.T) {
+	c := &containerRecord{
+		Rootfs:     t.TempDir(),
+		WorkingDir: "/srv",
+		Command:    []string{"/bin/app", "--flag"},
+		User:       &containerUser{UID: 1000, GID: 1000, Groups: []uint32{2000}},
+	}
+	if err := writeUserBundle(c); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(c.Rootfs, userBundleConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]any
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"ociVersion": "1.0.2",
+		"root":       map[string]any{"path": "merged"},
+		"process": map[string]any{
+			"cwd":  "/srv",
+			"args": []any{"/bin/app", "--flag"},
+			"user": map[string]any{
+				"uid":            1000.0,
+				"gid":            1000.0,
+				"additionalGids": []any{2000.0},
+			},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("config = %v\nwant %v", got, want)
+	}
+
+	// Containers that run as root have no bundle.
+	root := &containerRecord{Rootfs: t.TempDir(), Command: []string{"/bin/app"}}
+	if err := writeUserBundle(root); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root.Rootfs, userBundleConfig)); !os.IsNotExist(err) {
+		t.Errorf("config of a root container: %v, want none", err)
+	}
+}
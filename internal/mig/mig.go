@@ -0,0 +1,143 @@
+// Package mig resolves the NVIDIA Multi-Instance GPU (MIG) instances that
+// containers ask for into the device nodes that give access to them.
+package mig
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// Annotation is the container annotation that asks for MIG instances, as a
+// comma-separated list of gpu:gi:ci indexes: the GPU, the GPU instance on it
+// and the compute instance in that, like "0:1:0,0:2:0".
+const Annotation = "systemd-cri.io/nvidia-mig-devices"
+
+const (
+	// capabilitiesPath is where the NVIDIA driver lists the capabilities
+	// that grant access to MIG instances.
+	capabilitiesPath = "/proc/driver/nvidia/capabilities"
+	// capsDevicePath is where the device nodes of those capabilities are.
+	capsDevicePath = "/dev/nvidia-caps"
+	// devicePath is where the device nodes of the GPUs are.
+	devicePath = "/dev"
+)
+
+// Resolver resolves the MIG instances of Annotation. It implements
+// machineman.DeviceResolver.
+type Resolver struct{}
+
+// Annotation returns Annotation.
+func (Resolver) Annotation() string {
+	return Annotation
+}
+
+// Resolve returns the device nodes a container needs for the MIG instances
+// value asks for: the control device, the unified memory device if the
+// driver has one, the GPUs the instances are on and the capability devices
+// of the GPU and compute instances.
+func (Resolver) Resolve(value string) ([]*runtimeapi.Device, error) {
+	devices := []*runtimeapi.Device{gpuDevice("nvidiactl")}
+	if _, err := os.Stat(filepath.Join(devicePath, "nvidia-uvm")); err == nil {
+		devices = append(devices, gpuDevice("nvidia-uvm"))
+	}
+	seen := map[string]bool{}
+	for _, instance := range strings.Split(value, ",") {
+		gpu, gi, ci, err := parseInstance(strings.TrimSpace(instance))
+		if err != nil {
+			return nil, err
+		}
+		dir := filepath.Join(capabilitiesPath, "gpu"+gpu, "mig", "gi"+gi)
+		giMinor, err := capabilityMinor(filepath.Join(dir, "access"))
+		if err != nil {
+			return nil, unavailable(instance, err)
+		}
+		ciMinor, err := capabilityMinor(filepath.Join(dir, "ci"+ci, "access"))
+		if err != nil {
+			return nil, unavailable(instance, err)
+		}
+		for _, device := range []*runtimeapi.Device{
+			gpuDevice("nvidia" + gpu),
+			capDevice(giMinor),
+			capDevice(ciMinor),
+		} {
+			if !seen[device.HostPath] {
+				seen[device.HostPath] = true
+				devices = append(devices, device)
+			}
+		}
+	}
+	return devices, nil
+}
+
+// parseInstance parses a gpu:gi:ci triple of Annotation.
+func parseInstance(instance string) (gpu, gi, ci string, err error) {
+	parts := strings.Split(instance, ":")
+	if len(parts) != 3 {
+		return "", "", "", status.Errorf(
+			codes.InvalidArgument,
+			"annotation %s: %q is not gpu:gi:ci",
+			Annotation, instance,
+		)
+	}
+	for _, part := range parts {
+		if _, err := strconv.ParseUint(part, 10, 32); err != nil {
+			return "", "", "", status.Errorf(
+				codes.InvalidArgument,
+				"annotation %s: %q is not gpu:gi:ci",
+				Annotation, instance,
+			)
+		}
+	}
+	return parts[0], parts[1], parts[2], nil
+}
+
+// capabilityMinor reads the minor number of the device node of a
+// capability from its access file, which holds lines like
+// "DeviceFileMinor: 12".
+func capabilityMinor(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	lines := bufio.NewScanner(f)
+	for lines.Scan() {
+		name, value, ok := strings.Cut(lines.Text(), ":")
+		if ok && strings.TrimSpace(name) == "DeviceFileMinor" {
+			return strconv.Atoi(strings.TrimSpace(value))
+		}
+	}
+	if err := lines.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("%s has no DeviceFileMinor", path)
+}
+
+// unavailable is the error for a MIG instance the node doesn't have.
+func unavailable(instance string, err error) error {
+	return status.Errorf(
+		codes.FailedPrecondition,
+		"MIG instance %s is not available on this node: %v",
+		instance, err,
+	)
+}
+
+func gpuDevice(name string) *runtimeapi.Device {
+	path := filepath.Join(devicePath, name)
+	return &runtimeapi.Device{ContainerPath: path, HostPath: path, Permissions: "rw"}
+}
+
+// capDevice returns the device node of a capability. Holding it open is
+// what grants access, so it is read-only.
+func capDevice(minor int) *runtimeapi.Device {
+	path := filepath.Join(capsDevicePath, "nvidia-cap"+strconv.Itoa(minor))
+	return &runtimeapi.Device{ContainerPath: path, HostPath: path, Permissions: "r"}
+}
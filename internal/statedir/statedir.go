@@ -0,0 +1,58 @@
+// Package statedir manages the directory systemd-cri keeps its state in.
+package statedir
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockFile is held locked by the instance that owns a state directory.
+const lockFile = ".lock"
+
+// ErrInUse is returned when another instance holds the state directory.
+var ErrInUse = errors.New("state dir already in use")
+
+// Dir is a state directory owned by this instance.
+type Dir struct {
+	path string
+	lock *os.File
+}
+
+// Open creates the state directory at path if needed and takes an exclusive
+// lock on it. It fails fast with ErrInUse if another instance holds the lock,
+// since two instances sharing a state directory would corrupt it.
+func Open(path string) (*Dir, error) {
+	if err := os.MkdirAll(path, 0o700); err != nil {
+		return nil, err
+	}
+	lock, err := os.OpenFile(filepath.Join(path, lockFile), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Flock(int(lock.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		lock.Close()
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			return nil, fmt.Errorf("%s: %w", path, ErrInUse)
+		}
+		return nil, fmt.Errorf("lock %s: %w", path, err)
+	}
+	return &Dir{path: path, lock: lock}, nil
+}
+
+// Path returns the path of the state directory.
+func (d *Dir) Path() string {
+	return d.path
+}
+
+// Close releases the lock on the state directory.
+func (d *Dir) Close() error {
+	if err := unix.Flock(int(d.lock.Fd()), unix.LOCK_UN); err != nil {
+		d.lock.Close()
+		return err
+	}
+	return d.lock.Close()
+}
@@ -0,0 +1,78 @@
+package streaming
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// ErrSessionExpired is returned for tokens of sessions that were still
+// running when the runtime restarted. Their processes are gone, so the
+// client has to ask for a new session.
+var ErrSessionExpired = errors.New("streaming session expired with a restart of the runtime, request a new one")
+
+// Restore makes the sessions remember, in the file at path, which tokens
+// they issued. Tokens of sessions that were live when a previous instance
+// stopped are read back and expired, so that clients still holding their
+// URLs get ErrSessionExpired instead of ErrSessionNotFound. Only hashes of
+// the tokens are stored, since a token is all it takes to join a session.
+func (s *Sessions) Restore(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expired = map[string]bool{}
+	lines := bufio.NewScanner(bytes.NewReader(data))
+	for lines.Scan() {
+		if line := lines.Text(); line != "" {
+			s.expired[line] = true
+		}
+	}
+	s.path = path
+	return s.saveLocked()
+}
+
+// isExpired reports whether token was issued before a restart.
+func (s *Sessions) isExpired(token string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.expired[hashToken(token)]
+}
+
+// saveLocked replaces the file of issued tokens with the hashes of the live
+// sessions. It does nothing unless the sessions were restored from a file.
+func (s *Sessions) saveLocked() error {
+	if s.path == "" {
+		return nil
+	}
+	var buf bytes.Buffer
+	for token := range s.sessions {
+		buf.WriteString(hashToken(token))
+		buf.WriteByte('\n')
+	}
+	f, err := os.CreateTemp(filepath.Dir(s.path), "."+filepath.Base(s.path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), s.path)
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
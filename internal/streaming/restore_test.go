@@ -0,0 +1,74 @@
+package streaming
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRestore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "streaming-sessions")
+	before := NewSessions(time.Minute, 0)
+	if err := before.Restore(path); err != nil {
+		t.Fatal(err)
+	}
+	token, err := before.Add(newEchoProcess().Process)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), token) {
+		t.Error("sessions file holds a token in the clear")
+	}
+
+	// The runtime restarts, and the session's process is gone with it.
+	after := NewSessions(time.Minute, 0)
+	if err := after.Restore(path); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := after.Attach(ctx, token, nil, io.Discard, nil); !errors.Is(err, ErrSessionExpired) {
+		t.Errorf("Attach() with a token from before the restart = %v, want %v", err, ErrSessionExpired)
+	}
+	if err := after.Attach(ctx, "unknown", nil, io.Discard, nil); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("Attach() with an unknown token = %v, want %v", err, ErrSessionNotFound)
+	}
+
+	server := httptest.NewServer(after.Handler())
+	defer server.Close()
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(server.URL + "/exec/" + token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGone {
+		t.Errorf("status of an expired token = %d, want %d", resp.StatusCode, http.StatusGone)
+	}
+	if !strings.Contains(string(body), ErrSessionExpired.Error()) {
+		t.Errorf("body of an expired token = %q, want %q", body, ErrSessionExpired)
+	}
+}
+
+func TestRestoreMissingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "streaming-sessions")
+	s := NewSessions(time.Minute, 0)
+	if err := s.Restore(path); err != nil {
+		t.Fatalf("Restore() without a file = %v", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("Restore() did not create the file: %v", err)
+	}
+}
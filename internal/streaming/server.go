@@ -0,0 +1,183 @@
+package streaming
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+
+	"golang.org/x/net/websocket"
+)
+
+// protocols are the WebSocket subprotocols the server speaks, in order of
+// preference: the channel protocols of Kubernetes, in which every message
+// starts with the byte of the stream it belongs to. Version 5 adds a
+// message that closes a stream, which lets clients close stdin.
+var protocols = []string{"v5.channel.k8s.io", "v4.channel.k8s.io"}
+
+// The channels of the channel protocols.
+const (
+	stdinChannel  = 0
+	stdoutChannel = 1
+	stderrChannel = 2
+	// errorChannel carries the status the session ended with.
+	errorChannel = 3
+	// resizeChannel carries the size of the client's terminal as JSON.
+	resizeChannel = 4
+	// closeChannel closes the channel named by the next byte.
+	closeChannel = 255
+)
+
+// Handler serves the sessions to clients at URLs whose last path element is
+// the token of a session. Clients that upgrade to SPDY, as kubectl and
+// kubelet do, get the stream protocols of Kubernetes over it; any other
+// client gets the channel protocols over WebSockets. Tokens that aren't
+// issued are refused before the connection is upgraded: with 410 Gone if
+// their session expired with a restart, 404 Not Found otherwise.
+func (s *Sessions) Handler() http.Handler {
+	server := websocket.Server{Handshake: negotiate, Handler: s.serveConn}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		token := path.Base(req.URL.Path)
+		sess, err := s.lookup(token)
+		if err != nil {
+			code := http.StatusNotFound
+			if errors.Is(err, ErrSessionExpired) {
+				code = http.StatusGone
+			}
+			http.Error(w, err.Error(), code)
+			return
+		}
+		if isSPDYUpgrade(req) {
+			s.serveSPDY(w, req, token, sess.proc.Streams)
+			return
+		}
+		server.ServeHTTP(w, req)
+	})
+}
+
+// negotiate picks the most preferred of the protocols the client offers.
+func negotiate(config *websocket.Config, _ *http.Request) error {
+	for _, protocol := range protocols {
+		for _, offered := range config.Protocol {
+			if offered == protocol {
+				config.Protocol = []string{protocol}
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("none of the protocols %q is supported", config.Protocol)
+}
+
+// serveConn attaches a client connection to its session until either goes
+// away, and sends the client the status the session ended with.
+func (s *Sessions) serveConn(ws *websocket.Conn) {
+	defer ws.Close()
+	ws.PayloadType = websocket.BinaryFrame
+	token := path.Base(ws.Request().URL.Path)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stdin, stdinW := io.Pipe()
+	go func() {
+		// Reading fails once the client closed the connection, which
+		// detaches it from the session.
+		defer cancel()
+		stdinW.CloseWithError(s.readChannels(ws, token, stdinW))
+	}()
+	err := s.Attach(
+		ctx,
+		token,
+		stdin,
+		channelWriter{ws, stdoutChannel},
+		channelWriter{ws, stderrChannel},
+	)
+	if ctx.Err() != nil {
+		// The client is gone, there is no one to tell.
+		return
+	}
+	data, _ := json.Marshal(newStatus(err))
+	websocket.Message.Send(ws, append([]byte{errorChannel}, data...))
+}
+
+// readChannels reads the messages of a client until the connection fails,
+// passing stdin to the session's process through stdin and resizing its
+// terminal.
+func (s *Sessions) readChannels(ws *websocket.Conn, token string, stdin *io.PipeWriter) error {
+	for {
+		var msg []byte
+		if err := websocket.Message.Receive(ws, &msg); err != nil {
+			return err
+		}
+		if len(msg) == 0 {
+			continue
+		}
+		switch msg[0] {
+		case stdinChannel:
+			// Writes fail once the client closed stdin, later input
+			// is dropped.
+			stdin.Write(msg[1:])
+		case resizeChannel:
+			var size TerminalSize
+			if err := json.Unmarshal(msg[1:], &size); err == nil {
+				s.Resize(token, size)
+			}
+		case closeChannel:
+			if len(msg) > 1 && msg[1] == stdinChannel {
+				stdin.Close()
+			}
+		}
+	}
+}
+
+// channelWriter writes to one channel of a client connection.
+type channelWriter struct {
+	ws      *websocket.Conn
+	channel byte
+}
+
+func (w channelWriter) Write(p []byte) (int, error) {
+	if err := websocket.Message.Send(w.ws, append([]byte{w.channel}, p...)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// status is the Kubernetes Status object the channel protocols report the
+// end of a session with.
+type status struct {
+	Metadata struct{}       `json:"metadata"`
+	Status   string         `json:"status"`
+	Message  string         `json:"message,omitempty"`
+	Reason   string         `json:"reason,omitempty"`
+	Details  *statusDetails `json:"details,omitempty"`
+}
+
+type statusDetails struct {
+	Causes []statusCause `json:"causes"`
+}
+
+type statusCause struct {
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+// newStatus returns the status of a session that ended with err. Exit codes
+// are passed the way kubectl expects them.
+func newStatus(err error) status {
+	if err == nil {
+		return status{Status: "Success"}
+	}
+	st := status{Status: "Failure", Message: err.Error()}
+	var exitErr *ExitError
+	if errors.As(err, &exitErr) {
+		st.Reason = "NonZeroExitCode"
+		st.Details = &statusDetails{Causes: []statusCause{{
+			Reason:  "ExitCode",
+			Message: strconv.Itoa(exitErr.Code),
+		}}}
+	}
+	return st
+}
@@ -0,0 +1,117 @@
+package streaming
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// dial connects to the session issued token over the channel protocol.
+func dial(t *testing.T, server *httptest.Server, token string) *websocket.Conn {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/exec/" + token
+	config, err := websocket.NewConfig(url, server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Protocol = []string{"v5.channel.k8s.io"}
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	ws.SetDeadline(time.Now().Add(5 * time.Second))
+	return ws
+}
+
+func send(t *testing.T, ws *websocket.Conn, msg ...byte) {
+	t.Helper()
+	if err := websocket.Message.Send(ws, msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func receive(t *testing.T, ws *websocket.Conn) []byte {
+	t.Helper()
+	var msg []byte
+	if err := websocket.Message.Receive(ws, &msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestHandler(t *testing.T) {
+	s := NewSessions(time.Minute, 0)
+	proc := newEchoProcess()
+	proc.ExitCode = func() int { return 2 }
+	token, err := s.Add(proc.Process)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(s.Handler())
+	defer server.Close()
+
+	ws := dial(t, server, token)
+	if got := ws.Config().Protocol; !reflect.DeepEqual(got, []string{"v5.channel.k8s.io"}) {
+		t.Errorf("protocol = %q, want v5.channel.k8s.io", got)
+	}
+	send(t, ws, stdinChannel, 'h', 'i')
+	if got, want := receive(t, ws), []byte{stdoutChannel, 'h', 'i'}; !reflect.DeepEqual(got, want) {
+		t.Errorf("stdout message = %q, want %q", got, want)
+	}
+	// Closing stdin ends the echo, and the client learns the exit code.
+	send(t, ws, closeChannel, stdinChannel)
+	msg := receive(t, ws)
+	if msg[0] != errorChannel {
+		t.Fatalf("message on channel %d, want the error channel", msg[0])
+	}
+	var got status
+	if err := json.Unmarshal(msg[1:], &got); err != nil {
+		t.Fatal(err)
+	}
+	want := status{
+		Status:  "Failure",
+		Message: "command terminated with non-zero exit code: 2",
+		Reason:  "NonZeroExitCode",
+		Details: &statusDetails{Causes: []statusCause{{Reason: "ExitCode", Message: "2"}}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("status = %+v, want %+v", got, want)
+	}
+}
+
+func TestHandlerRefuses(t *testing.T) {
+	s := NewSessions(time.Minute, 0)
+	server := httptest.NewServer(s.Handler())
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/exec/unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("status of an unknown token = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+
+	proc := newEchoProcess()
+	token, err := s.Add(proc.Process)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/exec/" + token
+	config, err := websocket.NewConfig(url, server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Protocol = []string{"channel.k8s.io"}
+	if ws, err := websocket.DialConfig(config); err == nil {
+		ws.Close()
+		t.Error("connected with an unsupported protocol")
+	}
+}
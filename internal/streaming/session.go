@@ -0,0 +1,503 @@
+// Package streaming serves the standard streams of exec and attach sessions
+// to clients.
+package streaming
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// DefaultReconnectGrace is how long a session outlives its client by
+// default.
+const DefaultReconnectGrace = time.Minute
+
+var (
+	// ErrSessionNotFound is returned for tokens that were never issued, or
+	// whose session has ended or expired.
+	ErrSessionNotFound = errors.New("streaming session not found")
+	// ErrTakenOver is returned to a client whose session was reattached by
+	// another client.
+	ErrTakenOver = errors.New("streaming session was reattached by another client")
+	// ErrIdle is returned to a client whose session was torn down because
+	// no data flowed for the idle timeout.
+	ErrIdle = errors.New("streaming session was idle for too long")
+	// ErrShutdown is returned to a client whose session was torn down
+	// because the runtime is shutting down.
+	ErrShutdown = errors.New("streaming session was closed on shutdown")
+)
+
+// ExitError is returned to a client whose session ended with its process
+// exiting with a non-zero code.
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("command terminated with non-zero exit code: %d", e.Code)
+}
+
+// TerminalSize is the size of a terminal in characters.
+type TerminalSize struct {
+	Width  uint16
+	Height uint16
+}
+
+// Process is a running process whose standard streams are served to clients.
+// Any of the streams may be nil if the process wasn't given one. Stdin, and
+// the output streams that are io.Closers, are closed once the session ended.
+type Process struct {
+	Stdin  io.WriteCloser
+	Stdout io.Reader
+	Stderr io.Reader
+	// Kill terminates the process. It is called when a session expires or
+	// goes idle.
+	Kill func() error
+	// OnAttach, if set, is called each time a client attaches to the
+	// session, reconnects included.
+	OnAttach func()
+	// OnEnd, if set, is called once the session ended, with how long it
+	// lasted since it was added.
+	OnEnd func(time.Duration)
+	// ExitCode, if set, is called once the process's output is drained
+	// and waits for its exit code.
+	ExitCode func() int
+	// Resize, if set, changes the size of the process's terminal.
+	Resize func(TerminalSize) error
+	// Streams are the streams the session was asked for. SPDY clients
+	// open one for each before they are attached.
+	Streams Streams
+}
+
+// Streams says which standard streams a client asked for, and whether
+// they are those of a terminal.
+type Streams struct {
+	Stdin, Stdout, Stderr, TTY bool
+}
+
+// Sessions keeps processes and their streams around between client
+// connections, keyed by the token of the URL handed out for them. A client
+// that reconnects within the grace period rejoins the same process; a
+// process that has no client for longer than that is killed, and so is one
+// whose streams carry no data for the idle timeout.
+type Sessions struct {
+	grace time.Duration
+	idle  time.Duration
+	// afterFunc starts the timers of sessions, time.AfterFunc but for
+	// tests.
+	afterFunc func(time.Duration, func()) timer
+
+	mu       sync.Mutex
+	sessions map[string]*session
+	// path is the file the hashes of the live sessions' tokens are kept
+	// in, empty if they aren't.
+	path string
+	// expired holds the hashed tokens of the sessions that were live when
+	// a previous instance stopped.
+	expired map[string]bool
+}
+
+// NewSessions returns an empty session store whose sessions wait grace for
+// a client before they are killed. Sessions without any input or output for
+// idle are killed too, unless idle is zero.
+func NewSessions(grace, idle time.Duration) *Sessions {
+	return &Sessions{
+		grace: grace,
+		idle:  idle,
+		afterFunc: func(d time.Duration, f func()) timer {
+			return time.AfterFunc(d, f)
+		},
+		sessions: map[string]*session{},
+	}
+}
+
+// timer is the part of *time.Timer sessions use.
+type timer interface {
+	Stop() bool
+	Reset(time.Duration) bool
+}
+
+// Add starts serving the streams of a process and returns the token that
+// clients attach with. The first client must attach within the grace
+// period.
+func (s *Sessions) Add(proc Process) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	added := time.Now()
+	sess := &session{
+		sessions: s,
+		token:    token,
+		proc:     proc,
+		drained:  make(chan struct{}),
+	}
+	sess.cond = sync.NewCond(&sess.mu)
+	sess.timer = s.afterFunc(s.grace, sess.expire)
+	if s.idle > 0 {
+		sess.idle = s.afterFunc(s.idle, sess.idleOut)
+	}
+	s.mu.Lock()
+	s.sessions[token] = sess
+	// The file only tells expired tokens from unknown ones, a session
+	// works without it.
+	s.saveLocked()
+	s.mu.Unlock()
+
+	var pumps sync.WaitGroup
+	for _, r := range []struct {
+		reader io.Reader
+		stderr bool
+	}{{proc.Stdout, false}, {proc.Stderr, true}} {
+		if r.reader == nil {
+			continue
+		}
+		pumps.Add(1)
+		go func(r io.Reader, stderr bool) {
+			defer pumps.Done()
+			sess.pump(r, stderr)
+		}(r.reader, r.stderr)
+	}
+	go func() {
+		pumps.Wait()
+		sess.mu.Lock()
+		// A process can end before its first client attaches, which
+		// still has to learn how it ended.
+		for sess.client == nil && !sess.closed {
+			sess.cond.Wait()
+		}
+		sess.closed = true
+		sess.timer.Stop()
+		if sess.idle != nil {
+			sess.idle.Stop()
+		}
+		sess.mu.Unlock()
+		sess.remove()
+		if proc.Stdin != nil {
+			proc.Stdin.Close()
+		}
+		for _, r := range []io.Reader{proc.Stdout, proc.Stderr} {
+			if c, ok := r.(io.Closer); ok {
+				c.Close()
+			}
+		}
+		if proc.OnEnd != nil {
+			proc.OnEnd(time.Since(added))
+		}
+		close(sess.drained)
+	}()
+	return token, nil
+}
+
+// Drain waits for every session to end. Sessions still running when ctx is
+// done are killed, and ctx's error is returned.
+func (s *Sessions) Drain(ctx context.Context) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		s.mu.Lock()
+		n := len(s.sessions)
+		s.mu.Unlock()
+		if n == 0 {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			s.mu.Lock()
+			sessions := make([]*session, 0, len(s.sessions))
+			for _, sess := range s.sessions {
+				sessions = append(sessions, sess)
+			}
+			s.mu.Unlock()
+			for _, sess := range sessions {
+				sess.abort(ErrShutdown)
+			}
+			return ctx.Err()
+		}
+	}
+}
+
+// Attach connects a client to the session issued token, copying stdin to the
+// process and the process's output to stdout and stderr. It returns once the
+// process's output is drained, nil or an *ExitError for a process that
+// exited with a non-zero code, or an error when the client goes away:
+// ctx is done, or another client attached to the session. A client that
+// goes away leaves the process running for the grace period, so that it can
+// attach again.
+func (s *Sessions) Attach(
+	ctx context.Context,
+	token string,
+	stdin io.Reader,
+	stdout, stderr io.Writer,
+) error {
+	sess, err := s.lookup(token)
+	if err != nil {
+		return err
+	}
+	c := &client{stdout: stdout, stderr: stderr, gone: make(chan struct{})}
+	sess.mu.Lock()
+	if sess.closed {
+		sess.mu.Unlock()
+		return ErrSessionNotFound
+	}
+	if sess.client != nil {
+		sess.dropLocked(sess.client, ErrTakenOver)
+	}
+	sess.client = c
+	sess.timer.Stop()
+	sess.cond.Broadcast()
+	sess.mu.Unlock()
+	if sess.proc.OnAttach != nil {
+		sess.proc.OnAttach()
+	}
+
+	switch {
+	case stdin != nil && sess.proc.Stdin != nil:
+		go func() {
+			_, err := io.Copy(stdinWriter{sess, c}, stdin)
+			if err == nil {
+				// The client closed its stdin, pass that on.
+				sess.proc.Stdin.Close()
+			}
+		}()
+	case stdin != nil:
+		// Input to a process without stdin is dropped, rather than
+		// left to block the client.
+		go io.Copy(io.Discard, stdin)
+	}
+
+	select {
+	case <-sess.drained:
+		if sess.proc.ExitCode != nil {
+			if code := sess.proc.ExitCode(); code != 0 {
+				return &ExitError{Code: code}
+			}
+		}
+		return nil
+	case <-c.gone:
+		return c.err
+	case <-ctx.Done():
+		sess.detach(c, ctx.Err())
+		return ctx.Err()
+	}
+}
+
+// Resize changes the size of the terminal of the session issued token. It
+// does nothing for processes without a terminal.
+func (s *Sessions) Resize(token string, size TerminalSize) error {
+	sess, err := s.lookup(token)
+	if err != nil {
+		return err
+	}
+	if sess.proc.Resize == nil {
+		return nil
+	}
+	return sess.proc.Resize(size)
+}
+
+// lookup returns the session issued token, or why there is none.
+func (s *Sessions) lookup(token string) (*session, error) {
+	s.mu.Lock()
+	sess, ok := s.sessions[token]
+	s.mu.Unlock()
+	if !ok {
+		if s.isExpired(token) {
+			return nil, ErrSessionExpired
+		}
+		return nil, ErrSessionNotFound
+	}
+	return sess, nil
+}
+
+type session struct {
+	sessions *Sessions
+	token    string
+	proc     Process
+	// drained is closed once the process's output has been read to the end.
+	drained chan struct{}
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// client is the attached client, nil while the session waits for one.
+	client *client
+	// timer expires the session when no client attaches in time.
+	timer timer
+	// idle tears the session down when its streams carry no data for the
+	// idle timeout. It is nil without one.
+	idle timer
+	// closed is set once the session ended.
+	closed bool
+}
+
+type client struct {
+	stdout, stderr io.Writer
+	// gone is closed when the client loses the session, err says why.
+	gone chan struct{}
+	err  error
+}
+
+// detach drops c from the session and starts the grace period, unless c was
+// already replaced.
+func (sess *session) detach(c *client, err error) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if sess.client != c || sess.closed {
+		return
+	}
+	sess.dropLocked(c, err)
+	sess.timer.Reset(sess.sessions.grace)
+}
+
+func (sess *session) dropLocked(c *client, err error) {
+	c.err = err
+	close(c.gone)
+	sess.client = nil
+	sess.cond.Broadcast()
+}
+
+// expire kills the process of a session that no client attached to within
+// the grace period.
+func (sess *session) expire() {
+	sess.mu.Lock()
+	if sess.client != nil || sess.closed {
+		sess.mu.Unlock()
+		return
+	}
+	sess.closed = true
+	sess.cond.Broadcast()
+	sess.mu.Unlock()
+	sess.kill()
+}
+
+// idleOut kills the process of a session whose streams carried no data for
+// the idle timeout, and drops its client.
+func (sess *session) idleOut() {
+	sess.abort(ErrIdle)
+}
+
+// abort kills the process of a session and drops its client with err.
+func (sess *session) abort(err error) {
+	sess.mu.Lock()
+	if sess.closed {
+		sess.mu.Unlock()
+		return
+	}
+	if sess.client != nil {
+		sess.dropLocked(sess.client, err)
+	}
+	sess.closed = true
+	sess.timer.Stop()
+	if sess.idle != nil {
+		sess.idle.Stop()
+	}
+	sess.cond.Broadcast()
+	sess.mu.Unlock()
+	sess.kill()
+}
+
+// touch restarts the idle timeout of a session on activity.
+func (sess *session) touch() {
+	if sess.idle != nil {
+		sess.idle.Reset(sess.sessions.idle)
+	}
+}
+
+func (sess *session) kill() {
+	sess.remove()
+	if sess.proc.Stdin != nil {
+		sess.proc.Stdin.Close()
+	}
+	if sess.proc.Kill != nil {
+		sess.proc.Kill()
+	}
+}
+
+func (sess *session) remove() {
+	s := sess.sessions
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sessions[sess.token] == sess {
+		delete(s.sessions, sess.token)
+		s.saveLocked()
+	}
+}
+
+// pump copies one output stream of the process to whichever client is
+// attached. While no client is attached it stops reading, so that output
+// produced during a reconnect is held in the pipe rather than lost.
+func (sess *session) pump(r io.Reader, stderr bool) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			sess.touch()
+			sess.deliver(buf[:n], stderr)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// deliver writes p to the attached client, waiting for one if needed. Output
+// that a client fails to take is retried with the next one. It gives up only
+// when the session is closed.
+func (sess *session) deliver(p []byte, stderr bool) {
+	for len(p) > 0 {
+		sess.mu.Lock()
+		for sess.client == nil && !sess.closed {
+			sess.cond.Wait()
+		}
+		if sess.closed {
+			sess.mu.Unlock()
+			return
+		}
+		c := sess.client
+		sess.mu.Unlock()
+
+		w := c.stdout
+		if stderr {
+			w = c.stderr
+		}
+		if w == nil {
+			return
+		}
+		n, err := w.Write(p)
+		p = p[n:]
+		if err != nil {
+			sess.detach(c, err)
+		}
+	}
+}
+
+// stdinWriter forwards a client's stdin to the process for as long as the
+// client is attached.
+type stdinWriter struct {
+	sess *session
+	c    *client
+}
+
+func (w stdinWriter) Write(p []byte) (int, error) {
+	w.sess.mu.Lock()
+	attached := w.sess.client == w.c
+	w.sess.mu.Unlock()
+	if !attached {
+		return 0, ErrTakenOver
+	}
+	w.sess.touch()
+	return w.sess.proc.Stdin.Write(p)
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
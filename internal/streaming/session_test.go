@@ -0,0 +1,289 @@
+package streaming
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errKilled = errors.New("killed")
+
+// echoProcess is a process that echoes its stdin to its stdout, and exits
+// when its stdin is closed.
+type echoProcess struct {
+	Process
+	// killed is closed when the process is killed.
+	killed chan struct{}
+}
+
+func newEchoProcess() *echoProcess {
+	r, w := io.Pipe()
+	p := &echoProcess{killed: make(chan struct{})}
+	p.Process = Process{
+		Stdin:  w,
+		Stdout: r,
+		Kill: func() error {
+			close(p.killed)
+			return w.CloseWithError(errKilled)
+		},
+	}
+	return p
+}
+
+// testClient is a client attached to a session in the background.
+type testClient struct {
+	stdin  *io.PipeWriter
+	stdout *io.PipeReader
+	cancel context.CancelFunc
+	// done receives what Attach returned.
+	done chan error
+}
+
+func attach(t *testing.T, s *Sessions, token string) *testClient {
+	t.Helper()
+	stdin, stdinW := io.Pipe()
+	stdout, stdoutW := io.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &testClient{stdin: stdinW, stdout: stdout, cancel: cancel, done: make(chan error, 1)}
+	go func() {
+		err := s.Attach(ctx, token, stdin, stdoutW, nil)
+		stdoutW.CloseWithError(err)
+		c.done <- err
+	}()
+	t.Cleanup(cancel)
+	return c
+}
+
+// echo sends line through the process the client is attached to and checks
+// that it comes back.
+func (c *testClient) echo(t *testing.T, line string) {
+	t.Helper()
+	if _, err := c.stdin.Write([]byte(line)); err != nil {
+		t.Fatalf("write stdin: %v", err)
+	}
+	got := make([]byte, len(line))
+	if _, err := io.ReadFull(c.stdout, got); err != nil {
+		t.Fatalf("read stdout: %v", err)
+	}
+	if string(got) != line {
+		t.Errorf("stdout = %q, want %q", got, line)
+	}
+}
+
+func (c *testClient) wait(t *testing.T) error {
+	t.Helper()
+	select {
+	case err := <-c.done:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("Attach() did not return")
+		return nil
+	}
+}
+
+func TestReconnectWithinGrace(t *testing.T) {
+	s := NewSessions(time.Minute, 0)
+	proc := newEchoProcess()
+	token, err := s.Add(proc.Process)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := attach(t, s, token)
+	first.echo(t, "one")
+	first.cancel()
+	if err := first.wait(t); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Attach() of a client that went away = %v, want %v", err, context.Canceled)
+	}
+	// The process waits for the client to come back.
+	second := attach(t, s, token)
+	second.echo(t, "two")
+	select {
+	case <-proc.killed:
+		t.Fatal("process was killed within the grace period")
+	default:
+	}
+	second.stdin.Close()
+	if err := second.wait(t); err != nil {
+		t.Errorf("Attach() once the process ended = %v", err)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	tests := []struct {
+		name   string
+		attach bool
+	}{
+		{name: "never attached"},
+		{name: "client went away", attach: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewSessions(200*time.Millisecond, 0)
+			proc := newEchoProcess()
+			token, err := s.Add(proc.Process)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.attach {
+				c := attach(t, s, token)
+				c.echo(t, "x")
+				c.cancel()
+				c.wait(t)
+			}
+			select {
+			case <-proc.killed:
+			case <-time.After(5 * time.Second):
+				t.Fatal("process was not killed after the grace period")
+			}
+			err = s.Attach(context.Background(), token, nil, io.Discard, nil)
+			if !errors.Is(err, ErrSessionNotFound) {
+				t.Errorf("Attach() after expiry = %v, want %v", err, ErrSessionNotFound)
+			}
+		})
+	}
+}
+
+func TestTakeover(t *testing.T) {
+	s := NewSessions(time.Minute, 0)
+	proc := newEchoProcess()
+	token, err := s.Add(proc.Process)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := attach(t, s, token)
+	first.echo(t, "one")
+	second := attach(t, s, token)
+	if err := first.wait(t); !errors.Is(err, ErrTakenOver) {
+		t.Errorf("Attach() of the replaced client = %v, want %v", err, ErrTakenOver)
+	}
+	// The replaced client's input no longer reaches the process.
+	first.stdin.Write([]byte("lost"))
+	second.echo(t, "two")
+	second.stdin.Close()
+	if err := second.wait(t); err != nil {
+		t.Errorf("Attach() once the process ended = %v", err)
+	}
+}
+
+func TestAttachExitCode(t *testing.T) {
+	s := NewSessions(time.Minute, 0)
+	proc := newEchoProcess()
+	proc.ExitCode = func() int { return 3 }
+	token, err := s.Add(proc.Process)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := attach(t, s, token)
+	c.stdin.Close()
+	var exitErr *ExitError
+	if err := c.wait(t); !errors.As(err, &exitErr) || exitErr.Code != 3 {
+		t.Errorf("Attach() = %v, want exit code 3", err)
+	}
+}
+
+// fakeClock runs the timers of sessions on a clock that only moves when a
+// test advances it.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Duration
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock  *fakeClock
+	at     time.Duration
+	f      func()
+	active bool
+}
+
+func (c *fakeClock) afterFunc(d time.Duration, f func()) timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, at: c.now + d, f: f, active: true}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// advance moves the clock forward by d and runs the timers that fired.
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.now += d
+	var fired []func()
+	for _, t := range c.timers {
+		if t.active && t.at <= c.now {
+			t.active = false
+			fired = append(fired, t.f)
+		}
+	}
+	c.mu.Unlock()
+	for _, f := range fired {
+		f()
+	}
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	active := t.active
+	t.active = false
+	return active
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	active := t.active
+	t.at = t.clock.now + d
+	t.active = true
+	return active
+}
+
+func TestEndBeforeAttach(t *testing.T) {
+	s := NewSessions(time.Minute, 0)
+	proc := newEchoProcess()
+	proc.ExitCode = func() int { return 1 }
+	token, err := s.Add(proc.Process)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proc.Stdin.Close()
+	// The process has ended, the session waits for its client.
+	c := attach(t, s, token)
+	var exitErr *ExitError
+	if err := c.wait(t); !errors.As(err, &exitErr) || exitErr.Code != 1 {
+		t.Errorf("Attach() = %v, want exit code 1", err)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	var clock fakeClock
+	s := NewSessions(time.Hour, 10*time.Second)
+	s.afterFunc = clock.afterFunc
+	proc := newEchoProcess()
+	token, err := s.Add(proc.Process)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := attach(t, s, token)
+	clock.advance(6 * time.Second)
+	// Input and output push the timeout back.
+	c.echo(t, "x")
+	clock.advance(6 * time.Second)
+	select {
+	case <-proc.killed:
+		t.Fatal("session timed out 6s after activity, with an idle timeout of 10s")
+	default:
+	}
+	clock.advance(4 * time.Second)
+	select {
+	case <-proc.killed:
+	default:
+		t.Fatal("session did not time out 10s after activity")
+	}
+	if err := c.wait(t); !errors.Is(err, ErrIdle) {
+		t.Errorf("Attach() of an idle session = %v, want %v", err, ErrIdle)
+	}
+}
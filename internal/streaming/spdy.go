@@ -0,0 +1,246 @@
+package streaming
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/moby/spdystream"
+)
+
+// spdyUpgrade is the protocol SPDY clients, kubectl among them, upgrade
+// their connections to.
+const spdyUpgrade = "SPDY/3.1"
+
+// The headers SPDY clients and the server agree on a stream protocol with.
+const (
+	protocolHeader          = "X-Stream-Protocol-Version"
+	acceptedProtocolsHeader = "X-Accepted-Stream-Protocol-Versions"
+)
+
+// spdyProtocols are the stream protocols the server speaks over SPDY.
+// Version 4 ends a session with a Status on the error stream, as the
+// channel protocols do, and sends the size of the client's terminal as JSON
+// on the resize stream.
+var spdyProtocols = []string{"v4.channel.k8s.io"}
+
+// streamCreationTimeout is how long a SPDY client has to open the streams
+// of its session once its connection is upgraded.
+const streamCreationTimeout = 30 * time.Second
+
+// spdyCloseTimeout is how long a SPDY client has to close its streams once
+// its session ended, before its connection is closed under it.
+const spdyCloseTimeout = 10 * time.Second
+
+// The types of the streams of a SPDY client, which it names in the
+// streamType header of each.
+const (
+	streamTypeHeader = "streamType"
+	errorStream      = "error"
+	stdinStream      = "stdin"
+	stdoutStream     = "stdout"
+	stderrStream     = "stderr"
+	resizeStream     = "resize"
+)
+
+// isSPDYUpgrade reports whether req asks to upgrade its connection to SPDY.
+func isSPDYUpgrade(req *http.Request) bool {
+	return strings.EqualFold(req.Header.Get("Upgrade"), spdyUpgrade)
+}
+
+// spdyStreamTypes returns the types of the streams a SPDY client opens for
+// a session that was asked for want. A terminal has no separate stderr,
+// but can be resized.
+func spdyStreamTypes(want Streams) map[string]bool {
+	return map[string]bool{
+		errorStream:  true,
+		stdinStream:  want.Stdin,
+		stdoutStream: want.Stdout,
+		stderrStream: want.Stderr && !want.TTY,
+		resizeStream: want.TTY,
+	}
+}
+
+// serveSPDY upgrades the connection of a SPDY client and attaches the
+// streams it opens to the session issued token until either goes away, then
+// sends the client the status the session ended with.
+func (s *Sessions) serveSPDY(w http.ResponseWriter, req *http.Request, token string, want Streams) {
+	protocol := negotiateSPDY(req.Header.Values(protocolHeader))
+	if protocol == "" {
+		for _, p := range spdyProtocols {
+			w.Header().Add(acceptedProtocolsHeader, p)
+		}
+		http.Error(
+			w,
+			fmt.Sprintf("none of the protocols %q is supported", req.Header.Values(protocolHeader)),
+			http.StatusForbidden,
+		)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "the connection can't be upgraded", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Connection", "Upgrade")
+	w.Header().Set("Upgrade", spdyUpgrade)
+	w.Header().Set(protocolHeader, protocol)
+	w.WriteHeader(http.StatusSwitchingProtocols)
+	netConn, _, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	conn, err := spdystream.NewConnection(netConn, true)
+	if err != nil {
+		netConn.Close()
+		return
+	}
+	conn.SetCloseTimeout(spdyCloseTimeout)
+	defer conn.Close()
+	opened := make(chan *spdystream.Stream)
+	go conn.Serve(func(stream *spdystream.Stream) {
+		stream.SendReply(http.Header{}, false)
+		select {
+		case opened <- stream:
+		case <-conn.CloseChan():
+		}
+	})
+	streams, ok := acceptStreams(conn, opened, spdyStreamTypes(want))
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		// The client is gone once its connection is, which detaches
+		// it from the session.
+		select {
+		case <-conn.CloseChan():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	var stdin io.Reader
+	if stream := streams[stdinStream]; stream != nil {
+		stdin = spdyStdin{stream, conn}
+	}
+	if stream := streams[resizeStream]; stream != nil {
+		go func() {
+			sizes := json.NewDecoder(stream)
+			for {
+				var size TerminalSize
+				if err := sizes.Decode(&size); err != nil {
+					return
+				}
+				s.Resize(token, size)
+			}
+		}()
+	}
+	err = s.Attach(ctx, token, stdin, streamWriter(streams[stdoutStream]), streamWriter(streams[stderrStream]))
+	if ctx.Err() != nil {
+		// The client is gone, there is no one to tell.
+		return
+	}
+	data, _ := json.Marshal(newStatus(err))
+	streams[errorStream].Write(data)
+	for _, stream := range streams {
+		stream.Close()
+	}
+}
+
+// negotiateSPDY returns the most preferred of the protocols the client
+// offers, or "" if none of them is spoken.
+func negotiateSPDY(offered []string) string {
+	for _, protocol := range spdyProtocols {
+		for _, o := range offered {
+			// Clients may offer several protocols in one header.
+			for _, p := range strings.Split(o, ",") {
+				if strings.TrimSpace(p) == protocol {
+					return protocol
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// acceptStreams waits for a SPDY client to open a stream of each of types,
+// and returns them by type. Streams the session wasn't asked for are
+// drained, and their data dropped. It reports false if the client went
+// away or didn't open all of them within streamCreationTimeout.
+func acceptStreams(
+	conn *spdystream.Connection,
+	opened <-chan *spdystream.Stream,
+	types map[string]bool,
+) (map[string]*spdystream.Stream, bool) {
+	var want int
+	for _, ok := range types {
+		if ok {
+			want++
+		}
+	}
+	streams := make(map[string]*spdystream.Stream, want)
+	timeout := time.NewTimer(streamCreationTimeout)
+	defer timeout.Stop()
+	for len(streams) < want {
+		select {
+		case stream := <-opened:
+			typ := stream.Headers().Get(streamTypeHeader)
+			if !types[typ] || streams[typ] != nil {
+				go io.Copy(io.Discard, stream)
+				continue
+			}
+			streams[typ] = stream
+		case <-timeout.C:
+			return nil, false
+		case <-conn.CloseChan():
+			return nil, false
+		}
+	}
+	go func() {
+		for {
+			select {
+			case stream := <-opened:
+				go io.Copy(io.Discard, stream)
+			case <-conn.CloseChan():
+				return
+			}
+		}
+	}()
+	return streams, true
+}
+
+// spdyStdin reads the stdin stream of a SPDY client. The stream ends both
+// when the client closes it and when its connection goes away, only the
+// former is the end of the client's stdin.
+type spdyStdin struct {
+	stream *spdystream.Stream
+	conn   *spdystream.Connection
+}
+
+func (r spdyStdin) Read(p []byte) (int, error) {
+	n, err := r.stream.Read(p)
+	if err == io.EOF {
+		select {
+		case <-r.conn.CloseChan():
+			// A connection is closed before its streams are.
+			return n, io.ErrUnexpectedEOF
+		default:
+		}
+	}
+	return n, err
+}
+
+// streamWriter returns stream as a writer, nil if the client has no such
+// stream.
+func streamWriter(stream *spdystream.Stream) io.Writer {
+	if stream == nil {
+		return nil
+	}
+	return stream
+}
@@ -0,0 +1,185 @@
+package streaming
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/moby/spdystream"
+)
+
+// dialSPDY upgrades a connection to the session issued token to SPDY,
+// offering protocols, and returns the response to the upgrade. The
+// connection is nil unless it was upgraded.
+func dialSPDY(t *testing.T, server *httptest.Server, token string, protocols ...string) (*spdystream.Connection, *http.Response) {
+	t.Helper()
+	netConn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { netConn.Close() })
+	netConn.SetDeadline(time.Now().Add(5 * time.Second))
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/exec/"+token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", spdyUpgrade)
+	for _, p := range protocols {
+		req.Header.Add(protocolHeader, p)
+	}
+	if err := req.Write(netConn); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(netConn), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, resp
+	}
+	conn, err := spdystream.NewConnection(netConn, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go conn.Serve(spdystream.NoOpStreamHandler)
+	return conn, resp
+}
+
+// openStream opens a stream of typ on conn and waits for the server to take
+// it.
+func openStream(t *testing.T, conn *spdystream.Connection, typ string) *spdystream.Stream {
+	t.Helper()
+	stream, err := conn.CreateStream(http.Header{streamTypeHeader: {typ}}, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.WaitTimeout(5 * time.Second); err != nil {
+		t.Fatalf("open %s stream: %v", typ, err)
+	}
+	return stream
+}
+
+func TestHandlerSPDY(t *testing.T) {
+	s := NewSessions(time.Minute, 0)
+	proc := newEchoProcess()
+	proc.ExitCode = func() int { return 2 }
+	proc.Streams = Streams{Stdin: true, Stdout: true}
+	token, err := s.Add(proc.Process)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(s.Handler())
+	defer server.Close()
+
+	conn, resp := dialSPDY(t, server, token, "v4.channel.k8s.io", "v3.channel.k8s.io")
+	if conn == nil {
+		t.Fatalf("upgrade to SPDY answered with status %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get(protocolHeader); got != "v4.channel.k8s.io" {
+		t.Errorf("protocol = %q, want v4.channel.k8s.io", got)
+	}
+	errStream := openStream(t, conn, errorStream)
+	stdin := openStream(t, conn, stdinStream)
+	stdout := openStream(t, conn, stdoutStream)
+
+	if _, err := stdin.Write([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(stdout, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hi" {
+		t.Errorf("stdout = %q, want %q", buf, "hi")
+	}
+	// Closing stdin ends the echo, and the client learns the exit code.
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var got status
+	if err := json.NewDecoder(errStream).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	want := status{
+		Status:  "Failure",
+		Message: "command terminated with non-zero exit code: 2",
+		Reason:  "NonZeroExitCode",
+		Details: &statusDetails{Causes: []statusCause{{Reason: "ExitCode", Message: "2"}}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("status = %+v, want %+v", got, want)
+	}
+	if rest, err := io.ReadAll(stdout); err != nil || len(rest) != 0 {
+		t.Errorf("stdout after the end of the session = %q, %v, want it closed", rest, err)
+	}
+}
+
+func TestHandlerSPDYResize(t *testing.T) {
+	s := NewSessions(time.Minute, 0)
+	proc := newEchoProcess()
+	sizes := make(chan TerminalSize, 1)
+	proc.Resize = func(size TerminalSize) error {
+		sizes <- size
+		return nil
+	}
+	proc.Streams = Streams{Stdin: true, Stdout: true, TTY: true}
+	token, err := s.Add(proc.Process)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(s.Handler())
+	defer server.Close()
+
+	conn, resp := dialSPDY(t, server, token, "v4.channel.k8s.io")
+	if conn == nil {
+		t.Fatalf("upgrade to SPDY answered with status %d", resp.StatusCode)
+	}
+	for _, typ := range []string{errorStream, stdinStream, stdoutStream} {
+		openStream(t, conn, typ)
+	}
+	resize := openStream(t, conn, resizeStream)
+	if _, err := resize.Write([]byte(`{"Width":80,"Height":24}`)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-sizes:
+		if want := (TerminalSize{Width: 80, Height: 24}); got != want {
+			t.Errorf("terminal resized to %+v, want %+v", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("terminal not resized")
+	}
+}
+
+func TestHandlerSPDYRefuses(t *testing.T) {
+	s := NewSessions(time.Minute, 0)
+	proc := newEchoProcess()
+	proc.Streams = Streams{Stdin: true, Stdout: true}
+	token, err := s.Add(proc.Process)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(s.Handler())
+	defer server.Close()
+
+	conn, resp := dialSPDY(t, server, token, "channel.k8s.io")
+	if conn != nil {
+		t.Fatal("upgraded with an unsupported protocol")
+	}
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("status of an unsupported protocol = %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+	if got := resp.Header.Values(acceptedProtocolsHeader); !reflect.DeepEqual(got, spdyProtocols) {
+		t.Errorf("accepted protocols = %q, want %q", got, spdyProtocols)
+	}
+}
@@ -0,0 +1,37 @@
+package systemd
+
+import (
+	"time"
+
+	"github.com/ananthb/systemd-cri/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	callDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "dbus",
+		Name:      "call_duration_seconds",
+		Help:      "Latency of systemd D-Bus calls, including waiting for any job they queue.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+	}, []string{"method"})
+	callErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "dbus",
+		Name:      "call_errors_total",
+		Help:      "Number of systemd D-Bus calls that returned an error.",
+	}, []string{"method"})
+)
+
+func init() {
+	metrics.MustRegister(callDuration, callErrors)
+}
+
+// observe records the latency and outcome of a D-Bus call that began at
+// start. It is deferred with a pointer to the caller's named error result.
+func observe(method string, start time.Time, err *error) {
+	callDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	if *err != nil {
+		callErrors.WithLabelValues(method).Inc()
+	}
+}
@@ -0,0 +1,190 @@
+// Package systemd talks to the systemd service manager over D-Bus.
+package systemd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/dbus"
+	godbus "github.com/godbus/dbus/v5"
+)
+
+// ErrUnitExists is returned by StartTransientUnit when systemd already has
+// a unit of that name loaded.
+var ErrUnitExists = errors.New("unit already exists")
+
+// unitExistsError is the D-Bus error systemd replies with to a transient
+// unit whose name is taken.
+const unitExistsError = "org.freedesktop.systemd1.UnitExists"
+
+// Conn is a connection to the system instance of systemd.
+// Every call made through it is instrumented with latency and error metrics.
+type Conn struct {
+	conn *dbus.Conn
+}
+
+// New connects to systemd on the system bus.
+func New(ctx context.Context) (*Conn, error) {
+	conn, err := dbus.NewWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{conn: conn}, nil
+}
+
+// Connected reports whether the D-Bus connection is still usable.
+func (c *Conn) Connected() bool {
+	return c.conn.Connected()
+}
+
+// Version returns the major version of systemd, e.g. 252.
+func (c *Conn) Version() (version int, err error) {
+	defer observe("GetManagerProperty", time.Now(), &err)
+	v, err := c.conn.GetManagerProperty("Version")
+	if err != nil {
+		return 0, err
+	}
+	// The property is a variant, formatted with quotes. Distributions
+	// append their own suffix, as in "252.4-1.fc38".
+	v = strings.Trim(v, `"`)
+	major := v
+	if i := strings.IndexFunc(v, func(r rune) bool { return r < '0' || r > '9' }); i >= 0 {
+		major = v[:i]
+	}
+	version, err = strconv.Atoi(major)
+	if err != nil {
+		return 0, fmt.Errorf("unknown systemd version %q", v)
+	}
+	return version, nil
+}
+
+// Close closes the underlying D-Bus connection.
+func (c *Conn) Close() {
+	c.conn.Close()
+}
+
+// StartTransientUnit creates and starts a transient unit with the given
+// properties and waits for the start job to finish. If ctx is done first,
+// the unit is stopped again. It fails with ErrUnitExists if the name is
+// taken.
+func (c *Conn) StartTransientUnit(
+	ctx context.Context,
+	name string,
+	props ...dbus.Property,
+) (err error) {
+	defer observe("StartTransientUnit", time.Now(), &err)
+	ch := make(chan string, 1)
+	if _, err := c.conn.StartTransientUnitContext(ctx, name, "fail", props, ch); err != nil {
+		var dbusErr godbus.Error
+		if errors.As(err, &dbusErr) && dbusErr.Name == unitExistsError {
+			return fmt.Errorf("%w: %s", ErrUnitExists, name)
+		}
+		return err
+	}
+	if err := waitJob(ctx, name, ch); err != nil {
+		if ctx.Err() != nil {
+			// The caller gave up on the unit, don't leave it starting
+			// up behind its back.
+			c.conn.StopUnitContext(context.Background(), name, "replace", nil)
+		}
+		return err
+	}
+	return nil
+}
+
+// StartUnit starts a loaded unit and waits for the start job to finish.
+func (c *Conn) StartUnit(ctx context.Context, name string) (err error) {
+	defer observe("StartUnit", time.Now(), &err)
+	ch := make(chan string, 1)
+	if _, err := c.conn.StartUnitContext(ctx, name, "fail", ch); err != nil {
+		return err
+	}
+	return waitJob(ctx, name, ch)
+}
+
+// StopUnit stops a unit and waits for the stop job to finish.
+func (c *Conn) StopUnit(ctx context.Context, name string) (err error) {
+	defer observe("StopUnit", time.Now(), &err)
+	ch := make(chan string, 1)
+	if _, err := c.conn.StopUnitContext(ctx, name, "replace", ch); err != nil {
+		return err
+	}
+	return waitJob(ctx, name, ch)
+}
+
+// KillUnit sends a signal to every process of a unit.
+func (c *Conn) KillUnit(
+	ctx context.Context,
+	name string,
+	sig syscall.Signal,
+) (err error) {
+	defer observe("KillUnit", time.Now(), &err)
+	return c.conn.KillUnitWithTarget(ctx, name, dbus.All, int32(sig))
+}
+
+// ResetFailedUnit resets the failed state of a unit so that a unit with the
+// same name can be created again.
+func (c *Conn) ResetFailedUnit(ctx context.Context, name string) (err error) {
+	defer observe("ResetFailedUnit", time.Now(), &err)
+	return c.conn.ResetFailedUnitContext(ctx, name)
+}
+
+// SetUnitProperties changes properties of a running unit. The changes are not
+// persisted across reboots.
+func (c *Conn) SetUnitProperties(
+	ctx context.Context,
+	name string,
+	props ...dbus.Property,
+) (err error) {
+	defer observe("SetUnitProperties", time.Now(), &err)
+	return c.conn.SetUnitPropertiesContext(ctx, name, true, props...)
+}
+
+// UnitProperties reads the generic org.freedesktop.systemd1.Unit properties
+// of a unit.
+func (c *Conn) UnitProperties(
+	ctx context.Context,
+	name string,
+) (props map[string]interface{}, err error) {
+	defer observe("GetUnitProperties", time.Now(), &err)
+	return c.conn.GetUnitPropertiesContext(ctx, name)
+}
+
+// UnitTypeProperties reads the properties specific to a unit type, such as
+// "Service", "Scope" or "Slice".
+func (c *Conn) UnitTypeProperties(
+	ctx context.Context,
+	name string,
+	unitType string,
+) (props map[string]interface{}, err error) {
+	defer observe("GetUnitTypeProperties", time.Now(), &err)
+	return c.conn.GetUnitTypePropertiesContext(ctx, name, unitType)
+}
+
+// ListUnitsByPatterns lists the loaded units whose names match one of
+// patterns, shell-style globs such as "foo-*.service".
+func (c *Conn) ListUnitsByPatterns(
+	ctx context.Context,
+	patterns ...string,
+) (units []dbus.UnitStatus, err error) {
+	defer observe("ListUnitsByPatterns", time.Now(), &err)
+	return c.conn.ListUnitsByPatternsContext(ctx, nil, patterns)
+}
+
+// waitJob waits for the result of a queued job.
+func waitJob(ctx context.Context, name string, ch <-chan string) error {
+	select {
+	case result := <-ch:
+		if result != "done" {
+			return fmt.Errorf("systemd job for %s: %s", name, result)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}